@@ -0,0 +1,5 @@
+// Package gophermart содержит protobuf-описание gRPC API накопительной системы
+// лояльности и сгенерированный по нему код клиента и сервера.
+package gophermart
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative gophermart.proto
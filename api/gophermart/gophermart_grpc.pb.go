@@ -0,0 +1,418 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.6.2
+// - protoc             v5.29.3
+// source: gophermart.proto
+
+package gophermart
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Gophermart_Register_FullMethodName        = "/gophermart.v1.Gophermart/Register"
+	Gophermart_Login_FullMethodName           = "/gophermart.v1.Gophermart/Login"
+	Gophermart_UploadOrder_FullMethodName     = "/gophermart.v1.Gophermart/UploadOrder"
+	Gophermart_ListOrders_FullMethodName      = "/gophermart.v1.Gophermart/ListOrders"
+	Gophermart_GetBalance_FullMethodName      = "/gophermart.v1.Gophermart/GetBalance"
+	Gophermart_Withdraw_FullMethodName        = "/gophermart.v1.Gophermart/Withdraw"
+	Gophermart_ListWithdrawals_FullMethodName = "/gophermart.v1.Gophermart/ListWithdrawals"
+	Gophermart_WatchOrders_FullMethodName     = "/gophermart.v1.Gophermart/WatchOrders"
+)
+
+// GophermartClient is the client API for Gophermart service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Gophermart повторяет HTTP API накопительной системы лояльности.
+//
+// Все методы, кроме Register и Login, требуют JWT-токен в метаданных
+// запроса: "authorization: Bearer <token>".
+type GophermartClient interface {
+	// регистрация пользователя
+	Register(ctx context.Context, in *Credentials, opts ...grpc.CallOption) (*AuthResponse, error)
+	// аутентификация пользователя
+	Login(ctx context.Context, in *Credentials, opts ...grpc.CallOption) (*AuthResponse, error)
+	// загрузка номера заказа для расчёта
+	UploadOrder(ctx context.Context, in *UploadOrderRequest, opts ...grpc.CallOption) (*UploadOrderResponse, error)
+	// список загруженных пользователем заказов
+	ListOrders(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*ListOrdersResponse, error)
+	// текущий баланс счёта баллов лояльности
+	GetBalance(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*Balance, error)
+	// списание баллов в счёт оплаты нового заказа
+	Withdraw(ctx context.Context, in *WithdrawRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	// список списаний пользователя
+	ListWithdrawals(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*ListWithdrawalsResponse, error)
+	// поток изменений статусов заказов пользователя
+	WatchOrders(ctx context.Context, in *WatchOrdersRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[OrderEvent], error)
+}
+
+type gophermartClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewGophermartClient(cc grpc.ClientConnInterface) GophermartClient {
+	return &gophermartClient{cc}
+}
+
+func (c *gophermartClient) Register(ctx context.Context, in *Credentials, opts ...grpc.CallOption) (*AuthResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(AuthResponse)
+	err := c.cc.Invoke(ctx, Gophermart_Register_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *gophermartClient) Login(ctx context.Context, in *Credentials, opts ...grpc.CallOption) (*AuthResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(AuthResponse)
+	err := c.cc.Invoke(ctx, Gophermart_Login_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *gophermartClient) UploadOrder(ctx context.Context, in *UploadOrderRequest, opts ...grpc.CallOption) (*UploadOrderResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(UploadOrderResponse)
+	err := c.cc.Invoke(ctx, Gophermart_UploadOrder_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *gophermartClient) ListOrders(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*ListOrdersResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListOrdersResponse)
+	err := c.cc.Invoke(ctx, Gophermart_ListOrders_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *gophermartClient) GetBalance(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*Balance, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Balance)
+	err := c.cc.Invoke(ctx, Gophermart_GetBalance_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *gophermartClient) Withdraw(ctx context.Context, in *WithdrawRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, Gophermart_Withdraw_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *gophermartClient) ListWithdrawals(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*ListWithdrawalsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListWithdrawalsResponse)
+	err := c.cc.Invoke(ctx, Gophermart_ListWithdrawals_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *gophermartClient) WatchOrders(ctx context.Context, in *WatchOrdersRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[OrderEvent], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Gophermart_ServiceDesc.Streams[0], Gophermart_WatchOrders_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[WatchOrdersRequest, OrderEvent]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Gophermart_WatchOrdersClient = grpc.ServerStreamingClient[OrderEvent]
+
+// GophermartServer is the server API for Gophermart service.
+// All implementations must embed UnimplementedGophermartServer
+// for forward compatibility.
+//
+// Gophermart повторяет HTTP API накопительной системы лояльности.
+//
+// Все методы, кроме Register и Login, требуют JWT-токен в метаданных
+// запроса: "authorization: Bearer <token>".
+type GophermartServer interface {
+	// регистрация пользователя
+	Register(context.Context, *Credentials) (*AuthResponse, error)
+	// аутентификация пользователя
+	Login(context.Context, *Credentials) (*AuthResponse, error)
+	// загрузка номера заказа для расчёта
+	UploadOrder(context.Context, *UploadOrderRequest) (*UploadOrderResponse, error)
+	// список загруженных пользователем заказов
+	ListOrders(context.Context, *emptypb.Empty) (*ListOrdersResponse, error)
+	// текущий баланс счёта баллов лояльности
+	GetBalance(context.Context, *emptypb.Empty) (*Balance, error)
+	// списание баллов в счёт оплаты нового заказа
+	Withdraw(context.Context, *WithdrawRequest) (*emptypb.Empty, error)
+	// список списаний пользователя
+	ListWithdrawals(context.Context, *emptypb.Empty) (*ListWithdrawalsResponse, error)
+	// поток изменений статусов заказов пользователя
+	WatchOrders(*WatchOrdersRequest, grpc.ServerStreamingServer[OrderEvent]) error
+	mustEmbedUnimplementedGophermartServer()
+}
+
+// UnimplementedGophermartServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedGophermartServer struct{}
+
+func (UnimplementedGophermartServer) Register(context.Context, *Credentials) (*AuthResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method Register not implemented")
+}
+func (UnimplementedGophermartServer) Login(context.Context, *Credentials) (*AuthResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method Login not implemented")
+}
+func (UnimplementedGophermartServer) UploadOrder(context.Context, *UploadOrderRequest) (*UploadOrderResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method UploadOrder not implemented")
+}
+func (UnimplementedGophermartServer) ListOrders(context.Context, *emptypb.Empty) (*ListOrdersResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method ListOrders not implemented")
+}
+func (UnimplementedGophermartServer) GetBalance(context.Context, *emptypb.Empty) (*Balance, error) {
+	return nil, status.Error(codes.Unimplemented, "method GetBalance not implemented")
+}
+func (UnimplementedGophermartServer) Withdraw(context.Context, *WithdrawRequest) (*emptypb.Empty, error) {
+	return nil, status.Error(codes.Unimplemented, "method Withdraw not implemented")
+}
+func (UnimplementedGophermartServer) ListWithdrawals(context.Context, *emptypb.Empty) (*ListWithdrawalsResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method ListWithdrawals not implemented")
+}
+func (UnimplementedGophermartServer) WatchOrders(*WatchOrdersRequest, grpc.ServerStreamingServer[OrderEvent]) error {
+	return status.Error(codes.Unimplemented, "method WatchOrders not implemented")
+}
+func (UnimplementedGophermartServer) mustEmbedUnimplementedGophermartServer() {}
+func (UnimplementedGophermartServer) testEmbeddedByValue()                    {}
+
+// UnsafeGophermartServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to GophermartServer will
+// result in compilation errors.
+type UnsafeGophermartServer interface {
+	mustEmbedUnimplementedGophermartServer()
+}
+
+func RegisterGophermartServer(s grpc.ServiceRegistrar, srv GophermartServer) {
+	// If the following call panics, it indicates UnimplementedGophermartServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Gophermart_ServiceDesc, srv)
+}
+
+func _Gophermart_Register_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Credentials)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(GophermartServer).Register(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Gophermart_Register_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(GophermartServer).Register(ctx, req.(*Credentials))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Gophermart_Login_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Credentials)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(GophermartServer).Login(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Gophermart_Login_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(GophermartServer).Login(ctx, req.(*Credentials))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Gophermart_UploadOrder_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UploadOrderRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(GophermartServer).UploadOrder(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Gophermart_UploadOrder_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(GophermartServer).UploadOrder(ctx, req.(*UploadOrderRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Gophermart_ListOrders_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(GophermartServer).ListOrders(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Gophermart_ListOrders_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(GophermartServer).ListOrders(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Gophermart_GetBalance_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(GophermartServer).GetBalance(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Gophermart_GetBalance_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(GophermartServer).GetBalance(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Gophermart_Withdraw_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(WithdrawRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(GophermartServer).Withdraw(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Gophermart_Withdraw_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(GophermartServer).Withdraw(ctx, req.(*WithdrawRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Gophermart_ListWithdrawals_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(GophermartServer).ListWithdrawals(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Gophermart_ListWithdrawals_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(GophermartServer).ListWithdrawals(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Gophermart_WatchOrders_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchOrdersRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(GophermartServer).WatchOrders(m, &grpc.GenericServerStream[WatchOrdersRequest, OrderEvent]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Gophermart_WatchOrdersServer = grpc.ServerStreamingServer[OrderEvent]
+
+// Gophermart_ServiceDesc is the grpc.ServiceDesc for Gophermart service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Gophermart_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "gophermart.v1.Gophermart",
+	HandlerType: (*GophermartServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Register",
+			Handler:    _Gophermart_Register_Handler,
+		},
+		{
+			MethodName: "Login",
+			Handler:    _Gophermart_Login_Handler,
+		},
+		{
+			MethodName: "UploadOrder",
+			Handler:    _Gophermart_UploadOrder_Handler,
+		},
+		{
+			MethodName: "ListOrders",
+			Handler:    _Gophermart_ListOrders_Handler,
+		},
+		{
+			MethodName: "GetBalance",
+			Handler:    _Gophermart_GetBalance_Handler,
+		},
+		{
+			MethodName: "Withdraw",
+			Handler:    _Gophermart_Withdraw_Handler,
+		},
+		{
+			MethodName: "ListWithdrawals",
+			Handler:    _Gophermart_ListWithdrawals_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchOrders",
+			Handler:       _Gophermart_WatchOrders_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "gophermart.proto",
+}
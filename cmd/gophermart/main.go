@@ -4,81 +4,213 @@ import (
 	"context"
 	"errors"
 	"flag"
+	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
-	"github.com/caarlos0/env/v6"
 	"github.com/go-chi/jwtauth/v5"
 	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/region23/praktikum-diplom/internal/breaker"
+	"github.com/region23/praktikum-diplom/internal/config"
+	"github.com/region23/praktikum-diplom/internal/events"
 	externalapi "github.com/region23/praktikum-diplom/internal/external_api"
+	"github.com/region23/praktikum-diplom/internal/grpcserver"
+	"github.com/region23/praktikum-diplom/internal/health"
+	"github.com/region23/praktikum-diplom/internal/jobs"
+	"github.com/region23/praktikum-diplom/internal/lifecycle"
+	"github.com/region23/praktikum-diplom/internal/logging"
+	"github.com/region23/praktikum-diplom/internal/loyalty"
+	"github.com/region23/praktikum-diplom/internal/metrics"
+	"github.com/region23/praktikum-diplom/internal/ratelimit"
 	"github.com/region23/praktikum-diplom/internal/server"
 	"github.com/region23/praktikum-diplom/internal/storage"
+	"github.com/region23/praktikum-diplom/internal/tlsconfig"
+	"github.com/region23/praktikum-diplom/internal/tracing"
+	"github.com/region23/praktikum-diplom/internal/webhooks"
 	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
-var tokenAuth *jwtauth.JWTAuth
+// сколько партий баллов списывается за одну транзакцию
+const pointsExpiryBatch = 500
 
-type Config struct {
-	RunAddress           string `env:"RUN_ADDRESS"`
-	DatabaseURI          string `env:"DATABASE_URI"`
-	AccrualSystemAddress string `env:"ACCRUAL_SYSTEM_ADDRESS"`
+// сколько неподтверждённых переводов возвращается отправителям за одну транзакцию
+const transfersExpiryBatch = 500
+
+// HTTP-сервер: при остановке перестаёт принимать соединения и дожидается текущих запросов,
+// а если не успевает — закрывает оставшиеся
+func httpComponent(name string, server *http.Server) lifecycle.Component {
+	return lifecycle.Component{
+		Name: name,
+		Run: func() error {
+			var err error
+			if server.TLSConfig != nil {
+				// сертификаты берутся из TLSConfig, HTTP/2 включается автоматически
+				log.Info().Msgf("HTTPS server started on %s", server.Addr)
+				err = server.ListenAndServeTLS("", "")
+			} else {
+				log.Info().Msgf("HTTP server started on %s", server.Addr)
+				err = server.ListenAndServe()
+			}
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				return err
+			}
+			return nil
+		},
+		Stop: func(ctx context.Context) error {
+			err := server.Shutdown(ctx)
+			if err != nil {
+				// не дождались: закрываем оставшиеся соединения, в том числе потоки SSE
+				server.Close()
+			}
+			return err
+		},
+	}
 }
 
-var cfg Config = Config{}
+// gRPC-сервер: при остановке дожидается текущих вызовов, а если не успевает —
+// обрывает их, в том числе бесконечные потоки WatchOrders
+func grpcComponent(server *grpc.Server, listener net.Listener) lifecycle.Component {
+	return lifecycle.Component{
+		Name: "grpc",
+		Run: func() error {
+			log.Info().Msgf("gRPC server started on %s", listener.Addr())
+			return server.Serve(listener)
+		},
+		Stop: func(ctx context.Context) error {
+			stopped := make(chan struct{})
+			go func() {
+				server.GracefulStop()
+				close(stopped)
+			}()
+
+			select {
+			case <-stopped:
+				return nil
+			case <-ctx.Done():
+				server.Stop()
+				return ctx.Err()
+			}
+		},
+	}
+}
 
-func init() {
-	flag.StringVar(&cfg.RunAddress, "a", "127.0.0.1:8080", "server address")
-	flag.StringVar(&cfg.DatabaseURI, "d", "", "database connection string")
-	flag.StringVar(&cfg.AccrualSystemAddress, "r", "", "адрес системы расчёта начислений")
+// логины администраторов из строки через запятую
+func admins(logins string) map[string]bool {
+	result := make(map[string]bool)
+	for _, login := range strings.Split(logins, ",") {
+		if login = strings.TrimSpace(login); login != "" {
+			result[login] = true
+		}
+	}
 
-	tokenAuth = jwtauth.New("HS256", []byte("secret"), nil)
+	return result
 }
 
-func createChannel() (chan os.Signal, func()) {
-	stopCh := make(chan os.Signal, 1)
-	signal.Notify(stopCh, os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
+// ограничения частоты запросов из конфигурации. Значения уже проверены config.Validate
+func rateLimits(cfg *config.Config, repository *storage.Database) server.RateLimits {
+	limits := server.RateLimits{TrustProxy: cfg.RateLimitTrustProxy}
+	limits.TrustedProxies, _ = config.ParseTrustedProxies(cfg.RateLimitTrustedProxies)
 
-	return stopCh, func() {
-		close(stopCh)
+	switch cfg.RateLimitStore {
+	case "memory":
+		limits.Store = ratelimit.NewMemoryStore()
+	case "postgres":
+		limits.Store = ratelimit.NewPostgresStore(repository)
+	default:
+		return limits
 	}
+
+	limits.Auth, _ = ratelimit.ParsePolicy("auth", cfg.RateLimitAuth)
+	limits.Orders, _ = ratelimit.ParsePolicy("orders", cfg.RateLimitOrders)
+	limits.Withdraw, _ = ratelimit.ParsePolicy("withdraw", cfg.RateLimitWithdraw)
+	limits.Reads, _ = ratelimit.ParsePolicy("reads", cfg.RateLimitReads)
+
+	return limits
 }
 
-func start(server *http.Server) {
-	log.Info().Msg("application started")
-	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-		panic(err)
-	} else {
-		log.Info().Msg("application stopped gracefully")
+// gophermart config print [флаги] — показать итоговую конфигурацию со скрытыми секретами
+func configCommand(args []string) int {
+	if len(args) == 0 || args[0] != "print" {
+		fmt.Fprintln(os.Stderr, "использование: gophermart config print [флаги]")
+		return 2
+	}
+
+	cfg, err := config.Parse(args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	if err := cfg.Print(os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
 	}
-}
 
-func shutdown(ctx context.Context, cancel context.CancelFunc, server *http.Server) {
-	if err := server.Shutdown(ctx); err != nil && !errors.Is(err, context.DeadlineExceeded) {
-		panic(err)
-	} else {
-		log.Info().Msg("application shutdowned")
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
 	}
+
+	return 0
 }
 
 func main() {
-	var dbpool *pgxpool.Pool
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		os.Exit(configCommand(os.Args[2:]))
+	}
 
-	flag.Parse()
+	cfg, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
 
-	if err := env.Parse(&cfg); err != nil {
-		log.Error().Err(err).Msgf("%+v\n", err)
+	if err := logging.Setup(cfg.LogLevel, cfg.LogFormat); err != nil {
+		log.Fatal().Err(err).Msg("Не смогли настроить логирование")
 	}
 
+	tokenAuth := jwtauth.New(cfg.JWTAlgorithm, []byte(cfg.JWTSecret), nil)
+
+	shutdownTracing, err := tracing.Setup(context.Background(), tracing.Config{
+		Exporter:     cfg.TraceExporter,
+		OTLPEndpoint: cfg.TraceOTLPEndpoint,
+		OTLPInsecure: cfg.TraceOTLPInsecure,
+		File:         cfg.TraceFile,
+		SampleRatio:  cfg.TraceSampleRatio,
+	})
+	if err != nil {
+		log.Fatal().Err(err).Msg("Не смогли настроить трассировку")
+	}
 	var repository *storage.Database
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	// Компоненты запускаются в порядке добавления и останавливаются в обратном:
+	// сначала снимаем готовность, затем поллер дорабатывает начатые заказы,
+	// серверы дожидаются текущих запросов, и только потом закрывается пул соединений
+	app := lifecycle.New(cfg.ShutdownTimeout)
+	app.Add(lifecycle.Component{Name: "tracing", Stop: shutdownTracing})
+
+	poolConfig, err := pgxpool.ParseConfig(cfg.DatabaseURI)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Неверная строка подключения к базе данных")
+	}
+	if cfg.DBMaxConns > 0 {
+		poolConfig.MaxConns = int32(cfg.DBMaxConns)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.DBConnectTimeout)
 	defer cancel()
 	// Инициализируем подключение к базе данных
-	var err error
-	dbpool, err = pgxpool.Connect(ctx, cfg.DatabaseURI)
+	dbpool, err := pgxpool.ConnectConfig(ctx, poolConfig)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Не смогли подключиться к базе данных")
 	}
@@ -88,43 +220,210 @@ func main() {
 		log.Fatal().Err(err).Msg("Не смогли подключиться к базе данных")
 	}
 
-	defer dbpool.Close()
+	app.Add(lifecycle.Component{Name: "database", Stop: func(context.Context) error {
+		dbpool.Close()
+		return nil
+	}})
+
+	// уровни уже проверены при загрузке конфигурации
+	tiers, _ := loyalty.ParseTiers(cfg.LoyaltyTiers)
+
+	repository = storage.NewDatabase(dbpool, storage.Timeouts{
+		Default:   cfg.DBQueryTimeout,
+		PerMethod: cfg.DBQueryTimeouts,
+	}, storage.PointsPolicy{
+		LifetimeMonths:     cfg.PointsLifetimeMonths,
+		ExpiringSoonWindow: cfg.PointsExpiringSoon,
+		Tiers:              tiers,
+		TierBasis:          cfg.LoyaltyTierBasis,
+		TierWindowMonths:   cfg.LoyaltyTierMonths,
+
+		ReferralInviterBonus:  cfg.ReferralInviterBonus,
+		ReferralInviteeBonus:  cfg.ReferralInviteeBonus,
+		ReferralMaxPerInviter: cfg.ReferralMaxPerInviter,
+	}, storage.TransferLimits{
+		DailyAmount: cfg.TransferDailyAmount,
+		DailyCount:  cfg.TransferDailyCount,
+		PendingTTL:  cfg.TransferPendingTTL,
+	})
 
-	repository = storage.NewDatabase(ctx, dbpool)
+	metrics.RegisterPool(dbpool)
+	metrics.RegisterQueue(repository.CountOrdersForUpdate)
 
-	srv := server.New(*repository, tokenAuth)
+	// события из базы (в том числе порождённые другими экземплярами сервиса)
+	// раздаются подключённым клиентам через брокер
+	broker := events.NewBroker()
+	listenCtx, stopListen := context.WithCancel(context.Background())
+	app.Add(lifecycle.Component{
+		Name: "events",
+		Run: func() error {
+			repository.ListenEvents(listenCtx, broker.Publish)
+			return nil
+		},
+		Stop: func(context.Context) error {
+			stopListen()
+			return nil
+		},
+	})
+
+	srv := server.New(*repository, tokenAuth, broker)
+	srv.BatchMaxSize = cfg.BatchMaxSize
+	srv.RequestTimeout = cfg.RequestTimeout
+	srv.RateLimits = rateLimits(cfg, repository)
+	srv.Admins = admins(cfg.AdminLogins)
+	// ключи уже проверены при загрузке конфигурации
+	srv.MerchantKeys, _ = config.ParseMerchantKeys(cfg.MerchantAPIKeys)
+	srv.AccrualCallbackSecret = cfg.AccrualCallbackSecret
+	// сертификаты партнёров проверяются на TLS-рукопожатии, а обязательны они для партнёрских маршрутов
+	srv.RequireClientCert = cfg.TLSClientAuth != tlsconfig.ClientAuthNone
+	srv.WebhookMaxSubscriptions = cfg.WebhookMaxSubscriptions
+	httpClient := &http.Client{Timeout: cfg.AccrualTimeout}
+	// если система начислений присылает результаты сама, опрос нужен только для сверки
+	var reconcile time.Duration
+	if cfg.AccrualCallbackSecret != "" {
+		reconcile = cfg.AccrualReconcileInterval
+	}
+	poller := externalapi.NewPoller(httpClient, repository, cfg.AccrualSystemAddress, cfg.PollerConcurrency, cfg.PollerInterval, reconcile, breaker.Config{
+		Failures:       cfg.AccrualBreakerFailures,
+		OpenTimeout:    cfg.AccrualBreakerOpenTimeout,
+		MaxOpenTimeout: cfg.AccrualBreakerMaxOpenTimeout,
+	})
+
+	srv.Health = health.New(
+		health.Check{Name: "database", Critical: true, Fn: func(ctx context.Context) error {
+			return storage.Ping(ctx, dbpool)
+		}},
+		health.Check{Name: "migrations", Critical: true, Fn: func(ctx context.Context) error {
+			return storage.CheckSchema(ctx, dbpool)
+		}},
+		// без системы начислений пользователи по-прежнему могут работать со счётом;
+		// пока breaker поллера открыт, проверка сообщает об этом, не обращаясь к системе
+		health.Check{Name: "accrual", Critical: false, Fn: poller.Health},
+	)
 	srv.MountHandlers()
 
+	// без сертификата сервис работает по открытому HTTP, как раньше
+	var certs *tlsconfig.Reloader
+	if cfg.TLSCertFile != "" {
+		certs, err = tlsconfig.New(tlsconfig.Config{
+			CertFile:     cfg.TLSCertFile,
+			KeyFile:      cfg.TLSKeyFile,
+			MinVersion:   cfg.TLSMinVersion,
+			CipherPolicy: cfg.TLSCipherPolicy,
+			ClientCAFile: cfg.TLSClientCAFile,
+			ClientAuth:   cfg.TLSClientAuth,
+		})
+		if err != nil {
+			log.Fatal().Err(err).Msg("Не смогли загрузить сертификаты")
+		}
+
+		watchCtx, stopWatch := context.WithCancel(context.Background())
+		app.Add(lifecycle.Component{
+			Name: "tls",
+			Run: func() error {
+				certs.Watch(watchCtx, cfg.TLSReloadInterval)
+				return nil
+			},
+			Stop: func(context.Context) error {
+				stopWatch()
+				return nil
+			},
+		})
+	}
+
+	if cfg.GRPCAddress != "" {
+		listener, err := net.Listen("tcp", cfg.GRPCAddress)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Не смогли открыть порт для gRPC")
+		}
+
+		var opts []grpc.ServerOption
+		if certs != nil {
+			opts = append(opts, grpc.Creds(credentials.NewTLS(certs.TLSConfig())))
+		}
+		grpcService := grpcserver.New(repository, tokenAuth, broker)
+		grpcService.MerchantKeys = srv.MerchantKeys
+		grpcServer := grpcService.GRPCServer(opts...)
+		app.Add(grpcComponent(grpcServer, listener))
+	}
+
 	httpServer := &http.Server{Addr: cfg.RunAddress, Handler: srv.Router}
-	go start(httpServer)
+	httpServer.RegisterOnShutdown(srv.CloseWebSockets)
+	if certs != nil {
+		httpServer.TLSConfig = certs.TLSConfig()
+	}
+	app.Add(httpComponent("http", httpServer))
+
+	// метрики не отдаются на публичном адресе: их снимают с отдельного,
+	// закрытого от внешней сети, или администраторы через /api/admin/metrics
+	if cfg.MetricsAddress != "" {
+		metricsServer := &http.Server{
+			Addr:              cfg.MetricsAddress,
+			Handler:           metrics.Handler(),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		app.Add(httpComponent("metrics", metricsServer))
+	}
 
-	stopCh, closeCh := createChannel()
-	defer closeCh()
+	if cfg.HTTPRedirectAddress != "" {
+		redirectServer := &http.Server{
+			Addr:              cfg.HTTPRedirectAddress,
+			Handler:           server.RedirectToHTTPS(cfg.RunAddress),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		app.Add(httpComponent("http-redirect", redirectServer))
+	}
 
-	httpClient := http.Client{Timeout: 5 * time.Second}
+	// поллер останавливается раньше серверов: потоки SSE и WatchOrders могут
+	// держать серверы до конца таймаута, а начатые заказы нужно успеть доработать
+	app.Add(lifecycle.Component{Name: "poller", Run: poller.Run, Stop: poller.Stop})
 
-	go func(ctx context.Context, httpClient *http.Client) {
-	updateAccuralsBlock:
+	// сгоревшие баллы списываются пачками, пока не кончатся
+	expiry := jobs.NewPeriodic("points-expiry", cfg.PointsExpiryInterval, func(ctx context.Context) error {
 		for {
-			select {
-			case <-stopCh:
-				log.Info().Msg("завершили UpdateAccurals")
-				break updateAccuralsBlock
-			default:
-				err = externalapi.UpdateAccurals(ctx, httpClient, repository, cfg.AccrualSystemAddress)
-				if err != nil {
-					if errors.Is(err, context.DeadlineExceeded) {
-						log.Debug().Err(err).Msg("Внешний сервис не доступен")
-						time.Sleep(10 * time.Second)
-					} else {
-						log.Debug().Err(err).Msg("При доступе к внешнему сервису произошла ошибка")
-					}
-				}
+			expired, err := repository.ExpirePoints(ctx, pointsExpiryBatch)
+			if err != nil || expired < pointsExpiryBatch {
+				return err
+			}
+		}
+	})
+	app.Add(lifecycle.Component{Name: "points-expiry", Run: expiry.Run, Stop: expiry.Stop})
+
+	// неподтверждённые вовремя переводы возвращаются отправителям
+	transfersExpiry := jobs.NewPeriodic("transfers-expiry", cfg.TransferExpiryInterval, func(ctx context.Context) error {
+		for {
+			expired, err := repository.ExpireTransfers(ctx, transfersExpiryBatch)
+			if err != nil || expired < transfersExpiryBatch {
+				return err
 			}
 		}
-	}(ctx, &httpClient)
+	})
+	app.Add(lifecycle.Component{Name: "transfers-expiry", Run: transfersExpiry.Run, Stop: transfersExpiry.Stop})
+
+	// вебхуки отправляются из исходящей очереди, которую пишут транзакции с событиями
+	dispatcher := webhooks.NewDispatcher(webhooks.NewClient(cfg.WebhookTimeout), repository, cfg.WebhookMaxAttempts, cfg.WebhookRetryBase)
+	webhookJob := jobs.NewPeriodic("webhooks", cfg.WebhookInterval, dispatcher.Deliver)
+	app.Add(lifecycle.Component{Name: "webhooks", Run: webhookJob.Run, Stop: webhookJob.Stop})
+
+	// останавливается первым: даём балансировщику увидеть неготовность
+	// и перестать слать трафик, пока серверы ещё принимают запросы
+	app.Add(lifecycle.Component{Name: "readiness", Stop: func(ctx context.Context) error {
+		srv.Health.SetShuttingDown()
+		select {
+		case <-time.After(cfg.ShutdownDrainDelay):
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}})
 
-	log.Info().Msgf("notified: %v", <-stopCh)
+	signalCtx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+
+	if err := app.Run(signalCtx); err != nil {
+		log.Error().Err(err).Msg("приложение остановлено с ошибками")
+		os.Exit(1)
+	}
 
-	shutdown(ctx, cancel, httpServer)
+	log.Info().Msg("application shutdowned")
 }
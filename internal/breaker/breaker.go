@@ -0,0 +1,186 @@
+// Package breaker ограничивает обращения к внешней системе, пока она не отвечает.
+package breaker
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+type State string
+
+const (
+	// запросы идут как обычно, подряд идущие ошибки считаются
+	Closed State = "closed"
+	// запросы не выполняются до истечения паузы
+	Open State = "open"
+	// пауза истекла: пропускается один пробный запрос, его исход решает,
+	// закрыться или снова открыться на вдвое большую паузу
+	HalfOpen State = "half-open"
+)
+
+// OpenError — запрос не выполнен, потому что breaker открыт
+type OpenError struct {
+	// через сколько стоит попробовать снова
+	RetryAfter time.Duration
+}
+
+func (e *OpenError) Error() string {
+	return fmt.Sprintf("внешняя система недоступна, следующая попытка через %s", e.RetryAfter.Round(time.Millisecond))
+}
+
+type Config struct {
+	// сколько ошибок подряд открывают breaker
+	Failures int
+	// пауза после первого открытия; после каждого неудачного пробного запроса удваивается
+	OpenTimeout time.Duration
+	// пауза не растёт дольше
+	MaxOpenTimeout time.Duration
+	// вызывается при каждой смене состояния, например для метрик
+	OnStateChange func(from, to State)
+}
+
+// Breaker — автомат closed → open → half-open. Безопасен для параллельного использования.
+// Перед запросом вызывается Allow, после — Success, Failure или Cancel с полученным
+// от Allow поколением. Поколение меняется при каждой смене состояния, поэтому исход
+// запроса, начатого до неё, например опоздавший Success при открытом breaker, ничего не меняет
+type Breaker struct {
+	cfg Config
+
+	mu    sync.Mutex
+	state State
+	// растёт при каждой смене состояния
+	generation uint64
+	failures   int
+	// сколько раз подряд breaker открывался без успешного запроса между ними
+	opens     int
+	openUntil time.Time
+	// пробный запрос в состоянии half-open уже выполняется
+	probing bool
+}
+
+func New(cfg Config) *Breaker {
+	if cfg.Failures < 1 {
+		cfg.Failures = 1
+	}
+	if cfg.MaxOpenTimeout < cfg.OpenTimeout {
+		cfg.MaxOpenTimeout = cfg.OpenTimeout
+	}
+
+	return &Breaker{cfg: cfg, state: Closed}
+}
+
+// Allow разрешает запрос и возвращает поколение, с которым нужно сообщить его исход,
+// или возвращает *OpenError
+func (b *Breaker) Allow() (uint64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == Open {
+		if wait := time.Until(b.openUntil); wait > 0 {
+			return 0, &OpenError{RetryAfter: wait}
+		}
+		b.setState(HalfOpen)
+	}
+
+	if b.state == HalfOpen {
+		if b.probing {
+			// дождёмся исхода пробного запроса
+			return 0, &OpenError{RetryAfter: b.cfg.OpenTimeout}
+		}
+		b.probing = true
+	}
+
+	return b.generation, nil
+}
+
+// Success — запрос выполнен, система отвечает
+func (b *Breaker) Success(generation uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if generation != b.generation {
+		return
+	}
+
+	b.failures = 0
+	b.opens = 0
+	b.probing = false
+	if b.state != Closed {
+		b.setState(Closed)
+	}
+}
+
+// Failure — запрос не выполнен по вине внешней системы
+func (b *Breaker) Failure(generation uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if generation != b.generation {
+		return
+	}
+
+	b.failures++
+	switch {
+	case b.state == HalfOpen:
+		b.probing = false
+		b.open()
+	case b.state == Closed && b.failures >= b.cfg.Failures:
+		b.open()
+	}
+}
+
+// Cancel — запрос прерван не по вине внешней системы, например при остановке сервиса.
+// Исход не учитывается, но пробный запрос больше не считается выполняющимся
+func (b *Breaker) Cancel(generation uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if generation != b.generation {
+		return
+	}
+
+	b.probing = false
+}
+
+// State — текущее состояние и до какого времени breaker открыт
+func (b *Breaker) State() (State, time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state, b.openUntil
+}
+
+// открывает breaker на паузу, растущую вдвое с каждым открытием подряд.
+// Пауза случайно сокращается до половины, чтобы экземпляры сервиса,
+// открывшиеся одновременно, не вернулись к внешней системе тоже одновременно
+func (b *Breaker) open() {
+	timeout := b.cfg.OpenTimeout
+	for i := 0; i < b.opens && timeout < b.cfg.MaxOpenTimeout; i++ {
+		timeout *= 2
+	}
+	if timeout > b.cfg.MaxOpenTimeout {
+		timeout = b.cfg.MaxOpenTimeout
+	}
+	if half := int64(timeout / 2); half > 0 {
+		timeout = time.Duration(half + rand.Int63n(half+1))
+	}
+
+	b.opens++
+	b.openUntil = time.Now().Add(timeout)
+	b.setState(Open)
+}
+
+func (b *Breaker) setState(state State) {
+	from := b.state
+	if from == state {
+		return
+	}
+
+	b.state = state
+	b.generation++
+	if b.cfg.OnStateChange != nil {
+		b.cfg.OnStateChange(from, state)
+	}
+}
@@ -0,0 +1,178 @@
+package breaker
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// записывает смены состояния
+type transitions struct {
+	mu  sync.Mutex
+	got []State
+}
+
+func (t *transitions) record(_, to State) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.got = append(t.got, to)
+}
+
+func (t *transitions) list() []State {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return append([]State(nil), t.got...)
+}
+
+func allow(t *testing.T, b *Breaker) uint64 {
+	t.Helper()
+
+	generation, err := b.Allow()
+	if err != nil {
+		t.Fatalf("Allow: %v", err)
+	}
+
+	return generation
+}
+
+func denied(t *testing.T, b *Breaker) *OpenError {
+	t.Helper()
+
+	_, err := b.Allow()
+	var open *OpenError
+	if !errors.As(err, &open) {
+		t.Fatalf("Allow: ожидали *OpenError, получили %v", err)
+	}
+
+	return open
+}
+
+func wantState(t *testing.T, b *Breaker, want State) {
+	t.Helper()
+
+	if got, _ := b.State(); got != want {
+		t.Fatalf("состояние %s, ожидали %s", got, want)
+	}
+}
+
+func TestTransitions(t *testing.T) {
+	var tr transitions
+	b := New(Config{Failures: 3, OpenTimeout: 20 * time.Millisecond, MaxOpenTimeout: time.Second, OnStateChange: tr.record})
+
+	// ошибки меньше порога и успех между ними breaker не открывают
+	b.Failure(allow(t, b))
+	b.Failure(allow(t, b))
+	b.Success(allow(t, b))
+	b.Failure(allow(t, b))
+	b.Failure(allow(t, b))
+	wantState(t, b, Closed)
+
+	b.Failure(allow(t, b))
+	wantState(t, b, Open)
+
+	if open := denied(t, b); open.RetryAfter <= 0 || open.RetryAfter > 20*time.Millisecond {
+		t.Fatalf("RetryAfter %s вне (0, 20ms]", open.RetryAfter)
+	}
+
+	time.Sleep(25 * time.Millisecond)
+
+	// после паузы проходит ровно один пробный запрос
+	probe := allow(t, b)
+	wantState(t, b, HalfOpen)
+	denied(t, b)
+
+	b.Success(probe)
+	wantState(t, b, Closed)
+	allow(t, b)
+
+	want := []State{Open, HalfOpen, Closed}
+	got := tr.list()
+	if len(got) != len(want) {
+		t.Fatalf("переходы %v, ожидали %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("переходы %v, ожидали %v", got, want)
+		}
+	}
+}
+
+func TestHalfOpenFailureReopens(t *testing.T) {
+	b := New(Config{Failures: 1, OpenTimeout: 20 * time.Millisecond, MaxOpenTimeout: time.Second})
+
+	b.Failure(allow(t, b))
+	time.Sleep(25 * time.Millisecond)
+
+	b.Failure(allow(t, b))
+	wantState(t, b, Open)
+
+	// вторая пауза — от половины до полной удвоенной
+	_, until := b.State()
+	if wait := time.Until(until); wait < 15*time.Millisecond || wait > 40*time.Millisecond {
+		t.Fatalf("пауза после неудачного пробного запроса %s, ожидали [20ms, 40ms]", wait)
+	}
+}
+
+func TestCancelReleasesProbe(t *testing.T) {
+	b := New(Config{Failures: 1, OpenTimeout: 10 * time.Millisecond, MaxOpenTimeout: time.Second})
+
+	b.Failure(allow(t, b))
+	time.Sleep(15 * time.Millisecond)
+
+	b.Cancel(allow(t, b))
+	wantState(t, b, HalfOpen)
+
+	// исход прерванного запроса не учтён, следующий пробный разрешён
+	b.Success(allow(t, b))
+	wantState(t, b, Closed)
+}
+
+func TestStaleOutcomeIgnored(t *testing.T) {
+	b := New(Config{Failures: 1, OpenTimeout: 10 * time.Millisecond, MaxOpenTimeout: time.Second})
+
+	// запрос начат до открытия, а ответил после
+	late := allow(t, b)
+	b.Failure(allow(t, b))
+	wantState(t, b, Open)
+
+	b.Success(late)
+	wantState(t, b, Open)
+
+	time.Sleep(15 * time.Millisecond)
+	probe := allow(t, b)
+
+	// опоздавшие исходы не закрывают и не открывают half-open breaker
+	b.Success(late)
+	b.Failure(late)
+	b.Cancel(late)
+	wantState(t, b, HalfOpen)
+	denied(t, b)
+
+	b.Failure(probe)
+	wantState(t, b, Open)
+}
+
+func TestBackoffJitterBounds(t *testing.T) {
+	const (
+		base = 100 * time.Millisecond
+		max  = time.Second
+	)
+
+	for opens, full := range []time.Duration{base, 2 * base, 4 * base, 8 * base, max, max} {
+		for i := 0; i < 200; i++ {
+			b := New(Config{Failures: 1, OpenTimeout: base, MaxOpenTimeout: max})
+			b.opens = opens
+
+			start := time.Now()
+			b.open()
+			wait := b.openUntil.Sub(start)
+
+			if wait < full/2 || wait > full+time.Millisecond {
+				t.Fatalf("открытие %d: пауза %s вне [%s, %s]", opens+1, wait, full/2, full)
+			}
+		}
+	}
+}
@@ -0,0 +1,147 @@
+// Package campaigns описывает правила промоакций и решает, положен ли
+// пользователю бонус за обработанный заказ.
+package campaigns
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// правила акций
+const (
+	// начисление за заказ, загруженный в период акции, умножается на Multiplier
+	RuleMultiplier = "multiplier"
+	// Amount баллов за первый обработанный заказ пользователя
+	RuleFirstOrder = "first_order"
+	// Amount баллов, когда за календарный месяц обработано OrdersCount заказов пользователя
+	RuleOrdersInMonth = "orders_in_month"
+)
+
+// Campaign — акция, начисляющая бонусные баллы
+type Campaign struct {
+	ID          int64     `json:"id"`
+	Name        string    `json:"name"`
+	Rule        string    `json:"rule"`                   // правило акции
+	Multiplier  float64   `json:"multiplier,omitempty"`   // для multiplier
+	Amount      float64   `json:"amount,omitempty"`       // для first_order и orders_in_month
+	OrdersCount int       `json:"orders_count,omitempty"` // для orders_in_month
+	StartsAt    time.Time `json:"starts_at"`              // начало акции
+	EndsAt      time.Time `json:"ends_at"`                // окончание акции, не включительно
+	Active      bool      `json:"active"`                 // выключенная акция не начисляет бонусы
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// Validate проверяет, что параметры соответствуют правилу акции
+func (c Campaign) Validate() error {
+	var errs []string
+
+	if strings.TrimSpace(c.Name) == "" {
+		errs = append(errs, "не задано название акции")
+	}
+
+	switch c.Rule {
+	case RuleMultiplier:
+		if c.Multiplier <= 1 {
+			errs = append(errs, "multiplier должен быть больше 1")
+		}
+	case RuleFirstOrder:
+		if c.Amount <= 0 {
+			errs = append(errs, "amount должен быть положительным")
+		}
+	case RuleOrdersInMonth:
+		if c.Amount <= 0 {
+			errs = append(errs, "amount должен быть положительным")
+		}
+		if c.OrdersCount < 1 {
+			errs = append(errs, "orders_count должен быть положительным")
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("неизвестное правило %q: ожидается multiplier, first_order или orders_in_month", c.Rule))
+	}
+
+	if c.StartsAt.IsZero() || c.EndsAt.IsZero() {
+		errs = append(errs, "не заданы starts_at и ends_at")
+	} else if !c.EndsAt.After(c.StartsAt) {
+		errs = append(errs, "ends_at должен быть позже starts_at")
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// Facts — то, что известно об обработанном заказе и его владельце
+type Facts struct {
+	Order       string
+	Login       string
+	Accrual     float64
+	UploadedAt  time.Time
+	ProcessedAt time.Time
+	// сколько заказов пользователя было обработано до этого
+	ProcessedBefore int
+	// сколько заказов пользователя обработано за месяц ProcessedAt, включая этот
+	ProcessedInMonth int
+	// месяц ProcessedAt в виде "2006-01"
+	Month string
+}
+
+// Award — бонус по акции. Key определяет, за что начислен бонус: по одной
+// акции пользователь получает не больше одного бонуса с каждым ключом
+type Award struct {
+	CampaignID int64   `json:"campaign_id"`
+	Login      string  `json:"login"`
+	Key        string  `json:"key"`
+	Order      string  `json:"order"` // заказ, за который начислен бонус
+	Amount     float64 `json:"amount"`
+}
+
+// Evaluate решает, положен ли бонус за заказ. Признак Active не проверяется
+func (c Campaign) Evaluate(f Facts) (Award, bool) {
+	award := Award{CampaignID: c.ID, Login: f.Login, Order: f.Order}
+
+	switch c.Rule {
+	case RuleMultiplier:
+		if !c.covers(f.UploadedAt) {
+			return award, false
+		}
+		award.Key = "order:" + f.Order
+		award.Amount = math.Round(f.Accrual*(c.Multiplier-1)*100) / 100
+	case RuleFirstOrder:
+		if !c.covers(f.ProcessedAt) || f.ProcessedBefore != 0 {
+			return award, false
+		}
+		award.Key = "first_order"
+		award.Amount = c.Amount
+	case RuleOrdersInMonth:
+		if !c.covers(f.ProcessedAt) || f.ProcessedInMonth != c.OrdersCount {
+			return award, false
+		}
+		award.Key = "month:" + f.Month
+		award.Amount = c.Amount
+	default:
+		return award, false
+	}
+
+	return award, award.Amount > 0
+}
+
+// попадает ли момент в период акции
+func (c Campaign) covers(t time.Time) bool {
+	return !t.Before(c.StartsAt) && t.Before(c.EndsAt)
+}
+
+// DryRun — результат проверки акции на истории заказов
+type DryRun struct {
+	Orders int     `json:"orders"` // сколько обработанных заказов проверено
+	Awards int     `json:"awards"` // сколько бонусов было бы начислено
+	Users  int     `json:"users"`  // скольким пользователям
+	Total  float64 `json:"total"`  // сумма бонусов
+	// первые бонусы для примера
+	Sample []Award `json:"sample,omitempty"`
+}
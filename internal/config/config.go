@@ -0,0 +1,423 @@
+// Package config собирает настройки сервиса из значений по умолчанию,
+// файла конфигурации, переменных окружения и флагов командной строки.
+//
+// Приоритет источников: флаг > переменная окружения > файл > значение по умолчанию.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/caarlos0/env/v6"
+	"github.com/region23/praktikum-diplom/internal/loyalty"
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	// адрес и порт запуска HTTP-сервера
+	RunAddress string `yaml:"run_address" toml:"run_address" env:"RUN_ADDRESS"`
+	// адрес, на котором HTTP-запросы перенаправляются на HTTPS; пусто — не слушать
+	HTTPRedirectAddress string `yaml:"http_redirect_address" toml:"http_redirect_address" env:"HTTP_REDIRECT_ADDRESS"`
+	// адрес gRPC-сервера, пусто — gRPC не запускается
+	GRPCAddress string `yaml:"grpc_address" toml:"grpc_address" env:"GRPC_ADDRESS"`
+	// адрес отдельного HTTP-сервера с метриками Prometheus; пусто — метрики доступны
+	// только администраторам на /api/admin/metrics
+	MetricsAddress string `yaml:"metrics_address" toml:"metrics_address" env:"METRICS_ADDRESS"`
+	// время на обработку одного HTTP-запроса
+	RequestTimeout time.Duration `yaml:"request_timeout" toml:"request_timeout" env:"REQUEST_TIMEOUT"`
+	// общее время на остановку сервиса, включая shutdown_drain_delay
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT"`
+	// сколько отдавать неготовность на /readyz перед остановкой HTTP-сервера
+	ShutdownDrainDelay time.Duration `yaml:"shutdown_drain_delay" toml:"shutdown_drain_delay" env:"SHUTDOWN_DRAIN_DELAY"`
+	// максимальное количество номеров в пакетной загрузке заказов
+	BatchMaxSize int `yaml:"batch_max_size" toml:"batch_max_size" env:"BATCH_MAX_SIZE"`
+
+	// хранилище счётчиков ограничения частоты запросов: memory, postgres или none
+	RateLimitStore string `yaml:"rate_limit_store" toml:"rate_limit_store" env:"RATE_LIMIT_STORE"`
+	// брать адрес клиента из X-Forwarded-For / X-Real-IP
+	RateLimitTrustProxy bool `yaml:"rate_limit_trust_proxy" toml:"rate_limit_trust_proxy" env:"RATE_LIMIT_TRUST_PROXY"`
+	// адреса и подсети своих балансировщиков через запятую: они пропускаются
+	// при поиске адреса клиента в X-Forwarded-For; пусто — берётся последний адрес
+	RateLimitTrustedProxies string `yaml:"rate_limit_trusted_proxies" toml:"rate_limit_trusted_proxies" env:"RATE_LIMIT_TRUSTED_PROXIES"`
+	// ограничения по группам маршрутов в виде количество/окно, например 60/1m; off — без ограничения
+	RateLimitAuth     string `yaml:"rate_limit_auth" toml:"rate_limit_auth" env:"RATE_LIMIT_AUTH"`
+	RateLimitOrders   string `yaml:"rate_limit_orders" toml:"rate_limit_orders" env:"RATE_LIMIT_ORDERS"`
+	RateLimitWithdraw string `yaml:"rate_limit_withdraw" toml:"rate_limit_withdraw" env:"RATE_LIMIT_WITHDRAW"`
+	RateLimitReads    string `yaml:"rate_limit_reads" toml:"rate_limit_reads" env:"RATE_LIMIT_READS"`
+
+	// сертификат и ключ сервера; если не заданы, HTTP и gRPC работают без TLS
+	TLSCertFile string `yaml:"tls_cert_file" toml:"tls_cert_file" env:"TLS_CERT_FILE"`
+	TLSKeyFile  string `yaml:"tls_key_file" toml:"tls_key_file" env:"TLS_KEY_FILE"`
+	// минимальная версия TLS: 1.2 или 1.3
+	TLSMinVersion string `yaml:"tls_min_version" toml:"tls_min_version" env:"TLS_MIN_VERSION"`
+	// шифры TLS 1.2: intermediate или compatible
+	TLSCipherPolicy string `yaml:"tls_cipher_policy" toml:"tls_cipher_policy" env:"TLS_CIPHER_POLICY"`
+	// сертификаты центров, выпускающих клиентские сертификаты партнёров
+	TLSClientCAFile string `yaml:"tls_client_ca_file" toml:"tls_client_ca_file" env:"TLS_CLIENT_CA_FILE"`
+	// проверка клиентских сертификатов: none, optional или require
+	TLSClientAuth string `yaml:"tls_client_auth" toml:"tls_client_auth" env:"TLS_CLIENT_AUTH"`
+	// как часто проверять, не обновились ли файлы сертификатов
+	TLSReloadInterval time.Duration `yaml:"tls_reload_interval" toml:"tls_reload_interval" env:"TLS_RELOAD_INTERVAL"`
+
+	// строка подключения к PostgreSQL
+	DatabaseURI string `yaml:"database_uri" toml:"database_uri" env:"DATABASE_URI" secret:"uri"`
+	// время на подключение к базе данных при запуске
+	DBConnectTimeout time.Duration `yaml:"db_connect_timeout" toml:"db_connect_timeout" env:"DB_CONNECT_TIMEOUT"`
+	// максимальный размер пула соединений, 0 — значение pgxpool по умолчанию
+	DBMaxConns int `yaml:"db_max_conns" toml:"db_max_conns" env:"DB_MAX_CONNS"`
+	// таймаут запроса к базе данных по умолчанию
+	DBQueryTimeout time.Duration `yaml:"db_query_timeout" toml:"db_query_timeout" env:"DB_QUERY_TIMEOUT"`
+	// таймауты отдельных методов хранилища, 0 — без таймаута
+	DBQueryTimeouts QueryTimeouts `yaml:"db_query_timeouts" toml:"db_query_timeouts" env:"DB_QUERY_TIMEOUTS"`
+
+	// адрес системы расчёта начислений
+	AccrualSystemAddress string `yaml:"accrual_system_address" toml:"accrual_system_address" env:"ACCRUAL_SYSTEM_ADDRESS"`
+	// таймаут одного запроса к системе расчёта начислений
+	AccrualTimeout time.Duration `yaml:"accrual_timeout" toml:"accrual_timeout" env:"ACCRUAL_TIMEOUT"`
+	// сколько заказов поллер опрашивает параллельно
+	PollerConcurrency int `yaml:"poller_concurrency" toml:"poller_concurrency" env:"POLLER_CONCURRENCY"`
+	// пауза между проходами поллера по заказам
+	PollerInterval time.Duration `yaml:"poller_interval" toml:"poller_interval" env:"POLLER_INTERVAL"`
+	// общий секрет подписи результатов, которые система начислений присылает
+	// на /internal/accrual/callback; пусто — приём выключен, поллер опрашивает все заказы
+	AccrualCallbackSecret string `yaml:"accrual_callback_secret" toml:"accrual_callback_secret" env:"ACCRUAL_CALLBACK_SECRET" secret:"true"`
+	// при включённом приёме поллер опрашивает только заказы, по которым так долго ничего не приходило
+	AccrualReconcileInterval time.Duration `yaml:"accrual_reconcile_interval" toml:"accrual_reconcile_interval" env:"ACCRUAL_RECONCILE_INTERVAL"`
+	// после стольких ошибок системы начислений подряд поллер перестаёт к ней обращаться
+	AccrualBreakerFailures int `yaml:"accrual_breaker_failures" toml:"accrual_breaker_failures" env:"ACCRUAL_BREAKER_FAILURES"`
+	// пауза перед пробным запросом после первого отказа; удваивается с каждым неудачным пробным
+	AccrualBreakerOpenTimeout time.Duration `yaml:"accrual_breaker_open_timeout" toml:"accrual_breaker_open_timeout" env:"ACCRUAL_BREAKER_OPEN_TIMEOUT"`
+	// дольше пауза не растёт
+	AccrualBreakerMaxOpenTimeout time.Duration `yaml:"accrual_breaker_max_open_timeout" toml:"accrual_breaker_max_open_timeout" env:"ACCRUAL_BREAKER_MAX_OPEN_TIMEOUT"`
+
+	// через сколько месяцев после начисления баллы сгорают, 0 — не сгорают
+	PointsLifetimeMonths int `yaml:"points_lifetime_months" toml:"points_lifetime_months" env:"POINTS_LIFETIME_MONTHS"`
+	// за сколько до сгорания баллы показываются в балансе как сгорающие
+	PointsExpiringSoon time.Duration `yaml:"points_expiring_soon" toml:"points_expiring_soon" env:"POINTS_EXPIRING_SOON"`
+	// как часто запускается списание сгоревших баллов
+	PointsExpiryInterval time.Duration `yaml:"points_expiry_interval" toml:"points_expiry_interval" env:"POINTS_EXPIRY_INTERVAL"`
+
+	// уровни лояльности "название:порог:множитель" через запятую, пусто — без уровней
+	LoyaltyTiers string `yaml:"loyalty_tiers" toml:"loyalty_tiers" env:"LOYALTY_TIERS"`
+	// за что начисляется уровень: earned (начисленные баллы) или spent (списанные баллы)
+	LoyaltyTierBasis string `yaml:"loyalty_tier_basis" toml:"loyalty_tier_basis" env:"LOYALTY_TIER_BASIS"`
+	// за сколько последних месяцев считается сумма для уровня
+	LoyaltyTierMonths int `yaml:"loyalty_tier_months" toml:"loyalty_tier_months" env:"LOYALTY_TIER_MONTHS"`
+
+	// бонус пригласившему за первый обработанный заказ приглашённого
+	ReferralInviterBonus float64 `yaml:"referral_inviter_bonus" toml:"referral_inviter_bonus" env:"REFERRAL_INVITER_BONUS"`
+	// бонус приглашённому за его первый обработанный заказ
+	ReferralInviteeBonus float64 `yaml:"referral_invitee_bonus" toml:"referral_invitee_bonus" env:"REFERRAL_INVITEE_BONUS"`
+	// скольким приглашённым пригласивший может получить бонус, 0 — без ограничения
+	ReferralMaxPerInviter int `yaml:"referral_max_per_inviter" toml:"referral_max_per_inviter" env:"REFERRAL_MAX_PER_INVITER"`
+
+	// сколько баллов пользователь может перевести другим за сутки, 0 — без ограничения
+	TransferDailyAmount float64 `yaml:"transfer_daily_amount" toml:"transfer_daily_amount" env:"TRANSFER_DAILY_AMOUNT"`
+	// сколько переводов пользователь может сделать за сутки, 0 — без ограничения
+	TransferDailyCount int `yaml:"transfer_daily_count" toml:"transfer_daily_count" env:"TRANSFER_DAILY_COUNT"`
+	// за сколько отправитель должен подтвердить перевод, иначе баллы вернутся к нему
+	TransferPendingTTL time.Duration `yaml:"transfer_pending_ttl" toml:"transfer_pending_ttl" env:"TRANSFER_PENDING_TTL"`
+	// как часто неподтверждённые вовремя переводы возвращаются отправителям
+	TransferExpiryInterval time.Duration `yaml:"transfer_expiry_interval" toml:"transfer_expiry_interval" env:"TRANSFER_EXPIRY_INTERVAL"`
+
+	// как часто проверять очередь доставки вебхуков
+	WebhookInterval time.Duration `yaml:"webhook_interval" toml:"webhook_interval" env:"WEBHOOK_INTERVAL"`
+	// таймаут одного запроса к получателю вебхука
+	WebhookTimeout time.Duration `yaml:"webhook_timeout" toml:"webhook_timeout" env:"WEBHOOK_TIMEOUT"`
+	// сколько попыток доставки делается, прежде чем вебхук уходит в недоставленные
+	WebhookMaxAttempts int `yaml:"webhook_max_attempts" toml:"webhook_max_attempts" env:"WEBHOOK_MAX_ATTEMPTS"`
+	// пауза перед первым повтором, дальше удваивается
+	WebhookRetryBase time.Duration `yaml:"webhook_retry_base" toml:"webhook_retry_base" env:"WEBHOOK_RETRY_BASE"`
+	// сколько подписок на вебхуки может быть у одного пользователя или магазина
+	WebhookMaxSubscriptions int `yaml:"webhook_max_subscriptions" toml:"webhook_max_subscriptions" env:"WEBHOOK_MAX_SUBSCRIPTIONS"`
+
+	// алгоритм подписи JWT: HS256, HS384 или HS512
+	JWTAlgorithm string `yaml:"jwt_algorithm" toml:"jwt_algorithm" env:"JWT_ALGORITHM"`
+	// ключ подписи JWT, не короче ключа алгоритма: 32 байта для HS256, 48 для HS384, 64 для HS512
+	JWTSecret string `yaml:"jwt_secret" toml:"jwt_secret" env:"JWT_SECRET" secret:"true"`
+	// логины администраторов через запятую
+	AdminLogins string `yaml:"admin_logins" toml:"admin_logins" env:"ADMIN_LOGINS"`
+	// API-ключи магазинов "название:ключ" через запятую
+	MerchantAPIKeys string `yaml:"merchant_api_keys" toml:"merchant_api_keys" env:"MERCHANT_API_KEYS" secret:"true"`
+
+	// уровень логирования: trace, debug, info, warn, error
+	LogLevel string `yaml:"log_level" toml:"log_level" env:"LOG_LEVEL"`
+	// формат логов: json или console
+	LogFormat string `yaml:"log_format" toml:"log_format" env:"LOG_FORMAT"`
+
+	// экспорт трейсов: none, otlp, stdout или file
+	TraceExporter string `yaml:"trace_exporter" toml:"trace_exporter" env:"TRACE_EXPORTER"`
+	// адрес OTLP/gRPC коллектора трейсов
+	TraceOTLPEndpoint string `yaml:"trace_otlp_endpoint" toml:"trace_otlp_endpoint" env:"TRACE_OTLP_ENDPOINT"`
+	// подключаться к коллектору трейсов без TLS
+	TraceOTLPInsecure bool `yaml:"trace_otlp_insecure" toml:"trace_otlp_insecure" env:"TRACE_OTLP_INSECURE"`
+	// файл для экспорта трейсов в режиме file
+	TraceFile string `yaml:"trace_file" toml:"trace_file" env:"TRACE_FILE"`
+	// доля запросов, для которых пишутся трейсы
+	TraceSampleRatio float64 `yaml:"trace_sample_ratio" toml:"trace_sample_ratio" env:"TRACE_SAMPLE_RATIO"`
+}
+
+// Default возвращает значения по умолчанию
+func Default() Config {
+	return Config{
+		RunAddress:         "127.0.0.1:8080",
+		RequestTimeout:     60 * time.Second,
+		ShutdownTimeout:    10 * time.Second,
+		ShutdownDrainDelay: 5 * time.Second,
+		BatchMaxSize:       1000,
+
+		RateLimitStore:    "memory",
+		RateLimitAuth:     "10/1m",
+		RateLimitOrders:   "60/1m",
+		RateLimitWithdraw: "10/1m",
+		RateLimitReads:    "300/1m",
+
+		TLSMinVersion:     "1.2",
+		TLSCipherPolicy:   "intermediate",
+		TLSClientAuth:     "none",
+		TLSReloadInterval: 10 * time.Second,
+
+		DBConnectTimeout: 10 * time.Second,
+		DBQueryTimeout:   5 * time.Second,
+		// выписка читается построчно, пока клиент её скачивает
+		DBQueryTimeouts: QueryTimeouts{
+			"StreamStatement": 10 * time.Minute,
+			"AddOrdersBatch":  30 * time.Second,
+		},
+
+		AccrualTimeout:    5 * time.Second,
+		PollerConcurrency: 1,
+		PollerInterval:    time.Second,
+
+		AccrualReconcileInterval:     5 * time.Minute,
+		AccrualBreakerFailures:       5,
+		AccrualBreakerOpenTimeout:    5 * time.Second,
+		AccrualBreakerMaxOpenTimeout: 5 * time.Minute,
+
+		PointsExpiringSoon:   30 * 24 * time.Hour,
+		PointsExpiryInterval: time.Hour,
+
+		LoyaltyTierBasis:  loyalty.BasisEarned,
+		LoyaltyTierMonths: 12,
+
+		ReferralMaxPerInviter: 50,
+
+		TransferDailyAmount:    10000,
+		TransferDailyCount:     10,
+		TransferPendingTTL:     15 * time.Minute,
+		TransferExpiryInterval: time.Minute,
+
+		WebhookInterval:    5 * time.Second,
+		WebhookTimeout:     10 * time.Second,
+		WebhookMaxAttempts: 10,
+		WebhookRetryBase:   30 * time.Second,
+
+		WebhookMaxSubscriptions: 10,
+
+		JWTAlgorithm: "HS256",
+
+		LogLevel:  "info",
+		LogFormat: "json",
+
+		TraceExporter:     "none",
+		TraceOTLPEndpoint: "localhost:4317",
+		TraceFile:         "traces.jsonl",
+		TraceSampleRatio:  1,
+	}
+}
+
+// Load собирает конфигурацию из всех источников и проверяет её.
+// args — аргументы командной строки без имени программы
+func Load(args []string) (*Config, error) {
+	cfg, err := Parse(args)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// Parse собирает конфигурацию из всех источников без проверки значений
+func Parse(args []string) (*Config, error) {
+	cfg := Default()
+
+	path := configPath(args)
+	if path != "" {
+		if err := loadFile(path, &cfg); err != nil {
+			return nil, fmt.Errorf("файл конфигурации %s: %w", path, err)
+		}
+	}
+
+	if err := env.ParseWithFuncs(&cfg, envParsers); err != nil {
+		return nil, fmt.Errorf("переменные окружения: %w", err)
+	}
+
+	// значения по умолчанию для флагов — уже собранные из файла и окружения,
+	// поэтому флаг меняет настройку, только если явно передан
+	fs := newFlagSet(&cfg)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("неожиданные аргументы: %s", strings.Join(fs.Args(), " "))
+	}
+
+	return &cfg, nil
+}
+
+func newFlagSet(cfg *Config) *flag.FlagSet {
+	fs := flag.NewFlagSet("gophermart", flag.ContinueOnError)
+
+	// сам путь к файлу разбирается до флагов, здесь он нужен, чтобы флаг был известен
+	fs.String("config", "", "путь к файлу конфигурации YAML или TOML (переменная CONFIG)")
+
+	fs.StringVar(&cfg.RunAddress, "a", cfg.RunAddress, "server address")
+	fs.StringVar(&cfg.HTTPRedirectAddress, "http-redirect-address", cfg.HTTPRedirectAddress, "адрес, на котором HTTP-запросы перенаправляются на HTTPS")
+	fs.StringVar(&cfg.GRPCAddress, "g", cfg.GRPCAddress, "адрес gRPC сервера (пусто — gRPC не запускается)")
+	fs.StringVar(&cfg.MetricsAddress, "metrics-addr", cfg.MetricsAddress, "адрес сервера метрик Prometheus (пусто — только /api/admin/metrics)")
+	fs.DurationVar(&cfg.RequestTimeout, "request-timeout", cfg.RequestTimeout, "время на обработку одного HTTP-запроса")
+	fs.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", cfg.ShutdownTimeout, "общее время на остановку сервиса, включая shutdown-drain-delay")
+	fs.DurationVar(&cfg.ShutdownDrainDelay, "shutdown-drain-delay", cfg.ShutdownDrainDelay, "сколько отдавать неготовность на /readyz перед остановкой HTTP-сервера")
+	fs.IntVar(&cfg.BatchMaxSize, "batch-max-size", cfg.BatchMaxSize, "максимальное количество номеров в пакетной загрузке заказов")
+
+	fs.StringVar(&cfg.RateLimitStore, "rate-limit-store", cfg.RateLimitStore, "хранилище счётчиков ограничения частоты запросов: memory, postgres или none")
+	fs.BoolVar(&cfg.RateLimitTrustProxy, "rate-limit-trust-proxy", cfg.RateLimitTrustProxy, "брать адрес клиента из X-Forwarded-For / X-Real-IP")
+	fs.StringVar(&cfg.RateLimitTrustedProxies, "rate-limit-trusted-proxies", cfg.RateLimitTrustedProxies, "адреса и подсети балансировщиков через запятую, которые пропускаются в X-Forwarded-For")
+	fs.StringVar(&cfg.RateLimitAuth, "rate-limit-auth", cfg.RateLimitAuth, "ограничение на регистрацию и вход, например 10/1m; off — без ограничения")
+	fs.StringVar(&cfg.RateLimitOrders, "rate-limit-orders", cfg.RateLimitOrders, "ограничение на загрузку заказов")
+	fs.StringVar(&cfg.RateLimitWithdraw, "rate-limit-withdraw", cfg.RateLimitWithdraw, "ограничение на списание баллов")
+	fs.StringVar(&cfg.RateLimitReads, "rate-limit-reads", cfg.RateLimitReads, "ограничение на чтение заказов, баланса, списаний и выписки")
+
+	fs.StringVar(&cfg.TLSCertFile, "tls-cert-file", cfg.TLSCertFile, "сертификат сервера (PEM); без него HTTP и gRPC работают без TLS")
+	fs.StringVar(&cfg.TLSKeyFile, "tls-key-file", cfg.TLSKeyFile, "ключ сертификата сервера (PEM)")
+	fs.StringVar(&cfg.TLSMinVersion, "tls-min-version", cfg.TLSMinVersion, "минимальная версия TLS: 1.2 или 1.3")
+	fs.StringVar(&cfg.TLSCipherPolicy, "tls-cipher-policy", cfg.TLSCipherPolicy, "шифры TLS 1.2: intermediate или compatible")
+	fs.StringVar(&cfg.TLSClientCAFile, "tls-client-ca-file", cfg.TLSClientCAFile, "сертификаты центров для проверки клиентских сертификатов партнёров")
+	fs.StringVar(&cfg.TLSClientAuth, "tls-client-auth", cfg.TLSClientAuth, "проверка клиентских сертификатов: none, optional или require")
+	fs.DurationVar(&cfg.TLSReloadInterval, "tls-reload-interval", cfg.TLSReloadInterval, "как часто проверять, не обновились ли файлы сертификатов")
+
+	fs.StringVar(&cfg.DatabaseURI, "d", cfg.DatabaseURI, "database connection string")
+	fs.DurationVar(&cfg.DBConnectTimeout, "db-connect-timeout", cfg.DBConnectTimeout, "время на подключение к базе данных при запуске")
+	fs.IntVar(&cfg.DBMaxConns, "db-max-conns", cfg.DBMaxConns, "максимальный размер пула соединений, 0 — значение pgxpool по умолчанию")
+	fs.DurationVar(&cfg.DBQueryTimeout, "db-query-timeout", cfg.DBQueryTimeout, "таймаут запроса к базе данных по умолчанию")
+	fs.Var(&cfg.DBQueryTimeouts, "db-query-timeouts", "таймауты отдельных методов хранилища: Метод=таймаут через запятую, 0 — без таймаута")
+
+	fs.StringVar(&cfg.AccrualSystemAddress, "r", cfg.AccrualSystemAddress, "адрес системы расчёта начислений")
+	fs.DurationVar(&cfg.AccrualTimeout, "accrual-timeout", cfg.AccrualTimeout, "таймаут запроса к системе расчёта начислений")
+	fs.IntVar(&cfg.PollerConcurrency, "poller-concurrency", cfg.PollerConcurrency, "сколько заказов поллер опрашивает параллельно")
+	fs.DurationVar(&cfg.PollerInterval, "poller-interval", cfg.PollerInterval, "пауза между проходами поллера по заказам")
+	fs.StringVar(&cfg.AccrualCallbackSecret, "accrual-callback-secret", cfg.AccrualCallbackSecret, "секрет подписи результатов, которые присылает система начислений, пусто — приём выключен")
+	fs.DurationVar(&cfg.AccrualReconcileInterval, "accrual-reconcile-interval", cfg.AccrualReconcileInterval, "при включённом приёме результатов опрашивать только заказы, по которым так долго ничего не приходило")
+	fs.IntVar(&cfg.AccrualBreakerFailures, "accrual-breaker-failures", cfg.AccrualBreakerFailures, "после стольких ошибок системы начислений подряд приостановить запросы к ней")
+	fs.DurationVar(&cfg.AccrualBreakerOpenTimeout, "accrual-breaker-open-timeout", cfg.AccrualBreakerOpenTimeout, "пауза перед пробным запросом к системе начислений, удваивается после каждого неудачного")
+	fs.DurationVar(&cfg.AccrualBreakerMaxOpenTimeout, "accrual-breaker-max-open-timeout", cfg.AccrualBreakerMaxOpenTimeout, "максимальная пауза перед пробным запросом к системе начислений")
+
+	fs.IntVar(&cfg.PointsLifetimeMonths, "points-lifetime-months", cfg.PointsLifetimeMonths, "через сколько месяцев после начисления баллы сгорают, 0 — не сгорают")
+	fs.DurationVar(&cfg.PointsExpiringSoon, "points-expiring-soon", cfg.PointsExpiringSoon, "за сколько до сгорания баллы показываются в балансе как сгорающие")
+	fs.DurationVar(&cfg.PointsExpiryInterval, "points-expiry-interval", cfg.PointsExpiryInterval, "как часто запускается списание сгоревших баллов")
+
+	fs.StringVar(&cfg.LoyaltyTiers, "loyalty-tiers", cfg.LoyaltyTiers, "уровни лояльности название:порог:множитель через запятую, например bronze:0:1,silver:1000:1.1")
+	fs.StringVar(&cfg.LoyaltyTierBasis, "loyalty-tier-basis", cfg.LoyaltyTierBasis, "за что начисляется уровень: earned или spent")
+	fs.IntVar(&cfg.LoyaltyTierMonths, "loyalty-tier-months", cfg.LoyaltyTierMonths, "за сколько последних месяцев считается сумма для уровня")
+
+	fs.Float64Var(&cfg.ReferralInviterBonus, "referral-inviter-bonus", cfg.ReferralInviterBonus, "бонус пригласившему за первый обработанный заказ приглашённого")
+	fs.Float64Var(&cfg.ReferralInviteeBonus, "referral-invitee-bonus", cfg.ReferralInviteeBonus, "бонус приглашённому за его первый обработанный заказ")
+	fs.IntVar(&cfg.ReferralMaxPerInviter, "referral-max-per-inviter", cfg.ReferralMaxPerInviter, "скольким приглашённым пригласивший может получить бонус, 0 — без ограничения")
+
+	fs.Float64Var(&cfg.TransferDailyAmount, "transfer-daily-amount", cfg.TransferDailyAmount, "сколько баллов пользователь может перевести другим за сутки, 0 — без ограничения")
+	fs.IntVar(&cfg.TransferDailyCount, "transfer-daily-count", cfg.TransferDailyCount, "сколько переводов пользователь может сделать за сутки, 0 — без ограничения")
+	fs.DurationVar(&cfg.TransferPendingTTL, "transfer-pending-ttl", cfg.TransferPendingTTL, "за сколько отправитель должен подтвердить перевод, иначе баллы вернутся к нему")
+	fs.DurationVar(&cfg.TransferExpiryInterval, "transfer-expiry-interval", cfg.TransferExpiryInterval, "как часто неподтверждённые вовремя переводы возвращаются отправителям")
+
+	fs.DurationVar(&cfg.WebhookInterval, "webhook-interval", cfg.WebhookInterval, "как часто проверять очередь доставки вебхуков")
+	fs.DurationVar(&cfg.WebhookTimeout, "webhook-timeout", cfg.WebhookTimeout, "таймаут одного запроса к получателю вебхука")
+	fs.IntVar(&cfg.WebhookMaxAttempts, "webhook-max-attempts", cfg.WebhookMaxAttempts, "сколько попыток доставки делается, прежде чем вебхук уходит в недоставленные")
+	fs.DurationVar(&cfg.WebhookRetryBase, "webhook-retry-base", cfg.WebhookRetryBase, "пауза перед первым повтором доставки вебхука, дальше удваивается")
+	fs.IntVar(&cfg.WebhookMaxSubscriptions, "webhook-max-subscriptions", cfg.WebhookMaxSubscriptions, "сколько подписок на вебхуки может быть у одного пользователя или магазина")
+
+	fs.StringVar(&cfg.JWTAlgorithm, "jwt-algorithm", cfg.JWTAlgorithm, "алгоритм подписи JWT: HS256, HS384 или HS512")
+	fs.StringVar(&cfg.JWTSecret, "jwt-secret", cfg.JWTSecret, "ключ подписи JWT")
+	fs.StringVar(&cfg.AdminLogins, "admin-logins", cfg.AdminLogins, "логины администраторов через запятую")
+	fs.StringVar(&cfg.MerchantAPIKeys, "merchant-api-keys", cfg.MerchantAPIKeys, "API-ключи магазинов название:ключ через запятую")
+
+	fs.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "уровень логирования: trace, debug, info, warn, error")
+	fs.StringVar(&cfg.LogFormat, "log-format", cfg.LogFormat, "формат логов: json или console")
+
+	fs.StringVar(&cfg.TraceExporter, "trace-exporter", cfg.TraceExporter, "экспорт трейсов: none, otlp, stdout или file")
+	fs.StringVar(&cfg.TraceOTLPEndpoint, "trace-otlp-endpoint", cfg.TraceOTLPEndpoint, "адрес OTLP/gRPC коллектора трейсов")
+	fs.BoolVar(&cfg.TraceOTLPInsecure, "trace-otlp-insecure", cfg.TraceOTLPInsecure, "подключаться к коллектору трейсов без TLS")
+	fs.StringVar(&cfg.TraceFile, "trace-file", cfg.TraceFile, "файл для экспорта трейсов в режиме file")
+	fs.Float64Var(&cfg.TraceSampleRatio, "trace-sample-ratio", cfg.TraceSampleRatio, "доля запросов, для которых пишутся трейсы")
+
+	return fs
+}
+
+// путь к файлу конфигурации из флага -config или переменной CONFIG
+func configPath(args []string) string {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			break
+		}
+
+		name := strings.TrimLeft(arg, "-")
+		if name == arg {
+			continue
+		}
+
+		if value, ok := strings.CutPrefix(name, "config="); ok {
+			return value
+		}
+		if name == "config" && i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+
+	return os.Getenv("CONFIG")
+}
+
+// читает файл конфигурации. Неизвестные ключи — ошибка, чтобы опечатки не проходили молча
+func loadFile(path string, cfg *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+	case ".toml":
+		meta, err := toml.Decode(string(data), cfg)
+		if err != nil {
+			return err
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			keys := make([]string, len(undecoded))
+			for i, key := range undecoded {
+				keys[i] = key.String()
+			}
+			return fmt.Errorf("неизвестные ключи: %s", strings.Join(keys, ", "))
+		}
+	default:
+		return fmt.Errorf("неизвестный формат %q: ожидается .yaml, .yml или .toml", ext)
+	}
+
+	return nil
+}
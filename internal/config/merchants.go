@@ -0,0 +1,39 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// минимальная длина API-ключа магазина
+const minMerchantKeyLength = 16
+
+// ParseMerchantKeys разбирает API-ключи магазинов вида "shop:key,partner:key2"
+// и возвращает ключи по названиям магазинов
+func ParseMerchantKeys(spec string) (map[string]string, error) {
+	keys := make(map[string]string)
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		name, key, ok := strings.Cut(entry, ":")
+		if !ok || name == "" {
+			// ключ не выводится: ошибка попадает в лог
+			return nil, errors.New("ожидается название:ключ")
+		}
+		if _, exists := keys[name]; exists {
+			return nil, fmt.Errorf("магазин %q указан дважды", name)
+		}
+		if len(key) < minMerchantKeyLength {
+			return nil, fmt.Errorf("%s: ключ короче %d символов", name, minMerchantKeyLength)
+		}
+
+		keys[name] = key
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,80 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/caarlos0/env/v6"
+)
+
+// QueryTimeouts — таймауты запросов к базе данных по имени метода хранилища.
+// В переменной окружения и флаге задаются списком "Метод=таймаут" через запятую,
+// например "StreamStatement=10m,AddOrdersBatch=30s". Флаг дополняет значения
+// из других источников, переменная окружения заменяет их целиком
+type QueryTimeouts map[string]time.Duration
+
+// String нужен для flag.Value
+func (t *QueryTimeouts) String() string {
+	if t == nil {
+		return ""
+	}
+
+	items := make([]string, 0, len(*t))
+	for method, timeout := range *t {
+		items = append(items, method+"="+timeout.String())
+	}
+	sort.Strings(items)
+
+	return strings.Join(items, ",")
+}
+
+// Set разбирает список "Метод=таймаут" и добавляет значения к уже заданным
+func (t *QueryTimeouts) Set(value string) error {
+	parsed, err := parseQueryTimeouts(value)
+	if err != nil {
+		return err
+	}
+
+	if *t == nil {
+		*t = QueryTimeouts{}
+	}
+	for method, timeout := range parsed {
+		(*t)[method] = timeout
+	}
+
+	return nil
+}
+
+func parseQueryTimeouts(value string) (QueryTimeouts, error) {
+	timeouts := QueryTimeouts{}
+
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		method, raw, ok := strings.Cut(item, "=")
+		if !ok || method == "" {
+			return nil, fmt.Errorf("ожидается Метод=таймаут, получено %q", item)
+		}
+
+		timeout, err := time.ParseDuration(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", method, err)
+		}
+		timeouts[method] = timeout
+	}
+
+	return timeouts, nil
+}
+
+// разборщики переменных окружения для типов, которые env не знает
+var envParsers = map[reflect.Type]env.ParserFunc{
+	reflect.TypeOf(QueryTimeouts{}): func(value string) (interface{}, error) {
+		return parseQueryTimeouts(value)
+	},
+}
@@ -0,0 +1,273 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/region23/praktikum-diplom/internal/loyalty"
+	"github.com/region23/praktikum-diplom/internal/ratelimit"
+	"github.com/region23/praktikum-diplom/internal/storage"
+)
+
+// минимальная длина ключа подписи JWT: не короче выхода хеш-функции алгоритма
+var jwtKeySizes = map[string]int{"HS256": 32, "HS384": 48, "HS512": 64}
+
+// ключи из старых значений по умолчанию и примеров конфигурации
+var weakJWTSecrets = map[string]bool{"secret": true, "change-me": true}
+
+// Validate проверяет все настройки сразу и возвращает список всех ошибок,
+// чтобы не исправлять конфигурацию по одной опечатке за запуск
+func (cfg *Config) Validate() error {
+	var errs []string
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+
+	if _, _, err := net.SplitHostPort(cfg.RunAddress); err != nil {
+		fail("run_address (-a, RUN_ADDRESS): ожидается host:port, получено %q", cfg.RunAddress)
+	}
+
+	if cfg.GRPCAddress != "" {
+		if _, _, err := net.SplitHostPort(cfg.GRPCAddress); err != nil {
+			fail("grpc_address (-g, GRPC_ADDRESS): ожидается host:port, получено %q", cfg.GRPCAddress)
+		}
+	}
+
+	if cfg.MetricsAddress != "" {
+		if _, _, err := net.SplitHostPort(cfg.MetricsAddress); err != nil {
+			fail("metrics_address (-metrics-addr, METRICS_ADDRESS): ожидается host:port, получено %q", cfg.MetricsAddress)
+		}
+	}
+
+	if cfg.HTTPRedirectAddress != "" {
+		if _, _, err := net.SplitHostPort(cfg.HTTPRedirectAddress); err != nil {
+			fail("http_redirect_address (-http-redirect-address, HTTP_REDIRECT_ADDRESS): ожидается host:port, получено %q", cfg.HTTPRedirectAddress)
+		}
+		if cfg.TLSCertFile == "" {
+			fail("http_redirect_address (-http-redirect-address, HTTP_REDIRECT_ADDRESS): перенаправление на HTTPS требует tls_cert_file и tls_key_file")
+		}
+	}
+
+	switch cfg.RateLimitStore {
+	case "memory", "postgres", "none":
+	default:
+		fail("rate_limit_store (-rate-limit-store, RATE_LIMIT_STORE): ожидается memory, postgres или none, получено %q", cfg.RateLimitStore)
+	}
+
+	if _, err := ParseTrustedProxies(cfg.RateLimitTrustedProxies); err != nil {
+		fail("rate_limit_trusted_proxies (-rate-limit-trusted-proxies, RATE_LIMIT_TRUSTED_PROXIES): %v", err)
+	}
+
+	for _, limit := range []struct{ name, spec string }{
+		{"rate_limit_auth (-rate-limit-auth, RATE_LIMIT_AUTH)", cfg.RateLimitAuth},
+		{"rate_limit_orders (-rate-limit-orders, RATE_LIMIT_ORDERS)", cfg.RateLimitOrders},
+		{"rate_limit_withdraw (-rate-limit-withdraw, RATE_LIMIT_WITHDRAW)", cfg.RateLimitWithdraw},
+		{"rate_limit_reads (-rate-limit-reads, RATE_LIMIT_READS)", cfg.RateLimitReads},
+	} {
+		if _, err := ratelimit.ParsePolicy("", limit.spec); err != nil {
+			fail("%s: %v", limit.name, err)
+		}
+	}
+
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		fail("tls_cert_file и tls_key_file (-tls-cert-file, -tls-key-file): задаются только вместе")
+	}
+
+	switch cfg.TLSMinVersion {
+	case "1.2", "1.3":
+	default:
+		fail("tls_min_version (-tls-min-version, TLS_MIN_VERSION): ожидается 1.2 или 1.3, получено %q", cfg.TLSMinVersion)
+	}
+
+	switch cfg.TLSCipherPolicy {
+	case "intermediate", "compatible":
+	default:
+		fail("tls_cipher_policy (-tls-cipher-policy, TLS_CIPHER_POLICY): ожидается intermediate или compatible, получено %q", cfg.TLSCipherPolicy)
+	}
+
+	switch cfg.TLSClientAuth {
+	case "none":
+	case "optional", "require":
+		if cfg.TLSCertFile == "" {
+			fail("tls_client_auth (-tls-client-auth, TLS_CLIENT_AUTH): проверка клиентских сертификатов требует tls_cert_file и tls_key_file")
+		}
+		if cfg.TLSClientCAFile == "" {
+			fail("tls_client_ca_file (-tls-client-ca-file, TLS_CLIENT_CA_FILE): обязателен при tls_client_auth = %s", cfg.TLSClientAuth)
+		}
+	default:
+		fail("tls_client_auth (-tls-client-auth, TLS_CLIENT_AUTH): ожидается none, optional или require, получено %q", cfg.TLSClientAuth)
+	}
+
+	positive := func(name string, d time.Duration) {
+		if d <= 0 {
+			fail("%s: должно быть больше нуля, получено %s", name, d)
+		}
+	}
+	positive("request_timeout (-request-timeout, REQUEST_TIMEOUT)", cfg.RequestTimeout)
+	positive("tls_reload_interval (-tls-reload-interval, TLS_RELOAD_INTERVAL)", cfg.TLSReloadInterval)
+	positive("shutdown_timeout (-shutdown-timeout, SHUTDOWN_TIMEOUT)", cfg.ShutdownTimeout)
+	positive("db_connect_timeout (-db-connect-timeout, DB_CONNECT_TIMEOUT)", cfg.DBConnectTimeout)
+	positive("accrual_timeout (-accrual-timeout, ACCRUAL_TIMEOUT)", cfg.AccrualTimeout)
+	positive("poller_interval (-poller-interval, POLLER_INTERVAL)", cfg.PollerInterval)
+
+	if cfg.ShutdownDrainDelay < 0 {
+		fail("shutdown_drain_delay (-shutdown-drain-delay, SHUTDOWN_DRAIN_DELAY): не может быть отрицательным, получено %s", cfg.ShutdownDrainDelay)
+	} else if cfg.ShutdownDrainDelay >= cfg.ShutdownTimeout {
+		fail("shutdown_drain_delay (-shutdown-drain-delay, SHUTDOWN_DRAIN_DELAY): должно быть меньше shutdown_timeout (%s), получено %s", cfg.ShutdownTimeout, cfg.ShutdownDrainDelay)
+	}
+
+	if cfg.BatchMaxSize < 1 {
+		fail("batch_max_size (-batch-max-size, BATCH_MAX_SIZE): должно быть положительным, получено %d", cfg.BatchMaxSize)
+	}
+
+	if cfg.DatabaseURI == "" {
+		fail("database_uri (-d, DATABASE_URI): не задана строка подключения к базе данных")
+	} else if _, err := pgxpool.ParseConfig(cfg.DatabaseURI); err != nil {
+		fail("database_uri (-d, DATABASE_URI): неверная строка подключения: %v", err)
+	}
+
+	if cfg.DBMaxConns < 0 {
+		fail("db_max_conns (-db-max-conns, DB_MAX_CONNS): не может быть отрицательным, получено %d", cfg.DBMaxConns)
+	}
+
+	positive("db_query_timeout (-db-query-timeout, DB_QUERY_TIMEOUT)", cfg.DBQueryTimeout)
+	for method, timeout := range cfg.DBQueryTimeouts {
+		if !slices.Contains(storage.QueryMethods, method) {
+			fail("db_query_timeouts (-db-query-timeouts, DB_QUERY_TIMEOUTS): неизвестный метод хранилища %q, ожидается один из: %s",
+				method, strings.Join(storage.QueryMethods, ", "))
+		}
+		if timeout < 0 {
+			fail("db_query_timeouts (-db-query-timeouts, DB_QUERY_TIMEOUTS): %s: не может быть отрицательным, получено %s", method, timeout)
+		}
+	}
+
+	if cfg.AccrualSystemAddress == "" {
+		fail("accrual_system_address (-r, ACCRUAL_SYSTEM_ADDRESS): не задан адрес системы расчёта начислений")
+	} else if u, err := url.Parse(cfg.AccrualSystemAddress); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		fail("accrual_system_address (-r, ACCRUAL_SYSTEM_ADDRESS): ожидается http(s)://host:port, получено %q", cfg.AccrualSystemAddress)
+	}
+
+	if cfg.PollerConcurrency < 1 {
+		fail("poller_concurrency (-poller-concurrency, POLLER_CONCURRENCY): должно быть положительным, получено %d", cfg.PollerConcurrency)
+	}
+
+	positive("accrual_reconcile_interval (-accrual-reconcile-interval, ACCRUAL_RECONCILE_INTERVAL)", cfg.AccrualReconcileInterval)
+	if cfg.AccrualBreakerFailures < 1 {
+		fail("accrual_breaker_failures (-accrual-breaker-failures, ACCRUAL_BREAKER_FAILURES): должно быть положительным, получено %d", cfg.AccrualBreakerFailures)
+	}
+	positive("accrual_breaker_open_timeout (-accrual-breaker-open-timeout, ACCRUAL_BREAKER_OPEN_TIMEOUT)", cfg.AccrualBreakerOpenTimeout)
+	positive("accrual_breaker_max_open_timeout (-accrual-breaker-max-open-timeout, ACCRUAL_BREAKER_MAX_OPEN_TIMEOUT)", cfg.AccrualBreakerMaxOpenTimeout)
+	if cfg.AccrualBreakerMaxOpenTimeout < cfg.AccrualBreakerOpenTimeout {
+		fail("accrual_breaker_max_open_timeout (-accrual-breaker-max-open-timeout, ACCRUAL_BREAKER_MAX_OPEN_TIMEOUT): не может быть меньше accrual_breaker_open_timeout")
+	}
+	if cfg.AccrualCallbackSecret != "" && len(cfg.AccrualCallbackSecret) < 16 {
+		fail("accrual_callback_secret (-accrual-callback-secret, ACCRUAL_CALLBACK_SECRET): должен быть не короче 16 символов")
+	}
+
+	if cfg.PointsLifetimeMonths < 0 {
+		fail("points_lifetime_months (-points-lifetime-months, POINTS_LIFETIME_MONTHS): не может быть отрицательным, получено %d", cfg.PointsLifetimeMonths)
+	}
+	if cfg.PointsExpiringSoon < 0 {
+		fail("points_expiring_soon (-points-expiring-soon, POINTS_EXPIRING_SOON): не может быть отрицательным, получено %s", cfg.PointsExpiringSoon)
+	}
+	positive("points_expiry_interval (-points-expiry-interval, POINTS_EXPIRY_INTERVAL)", cfg.PointsExpiryInterval)
+
+	if _, err := loyalty.ParseTiers(cfg.LoyaltyTiers); err != nil {
+		fail("loyalty_tiers (-loyalty-tiers, LOYALTY_TIERS): %v", err)
+	}
+	switch cfg.LoyaltyTierBasis {
+	case loyalty.BasisEarned, loyalty.BasisSpent:
+	default:
+		fail("loyalty_tier_basis (-loyalty-tier-basis, LOYALTY_TIER_BASIS): ожидается earned или spent, получено %q", cfg.LoyaltyTierBasis)
+	}
+	if cfg.LoyaltyTierMonths < 1 {
+		fail("loyalty_tier_months (-loyalty-tier-months, LOYALTY_TIER_MONTHS): должно быть положительным, получено %d", cfg.LoyaltyTierMonths)
+	}
+
+	if cfg.ReferralInviterBonus < 0 {
+		fail("referral_inviter_bonus (-referral-inviter-bonus, REFERRAL_INVITER_BONUS): не может быть отрицательным, получено %v", cfg.ReferralInviterBonus)
+	}
+	if cfg.ReferralInviteeBonus < 0 {
+		fail("referral_invitee_bonus (-referral-invitee-bonus, REFERRAL_INVITEE_BONUS): не может быть отрицательным, получено %v", cfg.ReferralInviteeBonus)
+	}
+	if cfg.ReferralMaxPerInviter < 0 {
+		fail("referral_max_per_inviter (-referral-max-per-inviter, REFERRAL_MAX_PER_INVITER): не может быть отрицательным, получено %d", cfg.ReferralMaxPerInviter)
+	}
+
+	if _, err := ParseMerchantKeys(cfg.MerchantAPIKeys); err != nil {
+		fail("merchant_api_keys (-merchant-api-keys, MERCHANT_API_KEYS): %v", err)
+	}
+
+	if cfg.TransferDailyAmount < 0 {
+		fail("transfer_daily_amount (-transfer-daily-amount, TRANSFER_DAILY_AMOUNT): не может быть отрицательным, получено %v", cfg.TransferDailyAmount)
+	}
+	if cfg.TransferDailyCount < 0 {
+		fail("transfer_daily_count (-transfer-daily-count, TRANSFER_DAILY_COUNT): не может быть отрицательным, получено %d", cfg.TransferDailyCount)
+	}
+	positive("transfer_pending_ttl (-transfer-pending-ttl, TRANSFER_PENDING_TTL)", cfg.TransferPendingTTL)
+	positive("transfer_expiry_interval (-transfer-expiry-interval, TRANSFER_EXPIRY_INTERVAL)", cfg.TransferExpiryInterval)
+
+	positive("webhook_interval (-webhook-interval, WEBHOOK_INTERVAL)", cfg.WebhookInterval)
+	positive("webhook_timeout (-webhook-timeout, WEBHOOK_TIMEOUT)", cfg.WebhookTimeout)
+	positive("webhook_retry_base (-webhook-retry-base, WEBHOOK_RETRY_BASE)", cfg.WebhookRetryBase)
+	if cfg.WebhookMaxSubscriptions < 1 {
+		fail("webhook_max_subscriptions (-webhook-max-subscriptions, WEBHOOK_MAX_SUBSCRIPTIONS): должно быть положительным, получено %d", cfg.WebhookMaxSubscriptions)
+	}
+	if cfg.WebhookMaxAttempts < 1 {
+		fail("webhook_max_attempts (-webhook-max-attempts, WEBHOOK_MAX_ATTEMPTS): должно быть положительным, получено %d", cfg.WebhookMaxAttempts)
+	}
+
+	keySize, ok := jwtKeySizes[cfg.JWTAlgorithm]
+	if !ok {
+		fail("jwt_algorithm (-jwt-algorithm, JWT_ALGORITHM): ожидается HS256, HS384 или HS512, получено %q", cfg.JWTAlgorithm)
+	}
+
+	// ключом подписываются и токены администраторов, поэтому известные
+	// и короткие ключи не принимаются
+	switch {
+	case cfg.JWTSecret == "":
+		fail("jwt_secret (-jwt-secret, JWT_SECRET): не задан ключ подписи JWT")
+	case weakJWTSecrets[cfg.JWTSecret]:
+		fail("jwt_secret (-jwt-secret, JWT_SECRET): ключ из примера, задайте свой")
+	case ok && len(cfg.JWTSecret) < keySize:
+		fail("jwt_secret (-jwt-secret, JWT_SECRET): ключ для %s должен быть не короче %d байт, получено %d", cfg.JWTAlgorithm, keySize, len(cfg.JWTSecret))
+	}
+
+	switch cfg.LogLevel {
+	case "trace", "debug", "info", "warn", "error", "fatal", "panic", "disabled":
+	default:
+		fail("log_level (-log-level, LOG_LEVEL): ожидается trace, debug, info, warn или error, получено %q", cfg.LogLevel)
+	}
+
+	switch cfg.LogFormat {
+	case "json", "console":
+	default:
+		fail("log_format (-log-format, LOG_FORMAT): ожидается json или console, получено %q", cfg.LogFormat)
+	}
+
+	switch cfg.TraceExporter {
+	case "none", "otlp", "stdout":
+	case "file":
+		if cfg.TraceFile == "" {
+			fail("trace_file (-trace-file, TRACE_FILE): обязателен при trace_exporter = file")
+		}
+	default:
+		fail("trace_exporter (-trace-exporter, TRACE_EXPORTER): ожидается none, otlp, stdout или file, получено %q", cfg.TraceExporter)
+	}
+
+	if cfg.TraceSampleRatio < 0 || cfg.TraceSampleRatio > 1 {
+		fail("trace_sample_ratio (-trace-sample-ratio, TRACE_SAMPLE_RATIO): ожидается число от 0 до 1, получено %v", cfg.TraceSampleRatio)
+	}
+
+	if len(errs) > 0 {
+		return errors.New("неверная конфигурация:\n  " + strings.Join(errs, "\n  "))
+	}
+
+	return nil
+}
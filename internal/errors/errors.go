@@ -9,6 +9,13 @@ var (
 	ErrNotFound            = errors.New("not found")
 	ErrAlreadyExists       = errors.New("already exists")
 	ErrInsufficientBalance = errors.New("сумма списания больше текущей суммы")
+	ErrInvalidReferral     = errors.New("неизвестный реферальный код")
+	ErrTransferLimit       = errors.New("превышен дневной лимит переводов")
+	ErrTransferState       = errors.New("перевод уже подтверждён или истёк")
+	ErrWithdrawalState     = errors.New("действие недоступно для списания в текущем статусе")
+	ErrOrderState          = errors.New("действие недоступно для заказа в текущем статусе")
+	ErrBalanceBlocked      = errors.New("списания заблокированы, пока отрицательный баланс не будет погашен")
+	ErrWebhookLimit        = errors.New("достигнуто максимальное число подписок на вебхуки")
 	ErrInternalServerError = errors.New("InternalServerError")
 )
 
@@ -0,0 +1,77 @@
+package events
+
+import (
+	"sync"
+
+	"github.com/region23/praktikum-diplom/internal/storage"
+)
+
+// размер буфера канала подписчика. Если подписчик не успевает вычитывать
+// события и буфер переполняется, подписка закрывается — клиент должен
+// переподключиться и догнать пропущенное по Last-Event-ID
+const subscriberBuffer = 64
+
+// Broker раздаёт события подписчикам внутри процесса.
+// Подписки группируются по логину пользователя.
+type Broker struct {
+	mu          sync.Mutex
+	subscribers map[string]map[chan storage.Event]struct{}
+}
+
+func NewBroker() *Broker {
+	return &Broker{
+		subscribers: make(map[string]map[chan storage.Event]struct{}),
+	}
+}
+
+// подписывает на события пользователя. Возвращает канал событий и функцию отписки
+func (b *Broker) Subscribe(login string) (<-chan storage.Event, func()) {
+	ch := make(chan storage.Event, subscriberBuffer)
+
+	b.mu.Lock()
+	if b.subscribers[login] == nil {
+		b.subscribers[login] = make(map[chan storage.Event]struct{})
+	}
+	b.subscribers[login][ch] = struct{}{}
+	b.mu.Unlock()
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.remove(login, ch)
+	}
+}
+
+// рассылает событие всем подписчикам его владельца
+func (b *Broker) Publish(event storage.Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subscribers[event.Login] {
+		select {
+		case ch <- event:
+		default:
+			// медленный подписчик — отключаем его
+			b.remove(event.Login, ch)
+		}
+	}
+}
+
+// удаляет подписку и закрывает её канал. Вызывается под b.mu
+func (b *Broker) remove(login string, ch chan storage.Event) {
+	subs, ok := b.subscribers[login]
+	if !ok {
+		return
+	}
+
+	if _, ok := subs[ch]; !ok {
+		return
+	}
+
+	delete(subs, ch)
+	close(ch)
+
+	if len(subs) == 0 {
+		delete(b.subscribers, login)
+	}
+}
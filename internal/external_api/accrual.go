@@ -6,22 +6,55 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"strconv"
+	"sync"
 	"time"
 
+	"github.com/region23/praktikum-diplom/internal/breaker"
 	my_errors "github.com/region23/praktikum-diplom/internal/errors"
+	"github.com/region23/praktikum-diplom/internal/metrics"
 	"github.com/region23/praktikum-diplom/internal/storage"
+	"github.com/region23/praktikum-diplom/internal/tracing"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
+var tracer = tracing.Tracer("accrual")
+
 type AccuralType struct {
 	Order   string              `json:"order"`             // номер заказа
 	Status  storage.OrderStatus `json:"status"`            // статус расчёта начисления
 	Accrual float64             `json:"accrual,omitempty"` // рассчитанные баллы к начислению, при отсутствии начисления — поле отсутствует в ответе
 }
 
+// ErrNotRegistered — система начислений ещё не знает о заказе (ответ 204). Это не сбой:
+// заказ будет опрошен позже
+var ErrNotRegistered = errors.New("заказ не зарегистрирован в системе расчёта начислений")
+
 // получение информации о расчёте начислений баллов лояльности
 func getOrderAccrual(ctx context.Context, httpClient *http.Client, accrualSystemAddress, number string) (accuralType *AccuralType, err error) {
+	ctx, span := tracer.Start(ctx, "accrual.getOrderAccrual",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("order.number", number)))
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+
+		retryAfter := new(my_errors.RetryAfterError)
+		switch {
+		case err == nil, errors.Is(err, ErrNotRegistered):
+			state.success()
+		case errors.As(err, &retryAfter):
+			state.throttled(retryAfter.RetryAfter * time.Second)
+		default:
+			state.failure(err)
+		}
+	}()
+
 	url := accrualSystemAddress + "/api/orders/" + number
 
 	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
@@ -30,14 +63,33 @@ func getOrderAccrual(ctx context.Context, httpClient *http.Client, accrualSystem
 		return nil, err
 	}
 
+	// передаём traceparent, чтобы система расчёта начислений могла продолжить трейс
+	tracing.Inject(ctx, request.Header)
+
 	// отправляем запрос
 	response, err := httpClient.Do(request)
 	if err != nil {
+		metrics.ObserveAccrualRequest(accrualErrorOutcome(err))
 		return nil, err
 	}
 
 	defer response.Body.Close()
 
+	span.SetAttributes(semconv.HTTPResponseStatusCode(response.StatusCode))
+
+	switch response.StatusCode {
+	case http.StatusOK:
+		metrics.ObserveAccrualRequest(metrics.AccrualOK)
+	case http.StatusNoContent:
+		metrics.ObserveAccrualRequest(metrics.AccrualNoContent)
+	case http.StatusTooManyRequests:
+		metrics.ObserveAccrualRequest(metrics.AccrualTooManyRequests)
+	case http.StatusInternalServerError:
+		metrics.ObserveAccrualRequest(metrics.AccrualInternalError)
+	default:
+		metrics.ObserveAccrualRequest(metrics.AccrualError)
+	}
+
 	// успешная обработка запроса
 	if response.StatusCode == http.StatusOK {
 		var accuralType AccuralType
@@ -63,6 +115,10 @@ func getOrderAccrual(ctx context.Context, httpClient *http.Client, accrualSystem
 		}
 	}
 
+	if response.StatusCode == http.StatusNoContent {
+		return nil, ErrNotRegistered
+	}
+
 	// внутренняя ошибка сервера
 	if response.StatusCode == http.StatusInternalServerError {
 		return nil, my_errors.ErrInternalServerError
@@ -77,42 +133,208 @@ func getOrderAccrual(ctx context.Context, httpClient *http.Client, accrualSystem
 
 }
 
-// Обновлений начислений и статусов начислений по заказам
-func UpdateAccurals(ctx context.Context, httpClient *http.Client, storage *storage.Database, accrualSystemAddress string) error {
+// истёк ли таймаут запроса или произошла другая ошибка
+func accrualErrorOutcome(err error) string {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return metrics.AccrualTimeout
+	}
+
+	return metrics.AccrualError
+}
+
+// Обновлений начислений и статусов начислений по заказам — один проход поллера.
+// Заказы опрашиваются в p.concurrency воркеров. Ошибка базы данных прерывает проход,
+// Retry-After от системы начислений притормаживает все воркеры. Пока breaker перед
+// системой начислений открыт, заказы пропускаются, а проход возвращает *breaker.OpenError.
+// После Stop или ошибки новые заказы воркерам не раздаются, а начатые дорабатываются до конца:
+// их запросы идут в контексте ctx, а не прохода, чтобы не отменить пробный запрос breaker
+func (p *Poller) UpdateAccurals(ctx context.Context) (err error) {
+	ctx, span := tracer.Start(ctx, "accrual.UpdateAccurals")
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+
 	// получаем список всех заказов со статусами NEW, REGISTERED, PROCESSING
-	orders, err := storage.GetOrdersForUpdate()
+	orders, err := p.repository.GetOrdersForUpdate(ctx, p.reconcile)
 	if err != nil {
 		return err
 	}
 
-	sleep := 1 * time.Nanosecond
-	// проходим в цикле по списку и получаем из удаленного сервиса обновления
-	for _, order := range *orders {
-		time.Sleep(sleep)
+	span.SetAttributes(
+		attribute.Int("orders.count", len(*orders)),
+		attribute.Int("poller.concurrency", p.concurrency))
 
-		accural, err := getOrderAccrual(ctx, httpClient, accrualSystemAddress, order.Number)
-		if err != nil {
-			retryAfter := new(my_errors.RetryAfterError)
-			if errors.As(err, &retryAfter) {
-				sleep = retryAfter.RetryAfter * time.Second
-				continue
+	return p.updateOrders(ctx, *orders)
+}
+
+// раздаёт заказы воркерам и собирает итог прохода
+func (p *Poller) updateOrders(ctx context.Context, orders []storage.Order) error {
+	passCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+		open     *breaker.OpenError
+		pause    throttle
+	)
+
+	jobs := make(chan storage.Order)
+	for i := 0; i < p.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for order := range jobs {
+				err := p.updateAccrual(ctx, passCtx, order, &pause)
+
+				mu.Lock()
+				var openErr *breaker.OpenError
+				switch {
+				case errors.As(err, &openErr):
+					// заказ будет опрошен на следующем проходе
+					if open == nil || openErr.RetryAfter > open.RetryAfter {
+						open = openErr
+					}
+				case err != nil && firstErr == nil:
+					firstErr = err
+					cancel()
+				}
+				mu.Unlock()
 			}
+		}()
+	}
 
-			return err
+	// проходим в цикле по списку и раздаём заказы воркерам
+feed:
+	for _, order := range orders {
+		// select выбирает случайно, если воркер свободен и Stop уже вызван
+		if isStopped(p.stop) {
+			break
 		}
 
-		// обновлять не нужно - пропускаем этот заказ
-		if order.Status == accural.Status {
-			continue
+		select {
+		case jobs <- order:
+		case <-passCtx.Done():
+			break feed
+		case <-p.stop:
+			break feed
 		}
+	}
+	close(jobs)
+	wg.Wait()
 
-		// обновляем данные по заказу в orders
-		err = storage.UpdateOrder(accural.Order, accural.Status, accural.Accrual)
-		if err != nil {
-			return err
+	if firstErr == nil && open != nil {
+		return open
+	}
+
+	return firstErr
+}
+
+// получает из удаленного сервиса обновление по одному заказу и сохраняет его.
+// passCtx отменяется при ошибке в другом воркере: тогда заказ откладывается, если ещё не начат
+func (p *Poller) updateAccrual(ctx, passCtx context.Context, order storage.Order, pause *throttle) error {
+	// заказ ещё не начат: при остановке его можно спокойно отложить до следующего запуска
+	if pause.wait(passCtx, p.stop) != nil || isStopped(p.stop) || passCtx.Err() != nil {
+		return nil
+	}
+
+	// пока система начислений не отвечает, запросы к ней не отправляются
+	generation, err := p.breaker.Allow()
+	if err != nil {
+		return err
+	}
+
+	accural, err := getOrderAccrual(ctx, p.client, p.address, order.Number)
+	if err != nil {
+		retryAfter := new(my_errors.RetryAfterError)
+		switch {
+		case errors.As(err, &retryAfter):
+			// система отвечает, но просит подождать; заказ будет опрошен на следующем проходе
+			p.breaker.Success(generation)
+			pause.set(retryAfter.RetryAfter * time.Second)
+			return nil
+		case errors.Is(err, ErrNotRegistered):
+			p.breaker.Success(generation)
+			if p.reconcile > 0 {
+				return p.repository.MarkAccrualChecked(ctx, order.Number)
+			}
+			return nil
+		case ctx.Err() != nil:
+			p.breaker.Cancel(generation)
+			return ctx.Err()
 		}
-		sleep = 1 * time.Nanosecond
+
+		// одна ошибка не прерывает проход: остальные заказы опрашиваются,
+		// пока ошибок подряд не станет столько, что breaker откроется
+		p.breaker.Failure(generation)
+		log.Debug().Err(err).Str("order", order.Number).Msg("Ошибка запроса к системе начислений")
+		if state, until := p.breaker.State(); state == breaker.Open {
+			return &breaker.OpenError{RetryAfter: time.Until(until)}
+		}
+		return nil
+	}
+	p.breaker.Success(generation)
+
+	// обновлять не нужно - пропускаем этот заказ
+	if order.Status == accural.Status {
+		if p.reconcile > 0 {
+			// сверка прошла, следующая — не раньше чем через reconcile
+			return p.repository.MarkAccrualChecked(ctx, order.Number)
+		}
+		return nil
 	}
 
-	return nil
+	// обновляем данные по заказу в orders тем же путём, что и присланные результаты
+	_, err = Apply(ctx, p.repository, order, *accural)
+
+	return err
+}
+
+// общая для всех воркеров пауза после ответа 429
+type throttle struct {
+	mu    sync.Mutex
+	until time.Time
+}
+
+func (t *throttle) set(d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if until := time.Now().Add(d); until.After(t.until) {
+		t.until = until
+	}
+}
+
+func (t *throttle) wait(ctx context.Context, stop <-chan struct{}) error {
+	t.mu.Lock()
+	d := time.Until(t.until)
+	t.mu.Unlock()
+
+	if d <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-stop:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func isStopped(stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
 }
@@ -0,0 +1,54 @@
+package externalapi
+
+import (
+	"context"
+	"errors"
+
+	my_errors "github.com/region23/praktikum-diplom/internal/errors"
+	"github.com/region23/praktikum-diplom/internal/metrics"
+	"github.com/region23/praktikum-diplom/internal/storage"
+)
+
+// что стало с результатом расчёта по заказу
+const (
+	ApplyApplied   = "applied"   // статус или начисление заказа обновлены
+	ApplyUnchanged = "unchanged" // заказ уже в этом статусе
+	ApplyIgnored   = "ignored"   // переход недопустим: расчёт завершён или результат устарел
+	ApplyNotFound  = "not_found" // заказа нет
+	ApplyInvalid   = "invalid"   // результат не разобран: нет номера или неизвестный статус
+)
+
+// Apply сохраняет результат расчёта по заказу order — последнему известному его состоянию.
+// Один и тот же путь для результатов поллера и присланных системой начислений: переходы
+// статусов проверяются в UpdateOrder под блокировкой заказа, поэтому результат, опоздавший
+// к уже обработанному заказу, ничего не меняет
+func Apply(ctx context.Context, repository Repository, order storage.Order, result AccuralType) (string, error) {
+	if result.Order == "" || !result.Status.Known() {
+		return ApplyInvalid, nil
+	}
+
+	if order.Status == result.Status && !order.Status.Final() {
+		return ApplyUnchanged, repository.MarkAccrualChecked(ctx, order.Number)
+	}
+
+	if !order.Status.CanBecome(result.Status) {
+		return ApplyIgnored, nil
+	}
+
+	err := repository.UpdateOrder(ctx, order.Number, result.Status, result.Accrual)
+	switch {
+	case errors.Is(err, my_errors.ErrOrderState):
+		// заказ успели обновить из другого источника
+		return ApplyIgnored, nil
+	case errors.Is(err, my_errors.ErrNotFound):
+		return ApplyNotFound, nil
+	case err != nil:
+		return "", err
+	}
+
+	if result.Status == storage.StatusProcessed {
+		metrics.ObserveTimeToProcessed(order.UploadedAt)
+	}
+
+	return ApplyApplied, nil
+}
@@ -0,0 +1,61 @@
+package externalapi
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// состояние связи с системой расчёта начислений по последнему запросу поллера
+type accrualState struct {
+	mu             sync.Mutex
+	lastErr        error
+	lastCheckedAt  time.Time
+	throttledUntil time.Time
+}
+
+var state accrualState
+
+func (s *accrualState) success() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastErr = nil
+	s.lastCheckedAt = time.Now()
+}
+
+func (s *accrualState) failure(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastErr = err
+	s.lastCheckedAt = time.Now()
+}
+
+func (s *accrualState) throttled(retryAfter time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastErr = nil
+	s.lastCheckedAt = time.Now()
+	s.throttledUntil = time.Now().Add(retryAfter)
+}
+
+// Health сообщает, доступна ли система расчёта начислений по результату
+// последнего запроса поллера и не ограничивает ли она нас по частоте запросов.
+// Пока запросов не было, система считается доступной
+func Health(ctx context.Context) error {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	if until := state.throttledUntil; time.Now().Before(until) {
+		return fmt.Errorf("превышен лимит запросов, ограничение до %s", until.Format(time.RFC3339))
+	}
+
+	if state.lastErr != nil {
+		return fmt.Errorf("последний запрос в %s завершился ошибкой: %w", state.lastCheckedAt.Format(time.RFC3339), state.lastErr)
+	}
+
+	return nil
+}
@@ -0,0 +1,141 @@
+package externalapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/region23/praktikum-diplom/internal/breaker"
+	"github.com/region23/praktikum-diplom/internal/metrics"
+	"github.com/region23/praktikum-diplom/internal/storage"
+	"github.com/rs/zerolog/log"
+)
+
+// все состояния breaker, для метрики
+var breakerStates = []string{string(breaker.Closed), string(breaker.Open), string(breaker.HalfOpen)}
+
+// Repository — методы хранилища, которые используют поллер и Apply; их реализует *storage.Database
+type Repository interface {
+	GetOrdersForUpdate(ctx context.Context, reconcile time.Duration) (*[]storage.Order, error)
+	MarkAccrualChecked(ctx context.Context, orderNumber string) error
+	UpdateOrder(ctx context.Context, orderNumber string, status storage.OrderStatus, accrual float64) error
+}
+
+// Poller периодически опрашивает систему расчёта начислений
+// по заказам, которые ещё не в конечном статусе
+type Poller struct {
+	client      *http.Client
+	repository  Repository
+	address     string
+	concurrency int
+	interval    time.Duration
+	// > 0 — система начислений сама присылает результаты, а поллер только сверяет
+	// заказы, по которым ничего не приходило дольше reconcile
+	reconcile time.Duration
+	// перестаёт отправлять запросы, когда система начислений раз за разом отвечает ошибкой
+	breaker *breaker.Breaker
+
+	// закрывается в Stop: новых заказов в работу не берём
+	stop chan struct{}
+	// закрывается, когда Run вернулся
+	done chan struct{}
+	// контекст запросов к системе начислений и базе. Он не зависит от сигнала
+	// остановки, чтобы начатые заказы доработались, и отменяется, только
+	// если остановка не уложилась в отведённое время
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewPoller(client *http.Client, repository Repository, address string, concurrency int, interval, reconcile time.Duration, breakerConfig breaker.Config) *Poller {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	// изменения статусов заказов попадают в журнал аудита от имени поллера
+	ctx := storage.WithActor(context.Background(), storage.Actor{Name: storage.ActorAccrualPoller})
+	ctx, cancel := context.WithCancel(ctx)
+
+	breakerConfig.OnStateChange = func(from, to breaker.State) {
+		metrics.SetAccrualBreakerState(string(to), breakerStates...)
+		metrics.ObserveAccrualBreakerTransition(string(to))
+		log.Info().Str("from", string(from)).Str("to", string(to)).Msg("Изменилось состояние breaker системы начислений")
+	}
+	metrics.SetAccrualBreakerState(string(breaker.Closed), breakerStates...)
+
+	return &Poller{
+		client:      client,
+		repository:  repository,
+		address:     address,
+		concurrency: concurrency,
+		interval:    interval,
+		reconcile:   reconcile,
+		breaker:     breaker.New(breakerConfig),
+
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Run проходит по заказам с паузой interval между проходами, пока не вызван Stop
+func (p *Poller) Run() error {
+	defer close(p.done)
+
+	for {
+		pause := p.interval
+
+		err := p.UpdateAccurals(p.ctx)
+		if err != nil {
+			var open *breaker.OpenError
+			if errors.As(err, &open) {
+				// следующий проход — когда breaker будет готов пропустить пробный запрос
+				log.Debug().Err(err).Msg("Внешний сервис не доступен")
+				if open.RetryAfter > pause {
+					pause = open.RetryAfter
+				}
+			} else if !errors.Is(err, context.Canceled) {
+				log.Debug().Err(err).Msg("При доступе к внешнему сервису произошла ошибка")
+			}
+		}
+
+		timer := time.NewTimer(pause)
+		select {
+		case <-p.stop:
+			timer.Stop()
+			log.Info().Msg("завершили UpdateAccurals")
+			return nil
+		case <-timer.C:
+		}
+	}
+}
+
+// Health сообщает, доступна ли система расчёта начислений: breaker закрыт
+// и последний запрос прошёл без ошибок
+func (p *Poller) Health(ctx context.Context) error {
+	switch state, until := p.breaker.State(); state {
+	case breaker.Open:
+		return fmt.Errorf("запросы приостановлены до %s после ошибок подряд", until.Format(time.RFC3339))
+	case breaker.HalfOpen:
+		return errors.New("проверяем, восстановилась ли система, пробным запросом")
+	}
+
+	return Health(ctx)
+}
+
+// Stop дожидается, пока поллер доработает начатые заказы. Если ctx истёк
+// раньше, незавершённые запросы обрываются
+func (p *Poller) Stop(ctx context.Context) error {
+	close(p.stop)
+
+	select {
+	case <-p.done:
+		p.cancel()
+		return nil
+	case <-ctx.Done():
+		p.cancel()
+		return ctx.Err()
+	}
+}
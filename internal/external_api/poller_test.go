@@ -0,0 +1,243 @@
+package externalapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/region23/praktikum-diplom/internal/breaker"
+	"github.com/region23/praktikum-diplom/internal/lifecycle"
+	"github.com/region23/praktikum-diplom/internal/storage"
+)
+
+// поддельная система начислений: пока down, отвечает 500, иначе — PROCESSING с задержкой delay
+type fakeAccrual struct {
+	down     atomic.Bool
+	delay    time.Duration
+	requests atomic.Int64
+	// ответы, которые клиент дождался, и запросы, которые он оборвал
+	completed atomic.Int64
+	aborted   atomic.Int64
+	// если задан, получает по значению на каждый принятый запрос
+	started chan struct{}
+}
+
+func (f *fakeAccrual) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.requests.Add(1)
+	if f.started != nil {
+		f.started <- struct{}{}
+	}
+
+	if f.down.Load() {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	select {
+	case <-time.After(f.delay):
+	case <-r.Context().Done():
+		f.aborted.Add(1)
+		return
+	}
+	f.completed.Add(1)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AccuralType{
+		Order:  strings.TrimPrefix(r.URL.Path, "/api/orders/"),
+		Status: storage.StatusProcessing,
+	})
+}
+
+// заказы уже в статусе PROCESSING: ответ поддельной системы не требует записи в базу
+func processingOrders(n int) []storage.Order {
+	orders := make([]storage.Order, n)
+	for i := range orders {
+		orders[i] = storage.Order{Number: fmt.Sprint(1000 + i), Status: storage.StatusProcessing}
+	}
+
+	return orders
+}
+
+// поддельное хранилище: отдаёт orders на первом проходе и запоминает обновления
+type fakeRepository struct {
+	orders []storage.Order
+	passes atomic.Int64
+
+	mu      sync.Mutex
+	updated []string
+	// ошибки контекстов, в которых пришли обновления
+	ctxErrs []error
+}
+
+func (f *fakeRepository) GetOrdersForUpdate(ctx context.Context, reconcile time.Duration) (*[]storage.Order, error) {
+	orders := []storage.Order{}
+	if f.passes.Add(1) == 1 {
+		orders = f.orders
+	}
+	return &orders, nil
+}
+
+func (f *fakeRepository) MarkAccrualChecked(ctx context.Context, orderNumber string) error {
+	return nil
+}
+
+func (f *fakeRepository) UpdateOrder(ctx context.Context, orderNumber string, status storage.OrderStatus, accrual float64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.updated = append(f.updated, orderNumber)
+	f.ctxErrs = append(f.ctxErrs, ctx.Err())
+	return nil
+}
+
+func newTestPoller(t *testing.T, fake *fakeAccrual, repository Repository, concurrency int, openTimeout time.Duration) *Poller {
+	t.Helper()
+
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	p := NewPoller(srv.Client(), repository, srv.URL, concurrency, time.Second, 0, breaker.Config{
+		Failures:       3,
+		OpenTimeout:    openTimeout,
+		MaxOpenTimeout: openTimeout,
+	})
+	t.Cleanup(p.cancel)
+
+	return p
+}
+
+func TestPassWithAccrualDown(t *testing.T) {
+	fake := &fakeAccrual{}
+	fake.down.Store(true)
+	p := newTestPoller(t, fake, nil, 4, time.Minute)
+
+	err := p.updateOrders(context.Background(), processingOrders(50))
+
+	var open *breaker.OpenError
+	if !errors.As(err, &open) {
+		t.Fatalf("проход вернул %v, ожидали *breaker.OpenError", err)
+	}
+	if open.RetryAfter <= 0 || open.RetryAfter > time.Minute {
+		t.Fatalf("RetryAfter %s вне (0, 1m]", open.RetryAfter)
+	}
+
+	// после трёх ошибок подряд запросы прекращаются; ещё три воркера могли успеть начать свои
+	if got := fake.requests.Load(); got < 3 || got > 6 {
+		t.Fatalf("запросов к системе начислений %d, ожидали от 3 до 6", got)
+	}
+
+	if state, _ := p.breaker.State(); state != breaker.Open {
+		t.Fatalf("состояние breaker %s, ожидали open", state)
+	}
+	if err := p.Health(context.Background()); err == nil {
+		t.Fatal("Health не сообщил об открытом breaker")
+	}
+
+	// следующий проход до истечения паузы не отправляет ни одного запроса
+	before := fake.requests.Load()
+	if err := p.updateOrders(context.Background(), processingOrders(50)); !errors.As(err, &open) {
+		t.Fatalf("проход вернул %v, ожидали *breaker.OpenError", err)
+	}
+	if got := fake.requests.Load(); got != before {
+		t.Fatalf("при открытом breaker отправлено %d запросов", got-before)
+	}
+}
+
+func TestProbeClosesBreakerWithConcurrentWorkers(t *testing.T) {
+	fake := &fakeAccrual{delay: 50 * time.Millisecond}
+	fake.down.Store(true)
+	p := newTestPoller(t, fake, nil, 4, 20*time.Millisecond)
+
+	p.updateOrders(context.Background(), processingOrders(10))
+	if state, _ := p.breaker.State(); state != breaker.Open {
+		t.Fatalf("состояние breaker %s, ожидали open", state)
+	}
+
+	fake.down.Store(false)
+	time.Sleep(30 * time.Millisecond)
+
+	// пока пробный запрос идёт, остальные заказы пропускаются, но не отменяют его
+	before := fake.requests.Load()
+	p.updateOrders(context.Background(), processingOrders(20))
+
+	if got := fake.requests.Load() - before; got != 1 {
+		t.Fatalf("в half-open отправлено %d запросов, ожидали один пробный", got)
+	}
+	if state, _ := p.breaker.State(); state != breaker.Closed {
+		t.Fatalf("состояние breaker после успешного пробного запроса %s, ожидали closed", state)
+	}
+
+	// следующий проход опрашивает все заказы
+	before = fake.requests.Load()
+	if err := p.updateOrders(context.Background(), processingOrders(20)); err != nil {
+		t.Fatalf("проход: %v", err)
+	}
+	if got := fake.requests.Load() - before; got != 20 {
+		t.Fatalf("отправлено %d запросов, ожидали 20", got)
+	}
+	if err := p.Health(context.Background()); err != nil {
+		t.Fatalf("Health: %v", err)
+	}
+}
+
+// по SIGTERM поллер под lifecycle.Manager дожидается начатых запросов к системе
+// начислений, сохраняет их результаты и не берёт в работу новые заказы
+func TestStopOnSignalFinishesInFlight(t *testing.T) {
+	const concurrency = 2
+
+	fake := &fakeAccrual{delay: 300 * time.Millisecond, started: make(chan struct{}, 10)}
+	repository := &fakeRepository{}
+	for i := 0; i < 10; i++ {
+		repository.orders = append(repository.orders, storage.Order{Number: fmt.Sprint(1000 + i), Status: storage.StatusRegistered})
+	}
+	p := newTestPoller(t, fake, repository, concurrency, time.Minute)
+
+	app := lifecycle.New(5 * time.Second)
+	app.Add(lifecycle.Component{Name: "poller", Run: p.Run, Stop: p.Stop})
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM)
+	defer stop()
+
+	// сигнал приходит, когда все воркеры ждут ответа системы начислений
+	go func() {
+		for i := 0; i < concurrency; i++ {
+			<-fake.started
+		}
+		syscall.Kill(syscall.Getpid(), syscall.SIGTERM)
+	}()
+
+	if err := app.Run(ctx); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	if got := fake.requests.Load(); got != concurrency {
+		t.Fatalf("отправлено %d запросов, ожидали только %d начатых до сигнала", got, concurrency)
+	}
+	if completed, aborted := fake.completed.Load(), fake.aborted.Load(); completed != concurrency || aborted != 0 {
+		t.Fatalf("дождались %d ответов, оборвали %d запросов, ожидали %d и 0", completed, aborted, concurrency)
+	}
+
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+
+	if len(repository.updated) != concurrency {
+		t.Fatalf("сохранено %d заказов, ожидали %d", len(repository.updated), concurrency)
+	}
+	for i, err := range repository.ctxErrs {
+		if err != nil {
+			t.Fatalf("заказ %s сохранён в отменённом контексте: %v", repository.updated[i], err)
+		}
+	}
+	if passes := repository.passes.Load(); passes != 1 {
+		t.Fatalf("проходов %d, ожидали один", passes)
+	}
+}
@@ -0,0 +1,114 @@
+package grpcserver
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/go-chi/jwtauth/v5"
+	pb "github.com/region23/praktikum-diplom/api/gophermart"
+	"github.com/region23/praktikum-diplom/internal/storage"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+type loginKey struct{}
+
+// методы, доступные без токена
+var publicMethods = map[string]bool{
+	pb.Gophermart_Register_FullMethodName: true,
+	pb.Gophermart_Login_FullMethodName:    true,
+}
+
+// достаёт логин пользователя из JWT-токена в метаданных запроса
+func (s *Server) authenticate(ctx context.Context) (context.Context, error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "не передан токен")
+	}
+
+	values := md.Get("authorization")
+	if len(values) == 0 {
+		return nil, status.Error(codes.Unauthenticated, "не передан токен")
+	}
+
+	tokenString := values[0]
+	if len(tokenString) > 7 && strings.EqualFold(tokenString[:7], "BEARER ") {
+		tokenString = tokenString[7:]
+	}
+
+	token, err := jwtauth.VerifyToken(s.tokenAuth, tokenString)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "неверный токен: %v", err)
+	}
+
+	login, _ := token.PrivateClaims()["user_id"].(string)
+	if login == "" {
+		return nil, status.Error(codes.Unauthenticated, "в токене нет логина пользователя")
+	}
+
+	actor := storage.ActorFromContext(ctx)
+	actor.Name = login
+	ctx = storage.WithActor(ctx, actor)
+
+	return context.WithValue(ctx, loginKey{}, login), nil
+}
+
+// кладёт в контекст адрес клиента и клиентское приложение для журнала аудита
+func withActor(ctx context.Context) context.Context {
+	var actor storage.Actor
+	if p, ok := peer.FromContext(ctx); ok {
+		actor.IP = p.Addr.String()
+		if host, _, err := net.SplitHostPort(actor.IP); err == nil {
+			actor.IP = host
+		}
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("user-agent"); len(values) > 0 {
+			actor.UserAgent = values[0]
+		}
+	}
+
+	return storage.WithActor(ctx, actor)
+}
+
+func (s *Server) unaryAuth(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx = withActor(ctx)
+	if publicMethods[info.FullMethod] {
+		return handler(ctx, req)
+	}
+
+	ctx, err := s.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return handler(ctx, req)
+}
+
+func (s *Server) streamAuth(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := s.authenticate(withActor(ss.Context()))
+	if err != nil {
+		return err
+	}
+
+	return handler(srv, &authenticatedStream{ServerStream: ss, ctx: ctx})
+}
+
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+// логин аутентифицированного пользователя
+func currentLogin(ctx context.Context) string {
+	login, _ := ctx.Value(loginKey{}).(string)
+	return login
+}
@@ -0,0 +1,309 @@
+package grpcserver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/jackc/pgx/v4"
+	pb "github.com/region23/praktikum-diplom/api/gophermart"
+	my_errors "github.com/region23/praktikum-diplom/internal/errors"
+	"github.com/region23/praktikum-diplom/internal/events"
+	"github.com/region23/praktikum-diplom/internal/logging"
+	"github.com/region23/praktikum-diplom/internal/storage"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Repository — методы хранилища, которые использует gRPC API; их реализует *storage.Database
+type Repository interface {
+	UserExist(ctx context.Context, login, hashedPassword string) (bool, error)
+	AddUser(ctx context.Context, user *storage.User) error
+	GetOrder(ctx context.Context, orderNumber string) (*storage.Order, error)
+	AddOrder(ctx context.Context, orderNumber string, login string, status storage.OrderStatus) error
+	GetOrders(ctx context.Context, login string) (*[]storage.Order, error)
+	CurrentBalance(ctx context.Context, login string) (*storage.Balance, error)
+	AddWithdraw(ctx context.Context, orderNumber string, login string, sum float64, merchant string) error
+	GetWithdrawals(ctx context.Context, login string) (*[]storage.Withdraw, error)
+	GetEventsAfter(ctx context.Context, login string, afterID int64) (*[]storage.Event, error)
+	AddAuditEvent(ctx context.Context, login, action string, before, after interface{}) error
+}
+
+// Server реализует gRPC API поверх того же хранилища, что и HTTP API
+type Server struct {
+	pb.UnimplementedGophermartServer
+
+	storage   Repository
+	tokenAuth *jwtauth.JWTAuth
+	broker    *events.Broker
+
+	// API-ключи магазинов: название магазина → ключ. Списание можно сделать
+	// в счёт заказа только известного магазина
+	MerchantKeys map[string]string
+}
+
+func New(storage Repository, tokenAuth *jwtauth.JWTAuth, broker *events.Broker) *Server {
+	return &Server{
+		storage:   storage,
+		tokenAuth: tokenAuth,
+		broker:    broker,
+	}
+}
+
+// создаёт grpc.Server с зарегистрированным сервисом и проверкой JWT
+func (s *Server) GRPCServer(opts ...grpc.ServerOption) *grpc.Server {
+	opts = append(opts,
+		grpc.ChainUnaryInterceptor(s.unaryAuth),
+		grpc.ChainStreamInterceptor(s.streamAuth),
+	)
+
+	grpcServer := grpc.NewServer(opts...)
+	pb.RegisterGophermartServer(grpcServer, s)
+
+	return grpcServer
+}
+
+// регистрация пользователя
+func (s *Server) Register(ctx context.Context, req *pb.Credentials) (*pb.AuthResponse, error) {
+	if req.GetLogin() == "" || req.GetPassword() == "" {
+		return nil, status.Error(codes.InvalidArgument, "не переданы логин или пароль")
+	}
+
+	userExist, err := s.storage.UserExist(ctx, req.GetLogin(), "")
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "ошибка при получении пользователя: %v", err)
+	}
+
+	if userExist {
+		return nil, status.Error(codes.AlreadyExists, "логин уже занят")
+	}
+
+	user := storage.User{Login: req.GetLogin(), Password: hashPassword(req.GetPassword()), InvitedBy: req.GetReferralCode()}
+	err = s.storage.AddUser(ctx, &user)
+	if errors.Is(err, my_errors.ErrInvalidReferral) {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "ошибка при добавлении пользователя: %v", err)
+	}
+
+	return s.authResponse(user.Login)
+}
+
+// аутентификация пользователя
+func (s *Server) Login(ctx context.Context, req *pb.Credentials) (*pb.AuthResponse, error) {
+	userExist, err := s.storage.UserExist(ctx, req.GetLogin(), hashPassword(req.GetPassword()))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "ошибка при получении пользователя: %v", err)
+	}
+
+	if !userExist {
+		s.audit(ctx, req.GetLogin(), storage.AuditUserLoginFailed, nil)
+		return nil, status.Error(codes.Unauthenticated, "неверная пара логин/пароль")
+	}
+
+	s.audit(ctx, req.GetLogin(), storage.AuditUserLogin, nil)
+
+	return s.authResponse(req.GetLogin())
+}
+
+// загрузка номера заказа для расчёта
+func (s *Server) UploadOrder(ctx context.Context, req *pb.UploadOrderRequest) (*pb.UploadOrderResponse, error) {
+	login := currentLogin(ctx)
+
+	if !storage.ValidOrderNumber(req.GetNumber()) {
+		return nil, status.Error(codes.InvalidArgument, "неверный формат номера заказа")
+	}
+
+	order, err := s.storage.GetOrder(ctx, req.GetNumber())
+	if err == pgx.ErrNoRows {
+		err = s.storage.AddOrder(ctx, req.GetNumber(), login, storage.StatusNew)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "при загрузке заказа произошла ошибка: %v", err)
+		}
+
+		return &pb.UploadOrderResponse{}, nil
+	}
+
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "внутренняя ошибка сервера: %v", err)
+	}
+
+	if order.Login != login {
+		s.audit(ctx, login, storage.AuditOrderUploadConflict, map[string]string{"number": order.Number})
+		return nil, status.Error(codes.AlreadyExists, "номер заказа уже был загружен другим пользователем")
+	}
+
+	return &pb.UploadOrderResponse{AlreadyUploaded: true}, nil
+}
+
+// список загруженных пользователем заказов
+func (s *Server) ListOrders(ctx context.Context, _ *emptypb.Empty) (*pb.ListOrdersResponse, error) {
+	orders, err := s.storage.GetOrders(ctx, currentLogin(ctx))
+	if err != nil && err != pgx.ErrNoRows {
+		return nil, status.Errorf(codes.Internal, "внутренняя ошибка сервера: %v", err)
+	}
+
+	var resp pb.ListOrdersResponse
+	if orders != nil {
+		for _, order := range *orders {
+			resp.Orders = append(resp.Orders, orderToProto(order))
+		}
+	}
+
+	return &resp, nil
+}
+
+// текущий баланс счёта баллов лояльности
+func (s *Server) GetBalance(ctx context.Context, _ *emptypb.Empty) (*pb.Balance, error) {
+	balance, err := s.storage.CurrentBalance(ctx, currentLogin(ctx))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "внутренняя ошибка сервера: %v", err)
+	}
+
+	return &pb.Balance{Current: balance.Current, Withdrawn: balance.Withdrawn, ExpiringSoon: balance.ExpiringSoon, Blocked: balance.Blocked}, nil
+}
+
+// списание баллов в счёт оплаты нового заказа
+func (s *Server) Withdraw(ctx context.Context, req *pb.WithdrawRequest) (*emptypb.Empty, error) {
+	if !storage.ValidOrderNumber(req.GetOrder()) {
+		return nil, status.Error(codes.InvalidArgument, "неверный формат номера заказа")
+	}
+
+	if _, known := s.MerchantKeys[req.GetMerchant()]; req.GetMerchant() != "" && !known {
+		return nil, status.Error(codes.InvalidArgument, "неизвестный магазин")
+	}
+
+	err := s.storage.AddWithdraw(ctx, req.GetOrder(), currentLogin(ctx), req.GetSum(), req.GetMerchant())
+	if err != nil {
+		if errors.Is(err, my_errors.ErrInsufficientBalance) || errors.Is(err, my_errors.ErrBalanceBlocked) {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+
+		return nil, status.Errorf(codes.Internal, "внутренняя ошибка сервера: %v", err)
+	}
+
+	return &emptypb.Empty{}, nil
+}
+
+// список списаний пользователя
+func (s *Server) ListWithdrawals(ctx context.Context, _ *emptypb.Empty) (*pb.ListWithdrawalsResponse, error) {
+	withdrawals, err := s.storage.GetWithdrawals(ctx, currentLogin(ctx))
+	if err != nil && err != pgx.ErrNoRows {
+		return nil, status.Errorf(codes.Internal, "внутренняя ошибка сервера: %v", err)
+	}
+
+	var resp pb.ListWithdrawalsResponse
+	if withdrawals != nil {
+		for _, withdraw := range *withdrawals {
+			resp.Withdrawals = append(resp.Withdrawals, &pb.Withdrawal{
+				Order:       withdraw.Order,
+				Sum:         withdraw.Sum,
+				ProcessedAt: timestamppb.New(withdraw.ProcessedAt),
+				Status:      string(withdraw.Status),
+				Refunded:    withdraw.Refunded,
+				Merchant:    withdraw.Merchant,
+			})
+		}
+	}
+
+	return &resp, nil
+}
+
+// поток изменений статусов заказов пользователя
+func (s *Server) WatchOrders(req *pb.WatchOrdersRequest, stream pb.Gophermart_WatchOrdersServer) error {
+	ctx := stream.Context()
+	login := currentLogin(ctx)
+	lastEventID := req.GetLastEventId()
+
+	// подписываемся до чтения истории, чтобы не потерять события между выборкой и трансляцией
+	eventsCh, unsubscribe := s.broker.Subscribe(login)
+	defer unsubscribe()
+
+	if lastEventID > 0 {
+		missed, err := s.storage.GetEventsAfter(ctx, login, lastEventID)
+		if err != nil {
+			return status.Errorf(codes.Internal, "внутренняя ошибка сервера: %v", err)
+		}
+
+		for _, event := range *missed {
+			if err := sendOrderEvent(stream, event); err != nil {
+				return err
+			}
+			lastEventID = event.ID
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-eventsCh:
+			if !ok {
+				return status.Error(codes.ResourceExhausted, "клиент не успевает читать события, переподключитесь с last_event_id")
+			}
+			if event.ID <= lastEventID {
+				continue
+			}
+			if err := sendOrderEvent(stream, event); err != nil {
+				return err
+			}
+			lastEventID = event.ID
+		}
+	}
+}
+
+func sendOrderEvent(stream pb.Gophermart_WatchOrdersServer, event storage.Event) error {
+	if event.Type != storage.EventOrderUpdated {
+		return nil
+	}
+
+	var order storage.Order
+	if err := json.Unmarshal(event.Payload, &order); err != nil {
+		return status.Errorf(codes.Internal, "не смогли разобрать событие: %v", err)
+	}
+
+	return stream.Send(&pb.OrderEvent{
+		Id:        event.ID,
+		Order:     orderToProto(order),
+		CreatedAt: timestamppb.New(event.CreatedAt),
+	})
+}
+
+func (s *Server) authResponse(login string) (*pb.AuthResponse, error) {
+	_, tokenString, err := s.tokenAuth.Encode(map[string]interface{}{"user_id": login})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "не смогли выпустить токен: %v", err)
+	}
+
+	return &pb.AuthResponse{Token: tokenString}, nil
+}
+
+func orderToProto(order storage.Order) *pb.Order {
+	return &pb.Order{
+		Number:     order.Number,
+		Status:     string(order.Status),
+		Accrual:    order.Accrual,
+		UploadedAt: timestamppb.New(order.UploadedAt),
+	}
+}
+
+// пароли хранятся так же, как при регистрации через HTTP API
+func hashPassword(password string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(password)))
+}
+
+// записывает в журнал аудита действие, которое не меняет данные. Ошибка записи
+// не должна ломать сам вызов, поэтому только логируется
+func (s *Server) audit(ctx context.Context, login, action string, after interface{}) {
+	err := s.storage.AddAuditEvent(ctx, login, action, nil, after)
+	if err != nil {
+		logging.FromContext(ctx).Error().Err(err).Str("action", action).Msg("Не смогли записать действие в журнал аудита")
+	}
+}
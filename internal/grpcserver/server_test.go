@@ -0,0 +1,504 @@
+package grpcserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/jackc/pgx/v4"
+	pb "github.com/region23/praktikum-diplom/api/gophermart"
+	my_errors "github.com/region23/praktikum-diplom/internal/errors"
+	"github.com/region23/praktikum-diplom/internal/events"
+	"github.com/region23/praktikum-diplom/internal/storage"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+const (
+	validOrder   = "12345678903"
+	invalidOrder = "12345678900"
+	otherOrder   = "79927398713"
+)
+
+var errDatabase = errors.New("база недоступна")
+
+// хранилище в памяти; fail — ошибка, которую возвращают все методы
+type memoryRepository struct {
+	mu          sync.Mutex
+	fail        error
+	users       map[string]string // логин → хэш пароля
+	orders      map[string]storage.Order
+	balances    map[string]storage.Balance
+	withdrawals map[string][]storage.Withdraw
+	events      []storage.Event
+	audit       []string
+}
+
+func newMemoryRepository() *memoryRepository {
+	return &memoryRepository{
+		users:       map[string]string{},
+		orders:      map[string]storage.Order{},
+		balances:    map[string]storage.Balance{},
+		withdrawals: map[string][]storage.Withdraw{},
+	}
+}
+
+func (m *memoryRepository) UserExist(_ context.Context, login, hashedPassword string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.fail != nil {
+		return false, m.fail
+	}
+	hash, ok := m.users[login]
+
+	return ok && (hashedPassword == "" || hash == hashedPassword), nil
+}
+
+func (m *memoryRepository) AddUser(_ context.Context, user *storage.User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.fail != nil {
+		return m.fail
+	}
+	if user.InvitedBy != "" && user.InvitedBy != "GOODCODE" {
+		return my_errors.ErrInvalidReferral
+	}
+	m.users[user.Login] = user.Password
+
+	return nil
+}
+
+func (m *memoryRepository) GetOrder(_ context.Context, number string) (*storage.Order, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.fail != nil {
+		return nil, m.fail
+	}
+	order, ok := m.orders[number]
+	if !ok {
+		return nil, pgx.ErrNoRows
+	}
+
+	return &order, nil
+}
+
+func (m *memoryRepository) AddOrder(_ context.Context, number, login string, orderStatus storage.OrderStatus) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.fail != nil {
+		return m.fail
+	}
+	m.orders[number] = storage.Order{Number: number, Login: login, Status: orderStatus, UploadedAt: time.Now()}
+
+	return nil
+}
+
+func (m *memoryRepository) GetOrders(_ context.Context, login string) (*[]storage.Order, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.fail != nil {
+		return nil, m.fail
+	}
+	var orders []storage.Order
+	for _, order := range m.orders {
+		if order.Login == login {
+			orders = append(orders, order)
+		}
+	}
+	if len(orders) == 0 {
+		return nil, pgx.ErrNoRows
+	}
+
+	return &orders, nil
+}
+
+func (m *memoryRepository) CurrentBalance(_ context.Context, login string) (*storage.Balance, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.fail != nil {
+		return nil, m.fail
+	}
+	balance := m.balances[login]
+
+	return &balance, nil
+}
+
+func (m *memoryRepository) AddWithdraw(_ context.Context, number, login string, sum float64, merchant string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.fail != nil {
+		return m.fail
+	}
+	balance := m.balances[login]
+	if balance.Blocked {
+		return my_errors.ErrBalanceBlocked
+	}
+	if sum >= balance.Current {
+		return my_errors.ErrInsufficientBalance
+	}
+	balance.Current -= sum
+	balance.Withdrawn += sum
+	m.balances[login] = balance
+	m.withdrawals[login] = append(m.withdrawals[login], storage.Withdraw{
+		Order: number, Sum: sum, ProcessedAt: time.Now(), Status: storage.WithdrawPending, Merchant: merchant,
+	})
+
+	return nil
+}
+
+func (m *memoryRepository) GetWithdrawals(_ context.Context, login string) (*[]storage.Withdraw, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.fail != nil {
+		return nil, m.fail
+	}
+	withdrawals := m.withdrawals[login]
+
+	return &withdrawals, nil
+}
+
+func (m *memoryRepository) GetEventsAfter(_ context.Context, login string, afterID int64) (*[]storage.Event, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.fail != nil {
+		return nil, m.fail
+	}
+	var events []storage.Event
+	for _, event := range m.events {
+		if event.Login == login && event.ID > afterID {
+			events = append(events, event)
+		}
+	}
+
+	return &events, nil
+}
+
+func (m *memoryRepository) AddAuditEvent(_ context.Context, login, action string, _, _ interface{}) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.audit = append(m.audit, login+" "+action)
+
+	return nil
+}
+
+func (m *memoryRepository) setFail(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.fail = err
+}
+
+type testEnv struct {
+	client pb.GophermartClient
+	repo   *memoryRepository
+	broker *events.Broker
+	auth   *jwtauth.JWTAuth
+}
+
+// поднимает gRPC-сервер поверх bufconn и возвращает клиента к нему
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+
+	env := &testEnv{
+		repo:   newMemoryRepository(),
+		broker: events.NewBroker(),
+		auth:   jwtauth.New("HS256", []byte("test-secret"), nil),
+	}
+
+	service := New(env.repo, env.auth, env.broker)
+	service.MerchantKeys = map[string]string{"shop": "key"}
+	grpcServer := service.GRPCServer()
+
+	listener := bufconn.Listen(1 << 20)
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("grpc.NewClient: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	env.client = pb.NewGophermartClient(conn)
+
+	return env
+}
+
+// контекст с токеном пользователя login
+func (env *testEnv) as(t *testing.T, login string) context.Context {
+	t.Helper()
+
+	_, token, err := env.auth.Encode(map[string]interface{}{"user_id": login})
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token)
+}
+
+func wantCode(t *testing.T, err error, want codes.Code) {
+	t.Helper()
+
+	if got := status.Code(err); got != want {
+		t.Fatalf("код %s (%v), ожидали %s", got, err, want)
+	}
+}
+
+func TestAuthInterceptor(t *testing.T) {
+	env := newTestEnv(t)
+	empty := &emptypb.Empty{}
+
+	_, err := env.client.GetBalance(context.Background(), empty)
+	wantCode(t, err, codes.Unauthenticated)
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer not-a-jwt")
+	_, err = env.client.GetBalance(ctx, empty)
+	wantCode(t, err, codes.Unauthenticated)
+
+	// токен, подписанный другим ключом
+	_, foreign, _ := jwtauth.New("HS256", []byte("other-secret"), nil).Encode(map[string]interface{}{"user_id": "alice"})
+	ctx = metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+foreign)
+	_, err = env.client.GetBalance(ctx, empty)
+	wantCode(t, err, codes.Unauthenticated)
+
+	// токен без логина
+	_, anonymous, _ := env.auth.Encode(map[string]interface{}{})
+	ctx = metadata.AppendToOutgoingContext(context.Background(), "authorization", anonymous)
+	_, err = env.client.GetBalance(ctx, empty)
+	wantCode(t, err, codes.Unauthenticated)
+
+	if _, err := env.client.GetBalance(env.as(t, "alice"), empty); err != nil {
+		t.Fatalf("GetBalance с верным токеном: %v", err)
+	}
+
+	// потоковые методы тоже требуют токен
+	stream, err := env.client.WatchOrders(context.Background(), &pb.WatchOrdersRequest{})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	wantCode(t, err, codes.Unauthenticated)
+}
+
+func TestRegisterAndLogin(t *testing.T) {
+	env := newTestEnv(t)
+	ctx := context.Background()
+
+	resp, err := env.client.Register(ctx, &pb.Credentials{Login: "alice", Password: "secret"})
+	if err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	token, err := jwtauth.VerifyToken(env.auth, resp.GetToken())
+	if err != nil || token.PrivateClaims()["user_id"] != "alice" {
+		t.Fatalf("токен после регистрации: %v, claims %v", err, token)
+	}
+
+	_, err = env.client.Register(ctx, &pb.Credentials{Login: "alice", Password: "other"})
+	wantCode(t, err, codes.AlreadyExists)
+
+	_, err = env.client.Register(ctx, &pb.Credentials{Login: "bob"})
+	wantCode(t, err, codes.InvalidArgument)
+
+	_, err = env.client.Register(ctx, &pb.Credentials{Login: "bob", Password: "secret", ReferralCode: "BADCODE"})
+	wantCode(t, err, codes.InvalidArgument)
+
+	if _, err := env.client.Register(ctx, &pb.Credentials{Login: "bob", Password: "secret", ReferralCode: "GOODCODE"}); err != nil {
+		t.Fatalf("Register с кодом приглашения: %v", err)
+	}
+
+	if _, err := env.client.Login(ctx, &pb.Credentials{Login: "alice", Password: "secret"}); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+
+	_, err = env.client.Login(ctx, &pb.Credentials{Login: "alice", Password: "wrong"})
+	wantCode(t, err, codes.Unauthenticated)
+
+	want := []string{"alice " + storage.AuditUserLogin, "alice " + storage.AuditUserLoginFailed}
+	if len(env.repo.audit) != 2 || env.repo.audit[0] != want[0] || env.repo.audit[1] != want[1] {
+		t.Fatalf("журнал аудита %v, ожидали %v", env.repo.audit, want)
+	}
+
+	env.repo.setFail(errDatabase)
+	_, err = env.client.Register(ctx, &pb.Credentials{Login: "carol", Password: "secret"})
+	wantCode(t, err, codes.Internal)
+	_, err = env.client.Login(ctx, &pb.Credentials{Login: "alice", Password: "secret"})
+	wantCode(t, err, codes.Internal)
+}
+
+func TestOrders(t *testing.T) {
+	env := newTestEnv(t)
+	alice, bob := env.as(t, "alice"), env.as(t, "bob")
+
+	_, err := env.client.UploadOrder(alice, &pb.UploadOrderRequest{Number: invalidOrder})
+	wantCode(t, err, codes.InvalidArgument)
+
+	resp, err := env.client.UploadOrder(alice, &pb.UploadOrderRequest{Number: validOrder})
+	if err != nil || resp.GetAlreadyUploaded() {
+		t.Fatalf("UploadOrder: %v, %v", resp, err)
+	}
+
+	resp, err = env.client.UploadOrder(alice, &pb.UploadOrderRequest{Number: validOrder})
+	if err != nil || !resp.GetAlreadyUploaded() {
+		t.Fatalf("повторный UploadOrder: %v, %v", resp, err)
+	}
+
+	_, err = env.client.UploadOrder(bob, &pb.UploadOrderRequest{Number: validOrder})
+	wantCode(t, err, codes.AlreadyExists)
+
+	list, err := env.client.ListOrders(alice, &emptypb.Empty{})
+	if err != nil {
+		t.Fatalf("ListOrders: %v", err)
+	}
+	if len(list.GetOrders()) != 1 || list.GetOrders()[0].GetNumber() != validOrder || list.GetOrders()[0].GetStatus() != string(storage.StatusNew) {
+		t.Fatalf("заказы %v", list.GetOrders())
+	}
+
+	// у пользователя без заказов — пустой список, а не ошибка
+	list, err = env.client.ListOrders(bob, &emptypb.Empty{})
+	if err != nil || len(list.GetOrders()) != 0 {
+		t.Fatalf("ListOrders без заказов: %v, %v", list, err)
+	}
+
+	env.repo.setFail(errDatabase)
+	_, err = env.client.UploadOrder(alice, &pb.UploadOrderRequest{Number: otherOrder})
+	wantCode(t, err, codes.Internal)
+	_, err = env.client.ListOrders(alice, &emptypb.Empty{})
+	wantCode(t, err, codes.Internal)
+}
+
+func TestBalanceAndWithdrawals(t *testing.T) {
+	env := newTestEnv(t)
+	alice := env.as(t, "alice")
+	env.repo.balances["alice"] = storage.Balance{Current: 100}
+	env.repo.balances["bob"] = storage.Balance{Current: -10, Blocked: true}
+
+	_, err := env.client.Withdraw(alice, &pb.WithdrawRequest{Order: invalidOrder, Sum: 10})
+	wantCode(t, err, codes.InvalidArgument)
+
+	_, err = env.client.Withdraw(alice, &pb.WithdrawRequest{Order: validOrder, Sum: 10, Merchant: "unknown"})
+	wantCode(t, err, codes.InvalidArgument)
+
+	_, err = env.client.Withdraw(alice, &pb.WithdrawRequest{Order: validOrder, Sum: 1000})
+	wantCode(t, err, codes.FailedPrecondition)
+
+	_, err = env.client.Withdraw(env.as(t, "bob"), &pb.WithdrawRequest{Order: validOrder, Sum: 1})
+	wantCode(t, err, codes.FailedPrecondition)
+
+	if _, err := env.client.Withdraw(alice, &pb.WithdrawRequest{Order: validOrder, Sum: 30, Merchant: "shop"}); err != nil {
+		t.Fatalf("Withdraw: %v", err)
+	}
+
+	balance, err := env.client.GetBalance(alice, &emptypb.Empty{})
+	if err != nil || balance.GetCurrent() != 70 || balance.GetWithdrawn() != 30 {
+		t.Fatalf("баланс %v, %v", balance, err)
+	}
+
+	withdrawals, err := env.client.ListWithdrawals(alice, &emptypb.Empty{})
+	if err != nil {
+		t.Fatalf("ListWithdrawals: %v", err)
+	}
+	if got := withdrawals.GetWithdrawals(); len(got) != 1 || got[0].GetOrder() != validOrder || got[0].GetSum() != 30 ||
+		got[0].GetStatus() != string(storage.WithdrawPending) || got[0].GetMerchant() != "shop" {
+		t.Fatalf("списания %v", got)
+	}
+
+	env.repo.setFail(errDatabase)
+	_, err = env.client.GetBalance(alice, &emptypb.Empty{})
+	wantCode(t, err, codes.Internal)
+	_, err = env.client.Withdraw(alice, &pb.WithdrawRequest{Order: otherOrder, Sum: 1})
+	wantCode(t, err, codes.Internal)
+	_, err = env.client.ListWithdrawals(alice, &emptypb.Empty{})
+	wantCode(t, err, codes.Internal)
+}
+
+func orderEvent(t *testing.T, id int64, login string, order storage.Order) storage.Event {
+	t.Helper()
+
+	payload, err := json.Marshal(order)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return storage.Event{ID: id, Login: login, Type: storage.EventOrderUpdated, Payload: payload, CreatedAt: time.Now()}
+}
+
+func TestWatchOrders(t *testing.T) {
+	env := newTestEnv(t)
+	env.repo.events = []storage.Event{
+		orderEvent(t, 1, "alice", storage.Order{Number: validOrder, Status: storage.StatusProcessing}),
+		{ID: 2, Login: "alice", Type: storage.EventWithdrawalCreated, Payload: []byte(`{}`)},
+		orderEvent(t, 3, "alice", storage.Order{Number: otherOrder, Status: storage.StatusNew}),
+	}
+
+	ctx, cancel := context.WithTimeout(env.as(t, "alice"), 5*time.Second)
+	defer cancel()
+
+	// пропущенные после события 1 события приходят первыми, события других типов пропускаются
+	stream, err := env.client.WatchOrders(ctx, &pb.WatchOrdersRequest{LastEventId: 1})
+	if err != nil {
+		t.Fatalf("WatchOrders: %v", err)
+	}
+
+	event, err := stream.Recv()
+	if err != nil || event.GetId() != 3 || event.GetOrder().GetNumber() != otherOrder {
+		t.Fatalf("первое событие %v, %v", event, err)
+	}
+
+	// подписка на брокер оформлена до чтения истории, то есть уже есть
+	live := orderEvent(t, 4, "alice", storage.Order{Number: validOrder, Status: storage.StatusProcessed, Accrual: 50})
+	received := make(chan *pb.OrderEvent, 1)
+	go func() {
+		event, err := stream.Recv()
+		if err == nil {
+			received <- event
+		}
+	}()
+
+	// событие другого пользователя и уже отправленное не доходят
+	env.broker.Publish(orderEvent(t, 5, "bob", storage.Order{Number: "1"}))
+	env.broker.Publish(orderEvent(t, 3, "alice", storage.Order{Number: otherOrder}))
+	env.broker.Publish(live)
+
+	select {
+	case event := <-received:
+		if event.GetId() != 4 || event.GetOrder().GetStatus() != string(storage.StatusProcessed) || event.GetOrder().GetAccrual() != 50 {
+			t.Fatalf("событие из брокера %v", event)
+		}
+	case <-ctx.Done():
+		t.Fatal("событие из брокера не пришло")
+	}
+}
+
+func TestWatchOrdersHistoryError(t *testing.T) {
+	env := newTestEnv(t)
+	env.repo.setFail(errDatabase)
+
+	stream, err := env.client.WatchOrders(env.as(t, "alice"), &pb.WatchOrdersRequest{LastEventId: 1})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	wantCode(t, err, codes.Internal)
+}
@@ -0,0 +1,126 @@
+// Package health отвечает на проверки живости и готовности сервиса.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// сколько ждём ответа от одной проверки
+const checkTimeout = 2 * time.Second
+
+const (
+	StatusOK   = "ok"
+	StatusFail = "fail"
+	// проверка не прошла, но на готовность сервиса это не влияет
+	StatusDegraded = "degraded"
+)
+
+type Check struct {
+	Name string
+	// если некритичная проверка не проходит, сервис всё равно считается готовым
+	Critical bool
+	Fn       func(ctx context.Context) error
+}
+
+type CheckResult struct {
+	Status   string `json:"status"`
+	Critical bool   `json:"critical"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+type Report struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks,omitempty"`
+}
+
+// Checker выполняет проверки готовности и помнит, что сервис начал остановку
+type Checker struct {
+	checks       []Check
+	shuttingDown atomic.Bool
+}
+
+func New(checks ...Check) *Checker {
+	return &Checker{checks: checks}
+}
+
+// SetShuttingDown переводит готовность в false, чтобы балансировщик
+// перестал направлять трафик до остановки HTTP-сервера
+func (c *Checker) SetShuttingDown() {
+	c.shuttingDown.Store(true)
+}
+
+// Liveness — процесс жив и обслуживает HTTP
+func (c *Checker) Liveness(w http.ResponseWriter, r *http.Request) {
+	writeReport(w, Report{Status: StatusOK}, http.StatusOK)
+}
+
+// Readiness — сервис готов принимать трафик: все критичные проверки прошли
+// и остановка не начата
+func (c *Checker) Readiness(w http.ResponseWriter, r *http.Request) {
+	report := c.run(r.Context())
+
+	code := http.StatusOK
+	if report.Status != StatusOK {
+		code = http.StatusServiceUnavailable
+	}
+
+	writeReport(w, report, code)
+}
+
+func (c *Checker) run(ctx context.Context) Report {
+	report := Report{Status: StatusOK, Checks: make(map[string]CheckResult, len(c.checks)+1)}
+
+	if c.shuttingDown.Load() {
+		report.Status = StatusFail
+		report.Checks["shutdown"] = CheckResult{Status: StatusFail, Critical: true, Error: "сервис останавливается", Duration: "0s"}
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for _, check := range c.checks {
+		wg.Add(1)
+		go func(check Check) {
+			defer wg.Done()
+
+			checkCtx, cancel := context.WithTimeout(ctx, checkTimeout)
+			defer cancel()
+
+			start := time.Now()
+			err := check.Fn(checkCtx)
+			result := CheckResult{Status: StatusOK, Critical: check.Critical, Duration: time.Since(start).String()}
+
+			if err != nil {
+				result.Error = err.Error()
+				result.Status = StatusDegraded
+				if check.Critical {
+					result.Status = StatusFail
+				}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[check.Name] = result
+			if result.Status == StatusFail {
+				report.Status = StatusFail
+			}
+		}(check)
+	}
+
+	wg.Wait()
+
+	return report
+}
+
+func writeReport(w http.ResponseWriter, report Report, code int) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(report)
+}
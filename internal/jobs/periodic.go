@@ -0,0 +1,78 @@
+// Package jobs запускает фоновые задачи сервиса по расписанию.
+package jobs
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Periodic выполняет задачу с паузой interval между запусками, как Poller
+// для системы начислений. Останавливается через Stop, дав доработать текущему запуску
+type Periodic struct {
+	name     string
+	interval time.Duration
+	fn       func(ctx context.Context) error
+
+	// закрывается в Stop: новых запусков не будет
+	stop chan struct{}
+	// закрывается, когда Run вернулся
+	done chan struct{}
+	// контекст запусков задачи. Отменяется, только если остановка
+	// не уложилась в отведённое время
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewPeriodic(name string, interval time.Duration, fn func(ctx context.Context) error) *Periodic {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Periodic{
+		name:     name,
+		interval: interval,
+		fn:       fn,
+
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Run запускает задачу сразу и затем раз в interval, пока не вызван Stop.
+// Ошибки задачи пишутся в журнал, следующий запуск выполняется по расписанию
+func (p *Periodic) Run() error {
+	defer close(p.done)
+
+	for {
+		start := time.Now()
+		if err := p.fn(p.ctx); err != nil {
+			log.Error().Err(err).Str("job", p.name).Msg("Фоновая задача завершилась с ошибкой")
+		} else {
+			log.Debug().Str("job", p.name).Dur("duration", time.Since(start)).Msg("Фоновая задача выполнена")
+		}
+
+		timer := time.NewTimer(p.interval)
+		select {
+		case <-p.stop:
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+	}
+}
+
+// Stop дожидается завершения текущего запуска. Если ctx истёк раньше, запуск прерывается
+func (p *Periodic) Stop(ctx context.Context) error {
+	close(p.stop)
+
+	select {
+	case <-p.done:
+		p.cancel()
+		return nil
+	case <-ctx.Done():
+		p.cancel()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,107 @@
+// Package lifecycle запускает компоненты приложения по порядку и останавливает
+// их в обратном порядке, давая каждому закончить начатую работу.
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Component — часть приложения со своим циклом жизни
+type Component struct {
+	Name string
+	// Run работает, пока компонент не остановят через Stop. Ошибка из Run
+	// до начала остановки означает, что компонент упал, и останавливает приложение.
+	// Может быть nil, если компоненту нечего запускать (например, пул соединений)
+	Run func() error
+	// Stop просит компонент завершиться и ждёт этого не дольше, чем живёт ctx.
+	// Может быть nil
+	Stop func(ctx context.Context) error
+}
+
+type Manager struct {
+	components []Component
+	// закрываются, когда Run соответствующего компонента вернулся
+	done []chan struct{}
+	// общее время на остановку всех компонентов
+	timeout time.Duration
+}
+
+func New(shutdownTimeout time.Duration) *Manager {
+	return &Manager{timeout: shutdownTimeout}
+}
+
+// Add добавляет компонент. Компоненты запускаются в порядке добавления,
+// останавливаются — в обратном
+func (m *Manager) Add(c Component) {
+	m.components = append(m.components, c)
+}
+
+// Run запускает компоненты и ждёт отмены ctx (обычно по сигналу) или падения
+// одного из них. После этого останавливает все компоненты с новым контекстом
+// на shutdownTimeout: контекст запуска к этому моменту уже отменён
+func (m *Manager) Run(ctx context.Context) error {
+	failed := make(chan error, len(m.components))
+	m.done = make([]chan struct{}, len(m.components))
+
+	for i, c := range m.components {
+		m.done[i] = make(chan struct{})
+		if c.Run == nil {
+			close(m.done[i])
+			continue
+		}
+
+		go func(c Component, done chan struct{}) {
+			defer close(done)
+			if err := c.Run(); err != nil {
+				failed <- fmt.Errorf("%s: %w", c.Name, err)
+			}
+		}(c, m.done[i])
+
+		log.Info().Str("component", c.Name).Msg("компонент запущен")
+	}
+
+	var runErr error
+	select {
+	case <-ctx.Done():
+		log.Info().Msg("получен сигнал остановки")
+	case runErr = <-failed:
+		log.Error().Err(runErr).Msg("компонент упал, останавливаем приложение")
+	}
+
+	return errors.Join(runErr, m.stop())
+}
+
+func (m *Manager) stop() error {
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+
+	var errs []error
+	for i := len(m.components) - 1; i >= 0; i-- {
+		c := m.components[i]
+		logger := log.With().Str("component", c.Name).Logger()
+
+		if c.Stop != nil {
+			if err := c.Stop(ctx); err != nil {
+				logger.Error().Err(err).Msg("компонент остановлен с ошибкой")
+				errs = append(errs, fmt.Errorf("%s: %w", c.Name, err))
+			}
+		}
+
+		// ждём, пока Run действительно вернётся, иначе следующий компонент
+		// (например, пул соединений) закроется у работающего из-под ног
+		select {
+		case <-m.done[i]:
+			logger.Info().Msg("компонент остановлен")
+		case <-ctx.Done():
+			logger.Error().Msg("компонент не успел остановиться")
+			errs = append(errs, fmt.Errorf("%s: %w", c.Name, ctx.Err()))
+		}
+	}
+
+	return errors.Join(errs...)
+}
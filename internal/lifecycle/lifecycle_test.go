@@ -0,0 +1,203 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/region23/praktikum-diplom/internal/jobs"
+)
+
+// записывает, в каком порядке компоненты останавливались
+type stopLog struct {
+	mu    sync.Mutex
+	names []string
+}
+
+func (l *stopLog) add(name string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.names = append(l.names, name)
+}
+
+func (l *stopLog) list() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return append([]string(nil), l.names...)
+}
+
+// компонент, который работает до Stop и записывает остановку
+func blocking(name string, log *stopLog) Component {
+	stop := make(chan struct{})
+
+	return Component{
+		Name: name,
+		Run: func() error {
+			<-stop
+			return nil
+		},
+		Stop: func(context.Context) error {
+			log.add(name)
+			close(stop)
+			return nil
+		},
+	}
+}
+
+func wantOrder(t *testing.T, got []string, want ...string) {
+	t.Helper()
+
+	if len(got) != len(want) {
+		t.Fatalf("порядок остановки %v, ожидали %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("порядок остановки %v, ожидали %v", got, want)
+		}
+	}
+}
+
+func TestStopInReverseOrder(t *testing.T) {
+	var log stopLog
+	m := New(time.Second)
+	m.Add(blocking("database", &log))
+	m.Add(Component{Name: "pool"}) // без Run и Stop
+	m.Add(blocking("poller", &log))
+	m.Add(blocking("http", &log))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	if err := m.Run(ctx); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	wantOrder(t, log.list(), "http", "poller", "database")
+}
+
+// SIGTERM посреди фоновой задачи: задача доделывает начатое с неотменённым
+// контекстом, и только потом останавливаются компоненты, от которых она зависит
+func TestSigtermLetsInFlightWorkFinish(t *testing.T) {
+	var log stopLog
+	var (
+		started   = make(chan struct{})
+		startOnce sync.Once
+		completed atomic.Int64
+		cancelled atomic.Int64
+	)
+
+	job := jobs.NewPeriodic("job", time.Hour, func(ctx context.Context) error {
+		startOnce.Do(func() { close(started) })
+
+		select {
+		case <-time.After(200 * time.Millisecond):
+		case <-ctx.Done():
+			cancelled.Add(1)
+			return ctx.Err()
+		}
+
+		completed.Add(1)
+		log.add("job finished")
+		return nil
+	})
+
+	m := New(5 * time.Second)
+	m.Add(blocking("database", &log))
+	m.Add(Component{Name: "job", Run: job.Run, Stop: func(ctx context.Context) error {
+		log.add("job")
+		return job.Stop(ctx)
+	}})
+	m.Add(blocking("http", &log))
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		<-started
+		syscall.Kill(syscall.Getpid(), syscall.SIGTERM)
+	}()
+
+	start := time.Now()
+	if err := m.Run(ctx); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	if completed.Load() != 1 || cancelled.Load() != 0 {
+		t.Fatalf("задача выполнена %d раз, прервана %d раз, ожидали одно полное выполнение", completed.Load(), cancelled.Load())
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("остановка заняла %s", elapsed)
+	}
+
+	// база закрывается только после того, как задача доработала
+	wantOrder(t, log.list(), "http", "job", "job finished", "database")
+}
+
+// задача, не уложившаяся в shutdownTimeout, прерывается отменой контекста,
+// а Run возвращает ошибку, не дожидаясь её дольше положенного
+func TestShutdownTimeout(t *testing.T) {
+	var (
+		started   = make(chan struct{})
+		startOnce sync.Once
+		cancelled = make(chan struct{})
+	)
+
+	job := jobs.NewPeriodic("slow", time.Hour, func(ctx context.Context) error {
+		startOnce.Do(func() { close(started) })
+
+		select {
+		case <-time.After(time.Minute):
+		case <-ctx.Done():
+			close(cancelled)
+		}
+		return ctx.Err()
+	})
+
+	m := New(100 * time.Millisecond)
+	m.Add(Component{Name: "slow", Run: job.Run, Stop: job.Stop})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+
+	start := time.Now()
+	err := m.Run(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Run вернул %v, ожидали context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("остановка заняла %s при таймауте 100ms", elapsed)
+	}
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("контекст задачи не отменён после таймаута остановки")
+	}
+}
+
+func TestFailedComponentStopsApp(t *testing.T) {
+	var log stopLog
+	errBoom := errors.New("boom")
+
+	m := New(time.Second)
+	m.Add(blocking("database", &log))
+	m.Add(Component{Name: "broken", Run: func() error { return errBoom }})
+	m.Add(blocking("http", &log))
+
+	err := m.Run(context.Background())
+	if !errors.Is(err, errBoom) {
+		t.Fatalf("Run вернул %v, ожидали ошибку упавшего компонента", err)
+	}
+
+	wantOrder(t, log.list(), "http", "database")
+}
@@ -0,0 +1,86 @@
+// Package logging настраивает zerolog: уровень, формат вывода, маскирование
+// секретов и журнал HTTP-запросов с логгером, привязанным к запросу.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	FormatJSON    = "json"
+	FormatConsole = "console"
+)
+
+// Setup настраивает глобальный логгер. Все записи проходят через маскирование секретов
+func Setup(level, format string) error {
+	lvl, err := zerolog.ParseLevel(level)
+	if err != nil {
+		return fmt.Errorf("неизвестный уровень логирования %q: %w", level, err)
+	}
+
+	var out io.Writer
+	switch format {
+	case "", FormatJSON:
+		out = os.Stderr
+	case FormatConsole:
+		out = zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.RFC3339}
+	default:
+		return fmt.Errorf("неизвестный формат логов %q: ожидается json или console", format)
+	}
+
+	zerolog.SetGlobalLevel(lvl)
+	log.Logger = zerolog.New(&redactWriter{out: out}).With().Timestamp().Logger()
+	// логгер по умолчанию для кода, которому передали контекст без логгера запроса
+	zerolog.DefaultContextLogger = &log.Logger
+
+	return nil
+}
+
+// FromContext возвращает логгер запроса или глобальный логгер
+func FromContext(ctx context.Context) *zerolog.Logger {
+	return zerolog.Ctx(ctx)
+}
+
+const redacted = "[REDACTED]"
+
+var (
+	// значения JSON-полей с секретами
+	secretFields = regexp.MustCompile(`(?i)("[^"]*(?:password|passwd|token|secret|authorization|cookie|jwt)[^"]*"\s*:\s*)"(?:[^"\\]|\\.)*"`)
+	// схема Bearer с токеном в любом месте сообщения
+	bearerTokens = regexp.MustCompile(`(?i)(bearer\s+)[A-Za-z0-9\-_.~+/]+=*`)
+	// сами JWT, где бы они ни оказались
+	jwtTokens = regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`)
+)
+
+// redactWriter маскирует секреты в готовых JSON-записях zerolog до того,
+// как они попадут в вывод. zerolog пишет каждую запись одним вызовом Write
+type redactWriter struct {
+	out io.Writer
+}
+
+func (w *redactWriter) Write(p []byte) (int, error) {
+	clean := Redact(p)
+
+	if _, err := w.out.Write(clean); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// Redact убирает из записи пароли, токены и заголовки авторизации
+func Redact(p []byte) []byte {
+	p = secretFields.ReplaceAll(p, []byte(`$1"`+redacted+`"`))
+	p = bearerTokens.ReplaceAll(p, []byte(`${1}`+redacted))
+	p = jwtTokens.ReplaceAll(p, []byte(redacted))
+
+	return p
+}
@@ -0,0 +1,84 @@
+package logging
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// AccessLog пишет по записи на каждый HTTP-запрос и кладёт в контекст запроса
+// логгер с request_id, которым пользуются обработчики. Должен стоять после
+// middleware.RequestID
+func AccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		logger := log.Logger.With().
+			Str("request_id", middleware.GetReqID(r.Context())).
+			Logger()
+		r = r.WithContext(logger.WithContext(r.Context()))
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		route := ""
+		if rctx := chi.RouteContext(r.Context()); rctx != nil {
+			route = rctx.RoutePattern()
+		}
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		// логгер из контекста: в нём уже может быть логин, добавленный WithUser.
+		// Путь пишется без query-строки — в ней может оказаться токен
+		var event *zerolog.Event
+		switch {
+		case status >= http.StatusInternalServerError:
+			event = zerolog.Ctx(r.Context()).Error()
+		case status >= http.StatusBadRequest:
+			event = zerolog.Ctx(r.Context()).Warn()
+		default:
+			event = zerolog.Ctx(r.Context()).Info()
+		}
+
+		// партнёр, предъявивший проверенный клиентский сертификат
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			event = event.Str("client_cert", r.TLS.VerifiedChains[0][0].Subject.CommonName)
+		}
+
+		event.
+			Str("method", r.Method).
+			Str("path", r.URL.Path).
+			Str("route", route).
+			Int("status", status).
+			Int("bytes", ww.BytesWritten()).
+			Dur("latency", time.Since(start)).
+			Str("remote_addr", r.RemoteAddr).
+			Str("user_agent", r.UserAgent()).
+			Msg("request")
+	})
+}
+
+// WithUser добавляет логин аутентифицированного пользователя в логгер запроса.
+// Ставится после jwtauth.Authenticator
+func WithUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, claims, err := jwtauth.FromContext(r.Context())
+		if err == nil {
+			if login, ok := claims["user_id"].(string); ok {
+				zerolog.Ctx(r.Context()).UpdateContext(func(c zerolog.Context) zerolog.Context {
+					return c.Str("login", login)
+				})
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
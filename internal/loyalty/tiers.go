@@ -0,0 +1,94 @@
+// Package loyalty описывает уровни программы лояльности и их множители начислений.
+package loyalty
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// за что пользователь получает уровень
+const (
+	BasisEarned = "earned" // сумма начислений за заказы
+	BasisSpent  = "spent"  // сумма списанных баллов
+)
+
+// Tier — уровень программы лояльности
+type Tier struct {
+	Name string
+	// с какой суммы за период начинается уровень
+	Threshold float64
+	// во сколько раз увеличивается начисление за заказ, 1 — без бонуса
+	Multiplier float64
+}
+
+// Tiers — уровни по возрастанию порога
+type Tiers []Tier
+
+// ParseTiers разбирает уровни вида "bronze:0:1,silver:1000:1.1,gold:5000:1.25"
+// (название:порог:множитель). Пустая строка — уровней нет, начисления не увеличиваются
+func ParseTiers(spec string) (Tiers, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, nil
+	}
+
+	var tiers Tiers
+	names := make(map[string]bool)
+
+	for _, rawTier := range strings.Split(spec, ",") {
+		parts := strings.Split(strings.TrimSpace(rawTier), ":")
+		if len(parts) != 3 || parts[0] == "" {
+			return nil, fmt.Errorf("ожидается название:порог:множитель, получено %q", rawTier)
+		}
+
+		tier := Tier{Name: parts[0]}
+		if names[tier.Name] {
+			return nil, fmt.Errorf("уровень %q указан дважды", tier.Name)
+		}
+		names[tier.Name] = true
+
+		var err error
+		tier.Threshold, err = strconv.ParseFloat(parts[1], 64)
+		if err != nil || tier.Threshold < 0 {
+			return nil, fmt.Errorf("%s: порог должен быть неотрицательным числом, получено %q", tier.Name, parts[1])
+		}
+
+		tier.Multiplier, err = strconv.ParseFloat(parts[2], 64)
+		if err != nil || tier.Multiplier < 1 {
+			return nil, fmt.Errorf("%s: множитель должен быть не меньше 1, получено %q", tier.Name, parts[2])
+		}
+
+		if len(tiers) > 0 && tier.Threshold <= tiers[len(tiers)-1].Threshold {
+			return nil, fmt.Errorf("%s: пороги уровней должны возрастать", tier.Name)
+		}
+
+		tiers = append(tiers, tier)
+	}
+
+	return tiers, nil
+}
+
+// For возвращает уровень для суммы за период и следующий за ним.
+// nil — сумма не дотягивает до первого уровня или следующего уровня нет
+func (t Tiers) For(amount float64) (current, next *Tier) {
+	for i := range t {
+		if amount < t[i].Threshold {
+			return current, &t[i]
+		}
+		current = &t[i]
+	}
+
+	return current, nil
+}
+
+// Bonus — сколько баллов добавляет уровень к начислению accrual.
+// Округляется до копеек
+func (t *Tier) Bonus(accrual float64) float64 {
+	if t == nil {
+		return 0
+	}
+
+	return math.Round(accrual*(t.Multiplier-1)*100) / 100
+}
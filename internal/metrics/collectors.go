@@ -0,0 +1,100 @@
+package metrics
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+)
+
+// poolCollector снимает статистику пула соединений pgxpool в момент опроса
+type poolCollector struct {
+	pool *pgxpool.Pool
+
+	acquired        *prometheus.Desc
+	idle            *prometheus.Desc
+	total           *prometheus.Desc
+	max             *prometheus.Desc
+	acquireCount    *prometheus.Desc
+	emptyAcquire    *prometheus.Desc
+	canceledAcquire *prometheus.Desc
+	acquireDuration *prometheus.Desc
+}
+
+// RegisterPool добавляет метрики пула соединений к базе данных
+func RegisterPool(pool *pgxpool.Pool) {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "db_pool", name), help, nil, nil)
+	}
+
+	prometheus.MustRegister(&poolCollector{
+		pool:            pool,
+		acquired:        desc("acquired_conns", "Соединения, занятые в данный момент."),
+		idle:            desc("idle_conns", "Простаивающие соединения."),
+		total:           desc("total_conns", "Все открытые соединения."),
+		max:             desc("max_conns", "Максимальный размер пула."),
+		acquireCount:    desc("acquire_total", "Количество успешных получений соединения из пула."),
+		emptyAcquire:    desc("empty_acquire_total", "Получения соединения, которым пришлось ждать освобождения."),
+		canceledAcquire: desc("canceled_acquire_total", "Получения соединения, отменённые контекстом."),
+		acquireDuration: desc("acquire_wait_seconds_total", "Суммарное время ожидания соединения из пула."),
+	})
+}
+
+func (c *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.acquired
+	ch <- c.idle
+	ch <- c.total
+	ch <- c.max
+	ch <- c.acquireCount
+	ch <- c.emptyAcquire
+	ch <- c.canceledAcquire
+	ch <- c.acquireDuration
+}
+
+func (c *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	stat := c.pool.Stat()
+
+	ch <- prometheus.MustNewConstMetric(c.acquired, prometheus.GaugeValue, float64(stat.AcquiredConns()))
+	ch <- prometheus.MustNewConstMetric(c.idle, prometheus.GaugeValue, float64(stat.IdleConns()))
+	ch <- prometheus.MustNewConstMetric(c.total, prometheus.GaugeValue, float64(stat.TotalConns()))
+	ch <- prometheus.MustNewConstMetric(c.max, prometheus.GaugeValue, float64(stat.MaxConns()))
+	ch <- prometheus.MustNewConstMetric(c.acquireCount, prometheus.CounterValue, float64(stat.AcquireCount()))
+	ch <- prometheus.MustNewConstMetric(c.emptyAcquire, prometheus.CounterValue, float64(stat.EmptyAcquireCount()))
+	ch <- prometheus.MustNewConstMetric(c.canceledAcquire, prometheus.CounterValue, float64(stat.CanceledAcquireCount()))
+	ch <- prometheus.MustNewConstMetric(c.acquireDuration, prometheus.CounterValue, stat.AcquireDuration().Seconds())
+}
+
+// queueCollector показывает, сколько заказов ждут обновления от системы расчёта начислений
+type queueCollector struct {
+	count func(ctx context.Context) (map[string]int, error)
+	depth *prometheus.Desc
+}
+
+// RegisterQueue добавляет метрику очереди поллера. count возвращает количество
+// ожидающих заказов по статусам и вызывается при каждом опросе /metrics
+func RegisterQueue(count func(ctx context.Context) (map[string]int, error)) {
+	prometheus.MustRegister(&queueCollector{
+		count: count,
+		depth: prometheus.NewDesc(prometheus.BuildFQName(namespace, "accrual", "queue_depth"),
+			"Заказы, ожидающие обновления от системы расчёта начислений, по статусам.",
+			[]string{"status"}, nil),
+	})
+}
+
+func (c *queueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.depth
+}
+
+func (c *queueCollector) Collect(ch chan<- prometheus.Metric) {
+	counts, err := c.count(context.Background())
+	if err != nil {
+		log.Error().Err(err).Msg("Не смогли получить размер очереди заказов для метрик")
+		ch <- prometheus.NewInvalidMetric(c.depth, err)
+		return
+	}
+
+	for status, count := range counts {
+		ch <- prometheus.MustNewConstMetric(c.depth, prometheus.GaugeValue, float64(count), status)
+	}
+}
@@ -0,0 +1,202 @@
+// Package metrics описывает метрики Prometheus, которые отдаёт сервис на /metrics.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "gophermart"
+
+// исходы попыток доставки вебхуков
+const (
+	WebhookDelivered = "delivered"
+	WebhookRetry     = "retry"
+	WebhookDead      = "dead"
+)
+
+// исходы запросов к системе расчёта начислений
+const (
+	AccrualOK              = "200"
+	AccrualNoContent       = "204"
+	AccrualTooManyRequests = "429"
+	AccrualInternalError   = "500"
+	AccrualTimeout         = "timeout"
+	AccrualError           = "error"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "Количество HTTP-запросов по шаблону маршрута, методу и коду ответа.",
+	}, []string{"route", "method", "status"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Время обработки HTTP-запросов по шаблону маршрута, методу и коду ответа.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	accrualRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "accrual",
+		Name:      "requests_total",
+		Help:      "Запросы к системе расчёта начислений по исходу: 200, 204, 429, 500, timeout, error.",
+	}, []string{"outcome"})
+
+	accrualBreakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "accrual",
+		Name:      "breaker_state",
+		Help:      "Состояние circuit breaker перед системой расчёта начислений: 1 у текущего состояния, 0 у остальных.",
+	}, []string{"state"})
+
+	accrualBreakerTransitions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "accrual",
+		Name:      "breaker_transitions_total",
+		Help:      "Переходы circuit breaker перед системой расчёта начислений по новому состоянию.",
+	}, []string{"state"})
+
+	accrualPushes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "accrual",
+		Name:      "pushes_total",
+		Help:      "Результаты расчёта, присланные системой начислений, по исходу: applied, unchanged, ignored, not_found, invalid.",
+	}, []string{"outcome"})
+
+	timeToProcessed = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "orders",
+		Name:      "time_to_processed_seconds",
+		Help:      "Время от загрузки заказа до получения статуса PROCESSED.",
+		Buckets:   []float64{1, 5, 15, 30, 60, 300, 900, 3600, 4 * 3600, 24 * 3600},
+	})
+
+	registrations = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "users",
+		Name:      "registrations_total",
+		Help:      "Количество зарегистрированных пользователей.",
+	})
+
+	withdrawals = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "balance",
+		Name:      "withdrawals_total",
+		Help:      "Количество списаний баллов.",
+	})
+
+	withdrawalsSum = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "balance",
+		Name:      "withdrawals_sum",
+		Help:      "Сумма списанных баллов.",
+	})
+
+	webhookDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "webhooks",
+		Name:      "deliveries_total",
+		Help:      "Попытки доставки вебхуков по исходу: delivered, retry, dead.",
+	}, []string{"outcome"})
+
+	rateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "rate_limited_total",
+		Help:      "Запросы, отклонённые ограничением частоты, по политике.",
+	}, []string{"policy"})
+)
+
+// обработчик /metrics
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Middleware считает запросы и время их обработки. Маршрут берётся из шаблона chi,
+// чтобы номера заказов и прочие параметры пути не раздували число рядов
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+		next.ServeHTTP(ww, r)
+
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		labels := prometheus.Labels{"route": route, "method": r.Method, "status": strconv.Itoa(status)}
+		httpRequests.With(labels).Inc()
+		httpDuration.With(labels).Observe(time.Since(start).Seconds())
+	})
+}
+
+// учитывает исход запроса к системе расчёта начислений
+func ObserveAccrualRequest(outcome string) {
+	accrualRequests.WithLabelValues(outcome).Inc()
+}
+
+// SetAccrualBreakerState отмечает текущее состояние breaker перед системой начислений.
+// states — все возможные состояния, чтобы у остальных выставить 0
+func SetAccrualBreakerState(current string, states ...string) {
+	for _, state := range states {
+		value := 0.0
+		if state == current {
+			value = 1
+		}
+		accrualBreakerState.WithLabelValues(state).Set(value)
+	}
+}
+
+// учитывает переход breaker перед системой начислений в состояние state
+func ObserveAccrualBreakerTransition(state string) {
+	accrualBreakerTransitions.WithLabelValues(state).Inc()
+}
+
+// учитывает результат расчёта, присланный системой начислений
+func ObserveAccrualPush(outcome string) {
+	accrualPushes.WithLabelValues(outcome).Inc()
+}
+
+// учитывает время, за которое заказ дошёл до статуса PROCESSED
+func ObserveTimeToProcessed(uploadedAt time.Time) {
+	timeToProcessed.Observe(time.Since(uploadedAt).Seconds())
+}
+
+func IncRegistrations() {
+	registrations.Inc()
+}
+
+func ObserveWithdrawal(sum float64) {
+	withdrawals.Inc()
+	withdrawalsSum.Add(sum)
+}
+
+// учитывает запрос, отклонённый ограничением частоты
+func IncRateLimited(policy string) {
+	rateLimited.WithLabelValues(policy).Inc()
+}
+
+// учитывает исход попытки доставки вебхука
+func ObserveWebhookDelivery(outcome string) {
+	webhookDeliveries.WithLabelValues(outcome).Inc()
+}
@@ -0,0 +1,52 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// как часто вычищать закончившиеся окна
+const sweepInterval = time.Minute
+
+type window struct {
+	count int
+	reset time.Time
+}
+
+// MemoryStore хранит счётчики в памяти процесса. Подходит для одного экземпляра
+// сервиса: у нескольких экземпляров лимиты будут считаться раздельно
+type MemoryStore struct {
+	mu        sync.Mutex
+	windows   map[string]*window
+	nextSweep time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{windows: make(map[string]*window)}
+}
+
+func (m *MemoryStore) Hit(_ context.Context, key string, size time.Duration) (int, time.Time, error) {
+	now := time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if now.After(m.nextSweep) {
+		for k, w := range m.windows {
+			if !now.Before(w.reset) {
+				delete(m.windows, k)
+			}
+		}
+		m.nextSweep = now.Add(sweepInterval)
+	}
+
+	w, ok := m.windows[key]
+	if !ok || !now.Before(w.reset) {
+		w = &window{reset: now.Truncate(size).Add(size)}
+		m.windows[key] = w
+	}
+	w.count++
+
+	return w.count, w.reset, nil
+}
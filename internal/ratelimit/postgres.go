@@ -0,0 +1,46 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/region23/praktikum-diplom/internal/storage"
+	"github.com/rs/zerolog/log"
+)
+
+// PostgresStore хранит счётчики в PostgreSQL, общие для всех экземпляров сервиса
+type PostgresStore struct {
+	repository *storage.Database
+
+	mu        sync.Mutex
+	nextSweep time.Time
+}
+
+func NewPostgresStore(repository *storage.Database) *PostgresStore {
+	return &PostgresStore{repository: repository}
+}
+
+func (p *PostgresStore) Hit(ctx context.Context, key string, window time.Duration) (int, time.Time, error) {
+	p.sweep()
+
+	return p.repository.HitRateLimit(ctx, key, window)
+}
+
+// раз в sweepInterval удаляет закончившиеся окна, не задерживая запрос
+func (p *PostgresStore) sweep() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	if now.Before(p.nextSweep) {
+		return
+	}
+	p.nextSweep = now.Add(sweepInterval)
+
+	go func() {
+		if err := p.repository.DeleteExpiredRateLimits(context.Background()); err != nil {
+			log.Error().Err(err).Msg("Не смогли удалить устаревшие счётчики ограничения запросов")
+		}
+	}()
+}
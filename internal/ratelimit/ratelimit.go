@@ -0,0 +1,92 @@
+// Package ratelimit ограничивает количество запросов клиента за окно времени.
+// Используется фиксированное окно: счётчик обнуляется в начале каждого окна.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Policy — сколько запросов разрешено за окно. Limit = 0 — без ограничения
+type Policy struct {
+	Name   string
+	Limit  int
+	Window time.Duration
+}
+
+// ParsePolicy разбирает ограничение вида "60/1m" (60 запросов в минуту).
+// "off" или пустая строка — без ограничения
+func ParsePolicy(name, spec string) (Policy, error) {
+	policy := Policy{Name: name}
+
+	spec = strings.TrimSpace(spec)
+	if spec == "" || spec == "off" {
+		return policy, nil
+	}
+
+	rawLimit, rawWindow, ok := strings.Cut(spec, "/")
+	if !ok {
+		return policy, fmt.Errorf("ожидается количество/окно, например 60/1m, получено %q", spec)
+	}
+
+	limit, err := strconv.Atoi(rawLimit)
+	if err != nil || limit < 1 {
+		return policy, fmt.Errorf("количество запросов должно быть положительным числом, получено %q", rawLimit)
+	}
+
+	window, err := time.ParseDuration(rawWindow)
+	if err != nil || window < time.Second {
+		return policy, fmt.Errorf("окно должно быть не меньше секунды, получено %q", rawWindow)
+	}
+
+	policy.Limit = limit
+	policy.Window = window
+
+	return policy, nil
+}
+
+func (p Policy) Enabled() bool {
+	return p.Limit > 0
+}
+
+// String в формате заголовка RateLimit-Policy: "60;w=60"
+func (p Policy) String() string {
+	return fmt.Sprintf("%d;w=%d", p.Limit, int(p.Window.Seconds()))
+}
+
+// Store считает запросы в окне. Hit увеличивает счётчик ключа в текущем окне
+// и возвращает новое значение и время начала следующего окна
+type Store interface {
+	Hit(ctx context.Context, key string, window time.Duration) (count int, reset time.Time, err error)
+}
+
+// Result — решение по одному запросу
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	Reset     time.Time
+}
+
+// Allow учитывает запрос клиента identity по политике policy
+func Allow(ctx context.Context, store Store, policy Policy, identity string) (Result, error) {
+	count, reset, err := store.Hit(ctx, policy.Name+":"+identity, policy.Window)
+	if err != nil {
+		return Result{}, err
+	}
+
+	remaining := policy.Limit - count
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	return Result{
+		Allowed:   count <= policy.Limit,
+		Limit:     policy.Limit,
+		Remaining: remaining,
+		Reset:     reset,
+	}, nil
+}
@@ -0,0 +1,109 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestParsePolicy(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    Policy
+		wantErr bool
+	}{
+		{spec: "60/1m", want: Policy{Name: "p", Limit: 60, Window: time.Minute}},
+		{spec: " 5/30s ", want: Policy{Name: "p", Limit: 5, Window: 30 * time.Second}},
+		{spec: "", want: Policy{Name: "p"}},
+		{spec: "off", want: Policy{Name: "p"}},
+		{spec: "60", wantErr: true},
+		{spec: "0/1m", wantErr: true},
+		{spec: "-1/1m", wantErr: true},
+		{spec: "x/1m", wantErr: true},
+		{spec: "10/500ms", wantErr: true},
+		{spec: "10/minute", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParsePolicy("p", tt.spec)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParsePolicy(%q) = %+v, ожидали ошибку", tt.spec, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ParsePolicy(%q) = %+v, %v, ожидали %+v", tt.spec, got, err, tt.want)
+		}
+	}
+
+	policy, _ := ParsePolicy("auth", "10/1m")
+	if !policy.Enabled() || policy.String() != "10;w=60" {
+		t.Errorf("политика %+v: Enabled %v, String %q", policy, policy.Enabled(), policy.String())
+	}
+	if off, _ := ParsePolicy("auth", "off"); off.Enabled() {
+		t.Error("политика off включена")
+	}
+}
+
+func TestMemoryStoreHit(t *testing.T) {
+	store := NewMemoryStore()
+	ctx := context.Background()
+
+	var reset time.Time
+	for i := 1; i <= 3; i++ {
+		count, r, err := store.Hit(ctx, "a", time.Hour)
+		if err != nil || count != i {
+			t.Fatalf("Hit %d: %d, %v", i, count, err)
+		}
+		if i > 1 && !r.Equal(reset) {
+			t.Fatalf("окно сдвинулось: %s, было %s", r, reset)
+		}
+		reset = r
+	}
+	if !reset.After(time.Now()) || time.Until(reset) > time.Hour {
+		t.Fatalf("конец окна %s вне следующего часа", reset)
+	}
+
+	// ключи считаются раздельно
+	if count, _, _ := store.Hit(ctx, "b", time.Hour); count != 1 {
+		t.Fatalf("счётчик другого ключа %d, ожидали 1", count)
+	}
+
+	// по окончании окна счётчик начинается заново
+	count, _, _ := store.Hit(ctx, "short", time.Second)
+	if count != 1 {
+		t.Fatalf("первый запрос в окне: %d", count)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if count, _, _ := store.Hit(ctx, "short", time.Second); count != 1 {
+		t.Fatalf("после окончания окна счётчик %d, ожидали 1", count)
+	}
+}
+
+func TestAllow(t *testing.T) {
+	store := NewMemoryStore()
+	policy := Policy{Name: "auth", Limit: 2, Window: time.Hour}
+
+	var results []Result
+	for i := 0; i < 3; i++ {
+		result, err := Allow(context.Background(), store, policy, "ip:1.2.3.4")
+		if err != nil {
+			t.Fatalf("Allow: %v", err)
+		}
+		results = append(results, result)
+	}
+
+	for i, want := range []struct {
+		allowed   bool
+		remaining int
+	}{{true, 1}, {true, 0}, {false, 0}} {
+		if results[i].Allowed != want.allowed || results[i].Remaining != want.remaining || results[i].Limit != 2 {
+			t.Errorf("запрос %d: %+v", i+1, results[i])
+		}
+	}
+
+	// другой клиент считается отдельно
+	if result, _ := Allow(context.Background(), store, policy, "ip:5.6.7.8"); !result.Allowed {
+		t.Error("запрос другого клиента отклонён")
+	}
+}
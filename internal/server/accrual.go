@@ -0,0 +1,122 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	externalapi "github.com/region23/praktikum-diplom/internal/external_api"
+	"github.com/region23/praktikum-diplom/internal/logging"
+	"github.com/region23/praktikum-diplom/internal/metrics"
+	"github.com/region23/praktikum-diplom/internal/signature"
+	"github.com/region23/praktikum-diplom/internal/storage"
+)
+
+const (
+	// заголовок с подписью signature.Sign на accrual_callback_secret
+	accrualSignatureHeader = "X-Accrual-Signature"
+	// насколько подпись может расходиться с часами сервиса
+	accrualSignatureTolerance = 5 * time.Minute
+	// максимальный размер тела запроса с результатами
+	maxAccrualCallbackBody = 1 << 20
+)
+
+// заказы, к которым применяются присланные результаты; в тестах подменяется
+type accrualRepository interface {
+	externalapi.Repository
+	GetOrder(ctx context.Context, orderNumber string) (*storage.Order, error)
+}
+
+// итог обработки одного присланного результата
+type accrualCallbackResult struct {
+	Order  string `json:"order"`
+	Result string `json:"result"` // applied, unchanged, ignored, not_found или invalid
+}
+
+// приём результатов расчёта от системы начислений: один объект или массив
+// в формате ответа GET /api/orders/{number}
+func (s *Server) accrualCallback(w http.ResponseWriter, r *http.Request) {
+	// Возможные коды ответа:
+	// 200 — результаты обработаны, итог по каждому заказу в теле ответа;
+	// 400 — неверный формат запроса или слишком много результатов;
+	// 401 — подпись отсутствует, неверна или устарела;
+	// 413 — слишком большое тело запроса;
+	// 500 — внутренняя ошибка сервера.
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxAccrualCallbackBody))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			JSONResponse(w, ResponseBody{Error: "слишком большое тело запроса"}, http.StatusRequestEntityTooLarge)
+			return
+		}
+		JSONResponse(w, ResponseBody{Error: err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	err = signature.Verify(s.AccrualCallbackSecret, r.Header.Get(accrualSignatureHeader), body, time.Now(), accrualSignatureTolerance)
+	if err != nil {
+		JSONResponse(w, ResponseBody{Error: err.Error()}, http.StatusUnauthorized)
+		return
+	}
+
+	var results []externalapi.AccuralType
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(trimmed, &results)
+	} else {
+		var result externalapi.AccuralType
+		err = json.Unmarshal(trimmed, &result)
+		results = append(results, result)
+	}
+	if err != nil {
+		respBody := ResponseBody{Error: fmt.Sprint("Decode error! please check your JSON formating.", err.Error())}
+		JSONResponse(w, respBody, http.StatusBadRequest)
+		return
+	}
+
+	if len(results) > s.BatchMaxSize {
+		respBody := ResponseBody{Error: fmt.Sprintf("не больше %d результатов за запрос", s.BatchMaxSize)}
+		JSONResponse(w, respBody, http.StatusBadRequest)
+		return
+	}
+
+	// изменения заказов попадают в журнал аудита от имени системы начислений
+	actor := storage.ActorFromContext(r.Context())
+	actor.Name = storage.ActorAccrualPush
+	ctx := storage.WithActor(r.Context(), actor)
+
+	response := make([]accrualCallbackResult, 0, len(results))
+	for _, result := range results {
+		outcome := externalapi.ApplyInvalid
+		if result.Order != "" {
+			order, err := s.accruals.GetOrder(ctx, result.Order)
+			switch {
+			case errors.Is(err, pgx.ErrNoRows):
+				outcome = externalapi.ApplyNotFound
+			case err != nil:
+				logging.FromContext(ctx).Error().Err(err).Str("order", result.Order).Msg("Не смогли получить заказ для результата расчёта")
+				respBody := ResponseBody{Error: fmt.Sprintf("внутренняя ошибка сервера: %v", err.Error())}
+				JSONResponse(w, respBody, http.StatusInternalServerError)
+				return
+			default:
+				outcome, err = externalapi.Apply(ctx, s.accruals, *order, result)
+				if err != nil {
+					respBody := ResponseBody{Error: fmt.Sprintf("внутренняя ошибка сервера: %v", err.Error())}
+					JSONResponse(w, respBody, http.StatusInternalServerError)
+					return
+				}
+			}
+		}
+
+		metrics.ObserveAccrualPush(outcome)
+		response = append(response, accrualCallbackResult{Order: result.Order, Result: outcome})
+	}
+
+	JSONResponse(w, response, http.StatusOK)
+}
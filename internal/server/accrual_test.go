@@ -0,0 +1,148 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/jackc/pgx/v4"
+	"github.com/region23/praktikum-diplom/internal/events"
+	"github.com/region23/praktikum-diplom/internal/signature"
+	"github.com/region23/praktikum-diplom/internal/storage"
+)
+
+// заказы в памяти вместо базы
+type fakeAccruals struct {
+	mu     sync.Mutex
+	orders map[string]*storage.Order
+}
+
+func (f *fakeAccruals) GetOrder(ctx context.Context, orderNumber string) (*storage.Order, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	order, ok := f.orders[orderNumber]
+	if !ok {
+		return nil, pgx.ErrNoRows
+	}
+	copied := *order
+	return &copied, nil
+}
+
+func (f *fakeAccruals) GetOrdersForUpdate(ctx context.Context, reconcile time.Duration) (*[]storage.Order, error) {
+	return &[]storage.Order{}, nil
+}
+
+func (f *fakeAccruals) MarkAccrualChecked(ctx context.Context, orderNumber string) error {
+	return nil
+}
+
+func (f *fakeAccruals) UpdateOrder(ctx context.Context, orderNumber string, status storage.OrderStatus, accrual float64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.orders[orderNumber].Status = status
+	f.orders[orderNumber].Accrual = accrual
+	return nil
+}
+
+func TestAccrualCallback(t *testing.T) {
+	const secret = "0123456789abcdef0123456789abcdef"
+	now := time.Now()
+
+	single := `{"order":"79927398713","status":"PROCESSED","accrual":500}`
+	batch := `[
+		{"order":"79927398713","status":"PROCESSED","accrual":500},
+		{"order":"12345678903","status":"REGISTERED"},
+		{"order":"2377225624","status":"PROCESSING"},
+		{"order":"4561261212345467","status":"PROCESSED"},
+		{"status":"PROCESSED"}
+	]`
+
+	tests := []struct {
+		name   string
+		body   string
+		header string // по умолчанию — верная подпись тела
+		want   int
+		// итог по каждому результату при ответе 200
+		wantResults []accrualCallbackResult
+	}{
+		{
+			name:        "один результат",
+			body:        single,
+			want:        http.StatusOK,
+			wantResults: []accrualCallbackResult{{"79927398713", "applied"}},
+		},
+		{
+			name: "пакет результатов",
+			body: batch,
+			want: http.StatusOK,
+			wantResults: []accrualCallbackResult{
+				{"79927398713", "applied"}, {"12345678903", "unchanged"}, {"2377225624", "ignored"},
+				{"4561261212345467", "not_found"}, {"", "invalid"},
+			},
+		},
+		{name: "без подписи", body: single, header: "-", want: http.StatusUnauthorized},
+		{name: "чужой секрет", body: single, header: signature.Sign("другой секрет", now, []byte(single)), want: http.StatusUnauthorized},
+		{name: "подписано другое тело", body: single, header: signature.Sign(secret, now, []byte(batch)), want: http.StatusUnauthorized},
+		{name: "подпись устарела", body: single, header: signature.Sign(secret, now.Add(-time.Hour), []byte(single)), want: http.StatusUnauthorized},
+		{name: "испорченный заголовок", body: single, header: "t=now,v1=zz", want: http.StatusUnauthorized},
+		{name: "неверный JSON", body: `{"order":`, want: http.StatusBadRequest},
+		{name: "результатов больше BatchMaxSize", body: `[` + strings.Repeat(single+",", 5) + single + `]`, want: http.StatusBadRequest},
+		{name: "слишком большое тело", body: `{"order":"` + strings.Repeat("1", maxAccrualCallbackBody) + `"}`, want: http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		srv := New(storage.Database{}, jwtauth.New("HS256", []byte("test-secret"), nil), events.NewBroker())
+		srv.AccrualCallbackSecret = secret
+		srv.BatchMaxSize = 5
+		fake := &fakeAccruals{orders: map[string]*storage.Order{
+			"79927398713": {Number: "79927398713", Status: storage.StatusProcessing},
+			"12345678903": {Number: "12345678903", Status: storage.StatusRegistered},
+			"2377225624":  {Number: "2377225624", Status: storage.StatusInvalid},
+		}}
+		srv.accruals = fake
+		srv.MountHandlers()
+
+		r := httptest.NewRequest(http.MethodPost, "/internal/accrual/callback", strings.NewReader(tt.body))
+		switch tt.header {
+		case "":
+			r.Header.Set(accrualSignatureHeader, signature.Sign(secret, now, []byte(tt.body)))
+		case "-":
+		default:
+			r.Header.Set(accrualSignatureHeader, tt.header)
+		}
+		w := httptest.NewRecorder()
+		srv.Router.ServeHTTP(w, r)
+
+		if w.Code != tt.want {
+			t.Errorf("%s: код %d, ожидали %d: %.200s", tt.name, w.Code, tt.want, w.Body)
+			continue
+		}
+
+		if tt.want != http.StatusOK {
+			// отклонённый запрос ничего не меняет
+			if status := fake.orders["79927398713"].Status; status != storage.StatusProcessing {
+				t.Errorf("%s: заказ перешёл в %s", tt.name, status)
+			}
+			continue
+		}
+
+		var results []accrualCallbackResult
+		if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(results, tt.wantResults) {
+			t.Errorf("%s: итог %v, ожидали %v", tt.name, results, tt.wantResults)
+		}
+		if order := fake.orders["79927398713"]; order.Status != storage.StatusProcessed || order.Accrual != 500 {
+			t.Errorf("%s: заказ %s с начислением %v, ожидали PROCESSED и 500", tt.name, order.Status, order.Accrual)
+		}
+	}
+}
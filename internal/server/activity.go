@@ -0,0 +1,111 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/region23/praktikum-diplom/internal/logging"
+	"github.com/region23/praktikum-diplom/internal/storage"
+)
+
+// сколько записей журнала отдавать за один запрос
+const (
+	defaultActivityLimit = 50
+	maxActivityLimit     = 500
+)
+
+// кладёт в контекст запроса адрес и клиентское приложение для журнала аудита
+func (s *Server) auditActor(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := storage.WithActor(r.Context(), storage.Actor{
+			IP:        s.clientIP(r),
+			UserAgent: r.UserAgent(),
+		})
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// добавляет логин аутентифицированного пользователя к исполнителю действия.
+// Ставится после jwtauth.Authenticator
+func auditUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, claims, err := jwtauth.FromContext(r.Context())
+		if err == nil {
+			if login, ok := claims["user_id"].(string); ok {
+				actor := storage.ActorFromContext(r.Context())
+				actor.Name = login
+				r = r.WithContext(storage.WithActor(r.Context(), actor))
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// записывает в журнал аудита действие, которое не меняет данные. Ошибка записи
+// не должна ломать сам запрос, поэтому только логируется
+func (s *Server) audit(r *http.Request, login, action string, after interface{}) {
+	err := s.storage.AddAuditEvent(r.Context(), login, action, nil, after)
+	if err != nil {
+		logging.FromContext(r.Context()).Error().Err(err).Str("action", action).Msg("Не смогли записать действие в журнал аудита")
+	}
+}
+
+// история действий пользователя от новых к старым
+func (s *Server) userActivity(w http.ResponseWriter, r *http.Request) {
+	// Возможные коды ответа:
+	// 200 — успешная обработка запроса;
+	// 204 — нет данных для ответа;
+	// 400 — неверный формат параметров limit или before;
+	// 401 — пользователь не аутентифицирован;
+	// 429 — превышено ограничение частоты запросов;
+	// 500 — внутренняя ошибка сервера.
+
+	_, claims, err := jwtauth.FromContext(r.Context())
+	if err != nil {
+		respBody := ResponseBody{Error: fmt.Sprintf("внутренняя ошибка сервера: %v", err.Error())}
+		JSONResponse(w, respBody, http.StatusInternalServerError)
+		return
+	}
+
+	currentLogin, _ := claims["user_id"].(string)
+
+	limit := defaultActivityLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxActivityLimit {
+			respBody := ResponseBody{Error: fmt.Sprintf("limit должен быть числом от 1 до %d", maxActivityLimit)}
+			JSONResponse(w, respBody, http.StatusBadRequest)
+			return
+		}
+	}
+
+	// номер записи, с которой продолжить: id последней записи предыдущей страницы
+	var beforeID int64
+	if value := r.URL.Query().Get("before"); value != "" {
+		beforeID, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || beforeID < 1 {
+			respBody := ResponseBody{Error: "before должен быть положительным числом"}
+			JSONResponse(w, respBody, http.StatusBadRequest)
+			return
+		}
+	}
+
+	events, err := s.storage.GetAuditEvents(r.Context(), currentLogin, beforeID, limit)
+	if err != nil {
+		respBody := ResponseBody{Error: fmt.Sprintf("внутренняя ошибка сервера: %v", err.Error())}
+		JSONResponse(w, respBody, http.StatusInternalServerError)
+		return
+	}
+
+	if len(*events) == 0 {
+		respBody := ResponseBody{Success: "нет данных для ответа"}
+		JSONResponse(w, respBody, http.StatusNoContent)
+		return
+	}
+
+	JSONResponse(w, events, http.StatusOK)
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+	my_errors "github.com/region23/praktikum-diplom/internal/errors"
+)
+
+// максимальная длина причины корректировки
+const maxAdjustmentReason = 200
+
+type adjustRequest struct {
+	Accrual *float64 `json:"accrual,omitempty"` // новое начисление по заказу
+	Void    bool     `json:"void,omitempty"`    // аннулировать начисление целиком
+	Reason  string   `json:"reason"`            // причина корректировки, обязательна
+}
+
+// уменьшение или аннулирование начисления по обработанному заказу
+func (s *Server) adminAdjustOrder(w http.ResponseWriter, r *http.Request) {
+	// Возможные коды ответа:
+	// 200 — начисление скорректировано;
+	// 400 — неверный формат запроса, не указана причина или новое начисление;
+	// 401 — пользователь не аутентифицирован;
+	// 403 — пользователь не администратор;
+	// 404 — заказ не найден;
+	// 409 — заказ ещё не обработан или новое начисление не меньше текущего;
+	// 500 — внутренняя ошибка сервера.
+
+	var request adjustRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		respBody := ResponseBody{Error: fmt.Sprint("Decode error! please check your JSON formating.", err.Error())}
+		JSONResponse(w, respBody, http.StatusBadRequest)
+		return
+	}
+
+	request.Reason = strings.TrimSpace(request.Reason)
+
+	switch {
+	case request.Reason == "":
+		JSONResponse(w, ResponseBody{Error: "не указана причина корректировки"}, http.StatusBadRequest)
+		return
+	case utf8.RuneCountInString(request.Reason) > maxAdjustmentReason:
+		JSONResponse(w, ResponseBody{Error: fmt.Sprintf("причина длиннее %d символов", maxAdjustmentReason)}, http.StatusBadRequest)
+		return
+	case request.Void == (request.Accrual != nil):
+		JSONResponse(w, ResponseBody{Error: "укажите либо новое начисление accrual, либо void"}, http.StatusBadRequest)
+		return
+	case request.Accrual != nil && *request.Accrual < 0:
+		JSONResponse(w, ResponseBody{Error: "начисление не может быть отрицательным"}, http.StatusBadRequest)
+		return
+	}
+
+	var accrual float64
+	if request.Accrual != nil {
+		accrual = *request.Accrual
+	}
+
+	adjustment, err := s.storage.AdjustOrder(r.Context(), chi.URLParam(r, "number"), accrual, request.Reason)
+	switch {
+	case errors.Is(err, my_errors.ErrNotFound):
+		JSONResponse(w, ResponseBody{Error: "заказ не найден"}, http.StatusNotFound)
+		return
+	case errors.Is(err, my_errors.ErrOrderState):
+		JSONResponse(w, ResponseBody{Error: err.Error()}, http.StatusConflict)
+		return
+	case err != nil:
+		respBody := ResponseBody{Error: fmt.Sprintf("внутренняя ошибка сервера: %v", err.Error())}
+		JSONResponse(w, respBody, http.StatusInternalServerError)
+		return
+	}
+
+	JSONResponse(w, adjustment, http.StatusOK)
+}
+
+// история корректировок начисления по заказу
+func (s *Server) adminOrderAdjustments(w http.ResponseWriter, r *http.Request) {
+	// Возможные коды ответа:
+	// 200 — успешная обработка запроса;
+	// 204 — корректировок не было;
+	// 401 — пользователь не аутентифицирован;
+	// 403 — пользователь не администратор;
+	// 500 — внутренняя ошибка сервера.
+
+	adjustments, err := s.storage.GetAdjustments(r.Context(), chi.URLParam(r, "number"))
+	if err != nil {
+		respBody := ResponseBody{Error: fmt.Sprintf("внутренняя ошибка сервера: %v", err.Error())}
+		JSONResponse(w, respBody, http.StatusInternalServerError)
+		return
+	}
+
+	if len(*adjustments) == 0 {
+		respBody := ResponseBody{Success: "нет данных для ответа"}
+		JSONResponse(w, respBody, http.StatusNoContent)
+		return
+	}
+
+	JSONResponse(w, adjustments, http.StatusOK)
+}
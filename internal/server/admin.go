@@ -0,0 +1,23 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/go-chi/jwtauth/v5"
+)
+
+// пропускает только администраторов. Ставится после jwtauth.Authenticator
+func (s *Server) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, claims, _ := jwtauth.FromContext(r.Context())
+		login, _ := claims["user_id"].(string)
+
+		if !s.Admins[login] {
+			respBody := ResponseBody{Error: "доступно только администраторам"}
+			JSONResponse(w, respBody, http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,232 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/region23/praktikum-diplom/internal/campaigns"
+	my_errors "github.com/region23/praktikum-diplom/internal/errors"
+)
+
+// список акций
+func (s *Server) adminCampaigns(w http.ResponseWriter, r *http.Request) {
+	// Возможные коды ответа:
+	// 200 — успешная обработка запроса;
+	// 204 — акций нет;
+	// 401 — пользователь не аутентифицирован;
+	// 403 — пользователь не администратор;
+	// 500 — внутренняя ошибка сервера.
+
+	list, err := s.storage.GetCampaigns(r.Context())
+	if err != nil {
+		respBody := ResponseBody{Error: fmt.Sprintf("внутренняя ошибка сервера: %v", err.Error())}
+		JSONResponse(w, respBody, http.StatusInternalServerError)
+		return
+	}
+
+	if len(*list) == 0 {
+		respBody := ResponseBody{Success: "нет данных для ответа"}
+		JSONResponse(w, respBody, http.StatusNoContent)
+		return
+	}
+
+	JSONResponse(w, list, http.StatusOK)
+}
+
+// акция по номеру
+func (s *Server) adminCampaign(w http.ResponseWriter, r *http.Request) {
+	// Возможные коды ответа:
+	// 200 — успешная обработка запроса;
+	// 400 — неверный номер акции;
+	// 401 — пользователь не аутентифицирован;
+	// 403 — пользователь не администратор;
+	// 404 — акция не найдена;
+	// 500 — внутренняя ошибка сервера.
+
+	id, ok := campaignID(w, r)
+	if !ok {
+		return
+	}
+
+	campaign, err := s.storage.GetCampaign(r.Context(), id)
+	if err != nil {
+		campaignError(w, err)
+		return
+	}
+
+	JSONResponse(w, campaign, http.StatusOK)
+}
+
+// создание акции
+func (s *Server) adminCreateCampaign(w http.ResponseWriter, r *http.Request) {
+	// Возможные коды ответа:
+	// 201 — акция создана;
+	// 400 — неверный формат запроса или параметры акции;
+	// 401 — пользователь не аутентифицирован;
+	// 403 — пользователь не администратор;
+	// 500 — внутренняя ошибка сервера.
+
+	campaign, ok := decodeCampaign(w, r)
+	if !ok {
+		return
+	}
+
+	created, err := s.storage.CreateCampaign(r.Context(), campaign)
+	if err != nil {
+		campaignError(w, err)
+		return
+	}
+
+	JSONResponse(w, created, http.StatusCreated)
+}
+
+// изменение акции. Уже начисленные бонусы не пересчитываются
+func (s *Server) adminUpdateCampaign(w http.ResponseWriter, r *http.Request) {
+	// Возможные коды ответа:
+	// 200 — акция изменена;
+	// 400 — неверный формат запроса или параметры акции;
+	// 401 — пользователь не аутентифицирован;
+	// 403 — пользователь не администратор;
+	// 404 — акция не найдена;
+	// 500 — внутренняя ошибка сервера.
+
+	id, ok := campaignID(w, r)
+	if !ok {
+		return
+	}
+
+	campaign, ok := decodeCampaign(w, r)
+	if !ok {
+		return
+	}
+	campaign.ID = id
+
+	updated, err := s.storage.UpdateCampaign(r.Context(), campaign)
+	if err != nil {
+		campaignError(w, err)
+		return
+	}
+
+	JSONResponse(w, updated, http.StatusOK)
+}
+
+// удаление акции. Начисленные бонусы остаются у пользователей
+func (s *Server) adminDeleteCampaign(w http.ResponseWriter, r *http.Request) {
+	// Возможные коды ответа:
+	// 200 — акция удалена;
+	// 400 — неверный номер акции;
+	// 401 — пользователь не аутентифицирован;
+	// 403 — пользователь не администратор;
+	// 404 — акция не найдена;
+	// 500 — внутренняя ошибка сервера.
+
+	id, ok := campaignID(w, r)
+	if !ok {
+		return
+	}
+
+	err := s.storage.DeleteCampaign(r.Context(), id)
+	if err != nil {
+		campaignError(w, err)
+		return
+	}
+
+	respBody := ResponseBody{Success: "акция удалена"}
+	JSONResponse(w, respBody, http.StatusOK)
+}
+
+// проверка акции из тела запроса на истории заказов, без сохранения
+func (s *Server) adminDryRunCampaign(w http.ResponseWriter, r *http.Request) {
+	// Возможные коды ответа:
+	// 200 — успешная обработка запроса;
+	// 400 — неверный формат запроса или параметры акции;
+	// 401 — пользователь не аутентифицирован;
+	// 403 — пользователь не администратор;
+	// 500 — внутренняя ошибка сервера.
+
+	campaign, ok := decodeCampaign(w, r)
+	if !ok {
+		return
+	}
+
+	s.dryRun(w, r, campaign)
+}
+
+// проверка сохранённой акции на истории заказов
+func (s *Server) adminDryRunStoredCampaign(w http.ResponseWriter, r *http.Request) {
+	// Возможные коды ответа:
+	// 200 — успешная обработка запроса;
+	// 400 — неверный номер акции;
+	// 401 — пользователь не аутентифицирован;
+	// 403 — пользователь не администратор;
+	// 404 — акция не найдена;
+	// 500 — внутренняя ошибка сервера.
+
+	id, ok := campaignID(w, r)
+	if !ok {
+		return
+	}
+
+	campaign, err := s.storage.GetCampaign(r.Context(), id)
+	if err != nil {
+		campaignError(w, err)
+		return
+	}
+
+	s.dryRun(w, r, *campaign)
+}
+
+func (s *Server) dryRun(w http.ResponseWriter, r *http.Request, campaign campaigns.Campaign) {
+	result, err := s.storage.DryRunCampaign(r.Context(), campaign)
+	if err != nil {
+		respBody := ResponseBody{Error: fmt.Sprintf("внутренняя ошибка сервера: %v", err.Error())}
+		JSONResponse(w, respBody, http.StatusInternalServerError)
+		return
+	}
+
+	JSONResponse(w, result, http.StatusOK)
+}
+
+func campaignID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil || id < 1 {
+		respBody := ResponseBody{Error: "номер акции должен быть положительным числом"}
+		JSONResponse(w, respBody, http.StatusBadRequest)
+		return 0, false
+	}
+
+	return id, true
+}
+
+func decodeCampaign(w http.ResponseWriter, r *http.Request) (campaigns.Campaign, bool) {
+	var campaign campaigns.Campaign
+	err := json.NewDecoder(r.Body).Decode(&campaign)
+	if err != nil {
+		respBody := ResponseBody{Error: fmt.Sprint("Decode error! please check your JSON formating.", err.Error())}
+		JSONResponse(w, respBody, http.StatusBadRequest)
+		return campaign, false
+	}
+
+	if err := campaign.Validate(); err != nil {
+		respBody := ResponseBody{Error: err.Error()}
+		JSONResponse(w, respBody, http.StatusBadRequest)
+		return campaign, false
+	}
+
+	return campaign, true
+}
+
+func campaignError(w http.ResponseWriter, err error) {
+	if errors.Is(err, my_errors.ErrNotFound) {
+		respBody := ResponseBody{Error: "акция не найдена"}
+		JSONResponse(w, respBody, http.StatusNotFound)
+		return
+	}
+
+	respBody := ResponseBody{Error: fmt.Sprintf("внутренняя ошибка сервера: %v", err.Error())}
+	JSONResponse(w, respBody, http.StatusInternalServerError)
+}
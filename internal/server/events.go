@@ -0,0 +1,116 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/region23/praktikum-diplom/internal/logging"
+	"github.com/region23/praktikum-diplom/internal/storage"
+)
+
+// как часто отправлять комментарий-пинг, чтобы прокси не закрывали простаивающее соединение
+const sseKeepAlive = 15 * time.Second
+
+// поток событий по заказам и списаниям пользователя в формате Server-Sent Events
+func (s *Server) userOrdersEvents(w http.ResponseWriter, r *http.Request) {
+	// Возможные коды ответа:
+	// 200 — поток событий открыт;
+	// 400 — неверный формат Last-Event-ID;
+	// 401 — пользователь не аутентифицирован;
+	// 500 — внутренняя ошибка сервера.
+
+	_, claims, err := jwtauth.FromContext(r.Context())
+	if err != nil {
+		respBody := ResponseBody{Error: fmt.Sprintf("внутренняя ошибка сервера: %v", err.Error())}
+		JSONResponse(w, respBody, http.StatusInternalServerError)
+		return
+	}
+
+	currentLogin, _ := claims["user_id"].(string)
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		respBody := ResponseBody{Error: "внутренняя ошибка сервера: потоковая передача не поддерживается"}
+		JSONResponse(w, respBody, http.StatusInternalServerError)
+		return
+	}
+
+	var lastEventID int64
+	if header := r.Header.Get("Last-Event-ID"); header != "" {
+		lastEventID, err = strconv.ParseInt(header, 10, 64)
+		if err != nil {
+			respBody := ResponseBody{Error: "неверный формат Last-Event-ID"}
+			JSONResponse(w, respBody, http.StatusBadRequest)
+			return
+		}
+	}
+
+	// подписываемся до чтения истории, чтобы не потерять события,
+	// возникшие между выборкой из базы и началом трансляции
+	eventsCh, unsubscribe := s.broker.Subscribe(currentLogin)
+	defer unsubscribe()
+
+	var missed *[]storage.Event
+	if lastEventID > 0 {
+		missed, err = s.storage.GetEventsAfter(r.Context(), currentLogin, lastEventID)
+		if err != nil {
+			respBody := ResponseBody{Error: fmt.Sprintf("внутренняя ошибка сервера: %v", err.Error())}
+			JSONResponse(w, respBody, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if missed != nil {
+		for _, event := range *missed {
+			if err := writeSSE(w, event); err != nil {
+				return
+			}
+			lastEventID = event.ID
+		}
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(sseKeepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case event, ok := <-eventsCh:
+			if !ok {
+				// брокер отключил нас из-за переполнения буфера — клиент переподключится с Last-Event-ID
+				logging.FromContext(r.Context()).Debug().Msg("SSE подписчик отключён: не успевает читать события")
+				return
+			}
+			// событие уже отправлено из истории
+			if event.ID <= lastEventID {
+				continue
+			}
+			if err := writeSSE(w, event); err != nil {
+				return
+			}
+			lastEventID = event.ID
+			flusher.Flush()
+		}
+	}
+}
+
+func writeSSE(w http.ResponseWriter, event storage.Event) error {
+	_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, event.Payload)
+	return err
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/region23/praktikum-diplom/internal/storage"
+)
+
+// заголовок с API-ключом магазина
+const merchantKeyHeader = "X-API-Key"
+
+type merchantKey struct{}
+
+// название магазина, чей API-ключ предъявлен в запросе; пусто — запрос не от магазина
+func merchantFromContext(ctx context.Context) string {
+	merchant, _ := ctx.Value(merchantKey{}).(string)
+	return merchant
+}
+
+// пропускает запросы с API-ключом магазина и записывает магазин исполнителем
+// действия для журнала аудита
+func (s *Server) requireMerchant(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(merchantKeyHeader)
+
+		var merchant string
+		for name, merchantKey := range s.MerchantKeys {
+			if key != "" && subtle.ConstantTimeCompare([]byte(key), []byte(merchantKey)) == 1 {
+				merchant = name
+			}
+		}
+
+		if merchant == "" {
+			respBody := ResponseBody{Error: "неверный API-ключ"}
+			JSONResponse(w, respBody, http.StatusUnauthorized)
+			return
+		}
+
+		actor := storage.ActorFromContext(r.Context())
+		actor.Name = "merchant:" + merchant
+		ctx := context.WithValue(r.Context(), merchantKey{}, merchant)
+		next.ServeHTTP(w, r.WithContext(storage.WithActor(ctx, actor)))
+	})
+}
+
+// проверка клиентского сертификата на партнёрских маршрутах, если она включена
+func (s *Server) partnerTLS(next http.Handler) http.Handler {
+	if !s.RequireClientCert {
+		return next
+	}
+
+	return requireClientCert(next)
+}
+
+// Пропускает только запросы по соединению с проверенным клиентским сертификатом.
+// В режиме optional сертификат проверяется, лишь если клиент его предъявил,
+// поэтому обязательность для партнёрских маршрутов проверяется здесь
+func requireClientCert(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			respBody := ResponseBody{Error: "нужен действительный клиентский сертификат"}
+			JSONResponse(w, respBody, http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
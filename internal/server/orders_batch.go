@@ -0,0 +1,221 @@
+package server
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/region23/praktikum-diplom/internal/storage"
+)
+
+// размер пакета заказов по умолчанию
+const DefaultBatchMaxSize = 1000
+
+// сколько байт тела приходится на один номер: сам номер, кавычки, разделители и пробелы
+const batchBytesPerNumber = storage.MaxOrderNumberLength + 16
+
+var errBatchTooLarge = errors.New("слишком много номеров заказов в пакете")
+
+// запись пакета заказов; в тестах подменяется
+type batchRepository interface {
+	AddOrdersBatch(ctx context.Context, login string, numbers []string) (map[string]storage.BatchResult, error)
+}
+
+type BatchItem struct {
+	Number string              `json:"number"` // номер заказа
+	Result storage.BatchResult `json:"result"` // результат обработки
+}
+
+// пакетная загрузка номеров заказов в формате CSV или JSON-массива
+func (s *Server) postUserOrdersBatch(w http.ResponseWriter, r *http.Request) {
+	// Возможные коды ответа:
+	// 200 — пакет обработан, результат по каждому номеру в теле ответа;
+	// 400 — неверный формат запроса;
+	// 401 — пользователь не аутентифицирован;
+	// 413 — в пакете больше номеров, чем разрешено, или слишком большое тело запроса;
+	// 415 — неподдерживаемый Content-Type;
+	// 429 — превышено ограничение частоты запросов;
+	// 500 — внутренняя ошибка сервера.
+
+	_, claims, err := jwtauth.FromContext(r.Context())
+	if err != nil {
+		respBody := ResponseBody{Error: fmt.Sprintf("внутренняя ошибка сервера: %v", err.Error())}
+		JSONResponse(w, respBody, http.StatusInternalServerError)
+		return
+	}
+
+	currentLogin, _ := claims["user_id"].(string)
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		respBody := ResponseBody{Error: "не указан Content-Type: ожидается text/csv или application/json"}
+		JSONResponse(w, respBody, http.StatusUnsupportedMediaType)
+		return
+	}
+
+	// тело не может быть больше, чем BatchMaxSize номеров максимальной длины
+	body := http.MaxBytesReader(w, r.Body, int64(s.BatchMaxSize+1)*batchBytesPerNumber)
+
+	var numbers []string
+	switch mediaType {
+	case "text/csv":
+		numbers, err = parseCSVNumbers(body, s.BatchMaxSize)
+	case "application/json":
+		numbers, err = parseJSONNumbers(body, s.BatchMaxSize)
+	default:
+		respBody := ResponseBody{Error: fmt.Sprintf("неподдерживаемый Content-Type %q: ожидается text/csv или application/json", mediaType)}
+		JSONResponse(w, respBody, http.StatusUnsupportedMediaType)
+		return
+	}
+
+	if errors.Is(err, errBatchTooLarge) {
+		respBody := ResponseBody{Error: fmt.Sprintf("%v: не больше %d", err.Error(), s.BatchMaxSize)}
+		JSONResponse(w, respBody, http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		respBody := ResponseBody{Error: "слишком большое тело запроса"}
+		JSONResponse(w, respBody, http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if err != nil {
+		respBody := ResponseBody{Error: fmt.Sprintf("неверный формат запроса: %v", err.Error())}
+		JSONResponse(w, respBody, http.StatusBadRequest)
+		return
+	}
+
+	if len(numbers) == 0 {
+		respBody := ResponseBody{Error: "неверный формат запроса: пакет не содержит номеров заказов"}
+		JSONResponse(w, respBody, http.StatusBadRequest)
+		return
+	}
+
+	items := make([]BatchItem, len(numbers))
+	seen := make(map[string]bool, len(numbers))
+	var valid []string
+
+	for i, number := range numbers {
+		items[i].Number = number
+		if !storage.ValidOrderNumber(number) {
+			items[i].Result = storage.BatchInvalid
+			continue
+		}
+
+		if !seen[number] {
+			seen[number] = true
+			valid = append(valid, number)
+		}
+	}
+
+	var results map[string]storage.BatchResult
+	if len(valid) > 0 {
+		results, err = s.batches.AddOrdersBatch(r.Context(), currentLogin, valid)
+		if err != nil {
+			respBody := ResponseBody{Error: fmt.Sprintf("при загрузке заказов произошла ошибка: %v", err.Error())}
+			JSONResponse(w, respBody, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// повторы номера внутри пакета получают already_yours, если первый был принят
+	reported := make(map[string]bool, len(valid))
+	for i := range items {
+		if items[i].Result == storage.BatchInvalid {
+			continue
+		}
+
+		number := items[i].Number
+		items[i].Result = results[number]
+		if reported[number] && items[i].Result == storage.BatchAccepted {
+			items[i].Result = storage.BatchAlreadyYours
+		}
+		reported[number] = true
+	}
+
+	JSONResponse(w, items, http.StatusOK)
+}
+
+// номера заказов из первой колонки CSV. Строка заголовка допускается
+func parseCSVNumbers(body io.Reader, maxSize int) ([]string, error) {
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	var numbers []string
+	for line := 0; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		number := strings.TrimSpace(record[0])
+		if number == "" {
+			continue
+		}
+		if line == 0 && strings.EqualFold(number, "number") {
+			continue
+		}
+
+		if len(numbers) == maxSize {
+			return nil, errBatchTooLarge
+		}
+		numbers = append(numbers, number)
+	}
+
+	return numbers, nil
+}
+
+// номера заказов из JSON-массива строк или чисел. Массив читается по элементам,
+// чтобы не разбирать пакет целиком, если номеров больше maxSize
+func parseJSONNumbers(body io.Reader, maxSize int) ([]string, error) {
+	decoder := json.NewDecoder(body)
+	decoder.UseNumber()
+
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return nil, errors.New("ожидается JSON-массив номеров заказов")
+	}
+
+	var numbers []string
+	for i := 0; decoder.More(); i++ {
+		if len(numbers) == maxSize {
+			return nil, errBatchTooLarge
+		}
+
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		switch v := token.(type) {
+		case string:
+			numbers = append(numbers, strings.TrimSpace(v))
+		case json.Number:
+			numbers = append(numbers, v.String())
+		default:
+			return nil, fmt.Errorf("элемент %d: номер заказа должен быть строкой или числом", i)
+		}
+	}
+
+	if _, err := decoder.Token(); err != nil {
+		return nil, err
+	}
+
+	return numbers, nil
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/region23/praktikum-diplom/internal/events"
+	"github.com/region23/praktikum-diplom/internal/storage"
+)
+
+// запоминает переданные номера; номера из conflicts уже загружены другим пользователем
+type fakeBatches struct {
+	conflicts map[string]bool
+	got       []string
+}
+
+func (f *fakeBatches) AddOrdersBatch(ctx context.Context, login string, numbers []string) (map[string]storage.BatchResult, error) {
+	f.got = append(f.got, numbers...)
+
+	results := make(map[string]storage.BatchResult, len(numbers))
+	for _, number := range numbers {
+		results[number] = storage.BatchAccepted
+		if f.conflicts[number] {
+			results[number] = storage.BatchConflict
+		}
+	}
+	return results, nil
+}
+
+func TestPostUserOrdersBatch(t *testing.T) {
+	// проходит проверку Луна, но не помещается в колонку orders.number
+	long := strings.Repeat("0", storage.MaxOrderNumberLength-10) + "79927398713"
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        int
+		wantItems   []BatchItem
+		wantStored  []string
+	}{
+		{
+			name:        "CSV с заголовком",
+			contentType: "text/csv",
+			body:        "number,comment\n79927398713,первый\n12345678903\n",
+			want:        http.StatusOK,
+			wantItems:   []BatchItem{{"79927398713", storage.BatchAccepted}, {"12345678903", storage.BatchAccepted}},
+			wantStored:  []string{"79927398713", "12345678903"},
+		},
+		{
+			name:        "CSV без заголовка",
+			contentType: "text/csv; charset=utf-8",
+			body:        "79927398713\n\n1234\n2377225624\n",
+			want:        http.StatusOK,
+			wantItems: []BatchItem{
+				{"79927398713", storage.BatchAccepted}, {"1234", storage.BatchInvalid}, {"2377225624", storage.BatchConflict},
+			},
+			wantStored: []string{"79927398713", "2377225624"},
+		},
+		{
+			name:        "JSON из строк и чисел",
+			contentType: "application/json",
+			body:        `["79927398713", 12345678903, " 4561261212345467 "]`,
+			want:        http.StatusOK,
+			wantItems: []BatchItem{
+				{"79927398713", storage.BatchAccepted}, {"12345678903", storage.BatchAccepted}, {"4561261212345467", storage.BatchAccepted},
+			},
+			wantStored: []string{"79927398713", "12345678903", "4561261212345467"},
+		},
+		{
+			name:        "повторы номера",
+			contentType: "application/json",
+			body:        `["79927398713", 79927398713, "2377225624", "2377225624"]`,
+			want:        http.StatusOK,
+			wantItems: []BatchItem{
+				{"79927398713", storage.BatchAccepted}, {"79927398713", storage.BatchAlreadyYours},
+				{"2377225624", storage.BatchConflict}, {"2377225624", storage.BatchConflict},
+			},
+			wantStored: []string{"79927398713", "2377225624"},
+		},
+		{
+			name:        "слишком длинный номер",
+			contentType: "application/json",
+			body:        `["` + long + `", "79927398713"]`,
+			want:        http.StatusOK,
+			wantItems:   []BatchItem{{long, storage.BatchInvalid}, {"79927398713", storage.BatchAccepted}},
+			wantStored:  []string{"79927398713"},
+		},
+		{
+			name:        "в CSV больше номеров, чем разрешено",
+			contentType: "text/csv",
+			body:        "79927398713\n12345678903\n2377225624\n4561261212345467\n49927398716\n",
+			want:        http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:        "в JSON больше номеров, чем разрешено",
+			contentType: "application/json",
+			// разбор останавливается раньше испорченного хвоста
+			body: `["79927398713", "12345678903", "2377225624", "4561261212345467", "49927398716", {`,
+			want: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:        "слишком большое тело",
+			contentType: "application/json",
+			body:        `["` + strings.Repeat("1", 5*batchBytesPerNumber) + `"]`,
+			want:        http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:        "не массив",
+			contentType: "application/json",
+			body:        `{"number": "79927398713"}`,
+			want:        http.StatusBadRequest,
+		},
+		{
+			name:        "элемент не строка и не число",
+			contentType: "application/json",
+			body:        `["79927398713", ["12345678903"]]`,
+			want:        http.StatusBadRequest,
+		},
+		{
+			name:        "пустой пакет",
+			contentType: "text/csv",
+			body:        "number\n",
+			want:        http.StatusBadRequest,
+		},
+		{
+			name:        "неизвестный Content-Type",
+			contentType: "text/plain",
+			body:        "79927398713",
+			want:        http.StatusUnsupportedMediaType,
+		},
+	}
+	for _, tt := range tests {
+		srv := New(storage.Database{}, jwtauth.New("HS256", []byte("test-secret"), nil), events.NewBroker())
+		srv.BatchMaxSize = 4
+		fake := &fakeBatches{conflicts: map[string]bool{"2377225624": true}}
+		srv.batches = fake
+		srv.MountHandlers()
+
+		_, token, err := srv.TokenAuth.Encode(map[string]interface{}{"user_id": "alice"})
+		if err != nil {
+			t.Fatalf("Encode: %v", err)
+		}
+
+		r := httptest.NewRequest(http.MethodPost, "/api/user/orders/batch", strings.NewReader(tt.body))
+		r.Header.Set("Authorization", "Bearer "+token)
+		r.Header.Set("Content-Type", tt.contentType)
+		w := httptest.NewRecorder()
+		srv.Router.ServeHTTP(w, r)
+
+		if w.Code != tt.want {
+			t.Errorf("%s: код %d, ожидали %d: %s", tt.name, w.Code, tt.want, w.Body)
+			continue
+		}
+		if !reflect.DeepEqual(fake.got, tt.wantStored) {
+			t.Errorf("%s: записаны номера %v, ожидали %v", tt.name, fake.got, tt.wantStored)
+		}
+		if tt.want != http.StatusOK {
+			continue
+		}
+
+		var items []BatchItem
+		if err := json.Unmarshal(w.Body.Bytes(), &items); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(items, tt.wantItems) {
+			t.Errorf("%s: ответ %v, ожидали %v", tt.name, items, tt.wantItems)
+		}
+	}
+}
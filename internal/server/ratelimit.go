@@ -0,0 +1,126 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/region23/praktikum-diplom/internal/logging"
+	"github.com/region23/praktikum-diplom/internal/metrics"
+	"github.com/region23/praktikum-diplom/internal/ratelimit"
+)
+
+// RateLimits — ограничения частоты запросов по группам маршрутов
+type RateLimits struct {
+	// где хранятся счётчики; nil — ограничения выключены
+	Store ratelimit.Store
+	// брать адрес клиента из X-Forwarded-For / X-Real-IP. Включать только
+	// за балансировщиком, который сам выставляет эти заголовки
+	TrustProxy bool
+	// свои балансировщики: их адреса пропускаются при разборе X-Forwarded-For
+	TrustedProxies []netip.Prefix
+
+	Auth     ratelimit.Policy // регистрация и вход
+	Orders   ratelimit.Policy // загрузка заказов
+	Withdraw ratelimit.Policy // списание баллов
+	Reads    ratelimit.Policy // чтение заказов, баланса, списаний и выписки
+}
+
+// ограничивает частоту запросов по политике. Клиент определяется по логину,
+// если запрос аутентифицирован, иначе по IP-адресу
+func (s *Server) rateLimit(policy ratelimit.Policy) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if s.RateLimits.Store == nil || !policy.Enabled() {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			identity := "ip:" + s.clientIP(r)
+			if _, claims, err := jwtauth.FromContext(r.Context()); err == nil {
+				if login, ok := claims["user_id"].(string); ok && login != "" {
+					identity = "user:" + login
+				}
+			}
+
+			result, err := ratelimit.Allow(r.Context(), s.RateLimits.Store, policy, identity)
+			if err != nil {
+				// хранилище счётчиков недоступно — лучше пропустить запрос, чем отказать всем
+				logging.FromContext(r.Context()).Warn().Err(err).Str("policy", policy.Name).Msg("Не смогли проверить ограничение частоты запросов")
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			resetIn := int(time.Until(result.Reset).Seconds() + 0.999)
+			if resetIn < 0 {
+				resetIn = 0
+			}
+
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+			w.Header().Set("RateLimit-Reset", strconv.Itoa(resetIn))
+			w.Header().Set("RateLimit-Policy", policy.String())
+
+			if !result.Allowed {
+				metrics.IncRateLimited(policy.Name)
+				w.Header().Set("Retry-After", strconv.Itoa(resetIn))
+				respBody := ResponseBody{Error: "слишком много запросов, повторите позже"}
+				JSONResponse(w, respBody, http.StatusTooManyRequests)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Адрес клиента для ограничения частоты запросов и журнала аудита.
+// Начало X-Forwarded-For присылает сам клиент, а балансировщики дописывают адреса
+// в конец, поэтому список читается справа: первый адрес не из TrustedProxies
+// и есть адрес, с которого пришёл запрос
+func (s *Server) clientIP(r *http.Request) string {
+	if s.RateLimits.TrustProxy {
+		var forwarded []string
+		for _, value := range r.Header.Values("X-Forwarded-For") {
+			for _, addr := range strings.Split(value, ",") {
+				if addr = strings.TrimSpace(addr); addr != "" {
+					forwarded = append(forwarded, addr)
+				}
+			}
+		}
+		for i := len(forwarded) - 1; i >= 0; i-- {
+			if i == 0 || !s.trustedProxy(forwarded[i]) {
+				return forwarded[i]
+			}
+		}
+		if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+			return realIP
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+func (s *Server) trustedProxy(addr string) bool {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap()
+
+	for _, prefix := range s.RateLimits.TrustedProxies {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/region23/praktikum-diplom/internal/events"
+	"github.com/region23/praktikum-diplom/internal/ratelimit"
+	"github.com/region23/praktikum-diplom/internal/storage"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("192.0.2.1/32")}
+
+	tests := []struct {
+		name       string
+		trustProxy bool
+		trusted    []netip.Prefix
+		forwarded  []string
+		realIP     string
+		want       string
+	}{
+		{name: "без прокси заголовки игнорируются", forwarded: []string{"1.1.1.1"}, realIP: "2.2.2.2", want: "203.0.113.7"},
+		{name: "адрес соединения", trustProxy: true, want: "203.0.113.7"},
+		{name: "один адрес", trustProxy: true, forwarded: []string{"1.1.1.1"}, want: "1.1.1.1"},
+		// клиент подставил свой адрес в начало, балансировщик дописал настоящий
+		{name: "подделанное начало", trustProxy: true, forwarded: []string{"6.6.6.6, 1.1.1.1"}, want: "1.1.1.1"},
+		{name: "свои балансировщики пропускаются", trustProxy: true, trusted: trusted,
+			forwarded: []string{"6.6.6.6, 1.1.1.1, 10.1.2.3, 192.0.2.1"}, want: "1.1.1.1"},
+		{name: "несколько заголовков", trustProxy: true, trusted: trusted,
+			forwarded: []string{"6.6.6.6", "1.1.1.1, 10.0.0.1"}, want: "1.1.1.1"},
+		{name: "все адреса свои", trustProxy: true, trusted: trusted, forwarded: []string{"10.0.0.2, 10.0.0.1"}, want: "10.0.0.2"},
+		{name: "пустые элементы", trustProxy: true, forwarded: []string{"1.1.1.1, ,"}, want: "1.1.1.1"},
+		{name: "X-Real-IP", trustProxy: true, realIP: "2.2.2.2", want: "2.2.2.2"},
+	}
+	for _, tt := range tests {
+		s := &Server{RateLimits: RateLimits{TrustProxy: tt.trustProxy, TrustedProxies: tt.trusted}}
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = "203.0.113.7:51234"
+		for _, value := range tt.forwarded {
+			r.Header.Add("X-Forwarded-For", value)
+		}
+		if tt.realIP != "" {
+			r.Header.Set("X-Real-IP", tt.realIP)
+		}
+
+		if got := s.clientIP(r); got != tt.want {
+			t.Errorf("%s: clientIP = %q, ожидали %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	srv := New(storage.Database{}, jwtauth.New("HS256", []byte("test-secret"), nil), events.NewBroker())
+	srv.RateLimits = RateLimits{
+		Store:      ratelimit.NewMemoryStore(),
+		TrustProxy: true,
+		Auth:       ratelimit.Policy{Name: "auth", Limit: 2, Window: time.Hour},
+	}
+	handler := srv.rateLimit(srv.RateLimits.Auth)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	request := func(forwarded string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/api/user/login", nil)
+		r.Header.Set("X-Forwarded-For", forwarded)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	for i, remaining := range []string{"1", "0"} {
+		w := request("1.1.1.1")
+		if w.Code != http.StatusOK {
+			t.Fatalf("запрос %d: %d", i+1, w.Code)
+		}
+		if got := w.Header().Get("RateLimit-Remaining"); got != remaining {
+			t.Errorf("запрос %d: RateLimit-Remaining %q, ожидали %q", i+1, got, remaining)
+		}
+		if got := w.Header().Get("RateLimit-Limit"); got != "2" {
+			t.Errorf("запрос %d: RateLimit-Limit %q", i+1, got)
+		}
+		if got := w.Header().Get("RateLimit-Policy"); got != "2;w=3600" {
+			t.Errorf("запрос %d: RateLimit-Policy %q", i+1, got)
+		}
+		if w.Header().Get("Retry-After") != "" {
+			t.Errorf("запрос %d: Retry-After в разрешённом ответе", i+1)
+		}
+	}
+
+	// подмена начала X-Forwarded-For не даёт обойти лимит
+	w := request("9.9.9.9, 1.1.1.1")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("третий запрос: %d, ожидали 429", w.Code)
+	}
+
+	reset, err := strconv.Atoi(w.Header().Get("RateLimit-Reset"))
+	if err != nil || reset < 1 || reset > 3600 {
+		t.Fatalf("RateLimit-Reset %q", w.Header().Get("RateLimit-Reset"))
+	}
+	if got := w.Header().Get("Retry-After"); got != strconv.Itoa(reset) {
+		t.Fatalf("Retry-After %q, ожидали %d", got, reset)
+	}
+
+	// другой клиент за тем же балансировщиком не затронут
+	if w := request("2.2.2.2"); w.Code != http.StatusOK {
+		t.Fatalf("запрос другого клиента: %d", w.Code)
+	}
+}
@@ -0,0 +1,27 @@
+package server
+
+import (
+	"net"
+	"net/http"
+)
+
+// RedirectToHTTPS отправляет запросы, пришедшие по HTTP, на тот же путь по HTTPS.
+// httpsAddress — адрес, который слушает HTTPS-сервер; из него берётся порт
+func RedirectToHTTPS(httpsAddress string) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddress)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+
+		target := "https://" + host + r.URL.RequestURI()
+
+		// 308 сохраняет метод и тело: POST с паролем не превратится в GET
+		http.Redirect(w, r, target, http.StatusPermanentRedirect)
+	})
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/jwtauth/v5"
+)
+
+// реферальный код пользователя и приглашённые им пользователи
+func (s *Server) userReferrals(w http.ResponseWriter, r *http.Request) {
+	// Возможные коды ответа:
+	// 200 — успешная обработка запроса;
+	// 401 — пользователь не аутентифицирован;
+	// 429 — превышено ограничение частоты запросов;
+	// 500 — внутренняя ошибка сервера.
+
+	_, claims, err := jwtauth.FromContext(r.Context())
+	if err != nil {
+		respBody := ResponseBody{Error: fmt.Sprintf("внутренняя ошибка сервера: %v", err.Error())}
+		JSONResponse(w, respBody, http.StatusInternalServerError)
+		return
+	}
+
+	currentLogin, _ := claims["user_id"].(string)
+
+	referrals, err := s.storage.GetReferrals(r.Context(), currentLogin)
+	if err != nil {
+		respBody := ResponseBody{Error: fmt.Sprintf("внутренняя ошибка сервера: %v", err.Error())}
+		JSONResponse(w, respBody, http.StatusInternalServerError)
+		return
+	}
+
+	JSONResponse(w, referrals, http.StatusOK)
+}
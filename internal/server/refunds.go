@@ -0,0 +1,117 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	my_errors "github.com/region23/praktikum-diplom/internal/errors"
+)
+
+type refundRequest struct {
+	Amount float64 `json:"amount,omitempty"` // сколько вернуть; не задано — всё, что ещё не возвращено
+	Reason string  `json:"reason,omitempty"` // причина возврата
+}
+
+// подтверждение списания магазином
+func (s *Server) confirmWithdrawal(w http.ResponseWriter, r *http.Request) {
+	// Возможные коды ответа:
+	// 200 — списание подтверждено;
+	// 401 — не аутентифицирован или неверный API-ключ магазина;
+	// 403 — пользователь не администратор;
+	// 404 — списание не найдено или оплачено в другом магазине;
+	// 409 — списание уже подтверждено или отменено;
+	// 500 — внутренняя ошибка сервера.
+
+	// магазину доступны только списания в счёт его заказов, администратору — все
+	withdraw, err := s.storage.ConfirmWithdrawal(r.Context(), chi.URLParam(r, "order"), merchantFromContext(r.Context()))
+	if err != nil {
+		withdrawalError(w, err)
+		return
+	}
+
+	JSONResponse(w, withdraw, http.StatusOK)
+}
+
+// отмена списания: пользователю возвращаются все ещё не возвращённые баллы
+func (s *Server) cancelWithdrawal(w http.ResponseWriter, r *http.Request) {
+	// Возможные коды ответа:
+	// 200 — списание отменено, баллы возвращены;
+	// 400 — неверный формат запроса;
+	// 401 — не аутентифицирован или неверный API-ключ магазина;
+	// 403 — пользователь не администратор;
+	// 404 — списание не найдено или оплачено в другом магазине;
+	// 409 — списание уже отменено;
+	// 500 — внутренняя ошибка сервера.
+
+	request, ok := decodeRefund(w, r)
+	if !ok {
+		return
+	}
+
+	s.refund(w, r, 0, request.Reason)
+}
+
+// частичный возврат баллов по списанию
+func (s *Server) refundWithdrawal(w http.ResponseWriter, r *http.Request) {
+	// Возможные коды ответа:
+	// 200 — баллы возвращены;
+	// 400 — неверный формат запроса или сумма возврата;
+	// 401 — не аутентифицирован или неверный API-ключ магазина;
+	// 403 — пользователь не администратор;
+	// 404 — списание не найдено или оплачено в другом магазине;
+	// 409 — списание отменено или сумма больше невозвращённой;
+	// 500 — внутренняя ошибка сервера.
+
+	request, ok := decodeRefund(w, r)
+	if !ok {
+		return
+	}
+
+	if request.Amount <= 0 {
+		respBody := ResponseBody{Error: "сумма возврата должна быть положительной"}
+		JSONResponse(w, respBody, http.StatusBadRequest)
+		return
+	}
+
+	s.refund(w, r, request.Amount, request.Reason)
+}
+
+func (s *Server) refund(w http.ResponseWriter, r *http.Request, amount float64, reason string) {
+	withdraw, err := s.storage.RefundWithdrawal(r.Context(), chi.URLParam(r, "order"), merchantFromContext(r.Context()), amount, reason)
+	if err != nil {
+		withdrawalError(w, err)
+		return
+	}
+
+	JSONResponse(w, withdraw, http.StatusOK)
+}
+
+// тело запроса необязательно
+func decodeRefund(w http.ResponseWriter, r *http.Request) (refundRequest, bool) {
+	var request refundRequest
+
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil && !errors.Is(err, io.EOF) {
+		respBody := ResponseBody{Error: fmt.Sprint("Decode error! please check your JSON formating.", err.Error())}
+		JSONResponse(w, respBody, http.StatusBadRequest)
+		return request, false
+	}
+
+	return request, true
+}
+
+func withdrawalError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, my_errors.ErrNotFound):
+		JSONResponse(w, ResponseBody{Error: "списание не найдено"}, http.StatusNotFound)
+	case errors.Is(err, my_errors.ErrWithdrawalState):
+		JSONResponse(w, ResponseBody{Error: err.Error()}, http.StatusConflict)
+	default:
+		respBody := ResponseBody{Error: fmt.Sprintf("внутренняя ошибка сервера: %v", err.Error())}
+		JSONResponse(w, respBody, http.StatusInternalServerError)
+	}
+}
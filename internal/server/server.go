@@ -2,9 +2,11 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"sync"
 	"time"
 
 	"crypto/sha256"
@@ -14,61 +16,196 @@ import (
 	"github.com/go-chi/jwtauth/v5"
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
-	"github.com/joeljunstrom/go-luhn"
 	my_errors "github.com/region23/praktikum-diplom/internal/errors"
+	"github.com/region23/praktikum-diplom/internal/events"
+	"github.com/region23/praktikum-diplom/internal/health"
+	"github.com/region23/praktikum-diplom/internal/logging"
+	"github.com/region23/praktikum-diplom/internal/metrics"
 	"github.com/region23/praktikum-diplom/internal/storage"
-	"github.com/rs/zerolog/log"
+	"github.com/region23/praktikum-diplom/internal/tracing"
 )
 
+// время на обработку запроса по умолчанию
+const DefaultRequestTimeout = 60 * time.Second
+
 type Server struct {
 	storage   storage.Database
+	batches   batchRepository
+	accruals  accrualRepository
+	balances  balanceReader
 	Router    *chi.Mux
 	DBPool    *pgxpool.Pool
 	TokenAuth *jwtauth.JWTAuth
+	broker    *events.Broker
+
+	// закрывается при остановке сервера; по нему завершаются соединения WebSocket
+	closing   chan struct{}
+	closeOnce sync.Once
+
+	// максимальное количество номеров в пакетной загрузке заказов
+	BatchMaxSize int
+	// время на обработку одного запроса, не считая потоковых маршрутов
+	RequestTimeout time.Duration
+	// ограничения частоты запросов; по умолчанию выключены
+	RateLimits RateLimits
+	// проверки живости и готовности; если не заданы, /healthz и /readyz не подключаются
+	Health *health.Checker
+	// логины администраторов, которым доступны маршруты /api/admin
+	Admins map[string]bool
+	// API-ключи магазинов для маршрутов /api/merchant: название магазина → ключ
+	MerchantKeys map[string]string
+	// секрет подписи результатов от системы начислений; пусто — /internal/accrual/callback не подключается
+	AccrualCallbackSecret string
+	// требовать проверенный клиентский сертификат на /api/merchant и /internal/accrual/callback
+	RequireClientCert bool
+	// сколько подписок на вебхуки может быть у одного владельца
+	WebhookMaxSubscriptions int
 }
 
-func New(storage storage.Database, tokenAuth *jwtauth.JWTAuth) *Server {
-	return &Server{
+func New(storage storage.Database, tokenAuth *jwtauth.JWTAuth, broker *events.Broker) *Server {
+	s := &Server{
 		storage:   storage,
 		Router:    chi.NewRouter(),
 		TokenAuth: tokenAuth,
+		broker:    broker,
+		closing:   make(chan struct{}),
+
+		BatchMaxSize:            DefaultBatchMaxSize,
+		RequestTimeout:          DefaultRequestTimeout,
+		WebhookMaxSubscriptions: DefaultWebhookMaxSubscriptions,
 	}
+	s.batches = &s.storage
+	s.accruals = &s.storage
+	s.balances = &s.storage
+
+	return s
+}
+
+// CloseWebSockets закрывает соединения WebSocket. http.Server.Shutdown не ждёт
+// перехваченные соединения и не закрывает их, поэтому метод регистрируется
+// через RegisterOnShutdown
+func (s *Server) CloseWebSockets() {
+	s.closeOnce.Do(func() { close(s.closing) })
 }
 
 func (s *Server) MountHandlers() {
 	// Mount all Middleware here
-	s.Router.Use(middleware.Logger)
+	s.Router.Use(tracing.Middleware)
+	s.Router.Use(metrics.Middleware)
+	s.Router.Use(middleware.RequestID)
+	s.Router.Use(logging.AccessLog)
+	s.Router.Use(s.auditActor)
 	s.Router.Use(middleware.StripSlashes)
 	s.Router.Use(middleware.Compress(5))
 	s.Router.Use(middleware.Recoverer)
 
-	// Set a timeout value on the request context (ctx), that will signal
-	// through ctx.Done() that the request has timed out and further
-	// processing should be stopped.
-	s.Router.Use(middleware.Timeout(60 * time.Second))
+	// Liveness and readiness probes for the load balancer
+	if s.Health != nil {
+		s.Router.Get("/healthz", s.Health.Liveness)
+		s.Router.Get("/readyz", s.Health.Readiness)
+	}
 
-	// Public routes
+	// Long-lived streaming routes and large downloads. They must not be limited
+	// by the request timeout below, otherwise every stream would be cut after a minute.
 	s.Router.Group(func(r chi.Router) {
-		r.Post("/api/user/register", s.userRegister)
-		r.Post("/api/user/login", s.userLogin)
+		// Browser EventSource and WebSocket clients can't set headers,
+		// so the token may also come from the "jwt" query parameter.
+		r.Use(jwtauth.Verify(s.TokenAuth, jwtauth.TokenFromHeader, jwtauth.TokenFromCookie, jwtauth.TokenFromQuery))
+		r.Use(jwtauth.Authenticator)
+		r.Use(logging.WithUser)
+		r.Use(auditUser)
+
+		r.Get("/api/user/orders/events", s.userOrdersEvents)
+		r.Get("/api/user/ws", s.userWebSocket)
+		r.With(s.rateLimit(s.RateLimits.Reads)).Get("/api/user/statement", s.userStatement)
 	})
 
 	s.Router.Group(func(r chi.Router) {
-		// Seek, verify and validate JWT tokens
-		r.Use(jwtauth.Verifier(s.TokenAuth))
-
-		// Handle valid / invalid tokens. In this example, we use
-		// the provided authenticator middleware, but you can write your
-		// own very easily, look at the Authenticator method in jwtauth.go
-		// and tweak it, its not scary.
-		r.Use(jwtauth.Authenticator)
+		// Set a timeout value on the request context (ctx), that will signal
+		// through ctx.Done() that the request has timed out and further
+		// processing should be stopped.
+		r.Use(middleware.Timeout(s.RequestTimeout))
+
+		// Public routes
+		r.Group(func(r chi.Router) {
+			r.With(s.rateLimit(s.RateLimits.Auth)).Post("/api/user/register", s.userRegister)
+			r.With(s.rateLimit(s.RateLimits.Auth)).Post("/api/user/login", s.userLogin)
+		})
+
+		// система начислений присылает результаты расчёта сама, не дожидаясь опроса
+		if s.AccrualCallbackSecret != "" {
+			r.With(s.partnerTLS).Post("/internal/accrual/callback", s.accrualCallback)
+		}
 
-		r.Post("/api/user/orders", s.postUserOrders)
-		r.Get("/api/user/orders", s.getUserOrders)
-		r.Get("/api/user/balance", s.getUserBalance)
-		r.Post("/api/user/balance/withdraw", s.userBalanceWithdraw)
-		r.Get("/api/user/balance/withdrawals", s.userBalanceWithdrawals)
-		r.Get("/api/user/withdrawals", s.userBalanceWithdrawals)
+		// магазины подтверждают и отменяют заказы, оплаченные баллами
+		r.Route("/api/merchant", func(r chi.Router) {
+			r.Use(s.partnerTLS)
+			r.Use(s.requireMerchant)
+
+			r.Post("/withdrawals/{order}/confirm", s.confirmWithdrawal)
+			r.Post("/withdrawals/{order}/cancel", s.cancelWithdrawal)
+			r.Post("/withdrawals/{order}/refund", s.refundWithdrawal)
+
+			r.Route("/webhooks", s.webhookRoutes)
+		})
+
+		r.Group(func(r chi.Router) {
+			// Seek, verify and validate JWT tokens
+			r.Use(jwtauth.Verifier(s.TokenAuth))
+
+			// Handle valid / invalid tokens. In this example, we use
+			// the provided authenticator middleware, but you can write your
+			// own very easily, look at the Authenticator method in jwtauth.go
+			// and tweak it, its not scary.
+			r.Use(jwtauth.Authenticator)
+			r.Use(logging.WithUser)
+			r.Use(auditUser)
+
+			r.Group(func(r chi.Router) {
+				r.Use(s.rateLimit(s.RateLimits.Orders))
+				r.Post("/api/user/orders", s.postUserOrders)
+				r.Post("/api/user/orders/batch", s.postUserOrdersBatch)
+			})
+
+			r.With(s.rateLimit(s.RateLimits.Withdraw)).Post("/api/user/balance/withdraw", s.userBalanceWithdraw)
+			r.With(s.rateLimit(s.RateLimits.Withdraw)).Post("/api/user/balance/transfer", s.userBalanceTransfer)
+			r.With(s.rateLimit(s.RateLimits.Withdraw)).Post("/api/user/transfers/{id}/confirm", s.confirmTransfer)
+
+			r.Group(func(r chi.Router) {
+				r.Use(s.rateLimit(s.RateLimits.Reads))
+				r.Get("/api/user/orders", s.getUserOrders)
+				r.Get("/api/user/balance", s.getUserBalance)
+				r.Get("/api/user/balance/withdrawals", s.userBalanceWithdrawals)
+				r.Get("/api/user/withdrawals", s.userBalanceWithdrawals)
+				r.Get("/api/user/activity", s.userActivity)
+				r.Get("/api/user/tier", s.userTier)
+				r.Get("/api/user/referrals", s.userReferrals)
+				r.Get("/api/user/transfers", s.userTransfers)
+			})
+
+			r.Route("/api/user/webhooks", s.webhookRoutes)
+
+			r.Route("/api/admin", func(r chi.Router) {
+				r.Use(s.requireAdmin)
+
+				r.Handle("/metrics", metrics.Handler())
+
+				r.Get("/campaigns", s.adminCampaigns)
+				r.Post("/campaigns", s.adminCreateCampaign)
+				r.Post("/campaigns/dry-run", s.adminDryRunCampaign)
+				r.Get("/campaigns/{id}", s.adminCampaign)
+				r.Put("/campaigns/{id}", s.adminUpdateCampaign)
+				r.Delete("/campaigns/{id}", s.adminDeleteCampaign)
+				r.Post("/campaigns/{id}/dry-run", s.adminDryRunStoredCampaign)
+
+				r.Post("/withdrawals/{order}/confirm", s.confirmWithdrawal)
+				r.Post("/withdrawals/{order}/cancel", s.cancelWithdrawal)
+				r.Post("/withdrawals/{order}/refund", s.refundWithdrawal)
+
+				r.Get("/orders/{number}/adjustments", s.adminOrderAdjustments)
+				r.Post("/orders/{number}/adjust", s.adminAdjustOrder)
+			})
+		})
 	})
 }
 
@@ -76,8 +213,9 @@ func (s *Server) MountHandlers() {
 func (s *Server) userRegister(w http.ResponseWriter, r *http.Request) {
 	// Возможные коды ответа:
 	// 200 — пользователь успешно зарегистрирован и аутентифицирован;
-	// 400 — неверный формат запроса;
+	// 400 — неверный формат запроса или неизвестный реферальный код;
 	// 409 — логин уже занят;
+	// 429 — превышено ограничение частоты запросов;
 	// 500 — внутренняя ошибка сервера.
 
 	// декодировать логин и пароль, переданные в json
@@ -92,7 +230,7 @@ func (s *Server) userRegister(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// проверить, есть ли такой логин в базе. Если есть возвращаем 409
-	userExist, err := s.storage.UserExist(user.Login, "")
+	userExist, err := s.storage.UserExist(r.Context(), user.Login, "")
 
 	if err != nil {
 		respBody := ResponseBody{Error: fmt.Sprintf("Ошибка при получении пользователя: %v", err.Error())}
@@ -110,13 +248,17 @@ func (s *Server) userRegister(w http.ResponseWriter, r *http.Request) {
 	hashedPassword := fmt.Sprintf("%x", sha256.Sum256([]byte(user.Password)))
 	user.Password = hashedPassword
 	// если нет, добавляем в базу и возвращаем 200 и jwt-token
-	err = s.storage.AddUser(&user)
+	err = s.storage.AddUser(r.Context(), &user)
+	if errors.Is(err, my_errors.ErrInvalidReferral) {
+		respBody := ResponseBody{Error: err.Error()}
+		JSONResponse(w, respBody, http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Ошибка при получении пользователя: %v", err.Error()), http.StatusInternalServerError)
 		return
 	}
 	_, tokenString, _ := s.TokenAuth.Encode(map[string]interface{}{"user_id": user.Login})
-	log.Debug().Msg(tokenString)
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.Header().Set("X-Content-Type-Options", "nosniff")
 	w.Header().Set("Authorization", fmt.Sprintf("BEARER %v", tokenString))
@@ -144,6 +286,7 @@ func (s *Server) userLogin(w http.ResponseWriter, r *http.Request) {
 	// 200 — пользователь успешно аутентифицирован;
 	// 400 — неверный формат запроса;
 	// 401 — неверная пара логин/пароль;
+	// 429 — превышено ограничение частоты запросов;
 	// 500 — внутренняя ошибка сервера.
 
 	// декодировать логин и пароль, переданные в json
@@ -160,7 +303,7 @@ func (s *Server) userLogin(w http.ResponseWriter, r *http.Request) {
 	// Хэшируем пароль и проверяем в базе пару ключ/хэш пароля. Если ок 200 и jwt-токен
 	hashedPassword := fmt.Sprintf("%x", sha256.Sum256([]byte(user.Password)))
 	user.Password = hashedPassword
-	userExist, err := s.storage.UserExist(user.Login, user.Password)
+	userExist, err := s.storage.UserExist(r.Context(), user.Login, user.Password)
 
 	if err != nil {
 		respBody := ResponseBody{Error: fmt.Sprintf("Ошибка при получении пользователя: %v", err.Error())}
@@ -169,13 +312,15 @@ func (s *Server) userLogin(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if !userExist {
+		s.audit(r, user.Login, storage.AuditUserLoginFailed, nil)
 		respBody := ResponseBody{Error: "неверная пара логин/пароль"}
 		JSONResponse(w, respBody, http.StatusUnauthorized)
 		return
 	}
 
+	s.audit(r, user.Login, storage.AuditUserLogin, nil)
+
 	_, tokenString, _ := s.TokenAuth.Encode(map[string]interface{}{"user_id": user.Login})
-	log.Debug().Msg(tokenString)
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.Header().Set("X-Content-Type-Options", "nosniff")
 	w.Header().Set("Authorization", fmt.Sprintf("BEARER %v", tokenString))
@@ -205,6 +350,7 @@ func (s *Server) postUserOrders(w http.ResponseWriter, r *http.Request) {
 	// 401 — пользователь не аутентифицирован;
 	// 409 — номер заказа уже был загружен другим пользователем;
 	// 422 — неверный формат номера заказа;
+	// 429 — превышено ограничение частоты запросов;
 	// 500 — внутренняя ошибка сервера.
 
 	_, claims, err := jwtauth.FromContext(r.Context())
@@ -226,7 +372,7 @@ func (s *Server) postUserOrders(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		valid := luhn.Valid(string(orderNumber))
+		valid := storage.ValidOrderNumber(string(orderNumber))
 
 		if !valid {
 			respBody := ResponseBody{Error: "неверный формат номера заказа"}
@@ -236,11 +382,11 @@ func (s *Server) postUserOrders(w http.ResponseWriter, r *http.Request) {
 
 		// смотрим, есть ли такой номер заказа уже в базе и смотрим добавлен он текущим пользователем или другим
 		// и возвращаем соответствующую ошибку
-		order, err := s.storage.GetOrder(string(orderNumber))
+		order, err := s.storage.GetOrder(r.Context(), string(orderNumber))
 
 		// Такой номер заказа не найден - можно добавить новый
 		if err == pgx.ErrNoRows {
-			err := s.storage.AddOrder(string(orderNumber), currentLogin, storage.StatusNew)
+			err := s.storage.AddOrder(r.Context(), string(orderNumber), currentLogin, storage.StatusNew)
 			if err != nil {
 				respBody := ResponseBody{Error: fmt.Sprintf("при загрузке заказа произошла ошибка: %v", err.Error())}
 				JSONResponse(w, respBody, http.StatusInternalServerError)
@@ -265,6 +411,7 @@ func (s *Server) postUserOrders(w http.ResponseWriter, r *http.Request) {
 		}
 
 		if order.Login != currentLogin {
+			s.audit(r, currentLogin, storage.AuditOrderUploadConflict, map[string]string{"number": order.Number})
 			respBody := ResponseBody{Error: "номер заказа уже был загружен другим пользователем"}
 			JSONResponse(w, respBody, http.StatusConflict)
 			return
@@ -286,7 +433,7 @@ func (s *Server) getUserOrders(w http.ResponseWriter, r *http.Request) {
 
 	currentLogin, _ := claims["user_id"].(string)
 
-	orders, err := s.storage.GetOrders(currentLogin)
+	orders, err := s.storage.GetOrders(r.Context(), currentLogin)
 
 	// У пользователя нет заказов
 	if err == pgx.ErrNoRows || len(*orders) == 0 {
@@ -315,7 +462,7 @@ func (s *Server) getUserBalance(w http.ResponseWriter, r *http.Request) {
 
 	currentLogin, _ := claims["user_id"].(string)
 
-	balance, err := s.storage.CurrentBalance(currentLogin)
+	balance, err := s.storage.CurrentBalance(r.Context(), currentLogin)
 
 	if err != nil {
 		respBody := ResponseBody{Error: fmt.Sprintf("внутренняя ошибка сервера: %v", err.Error())}
@@ -346,7 +493,7 @@ func (s *Server) userBalanceWithdraw(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	valid := luhn.Valid(string(withdraw.Order))
+	valid := storage.ValidOrderNumber(string(withdraw.Order))
 
 	if !valid {
 		respBody := ResponseBody{Error: "неверный формат номера заказа"}
@@ -354,10 +501,17 @@ func (s *Server) userBalanceWithdraw(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = s.storage.AddWithdraw(withdraw.Order, currentLogin, withdraw.Sum)
+	// списание в счёт заказа магазина сможет подтвердить и вернуть только этот магазин
+	if _, known := s.MerchantKeys[withdraw.Merchant]; withdraw.Merchant != "" && !known {
+		respBody := ResponseBody{Error: "неизвестный магазин"}
+		JSONResponse(w, respBody, http.StatusUnprocessableEntity)
+		return
+	}
+
+	err = s.storage.AddWithdraw(r.Context(), withdraw.Order, currentLogin, withdraw.Sum, withdraw.Merchant)
 
 	if err != nil {
-		if err == my_errors.ErrInsufficientBalance {
+		if err == my_errors.ErrInsufficientBalance || err == my_errors.ErrBalanceBlocked {
 			respBody := ResponseBody{Error: err.Error()}
 			JSONResponse(w, respBody, http.StatusPaymentRequired)
 			return
@@ -383,7 +537,7 @@ func (s *Server) userBalanceWithdrawals(w http.ResponseWriter, r *http.Request)
 
 	currentLogin, _ := claims["user_id"].(string)
 
-	withdrawals, err := s.storage.GetWithdrawals(currentLogin)
+	withdrawals, err := s.storage.GetWithdrawals(r.Context(), currentLogin)
 
 	if err != nil {
 		// У пользователя нет ни одного списания
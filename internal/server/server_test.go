@@ -0,0 +1,90 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/region23/praktikum-diplom/internal/events"
+	"github.com/region23/praktikum-diplom/internal/storage"
+)
+
+// метрики не отдаются на публичном адресе, только администраторам
+func TestMetricsRequireAdmin(t *testing.T) {
+	srv := New(storage.Database{}, jwtauth.New("HS256", []byte("test-secret"), nil), events.NewBroker())
+	srv.Admins = map[string]bool{"admin": true}
+	srv.MountHandlers()
+
+	token := func(login string) string {
+		_, token, err := srv.TokenAuth.Encode(map[string]interface{}{"user_id": login})
+		if err != nil {
+			t.Fatalf("Encode: %v", err)
+		}
+		return token
+	}
+
+	tests := []struct {
+		name  string
+		path  string
+		token string
+		want  int
+	}{
+		{"публичный адрес", "/metrics", "", http.StatusNotFound},
+		{"без токена", "/api/admin/metrics", "", http.StatusUnauthorized},
+		{"не администратор", "/api/admin/metrics", token("alice"), http.StatusForbidden},
+		{"администратор", "/api/admin/metrics", token("admin"), http.StatusOK},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		if tt.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		w := httptest.NewRecorder()
+		srv.Router.ServeHTTP(w, r)
+
+		if w.Code != tt.want {
+			t.Errorf("%s: GET %s — %d, ожидали %d", tt.name, tt.path, w.Code, tt.want)
+		}
+	}
+}
+
+// в режиме optional партнёрские маршруты без проверенного сертификата закрыты
+func TestPartnerRoutesRequireClientCert(t *testing.T) {
+	verified := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "shop"}}}}}
+
+	tests := []struct {
+		name     string
+		required bool
+		tls      *tls.ConnectionState
+		want     int
+	}{
+		{"проверка выключена", false, nil, http.StatusUnauthorized},
+		{"без TLS", true, nil, http.StatusForbidden},
+		{"без клиентского сертификата", true, &tls.ConnectionState{}, http.StatusForbidden},
+		// сертификат проверен — дальше запрос отклоняется без API-ключа или подписи
+		{"с сертификатом", true, verified, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		srv := New(storage.Database{}, jwtauth.New("HS256", []byte("test-secret"), nil), events.NewBroker())
+		srv.MerchantKeys = map[string]string{"shop": "0123456789abcdef"}
+		srv.AccrualCallbackSecret = "0123456789abcdef0123456789abcdef"
+		srv.RequireClientCert = tt.required
+		srv.MountHandlers()
+
+		for _, path := range []string{"/api/merchant/withdrawals/79927398713/confirm", "/internal/accrual/callback"} {
+			r := httptest.NewRequest(http.MethodPost, path, strings.NewReader("{}"))
+			r.TLS = tt.tls
+			w := httptest.NewRecorder()
+			srv.Router.ServeHTTP(w, r)
+
+			if w.Code != tt.want {
+				t.Errorf("%s: POST %s — %d, ожидали %d", tt.name, path, w.Code, tt.want)
+			}
+		}
+	}
+}
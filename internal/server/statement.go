@@ -0,0 +1,292 @@
+package server
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/region23/praktikum-diplom/internal/logging"
+	"github.com/region23/praktikum-diplom/internal/storage"
+)
+
+// через сколько строк выписки сбрасывать буфер клиенту
+const statementFlushEvery = 100
+
+// формат дат в запросе выписки, если время не указано
+const dateLayout = "2006-01-02"
+
+// выписка по счёту баллов за период в формате CSV, OFX или JSON
+func (s *Server) userStatement(w http.ResponseWriter, r *http.Request) {
+	// Возможные коды ответа:
+	// 200 — выписка сформирована;
+	// 400 — неверный формат запроса;
+	// 401 — пользователь не аутентифицирован;
+	// 429 — превышено ограничение частоты запросов;
+	// 500 — внутренняя ошибка сервера.
+
+	_, claims, err := jwtauth.FromContext(r.Context())
+	if err != nil {
+		respBody := ResponseBody{Error: fmt.Sprintf("внутренняя ошибка сервера: %v", err.Error())}
+		JSONResponse(w, respBody, http.StatusInternalServerError)
+		return
+	}
+
+	currentLogin, _ := claims["user_id"].(string)
+
+	query := r.URL.Query()
+
+	from, err := parseStatementDate(query.Get("from"), time.Time{}, false)
+	if err != nil {
+		respBody := ResponseBody{Error: fmt.Sprintf("неверный формат параметра from: %v", err.Error())}
+		JSONResponse(w, respBody, http.StatusBadRequest)
+		return
+	}
+
+	to, err := parseStatementDate(query.Get("to"), time.Now(), true)
+	if err != nil {
+		respBody := ResponseBody{Error: fmt.Sprintf("неверный формат параметра to: %v", err.Error())}
+		JSONResponse(w, respBody, http.StatusBadRequest)
+		return
+	}
+
+	if !from.Before(to) {
+		respBody := ResponseBody{Error: "начало периода должно быть раньше его окончания"}
+		JSONResponse(w, respBody, http.StatusBadRequest)
+		return
+	}
+
+	var writer statementWriter
+	switch format := query.Get("format"); format {
+	case "", "json":
+		writer = &jsonStatement{w: w}
+	case "csv":
+		writer = &csvStatement{w: csv.NewWriter(w)}
+	case "ofx":
+		writer = &ofxStatement{w: w, login: currentLogin}
+	default:
+		respBody := ResponseBody{Error: fmt.Sprintf("неизвестный формат выписки %q: ожидается csv, ofx или json", format)}
+		JSONResponse(w, respBody, http.StatusBadRequest)
+		return
+	}
+
+	opening, err := s.storage.OpeningBalance(r.Context(), currentLogin, from)
+	if err != nil {
+		respBody := ResponseBody{Error: fmt.Sprintf("внутренняя ошибка сервера: %v", err.Error())}
+		JSONResponse(w, respBody, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", writer.contentType())
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="statement-%s-%s.%s"`,
+		from.Format(dateLayout), to.Format(dateLayout), writer.extension()))
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+
+	// после отправки заголовков сообщить об ошибке кодом ответа уже нельзя,
+	// поэтому ошибки только логируются, а выписка обрывается
+	if err := writer.begin(from, to, opening); err != nil {
+		logging.FromContext(r.Context()).Error().Err(err).Msg("Не смогли записать начало выписки")
+		return
+	}
+
+	written := 0
+	closing, err := s.storage.StreamStatement(r.Context(), currentLogin, from, to, opening, func(entry storage.StatementEntry) error {
+		if err := writer.entry(entry); err != nil {
+			return err
+		}
+
+		written++
+		if flusher != nil && written%statementFlushEvery == 0 {
+			writer.flush()
+			flusher.Flush()
+		}
+
+		return nil
+	})
+	if err != nil {
+		logging.FromContext(r.Context()).Error().Err(err).Msg("Не смогли сформировать выписку")
+		return
+	}
+
+	if err := writer.end(to, closing); err != nil {
+		logging.FromContext(r.Context()).Error().Err(err).Msg("Не смогли записать окончание выписки")
+	}
+}
+
+// парсит дату из запроса: RFC 3339 или YYYY-MM-DD. Для конца периода
+// дата без времени включает весь день
+func parseStatementDate(value string, fallback time.Time, endOfPeriod bool) (time.Time, error) {
+	if value == "" {
+		return fallback, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	t, err := time.Parse(dateLayout, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("ожидается RFC 3339 или %s", dateLayout)
+	}
+
+	if endOfPeriod {
+		t = t.AddDate(0, 0, 1)
+	}
+
+	return t, nil
+}
+
+type statementWriter interface {
+	contentType() string
+	extension() string
+	begin(from, to time.Time, opening float64) error
+	entry(entry storage.StatementEntry) error
+	end(to time.Time, closing float64) error
+	flush()
+}
+
+// выписка в виде JSON-объекта, массив операций пишется по одной записи
+type jsonStatement struct {
+	w       io.Writer
+	entries int
+}
+
+func (j *jsonStatement) contentType() string { return "application/json; charset=utf-8" }
+func (j *jsonStatement) extension() string   { return "json" }
+func (j *jsonStatement) flush()              {}
+
+func (j *jsonStatement) begin(from, to time.Time, opening float64) error {
+	_, err := fmt.Fprintf(j.w, `{"from":%q,"to":%q,"opening_balance":%s,"entries":[`,
+		from.Format(time.RFC3339), to.Format(time.RFC3339), formatAmount(opening))
+	return err
+}
+
+func (j *jsonStatement) entry(entry storage.StatementEntry) error {
+	if j.entries > 0 {
+		if _, err := io.WriteString(j.w, ","); err != nil {
+			return err
+		}
+	}
+	j.entries++
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	_, err = j.w.Write(data)
+	return err
+}
+
+func (j *jsonStatement) end(_ time.Time, closing float64) error {
+	_, err := fmt.Fprintf(j.w, `],"closing_balance":%s}`+"\n", formatAmount(closing))
+	return err
+}
+
+// выписка в CSV: строка входящего остатка, операции и строка исходящего остатка
+type csvStatement struct {
+	w *csv.Writer
+}
+
+func (c *csvStatement) contentType() string { return "text/csv; charset=utf-8" }
+func (c *csvStatement) extension() string   { return "csv" }
+func (c *csvStatement) flush()              { c.w.Flush() }
+
+func (c *csvStatement) begin(from, _ time.Time, opening float64) error {
+	if err := c.w.Write([]string{"date", "type", "reference", "amount", "balance"}); err != nil {
+		return err
+	}
+
+	return c.w.Write([]string{from.Format(time.RFC3339), "opening", "", "", formatAmount(opening)})
+}
+
+func (c *csvStatement) entry(entry storage.StatementEntry) error {
+	return c.w.Write([]string{
+		entry.Date.Format(time.RFC3339),
+		string(entry.Type),
+		entry.Reference,
+		formatAmount(entry.Amount),
+		formatAmount(entry.Balance),
+	})
+}
+
+func (c *csvStatement) end(to time.Time, closing float64) error {
+	if err := c.w.Write([]string{to.Format(time.RFC3339), "closing", "", "", formatAmount(closing)}); err != nil {
+		return err
+	}
+
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// выписка в OFX 2.2. 1 балл = 1 рубль, поэтому валюта счёта — RUB
+type ofxStatement struct {
+	w     io.Writer
+	login string
+}
+
+// формат дат OFX
+const ofxDateLayout = "20060102150405"
+
+func (o *ofxStatement) contentType() string { return "application/x-ofx" }
+func (o *ofxStatement) extension() string   { return "ofx" }
+func (o *ofxStatement) flush()              {}
+
+func (o *ofxStatement) begin(from, to time.Time, _ float64) error {
+	now := time.Now().UTC().Format(ofxDateLayout)
+
+	_, err := fmt.Fprintf(o.w, `<?xml version="1.0" encoding="UTF-8" standalone="no"?>
+<?OFX OFXHEADER="200" VERSION="220" SECURITY="NONE" OLDFILEUID="NONE" NEWFILEUID="NONE"?>
+<OFX>
+<SIGNONMSGSRSV1><SONRS><STATUS><CODE>0</CODE><SEVERITY>INFO</SEVERITY></STATUS><DTSERVER>%s</DTSERVER><LANGUAGE>RUS</LANGUAGE></SONRS></SIGNONMSGSRSV1>
+<BANKMSGSRSV1><STMTTRNRS><TRNUID>%s</TRNUID><STATUS><CODE>0</CODE><SEVERITY>INFO</SEVERITY></STATUS>
+<STMTRS><CURDEF>RUB</CURDEF>
+<BANKACCTFROM><BANKID>GOPHERMART</BANKID><ACCTID>%s</ACCTID><ACCTTYPE>SAVINGS</ACCTTYPE></BANKACCTFROM>
+<BANKTRANLIST><DTSTART>%s</DTSTART><DTEND>%s</DTEND>
+`, now, now, xmlEscape(o.login), from.UTC().Format(ofxDateLayout), to.UTC().Format(ofxDateLayout))
+
+	return err
+}
+
+func (o *ofxStatement) entry(entry storage.StatementEntry) error {
+	trnType := "CREDIT"
+	if entry.Amount < 0 {
+		trnType = "DEBIT"
+	}
+
+	fitID := fmt.Sprintf("%s-%s", entry.Type, entry.Reference)
+
+	_, err := fmt.Fprintf(o.w, "<STMTTRN><TRNTYPE>%s</TRNTYPE><DTPOSTED>%s</DTPOSTED><TRNAMT>%s</TRNAMT><FITID>%s</FITID><NAME>%s</NAME></STMTTRN>\n",
+		trnType, entry.Date.UTC().Format(ofxDateLayout), formatAmount(entry.Amount), xmlEscape(fitID), xmlEscape(entry.Reference))
+
+	return err
+}
+
+func (o *ofxStatement) end(to time.Time, closing float64) error {
+	_, err := fmt.Fprintf(o.w, `</BANKTRANLIST>
+<LEDGERBAL><BALAMT>%s</BALAMT><DTASOF>%s</DTASOF></LEDGERBAL>
+</STMTRS></STMTTRNRS></BANKMSGSRSV1>
+</OFX>
+`, formatAmount(closing), to.UTC().Format(ofxDateLayout))
+
+	return err
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func formatAmount(amount float64) string {
+	return strconv.FormatFloat(amount, 'f', 2, 64)
+}
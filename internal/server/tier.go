@@ -0,0 +1,42 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/jwtauth/v5"
+)
+
+// текущий уровень программы лояльности и прогресс до следующего
+func (s *Server) userTier(w http.ResponseWriter, r *http.Request) {
+	// Возможные коды ответа:
+	// 200 — успешная обработка запроса;
+	// 204 — уровни лояльности не настроены;
+	// 401 — пользователь не аутентифицирован;
+	// 429 — превышено ограничение частоты запросов;
+	// 500 — внутренняя ошибка сервера.
+
+	_, claims, err := jwtauth.FromContext(r.Context())
+	if err != nil {
+		respBody := ResponseBody{Error: fmt.Sprintf("внутренняя ошибка сервера: %v", err.Error())}
+		JSONResponse(w, respBody, http.StatusInternalServerError)
+		return
+	}
+
+	currentLogin, _ := claims["user_id"].(string)
+
+	tier, err := s.storage.GetTier(r.Context(), currentLogin)
+	if err != nil {
+		respBody := ResponseBody{Error: fmt.Sprintf("внутренняя ошибка сервера: %v", err.Error())}
+		JSONResponse(w, respBody, http.StatusInternalServerError)
+		return
+	}
+
+	if tier == nil {
+		respBody := ResponseBody{Success: "нет данных для ответа"}
+		JSONResponse(w, respBody, http.StatusNoContent)
+		return
+	}
+
+	JSONResponse(w, tier, http.StatusOK)
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"unicode/utf8"
+
+	"github.com/go-chi/jwtauth/v5"
+	my_errors "github.com/region23/praktikum-diplom/internal/errors"
+	"github.com/region23/praktikum-diplom/internal/storage"
+)
+
+// максимальная длина комментария к переводу
+const maxTransferNote = 200
+
+type transferRequest struct {
+	Recipient string  `json:"recipient"`      // логин получателя
+	Amount    float64 `json:"amount"`         // сколько баллов перевести
+	Note      string  `json:"note,omitempty"` // комментарий к переводу
+}
+
+// перевод баллов другому пользователю. Баллы списываются сразу, а получателю
+// зачисляются только после подтверждения перевода отправителем
+func (s *Server) userBalanceTransfer(w http.ResponseWriter, r *http.Request) {
+	// Возможные коды ответа:
+	// 202 — перевод создан и ждёт подтверждения;
+	// 400 — неверный формат запроса;
+	// 401 — пользователь не аутентифицирован;
+	// 402 — на счету недостаточно средств или списания заблокированы из-за отрицательного баланса;
+	// 404 — получатель не найден;
+	// 422 — перевод самому себе или превышен дневной лимит переводов;
+	// 429 — превышено ограничение частоты запросов;
+	// 500 — внутренняя ошибка сервера.
+
+	_, claims, err := jwtauth.FromContext(r.Context())
+	if err != nil {
+		respBody := ResponseBody{Error: fmt.Sprintf("внутренняя ошибка сервера: %v", err.Error())}
+		JSONResponse(w, respBody, http.StatusInternalServerError)
+		return
+	}
+
+	currentLogin, _ := claims["user_id"].(string)
+
+	var request transferRequest
+	err = json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		respBody := ResponseBody{Error: fmt.Sprint("Decode error! please check your JSON formating.", err.Error())}
+		JSONResponse(w, respBody, http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case request.Recipient == "":
+		JSONResponse(w, ResponseBody{Error: "не указан получатель"}, http.StatusBadRequest)
+		return
+	case request.Amount <= 0:
+		JSONResponse(w, ResponseBody{Error: "сумма перевода должна быть положительной"}, http.StatusBadRequest)
+		return
+	case utf8.RuneCountInString(request.Note) > maxTransferNote:
+		JSONResponse(w, ResponseBody{Error: fmt.Sprintf("комментарий длиннее %d символов", maxTransferNote)}, http.StatusBadRequest)
+		return
+	case request.Recipient == currentLogin:
+		JSONResponse(w, ResponseBody{Error: "нельзя перевести баллы самому себе"}, http.StatusUnprocessableEntity)
+		return
+	}
+
+	transfer, err := s.storage.AddTransfer(r.Context(), currentLogin, request.Recipient, request.Amount, request.Note)
+	switch {
+	case errors.Is(err, my_errors.ErrNotFound):
+		JSONResponse(w, ResponseBody{Error: "получатель не найден"}, http.StatusNotFound)
+		return
+	case errors.Is(err, my_errors.ErrInsufficientBalance), errors.Is(err, my_errors.ErrBalanceBlocked):
+		JSONResponse(w, ResponseBody{Error: err.Error()}, http.StatusPaymentRequired)
+		return
+	case errors.Is(err, my_errors.ErrTransferLimit):
+		JSONResponse(w, ResponseBody{Error: err.Error()}, http.StatusUnprocessableEntity)
+		return
+	case err != nil:
+		respBody := ResponseBody{Error: fmt.Sprintf("внутренняя ошибка сервера: %v", err.Error())}
+		JSONResponse(w, respBody, http.StatusInternalServerError)
+		return
+	}
+
+	transfer.Direction = storage.TransferOut
+	JSONResponse(w, transfer, http.StatusAccepted)
+}
+
+// подтверждение перевода отправителем: баллы зачисляются получателю
+func (s *Server) confirmTransfer(w http.ResponseWriter, r *http.Request) {
+	// Возможные коды ответа:
+	// 200 — перевод подтверждён;
+	// 400 — неверный номер перевода;
+	// 401 — пользователь не аутентифицирован;
+	// 404 — перевод не найден или отправлен другим пользователем;
+	// 409 — перевод уже подтверждён или истёк;
+	// 429 — превышено ограничение частоты запросов;
+	// 500 — внутренняя ошибка сервера.
+
+	_, claims, err := jwtauth.FromContext(r.Context())
+	if err != nil {
+		respBody := ResponseBody{Error: fmt.Sprintf("внутренняя ошибка сервера: %v", err.Error())}
+		JSONResponse(w, respBody, http.StatusInternalServerError)
+		return
+	}
+
+	currentLogin, _ := claims["user_id"].(string)
+
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return
+	}
+
+	transfer, err := s.storage.ConfirmTransfer(r.Context(), currentLogin, id)
+	switch {
+	case errors.Is(err, my_errors.ErrNotFound):
+		JSONResponse(w, ResponseBody{Error: "перевод не найден"}, http.StatusNotFound)
+		return
+	case errors.Is(err, my_errors.ErrTransferState):
+		JSONResponse(w, ResponseBody{Error: err.Error()}, http.StatusConflict)
+		return
+	case err != nil:
+		respBody := ResponseBody{Error: fmt.Sprintf("внутренняя ошибка сервера: %v", err.Error())}
+		JSONResponse(w, respBody, http.StatusInternalServerError)
+		return
+	}
+
+	transfer.Direction = storage.TransferOut
+	JSONResponse(w, transfer, http.StatusOK)
+}
+
+// отправленные и полученные переводы пользователя; входящие — только подтверждённые
+func (s *Server) userTransfers(w http.ResponseWriter, r *http.Request) {
+	// Возможные коды ответа:
+	// 200 — успешная обработка запроса;
+	// 204 — нет ни одного перевода;
+	// 401 — пользователь не аутентифицирован;
+	// 429 — превышено ограничение частоты запросов;
+	// 500 — внутренняя ошибка сервера.
+
+	_, claims, err := jwtauth.FromContext(r.Context())
+	if err != nil {
+		respBody := ResponseBody{Error: fmt.Sprintf("внутренняя ошибка сервера: %v", err.Error())}
+		JSONResponse(w, respBody, http.StatusInternalServerError)
+		return
+	}
+
+	currentLogin, _ := claims["user_id"].(string)
+
+	transfers, err := s.storage.GetTransfers(r.Context(), currentLogin)
+	if err != nil {
+		respBody := ResponseBody{Error: fmt.Sprintf("внутренняя ошибка сервера: %v", err.Error())}
+		JSONResponse(w, respBody, http.StatusInternalServerError)
+		return
+	}
+
+	if len(*transfers) == 0 {
+		respBody := ResponseBody{Success: "нет ни одного перевода"}
+		JSONResponse(w, respBody, http.StatusNoContent)
+		return
+	}
+
+	JSONResponse(w, transfers, http.StatusOK)
+}
@@ -0,0 +1,298 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/jwtauth/v5"
+	my_errors "github.com/region23/praktikum-diplom/internal/errors"
+	"github.com/region23/praktikum-diplom/internal/storage"
+	"github.com/region23/praktikum-diplom/internal/webhooks"
+)
+
+// ограничения подписки на вебхуки
+const (
+	minWebhookSecret = 16
+	maxWebhookURL    = 2000
+)
+
+// сколько подписок может быть у владельца по умолчанию
+const DefaultWebhookMaxSubscriptions = 10
+
+type webhookRequest struct {
+	URL        string   `json:"url"`              // куда отправлять события, http(s)
+	Secret     string   `json:"secret,omitempty"` // ключ подписи; не задан — будет сгенерирован
+	EventTypes []string `json:"event_types"`      // типы событий
+}
+
+// маршруты подписок на вебхуки, одинаковые для пользователей и магазинов
+func (s *Server) webhookRoutes(r chi.Router) {
+	r.Get("/", s.webhooks)
+	r.Post("/", s.createWebhook)
+	r.Delete("/{id}", s.deleteWebhook)
+	r.Get("/{id}/deliveries", s.webhookDeliveries)
+	r.Post("/{id}/deliveries/{delivery}/retry", s.retryWebhookDelivery)
+}
+
+// владелец подписок: магазин, если запрос с API-ключом, иначе пользователь из токена
+func webhookOwner(r *http.Request) storage.WebhookOwner {
+	if merchant := merchantFromContext(r.Context()); merchant != "" {
+		return storage.WebhookOwner{Merchant: merchant}
+	}
+
+	_, claims, _ := jwtauth.FromContext(r.Context())
+	login, _ := claims["user_id"].(string)
+
+	return storage.WebhookOwner{Login: login}
+}
+
+// подписки на вебхуки
+func (s *Server) webhooks(w http.ResponseWriter, r *http.Request) {
+	// Возможные коды ответа:
+	// 200 — успешная обработка запроса;
+	// 204 — подписок нет;
+	// 401 — не аутентифицирован или неверный API-ключ магазина;
+	// 500 — внутренняя ошибка сервера.
+
+	subscriptions, err := s.storage.GetWebhooks(r.Context(), webhookOwner(r))
+	if err != nil {
+		respBody := ResponseBody{Error: fmt.Sprintf("внутренняя ошибка сервера: %v", err.Error())}
+		JSONResponse(w, respBody, http.StatusInternalServerError)
+		return
+	}
+
+	if len(*subscriptions) == 0 {
+		respBody := ResponseBody{Success: "нет данных для ответа"}
+		JSONResponse(w, respBody, http.StatusNoContent)
+		return
+	}
+
+	JSONResponse(w, subscriptions, http.StatusOK)
+}
+
+// подписка на вебхуки. Секрет подписи возвращается только в ответе на этот запрос
+func (s *Server) createWebhook(w http.ResponseWriter, r *http.Request) {
+	// Возможные коды ответа:
+	// 201 — подписка создана;
+	// 400 — неверный формат запроса, адрес, секрет или типы событий;
+	// 401 — не аутентифицирован или неверный API-ключ магазина;
+	// 409 — достигнуто максимальное число подписок;
+	// 500 — внутренняя ошибка сервера.
+
+	var request webhookRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		respBody := ResponseBody{Error: fmt.Sprint("Decode error! please check your JSON formating.", err.Error())}
+		JSONResponse(w, respBody, http.StatusBadRequest)
+		return
+	}
+
+	owner := webhookOwner(r)
+	if err := validateWebhook(owner, request); err != nil {
+		JSONResponse(w, ResponseBody{Error: err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	if request.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			respBody := ResponseBody{Error: fmt.Sprintf("внутренняя ошибка сервера: %v", err.Error())}
+			JSONResponse(w, respBody, http.StatusInternalServerError)
+			return
+		}
+		request.Secret = hex.EncodeToString(secret)
+	}
+
+	subscription, err := s.storage.CreateWebhook(r.Context(), owner, storage.WebhookSubscription{
+		URL:        request.URL,
+		Secret:     request.Secret,
+		EventTypes: request.EventTypes,
+	}, s.WebhookMaxSubscriptions)
+	if errors.Is(err, my_errors.ErrWebhookLimit) {
+		respBody := ResponseBody{Error: fmt.Sprintf("не больше %d подписок", s.WebhookMaxSubscriptions)}
+		JSONResponse(w, respBody, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		respBody := ResponseBody{Error: fmt.Sprintf("внутренняя ошибка сервера: %v", err.Error())}
+		JSONResponse(w, respBody, http.StatusInternalServerError)
+		return
+	}
+
+	JSONResponse(w, subscription, http.StatusCreated)
+}
+
+func validateWebhook(owner storage.WebhookOwner, request webhookRequest) error {
+	u, err := url.Parse(request.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" || len(request.URL) > maxWebhookURL {
+		return errors.New("url: ожидается адрес http(s)://host/path")
+	}
+
+	// заранее отклоняем очевидно внутренние адреса; имена проверяются при каждой
+	// доставке после разрешения, см. webhooks.NewClient
+	host := u.Hostname()
+	if strings.EqualFold(host, "localhost") || strings.HasSuffix(strings.ToLower(host), ".localhost") {
+		return errors.New("url: адрес во внутренней сети")
+	}
+	if _, err := netip.ParseAddr(host); err == nil && webhooks.CheckAddress(host) != nil {
+		return errors.New("url: адрес во внутренней сети")
+	}
+
+	if request.Secret != "" && len(request.Secret) < minWebhookSecret {
+		return fmt.Errorf("secret: не короче %d символов", minWebhookSecret)
+	}
+
+	// магазину доступны только события о списаниях в счёт его заказов
+	eventTypes := storage.EventTypes
+	if owner.Merchant != "" {
+		eventTypes = storage.MerchantEventTypes
+	}
+
+	if len(request.EventTypes) == 0 {
+		return fmt.Errorf("event_types: укажите хотя бы один тип событий: %s", strings.Join(eventTypes, ", "))
+	}
+	for _, eventType := range request.EventTypes {
+		known := false
+		for _, t := range eventTypes {
+			known = known || t == eventType
+		}
+		if !known {
+			return fmt.Errorf("event_types: неизвестный тип события %q, ожидается один из %s", eventType, strings.Join(eventTypes, ", "))
+		}
+	}
+
+	return nil
+}
+
+// удаление подписки вместе с ещё не доставленными вебхуками
+func (s *Server) deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	// Возможные коды ответа:
+	// 200 — подписка удалена;
+	// 400 — неверный номер подписки;
+	// 401 — не аутентифицирован или неверный API-ключ магазина;
+	// 404 — подписка не найдена;
+	// 500 — внутренняя ошибка сервера.
+
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return
+	}
+
+	err := s.storage.DeleteWebhook(r.Context(), webhookOwner(r), id)
+	if err != nil {
+		webhookError(w, err)
+		return
+	}
+
+	JSONResponse(w, ResponseBody{Success: "подписка удалена"}, http.StatusOK)
+}
+
+// журнал доставки вебхуков по подписке от новых к старым
+func (s *Server) webhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	// Возможные коды ответа:
+	// 200 — успешная обработка запроса;
+	// 204 — доставок не было;
+	// 400 — неверный номер подписки или формат параметров limit и before;
+	// 401 — не аутентифицирован или неверный API-ключ магазина;
+	// 404 — подписка не найдена;
+	// 500 — внутренняя ошибка сервера.
+
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return
+	}
+
+	limit := defaultActivityLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxActivityLimit {
+			respBody := ResponseBody{Error: fmt.Sprintf("limit должен быть числом от 1 до %d", maxActivityLimit)}
+			JSONResponse(w, respBody, http.StatusBadRequest)
+			return
+		}
+	}
+
+	// номер доставки, с которой продолжить: id последней доставки предыдущей страницы
+	var beforeID int64
+	if value := r.URL.Query().Get("before"); value != "" {
+		var err error
+		beforeID, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || beforeID < 1 {
+			respBody := ResponseBody{Error: "before должен быть положительным числом"}
+			JSONResponse(w, respBody, http.StatusBadRequest)
+			return
+		}
+	}
+
+	deliveries, err := s.storage.GetWebhookDeliveries(r.Context(), webhookOwner(r), id, beforeID, limit)
+	if err != nil {
+		webhookError(w, err)
+		return
+	}
+
+	if len(*deliveries) == 0 {
+		respBody := ResponseBody{Success: "нет данных для ответа"}
+		JSONResponse(w, respBody, http.StatusNoContent)
+		return
+	}
+
+	JSONResponse(w, deliveries, http.StatusOK)
+}
+
+// повторная доставка вебхука, у которого кончились попытки
+func (s *Server) retryWebhookDelivery(w http.ResponseWriter, r *http.Request) {
+	// Возможные коды ответа:
+	// 202 — доставка снова поставлена в очередь;
+	// 400 — неверный номер подписки или доставки;
+	// 401 — не аутентифицирован или неверный API-ключ магазина;
+	// 404 — нет недоставленного вебхука с таким номером;
+	// 500 — внутренняя ошибка сервера.
+
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return
+	}
+	deliveryID, ok := pathID(w, r, "delivery")
+	if !ok {
+		return
+	}
+
+	err := s.storage.RetryWebhookDelivery(r.Context(), webhookOwner(r), id, deliveryID)
+	if err != nil {
+		webhookError(w, err)
+		return
+	}
+
+	JSONResponse(w, ResponseBody{Success: "доставка поставлена в очередь"}, http.StatusAccepted)
+}
+
+// положительный числовой параметр пути
+func pathID(w http.ResponseWriter, r *http.Request, name string) (int64, bool) {
+	id, err := strconv.ParseInt(chi.URLParam(r, name), 10, 64)
+	if err != nil || id < 1 {
+		JSONResponse(w, ResponseBody{Error: fmt.Sprintf("неверный номер: %s", name)}, http.StatusBadRequest)
+		return 0, false
+	}
+
+	return id, true
+}
+
+func webhookError(w http.ResponseWriter, err error) {
+	if errors.Is(err, my_errors.ErrNotFound) {
+		JSONResponse(w, ResponseBody{Error: "не найдено"}, http.StatusNotFound)
+		return
+	}
+
+	respBody := ResponseBody{Error: fmt.Sprintf("внутренняя ошибка сервера: %v", err.Error())}
+	JSONResponse(w, respBody, http.StatusInternalServerError)
+}
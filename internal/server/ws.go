@@ -0,0 +1,227 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/gorilla/websocket"
+	"github.com/region23/praktikum-diplom/internal/logging"
+	"github.com/region23/praktikum-diplom/internal/storage"
+)
+
+const (
+	// версия формата конверта сообщений WebSocket
+	wsEnvelopeVersion = 1
+
+	// время на запись одного сообщения клиенту
+	wsWriteWait = 10 * time.Second
+	// сколько ждём pong от клиента, прежде чем считать соединение мёртвым
+	wsPongWait = 60 * time.Second
+	// как часто отправляем ping. Должно быть меньше wsPongWait
+	wsPingPeriod = wsPongWait * 9 / 10
+	// максимальный размер сообщения от клиента
+	wsMaxMessageSize = 4096
+	// сколько ответов клиенту может ждать отправки. При переполнении
+	// соединение закрывается — клиент не успевает читать
+	wsSendBuffer = 32
+)
+
+// типы сообщений WebSocket, которых нет среди событий хранилища
+const (
+	wsBalanceChanged = "balance.changed"
+	wsPing           = "ping"
+	wsPong           = "pong"
+	wsBalanceGet     = "balance.get"
+	wsError          = "error"
+)
+
+// баланс для сообщений balance.changed; в тестах подменяется
+type balanceReader interface {
+	CurrentBalance(ctx context.Context, login string) (*storage.Balance, error)
+}
+
+// WSMessage — конверт всех сообщений, передаваемых по WebSocket в обе стороны
+type WSMessage struct {
+	Version int             `json:"version"`        // версия формата конверта
+	ID      int64           `json:"id,omitempty"`   // номер события, если сообщение порождено событием
+	Type    string          `json:"type"`           // тип сообщения
+	Data    json.RawMessage `json:"data,omitempty"` // данные сообщения
+	SentAt  time.Time       `json:"sent_at"`        // время отправки
+}
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// канал уведомлений об изменениях баланса, заказов и списаниях
+func (s *Server) userWebSocket(w http.ResponseWriter, r *http.Request) {
+	_, claims, err := jwtauth.FromContext(r.Context())
+	if err != nil {
+		respBody := ResponseBody{Error: fmt.Sprintf("внутренняя ошибка сервера: %v", err.Error())}
+		JSONResponse(w, respBody, http.StatusInternalServerError)
+		return
+	}
+
+	currentLogin, _ := claims["user_id"].(string)
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade сам отвечает клиенту ошибкой
+		logging.FromContext(r.Context()).Debug().Err(err).Msg("Не смогли установить WebSocket соединение")
+		return
+	}
+	defer conn.Close()
+
+	eventsCh, unsubscribe := s.broker.Subscribe(currentLogin)
+	defer unsubscribe()
+
+	replies := make(chan WSMessage, wsSendBuffer)
+	readerDone := make(chan struct{})
+
+	go s.wsReadLoop(r.Context(), conn, currentLogin, replies, readerDone)
+
+	ticker := time.NewTicker(wsPingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.closing:
+			wsClose(conn, websocket.CloseGoingAway, "сервер завершает работу")
+			return
+		case <-r.Context().Done():
+			wsClose(conn, websocket.CloseGoingAway, "сервер завершает работу")
+			return
+		case <-readerDone:
+			return
+		case <-ticker.C:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case msg := <-replies:
+			if err := wsWrite(conn, msg); err != nil {
+				return
+			}
+		case event, ok := <-eventsCh:
+			if !ok {
+				wsClose(conn, websocket.CloseTryAgainLater, "клиент не успевает читать сообщения")
+				return
+			}
+
+			msg := WSMessage{ID: event.ID, Type: event.Type, Data: event.Payload}
+			if err := wsWrite(conn, msg); err != nil {
+				return
+			}
+
+			if !balanceAffecting(event) {
+				continue
+			}
+
+			balanceMsg, err := s.wsBalanceMessage(r.Context(), currentLogin)
+			if err != nil {
+				logging.FromContext(r.Context()).Error().Err(err).Msg("Не смогли получить баланс для WebSocket уведомления")
+				continue
+			}
+			if err := wsWrite(conn, balanceMsg); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// читает сообщения клиента и кладёт ответы в replies. Закрывает done при разрыве соединения
+func (s *Server) wsReadLoop(ctx context.Context, conn *websocket.Conn, login string, replies chan<- WSMessage, done chan<- struct{}) {
+	defer close(done)
+
+	conn.SetReadLimit(wsMaxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	for {
+		var request WSMessage
+		err := conn.ReadJSON(&request)
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				logging.FromContext(ctx).Debug().Err(err).Msg("WebSocket соединение разорвано")
+			}
+			return
+		}
+
+		var reply WSMessage
+		switch request.Type {
+		case wsPing:
+			reply = WSMessage{Type: wsPong}
+		case wsBalanceGet:
+			reply, err = s.wsBalanceMessage(ctx, login)
+			if err != nil {
+				reply = wsErrorMessage(fmt.Sprintf("внутренняя ошибка сервера: %v", err.Error()))
+			}
+		default:
+			reply = wsErrorMessage(fmt.Sprintf("неизвестный тип сообщения: %q", request.Type))
+		}
+
+		select {
+		case replies <- reply:
+		default:
+			// клиент шлёт запросы быстрее, чем читает ответы
+			return
+		}
+	}
+}
+
+func (s *Server) wsBalanceMessage(ctx context.Context, login string) (WSMessage, error) {
+	balance, err := s.balances.CurrentBalance(ctx, login)
+	if err != nil {
+		return WSMessage{}, err
+	}
+
+	data, err := json.Marshal(balance)
+	if err != nil {
+		return WSMessage{}, err
+	}
+
+	return WSMessage{Type: wsBalanceChanged, Data: data}, nil
+}
+
+// меняет ли событие баланс пользователя
+func balanceAffecting(event storage.Event) bool {
+	switch event.Type {
+	case storage.EventWithdrawalCreated, storage.EventPointsExpired, storage.EventReferralRewarded,
+		storage.EventTransferSent, storage.EventTransferReceived, storage.EventTransferExpired, storage.EventWithdrawalRefunded,
+		storage.EventOrderAdjusted:
+		return true
+	case storage.EventOrderUpdated:
+		var order storage.Order
+		if err := json.Unmarshal(event.Payload, &order); err != nil {
+			return false
+		}
+		return order.Status == storage.StatusProcessed
+	}
+
+	return false
+}
+
+func wsErrorMessage(text string) WSMessage {
+	data, _ := json.Marshal(ResponseBody{Error: text})
+	return WSMessage{Type: wsError, Data: data}
+}
+
+func wsWrite(conn *websocket.Conn, msg WSMessage) error {
+	msg.Version = wsEnvelopeVersion
+	msg.SentAt = time.Now()
+
+	conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	return conn.WriteJSON(msg)
+}
+
+func wsClose(conn *websocket.Conn, code int, text string) {
+	message := websocket.FormatCloseMessage(code, text)
+	conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(wsWriteWait))
+}
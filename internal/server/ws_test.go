@@ -0,0 +1,264 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/gorilla/websocket"
+	"github.com/region23/praktikum-diplom/internal/events"
+	"github.com/region23/praktikum-diplom/internal/storage"
+)
+
+type wsEnv struct {
+	srv      *Server
+	broker   *events.Broker
+	balances *fakeBalances
+	http     *httptest.Server
+	url      string
+}
+
+// балансы пользователей в памяти вместо базы
+type fakeBalances struct {
+	mu       sync.Mutex
+	balances map[string]storage.Balance
+}
+
+func (f *fakeBalances) CurrentBalance(ctx context.Context, login string) (*storage.Balance, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	balance := f.balances[login]
+	return &balance, nil
+}
+
+func (f *fakeBalances) set(login string, balance storage.Balance) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.balances[login] = balance
+}
+
+// сервер без базы: баланс берётся из fakeBalances
+func newWSEnv(t *testing.T) *wsEnv {
+	t.Helper()
+
+	broker := events.NewBroker()
+	balances := &fakeBalances{balances: map[string]storage.Balance{}}
+	srv := New(storage.Database{}, jwtauth.New("HS256", []byte("test-secret"), nil), broker)
+	srv.balances = balances
+	srv.MountHandlers()
+
+	httpServer := httptest.NewUnstartedServer(srv.Router)
+	httpServer.Config.RegisterOnShutdown(srv.CloseWebSockets)
+	httpServer.Start()
+	t.Cleanup(httpServer.Close)
+
+	return &wsEnv{
+		srv:      srv,
+		broker:   broker,
+		balances: balances,
+		http:     httpServer,
+		url:      "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/api/user/ws",
+	}
+}
+
+func (env *wsEnv) token(t *testing.T, login string) string {
+	t.Helper()
+
+	_, token, err := env.srv.TokenAuth.Encode(map[string]interface{}{"user_id": login})
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+
+	return token
+}
+
+// подключается с токеном в параметре запроса, как браузерный клиент,
+// и дожидается pong — к этому моменту подписка на события уже оформлена
+func (env *wsEnv) dial(t *testing.T, login string) *websocket.Conn {
+	t.Helper()
+
+	conn, _, err := websocket.DefaultDialer.Dial(env.url+"?jwt="+env.token(t, login), nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	if err := conn.WriteJSON(WSMessage{Type: wsPing}); err != nil {
+		t.Fatalf("ping: %v", err)
+	}
+	if msg := readWS(t, conn); msg.Type != wsPong {
+		t.Fatalf("на ping пришло %q, ожидали pong", msg.Type)
+	}
+
+	return conn
+}
+
+func readWS(t *testing.T, conn *websocket.Conn) WSMessage {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var msg WSMessage
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatalf("ReadJSON: %v", err)
+	}
+	if msg.Version != wsEnvelopeVersion || msg.SentAt.IsZero() {
+		t.Fatalf("конверт %+v без версии или времени отправки", msg)
+	}
+
+	return msg
+}
+
+func orderEvent(t *testing.T, id int64, login, number string, status storage.OrderStatus) storage.Event {
+	t.Helper()
+
+	payload, err := json.Marshal(storage.Order{Number: number, Status: status})
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	return storage.Event{ID: id, Login: login, Type: storage.EventOrderUpdated, Payload: payload, CreatedAt: time.Now()}
+}
+
+func TestWebSocketAuth(t *testing.T) {
+	env := newWSEnv(t)
+
+	for name, query := range map[string]string{
+		"без токена":       "",
+		"неверный токен":   "?jwt=not-a-token",
+		"чужая подпись":    "?jwt=" + mustForeignToken(t),
+		"токен не в query": "?token=" + env.token(t, "alice"),
+	} {
+		conn, resp, err := websocket.DefaultDialer.Dial(env.url+query, nil)
+		if err == nil {
+			conn.Close()
+			t.Fatalf("%s: соединение установлено", name)
+		}
+		if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("%s: ответ %v, ожидали 401", name, resp)
+		}
+	}
+
+	env.dial(t, "alice")
+}
+
+func mustForeignToken(t *testing.T) string {
+	t.Helper()
+
+	_, token, err := jwtauth.New("HS256", []byte("another-secret"), nil).Encode(map[string]interface{}{"user_id": "alice"})
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+
+	return token
+}
+
+// события приходят в брокер из ListenEvents по NOTIFY; здесь публикуем их
+// напрямую, как это делает ListenEvents
+func TestWebSocketEventDelivery(t *testing.T) {
+	env := newWSEnv(t)
+	alice := env.dial(t, "alice")
+	bob := env.dial(t, "bob")
+
+	env.broker.Publish(orderEvent(t, 1, "bob", "12345678903", storage.StatusProcessing))
+	env.broker.Publish(orderEvent(t, 2, "alice", "79927398713", storage.StatusProcessing))
+
+	msg := readWS(t, alice)
+	if msg.ID != 2 || msg.Type != storage.EventOrderUpdated {
+		t.Fatalf("alice получила %+v, ожидали событие 2", msg)
+	}
+	var order storage.Order
+	if err := json.Unmarshal(msg.Data, &order); err != nil || order.Number != "79927398713" {
+		t.Fatalf("данные события %s: %v", msg.Data, err)
+	}
+
+	if msg := readWS(t, bob); msg.ID != 1 {
+		t.Fatalf("bob получил %+v, ожидали событие 1", msg)
+	}
+
+	// на неизвестный запрос клиент получает ошибку, соединение остаётся открытым
+	if err := alice.WriteJSON(WSMessage{Type: "subscribe"}); err != nil {
+		t.Fatalf("WriteJSON: %v", err)
+	}
+	if msg := readWS(t, alice); msg.Type != wsError {
+		t.Fatalf("на неизвестный запрос пришло %q, ожидали error", msg.Type)
+	}
+
+	env.broker.Publish(orderEvent(t, 3, "alice", "4561261212345467", storage.StatusProcessing))
+	if msg := readWS(t, alice); msg.ID != 3 {
+		t.Fatalf("alice получила %+v, ожидали событие 3", msg)
+	}
+}
+
+// обработанный заказ меняет баланс: вслед за событием приходит balance.changed
+// с балансом, прочитанным уже после начисления
+func TestWebSocketBalanceChanged(t *testing.T) {
+	env := newWSEnv(t)
+	env.balances.set("alice", storage.Balance{Current: 100, Withdrawn: 20})
+	alice := env.dial(t, "alice")
+
+	// заказ ещё в обработке: баланс не изменился, отдельного сообщения нет
+	env.broker.Publish(orderEvent(t, 1, "alice", "79927398713", storage.StatusProcessing))
+	if msg := readWS(t, alice); msg.ID != 1 || msg.Type != storage.EventOrderUpdated {
+		t.Fatalf("alice получила %+v, ожидали событие 1", msg)
+	}
+
+	env.balances.set("alice", storage.Balance{Current: 600, Withdrawn: 20})
+	env.broker.Publish(orderEvent(t, 2, "alice", "79927398713", storage.StatusProcessed))
+
+	if msg := readWS(t, alice); msg.ID != 2 || msg.Type != storage.EventOrderUpdated {
+		t.Fatalf("alice получила %+v, ожидали событие 2", msg)
+	}
+	msg := readWS(t, alice)
+	if msg.Type != wsBalanceChanged {
+		t.Fatalf("после обработанного заказа пришло %q, ожидали %s", msg.Type, wsBalanceChanged)
+	}
+	var balance storage.Balance
+	if err := json.Unmarshal(msg.Data, &balance); err != nil {
+		t.Fatalf("данные %s: %v", msg.Data, err)
+	}
+	if balance.Current != 600 || balance.Withdrawn != 20 {
+		t.Fatalf("баланс %+v, ожидали 600 и 20 списанных", balance)
+	}
+
+	// тот же баланс по запросу клиента
+	if err := alice.WriteJSON(WSMessage{Type: wsBalanceGet}); err != nil {
+		t.Fatalf("WriteJSON: %v", err)
+	}
+	if msg := readWS(t, alice); msg.Type != wsBalanceChanged || !strings.Contains(string(msg.Data), `"current":600`) {
+		t.Fatalf("на balance.get пришло %+v", msg)
+	}
+}
+
+func TestWebSocketCloseOnShutdown(t *testing.T) {
+	env := newWSEnv(t)
+	conn := env.dial(t, "alice")
+
+	done := make(chan error, 1)
+	go func() { done <- env.http.Config.Shutdown(context.Background()) }()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := conn.ReadMessage()
+
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseGoingAway {
+		t.Fatalf("ReadMessage: %v, ожидали закрытие с кодом %d", err, websocket.CloseGoingAway)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Shutdown: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown не завершился")
+	}
+}
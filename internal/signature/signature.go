@@ -0,0 +1,70 @@
+// Package signature подписывает и проверяет тела HTTP-запросов между сервисами:
+// исходящие вебхуки и результаты расчёта, которые присылает система начислений.
+package signature
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrMalformed = errors.New("неверный формат подписи")
+	ErrMismatch  = errors.New("подпись не совпадает")
+	ErrExpired   = errors.New("подпись устарела")
+)
+
+// Sign возвращает подпись "t=<unix>,v1=<hex>", где v1 — HMAC-SHA256 от "<unix>.<тело>"
+// на общем секрете. Время входит в подпись, чтобы получатель мог отбросить
+// повторно отправленные старые запросы
+func Sign(secret string, timestamp time.Time, body []byte) string {
+	t := strconv.FormatInt(timestamp.Unix(), 10)
+
+	return "t=" + t + ",v1=" + hex.EncodeToString(mac(secret, t, body))
+}
+
+// Verify проверяет подпись, сделанную Sign, и что она не старше tolerance относительно now
+func Verify(secret, header string, body []byte, now time.Time, tolerance time.Duration) error {
+	var t, v1 string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			t = value
+		case "v1":
+			v1 = value
+		}
+	}
+
+	unix, err := strconv.ParseInt(t, 10, 64)
+	if err != nil {
+		return ErrMalformed
+	}
+	sum, err := hex.DecodeString(v1)
+	if err != nil || len(sum) == 0 {
+		return ErrMalformed
+	}
+
+	if !hmac.Equal(sum, mac(secret, t, body)) {
+		return ErrMismatch
+	}
+
+	if age := now.Sub(time.Unix(unix, 0)); age > tolerance || age < -tolerance {
+		return ErrExpired
+	}
+
+	return nil
+}
+
+func mac(secret, timestamp string, body []byte) []byte {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(timestamp))
+	h.Write([]byte("."))
+	h.Write(body)
+
+	return h.Sum(nil)
+}
@@ -0,0 +1,50 @@
+package signature
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	const secret = "0123456789abcdef0123456789abcdef"
+	body := []byte(`{"order":"79927398713","status":"PROCESSED","accrual":500}`)
+	now := time.Unix(1_700_000_000, 0)
+	tolerance := 5 * time.Minute
+
+	valid := Sign(secret, now, body)
+	// та же подпись с другим временем: время входит в HMAC
+	v1 := valid[strings.Index(valid, "v1="):]
+
+	tests := []struct {
+		name   string
+		secret string
+		header string
+		body   []byte
+		want   error
+	}{
+		{name: "верная подпись", secret: secret, header: valid, body: body},
+		{name: "поля в другом порядке и с пробелами", secret: secret, header: " " + v1 + " , t=1700000000", body: body},
+		{name: "неизвестные поля пропускаются", secret: secret, header: valid + ",v0=deadbeef", body: body},
+		{name: "подписана чуть раньше", secret: secret, header: Sign(secret, now.Add(-tolerance), body), body: body},
+		{name: "часы отправителя чуть спешат", secret: secret, header: Sign(secret, now.Add(tolerance), body), body: body},
+		{name: "устарела", secret: secret, header: Sign(secret, now.Add(-tolerance-time.Second), body), body: body, want: ErrExpired},
+		{name: "из будущего", secret: secret, header: Sign(secret, now.Add(tolerance+time.Second), body), body: body, want: ErrExpired},
+		{name: "другой секрет", secret: "другой секрет", header: valid, body: body, want: ErrMismatch},
+		{name: "изменено тело", secret: secret, header: valid, body: []byte(`{"order":"79927398713","status":"PROCESSED","accrual":5000}`), want: ErrMismatch},
+		{name: "подменено время", secret: secret, header: "t=1700000001," + v1, body: body, want: ErrMismatch},
+		{name: "пустой заголовок", secret: secret, header: "", body: body, want: ErrMalformed},
+		{name: "нет времени", secret: secret, header: v1, body: body, want: ErrMalformed},
+		{name: "время не число", secret: secret, header: "t=вчера," + v1, body: body, want: ErrMalformed},
+		{name: "нет v1", secret: secret, header: "t=1700000000", body: body, want: ErrMalformed},
+		{name: "пустая v1", secret: secret, header: "t=1700000000,v1=", body: body, want: ErrMalformed},
+		{name: "v1 не hex", secret: secret, header: "t=1700000000,v1=not-hex", body: body, want: ErrMalformed},
+	}
+	for _, tt := range tests {
+		err := Verify(tt.secret, tt.header, tt.body, now, tolerance)
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%s: Verify вернул %v, ожидали %v", tt.name, err, tt.want)
+		}
+	}
+}
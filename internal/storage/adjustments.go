@@ -0,0 +1,189 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	my_errors "github.com/region23/praktikum-diplom/internal/errors"
+	"github.com/region23/praktikum-diplom/internal/logging"
+	"github.com/region23/praktikum-diplom/internal/tracing"
+)
+
+// Adjustment — корректировка начисления по уже обработанному заказу
+type Adjustment struct {
+	ID              int64     `json:"id"`
+	Order           string    `json:"order"`            // номер заказа
+	Login           string    `json:"login"`            // владелец заказа
+	PreviousAccrual float64   `json:"previous_accrual"` // начисление до корректировки
+	Accrual         float64   `json:"accrual"`          // начисление после корректировки
+	Amount          float64   `json:"amount"`           // сколько баллов списано, вместе с бонусами за заказ
+	Debt            float64   `json:"debt,omitempty"`   // сколько не хватило на балансе: баланс ушёл в минус
+	Reason          string    `json:"reason"`           // причина корректировки
+	Actor           string    `json:"actor"`            // кто выполнил корректировку
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+// бонусы, начисленные за заказ вдобавок к основному начислению и пропорциональные ему:
+// бонус уровня и акции-множители
+const orderBonuses = `
+	SELECT COALESCE(SUM(amount), 0) FROM point_lots
+	 WHERE login = $1
+	   AND ((source = 'tier_bonus' AND reference = $2)
+	     OR (source = 'campaign' AND reference IN (
+			SELECT campaign_id::text || ':' || order_number FROM campaign_awards
+			 WHERE login = $1 AND award_key = 'order:' || $2)))`
+
+// Уменьшает начисление по обработанному заказу до accrual, accrual = 0 — аннулирует его.
+// Вместе с начислением пропорционально уменьшаются бонусы уровня и акций-множителей за заказ.
+// Баллы списываются из партий пользователя начиная с самых ранних; если их не хватает,
+// остаток записывается долгом: баланс становится отрицательным, списания и переводы
+// блокируются, пока новые начисления не покроют долг
+func (storage *Database) AdjustOrder(ctx context.Context, orderNumber string, accrual float64, reason string) (*Adjustment, error) {
+	ctx, span, end := storage.startSpan(ctx, "AdjustOrder")
+	defer end()
+
+	tx, err := storage.dbpool.Begin(ctx)
+	if err != nil {
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	adjustment := Adjustment{
+		Order:   orderNumber,
+		Accrual: accrual,
+		Reason:  reason,
+		Actor:   ActorFromContext(ctx).Name,
+	}
+
+	var status OrderStatus
+	err = tx.QueryRow(ctx,
+		`SELECT login, status, accrual FROM orders WHERE number = $1 FOR UPDATE`,
+		orderNumber).Scan(&adjustment.Login, &status, &adjustment.PreviousAccrual)
+	if err == pgx.ErrNoRows {
+		return nil, my_errors.ErrNotFound
+	}
+	if err != nil {
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+
+	if status != StatusProcessed {
+		return nil, fmt.Errorf("заказ в статусе %s: %w", status, my_errors.ErrOrderState)
+	}
+	if accrual >= adjustment.PreviousAccrual {
+		return nil, fmt.Errorf("начисление можно только уменьшить, сейчас %v: %w", adjustment.PreviousAccrual, my_errors.ErrOrderState)
+	}
+
+	login := adjustment.Login
+	clawback := adjustment.PreviousAccrual - accrual
+
+	// бонусы считаются от первоначального начисления — партии за заказ, —
+	// поэтому несколько корректировок подряд в сумме спишут их ровно один раз
+	var original, bonuses float64
+	err = tx.QueryRow(ctx,
+		`SELECT COALESCE(SUM(amount), 0) FROM point_lots WHERE source = $1 AND reference = $2`,
+		LotSourceOrder, orderNumber).Scan(&original)
+	if err != nil {
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+	if original > 0 {
+		err = tx.QueryRow(ctx, orderBonuses, login, orderNumber).Scan(&bonuses)
+		if err != nil {
+			tracing.RecordError(span, err)
+			return nil, err
+		}
+		clawback += bonuses * (adjustment.PreviousAccrual - accrual) / original
+	}
+	adjustment.Amount = math.Round(clawback*100) / 100
+
+	err = storage.lockLots(ctx, tx, login)
+	if err != nil {
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+
+	available, err := storage.availablePoints(ctx, tx, login)
+	if err != nil {
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+
+	taken := math.Max(0, math.Min(adjustment.Amount, available))
+	if taken > 0 {
+		if _, err := storage.consumeLots(ctx, tx, login, taken); err != nil {
+			tracing.RecordError(span, err)
+			return nil, err
+		}
+	}
+	adjustment.Debt = math.Round((adjustment.Amount-taken)*100) / 100
+
+	_, err = tx.Exec(ctx, `UPDATE orders SET accrual = $1 WHERE number = $2`, accrual, orderNumber)
+	if err != nil {
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+
+	err = tx.QueryRow(ctx,
+		`INSERT INTO adjustments (order_number, login, previous_accrual, accrual, amount, debt, reason, actor)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id, created_at`,
+		orderNumber, login, adjustment.PreviousAccrual, accrual, adjustment.Amount, adjustment.Debt, reason, adjustment.Actor).
+		Scan(&adjustment.ID, &adjustment.CreatedAt)
+	if err != nil {
+		logging.FromContext(ctx).Error().Err(err).Msg("Unable to INSERT adjustment to DB")
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+
+	if adjustment.Debt > 0 {
+		reference := fmt.Sprintf("%s:%d", orderNumber, adjustment.ID)
+		err = storage.addLotExpiring(ctx, tx, login, LotSourceClawback, reference, -adjustment.Debt, nil)
+		if err != nil {
+			tracing.RecordError(span, err)
+			return nil, err
+		}
+	}
+
+	if err := storage.addEvent(ctx, tx, login, EventOrderAdjusted, adjustment); err != nil {
+		return nil, err
+	}
+
+	before := map[string]interface{}{"number": orderNumber, "accrual": adjustment.PreviousAccrual, "current": available}
+	after := map[string]interface{}{"adjustment": adjustment, "current": available - adjustment.Amount}
+	if err := storage.addAudit(ctx, tx, login, AuditOrderAdjusted, before, after); err != nil {
+		return nil, err
+	}
+
+	return &adjustment, tx.Commit(ctx)
+}
+
+// корректировки начислений по заказу от ранних к поздним
+func (storage *Database) GetAdjustments(ctx context.Context, orderNumber string) (*[]Adjustment, error) {
+	ctx, _, end := storage.startSpan(ctx, "GetAdjustments")
+	defer end()
+
+	rows, err := storage.dbpool.Query(ctx,
+		`SELECT id, order_number, login, previous_accrual, accrual, amount, debt, reason, actor, created_at
+		   FROM adjustments WHERE order_number = $1 ORDER BY id`,
+		orderNumber)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var adjustments []Adjustment
+	for rows.Next() {
+		var a Adjustment
+		err := rows.Scan(&a.ID, &a.Order, &a.Login, &a.PreviousAccrual, &a.Accrual, &a.Amount, &a.Debt, &a.Reason, &a.Actor, &a.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		adjustments = append(adjustments, a)
+	}
+
+	return &adjustments, rows.Err()
+}
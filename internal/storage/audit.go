@@ -0,0 +1,165 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/region23/praktikum-diplom/internal/logging"
+	"github.com/region23/praktikum-diplom/internal/tracing"
+)
+
+// действия, которые попадают в журнал аудита
+const (
+	AuditUserRegistered      = "user.registered"
+	AuditUserLogin           = "user.login"
+	AuditUserLoginFailed     = "user.login_failed"
+	AuditOrderUploaded       = "order.uploaded"
+	AuditOrderUploadConflict = "order.upload_conflict" // попытка загрузить чужой заказ
+	AuditOrdersBatchUploaded = "orders.batch_uploaded"
+	AuditOrderStatusChanged  = "order.status_changed"
+	AuditWithdrawalCreated   = "withdrawal.created"
+	AuditPointsExpired       = "points.expired"
+	AuditTierChanged         = "tier.changed"
+	AuditCampaignAwarded     = "campaign.awarded"
+	AuditReferralRewarded    = "referral.rewarded"
+	AuditTransferSent        = "transfer.sent"
+	AuditTransferReceived    = "transfer.received"
+	AuditTransferExpired     = "transfer.expired"
+	AuditWithdrawalConfirmed = "withdrawal.confirmed"
+	AuditWithdrawalRefunded  = "withdrawal.refunded"
+	AuditOrderAdjusted       = "order.adjusted"
+	AuditWebhookCreated      = "webhook.created"
+	AuditWebhookDeleted      = "webhook.deleted"
+)
+
+// AuditAdminPrefix — префикс действий администраторов, например "admin.campaign_created"
+const AuditAdminPrefix = "admin."
+
+// действия системных процессов записываются от этого имени
+const (
+	ActorAccrualPoller   = "system:accrual"
+	ActorAccrualPush     = "system:accrual-push"
+	ActorPointsExpiry    = "system:expiry"
+	ActorTransfersExpiry = "system:transfers-expiry"
+)
+
+// Actor — кто и откуда выполняет действие
+type Actor struct {
+	Name      string `json:"name,omitempty"`       // логин пользователя, администратора или системного процесса
+	IP        string `json:"ip,omitempty"`         // адрес клиента
+	UserAgent string `json:"user_agent,omitempty"` // клиентское приложение
+}
+
+type actorKey struct{}
+
+// WithActor сохраняет в контексте, кто выполняет действие. Методы хранилища
+// берут его отсюда при записи в журнал аудита
+func WithActor(ctx context.Context, actor Actor) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFromContext возвращает исполнителя действия из контекста
+func ActorFromContext(ctx context.Context) Actor {
+	actor, _ := ctx.Value(actorKey{}).(Actor)
+	return actor
+}
+
+type AuditEvent struct {
+	ID        int64           `json:"id"`               // порядковый номер записи
+	Login     string          `json:"login"`            // пользователь, которого касается действие
+	Action    string          `json:"action"`           // действие
+	Actor     Actor           `json:"actor"`            // кто выполнил действие
+	Before    json.RawMessage `json:"before,omitempty"` // состояние до действия
+	After     json.RawMessage `json:"after,omitempty"`  // состояние после действия
+	CreatedAt time.Time       `json:"created_at"`       // время действия
+}
+
+// то, чем можно выполнить запрос: пул соединений или транзакция
+type execer interface {
+	Exec(ctx context.Context, sql string, arguments ...interface{}) (pgconn.CommandTag, error)
+}
+
+// записывает действие в журнал аудита. Вызывается в той же транзакции, что и само
+// действие, чтобы журнал не расходился с данными. Исполнитель берётся из контекста,
+// если его там нет — действие записывается от имени самого пользователя
+func (storage *Database) addAudit(ctx context.Context, db execer, login, action string, before, after interface{}) error {
+	actor := ActorFromContext(ctx)
+	if actor.Name == "" {
+		actor.Name = login
+	}
+
+	beforeJSON, err := marshalAudit(before)
+	if err != nil {
+		return err
+	}
+	afterJSON, err := marshalAudit(after)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(ctx,
+		`INSERT INTO audit_events (login, action, actor, ip, user_agent, before, after) VALUES ($1, $2, $3, $4, $5, $6, $7);`,
+		login, action, actor.Name, actor.IP, actor.UserAgent, beforeJSON, afterJSON)
+	if err != nil {
+		logging.FromContext(ctx).Error().Err(err).Msg("Unable to INSERT audit event to DB")
+		return err
+	}
+
+	return nil
+}
+
+// nil остаётся NULL, а не строкой "null"
+func marshalAudit(value interface{}) ([]byte, error) {
+	if value == nil {
+		return nil, nil
+	}
+
+	return json.Marshal(value)
+}
+
+// Записывает в журнал аудита действие, которое не меняет данные
+// (вход, неудачный вход, попытка загрузить чужой заказ)
+func (storage *Database) AddAuditEvent(ctx context.Context, login, action string, before, after interface{}) error {
+	ctx, span, end := storage.startSpan(ctx, "AddAuditEvent")
+	defer end()
+
+	err := storage.addAudit(ctx, storage.dbpool, login, action, before, after)
+	tracing.RecordError(span, err)
+
+	return err
+}
+
+// извлекает записи журнала аудита пользователя от новых к старым.
+// beforeID > 0 — только записи старше указанной, для постраничного просмотра
+func (storage *Database) GetAuditEvents(ctx context.Context, login string, beforeID int64, limit int) (*[]AuditEvent, error) {
+	ctx, _, end := storage.startSpan(ctx, "GetAuditEvents")
+	defer end()
+
+	rows, err := storage.dbpool.Query(ctx,
+		`SELECT id, login, action, actor, ip, user_agent, before, after, created_at
+		   FROM audit_events
+		  WHERE login = $1 AND ($2::bigint = 0 OR id < $2::bigint)
+		  ORDER BY id DESC
+		  LIMIT $3`,
+		login, beforeID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []AuditEvent
+
+	for rows.Next() {
+		var event AuditEvent
+		err := rows.Scan(&event.ID, &event.Login, &event.Action, &event.Actor.Name, &event.Actor.IP, &event.Actor.UserAgent,
+			&event.Before, &event.After, &event.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+
+	return &events, rows.Err()
+}
@@ -0,0 +1,312 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/region23/praktikum-diplom/internal/campaigns"
+	my_errors "github.com/region23/praktikum-diplom/internal/errors"
+	"github.com/region23/praktikum-diplom/internal/tracing"
+)
+
+// сколько бонусов показывать в результате проверки акции на истории
+const dryRunSampleSize = 100
+
+const campaignColumns = `id, name, rule, multiplier, amount, orders_count, starts_at, ends_at, active, created_at, updated_at`
+
+func scanCampaign(row pgx.Row) (campaigns.Campaign, error) {
+	var c campaigns.Campaign
+	err := row.Scan(&c.ID, &c.Name, &c.Rule, &c.Multiplier, &c.Amount, &c.OrdersCount,
+		&c.StartsAt, &c.EndsAt, &c.Active, &c.CreatedAt, &c.UpdatedAt)
+
+	return c, err
+}
+
+// начисляет бонусы по действующим акциям за заказ, только что переведённый в PROCESSED.
+// Вызывается в транзакции UpdateOrder. Повторный вызов для того же заказа ничего не начисляет:
+// каждый бонус записывается в campaign_awards с ключом, который не может повториться
+func (storage *Database) applyCampaigns(ctx context.Context, tx pgx.Tx, order Order) error {
+	rows, err := tx.Query(ctx,
+		`SELECT `+campaignColumns+` FROM campaigns
+		  WHERE active AND starts_at <= NOW() AND ends_at > $1
+		  ORDER BY id`,
+		order.UploadedAt)
+	if err != nil {
+		return err
+	}
+
+	var active []campaigns.Campaign
+	for rows.Next() {
+		c, err := scanCampaign(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		active = append(active, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if len(active) == 0 {
+		return nil
+	}
+
+	// параллельно обработанные заказы пользователя считаются по очереди,
+	// иначе оба могут оказаться «первыми»
+	_, err = tx.Exec(ctx, `SELECT 1 FROM users WHERE login = $1 FOR UPDATE`, order.Login)
+	if err != nil {
+		return err
+	}
+
+	facts := campaigns.Facts{Order: order.Number, Login: order.Login, Accrual: order.Accrual, UploadedAt: order.UploadedAt}
+	err = tx.QueryRow(ctx,
+		`SELECT COUNT(*) FILTER (WHERE number <> $2),
+				COUNT(*) FILTER (WHERE date_trunc('month', COALESCE(processed_at, uploaded_at)) = date_trunc('month', NOW())),
+				NOW(), to_char(NOW(), 'YYYY-MM')
+		   FROM orders WHERE login = $1 AND status = 'PROCESSED'`,
+		order.Login, order.Number).Scan(&facts.ProcessedBefore, &facts.ProcessedInMonth, &facts.ProcessedAt, &facts.Month)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range active {
+		award, ok := c.Evaluate(facts)
+		if !ok {
+			continue
+		}
+
+		if err := storage.addAward(ctx, tx, award); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// записывает бонус по акции, если он ещё не начислялся
+func (storage *Database) addAward(ctx context.Context, tx pgx.Tx, award campaigns.Award) error {
+	tag, err := tx.Exec(ctx,
+		`INSERT INTO campaign_awards (campaign_id, login, award_key, order_number, amount)
+		 VALUES ($1, $2, $3, $4, $5)
+		 ON CONFLICT DO NOTHING`,
+		award.CampaignID, award.Login, award.Key, award.Order, award.Amount)
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return nil
+	}
+
+	reference := fmt.Sprintf("%d:%s", award.CampaignID, award.Order)
+	if err := storage.addLot(ctx, tx, award.Login, LotSourceCampaign, reference, award.Amount); err != nil {
+		return err
+	}
+
+	if err := storage.addEvent(ctx, tx, award.Login, EventCampaignAwarded, award); err != nil {
+		return err
+	}
+
+	return storage.addAudit(ctx, tx, award.Login, AuditCampaignAwarded, nil, award)
+}
+
+// все акции, начиная с последних созданных
+func (storage *Database) GetCampaigns(ctx context.Context) (*[]campaigns.Campaign, error) {
+	ctx, _, end := storage.startSpan(ctx, "GetCampaigns")
+	defer end()
+
+	rows, err := storage.dbpool.Query(ctx, `SELECT `+campaignColumns+` FROM campaigns ORDER BY id DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []campaigns.Campaign
+	for rows.Next() {
+		c, err := scanCampaign(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, c)
+	}
+
+	return &list, rows.Err()
+}
+
+// акция по номеру, my_errors.ErrNotFound — если её нет
+func (storage *Database) GetCampaign(ctx context.Context, id int64) (*campaigns.Campaign, error) {
+	ctx, _, end := storage.startSpan(ctx, "GetCampaign")
+	defer end()
+
+	c, err := scanCampaign(storage.dbpool.QueryRow(ctx, `SELECT `+campaignColumns+` FROM campaigns WHERE id = $1`, id))
+	if err == pgx.ErrNoRows {
+		return nil, my_errors.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+// Создаёт акцию. Действие записывается в журнал аудита от имени администратора из контекста
+func (storage *Database) CreateCampaign(ctx context.Context, c campaigns.Campaign) (*campaigns.Campaign, error) {
+	ctx, span, end := storage.startSpan(ctx, "CreateCampaign")
+	defer end()
+
+	tx, err := storage.dbpool.Begin(ctx)
+	if err != nil {
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	created, err := scanCampaign(tx.QueryRow(ctx,
+		`INSERT INTO campaigns (name, rule, multiplier, amount, orders_count, starts_at, ends_at, active)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		 RETURNING `+campaignColumns,
+		c.Name, c.Rule, c.Multiplier, c.Amount, c.OrdersCount, c.StartsAt, c.EndsAt, c.Active))
+	if err != nil {
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+
+	admin := ActorFromContext(ctx).Name
+	if err := storage.addAudit(ctx, tx, admin, AuditAdminPrefix+"campaign_created", nil, created); err != nil {
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+
+	return &created, tx.Commit(ctx)
+}
+
+// Изменяет акцию. Уже начисленные бонусы не пересчитываются
+func (storage *Database) UpdateCampaign(ctx context.Context, c campaigns.Campaign) (*campaigns.Campaign, error) {
+	ctx, span, end := storage.startSpan(ctx, "UpdateCampaign")
+	defer end()
+
+	tx, err := storage.dbpool.Begin(ctx)
+	if err != nil {
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	before, err := scanCampaign(tx.QueryRow(ctx, `SELECT `+campaignColumns+` FROM campaigns WHERE id = $1 FOR UPDATE`, c.ID))
+	if err == pgx.ErrNoRows {
+		return nil, my_errors.ErrNotFound
+	}
+	if err != nil {
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+
+	updated, err := scanCampaign(tx.QueryRow(ctx,
+		`UPDATE campaigns SET name = $2, rule = $3, multiplier = $4, amount = $5, orders_count = $6,
+				starts_at = $7, ends_at = $8, active = $9, updated_at = NOW()
+		  WHERE id = $1
+		 RETURNING `+campaignColumns,
+		c.ID, c.Name, c.Rule, c.Multiplier, c.Amount, c.OrdersCount, c.StartsAt, c.EndsAt, c.Active))
+	if err != nil {
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+
+	admin := ActorFromContext(ctx).Name
+	if err := storage.addAudit(ctx, tx, admin, AuditAdminPrefix+"campaign_updated", before, updated); err != nil {
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+
+	return &updated, tx.Commit(ctx)
+}
+
+// Удаляет акцию. Начисленные по ней бонусы остаются у пользователей
+func (storage *Database) DeleteCampaign(ctx context.Context, id int64) error {
+	ctx, span, end := storage.startSpan(ctx, "DeleteCampaign")
+	defer end()
+
+	tx, err := storage.dbpool.Begin(ctx)
+	if err != nil {
+		tracing.RecordError(span, err)
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	before, err := scanCampaign(tx.QueryRow(ctx, `DELETE FROM campaigns WHERE id = $1 RETURNING `+campaignColumns, id))
+	if err == pgx.ErrNoRows {
+		return my_errors.ErrNotFound
+	}
+	if err != nil {
+		tracing.RecordError(span, err)
+		return err
+	}
+
+	admin := ActorFromContext(ctx).Name
+	if err := storage.addAudit(ctx, tx, admin, AuditAdminPrefix+"campaign_deleted", before, nil); err != nil {
+		tracing.RecordError(span, err)
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// Проверяет акцию на истории: какие бонусы были бы начислены, если бы акция
+// действовала, когда обрабатывались заказы. Ничего не записывает; признак Active
+// и уже начисленные по акции бонусы не учитываются
+func (storage *Database) DryRunCampaign(ctx context.Context, c campaigns.Campaign) (*campaigns.DryRun, error) {
+	ctx, _, end := storage.startSpan(ctx, "DryRunCampaign")
+	defer end()
+
+	// счётчики заказов считаются по всей истории, а проверяются только заказы периода акции
+	rows, err := storage.dbpool.Query(ctx,
+		`SELECT number, login, accrual, uploaded_at, processed, processed_before, processed_in_month, month
+		   FROM (SELECT number, login, accrual, uploaded_at,
+						COALESCE(processed_at, uploaded_at) AS processed,
+						ROW_NUMBER() OVER (PARTITION BY login
+							ORDER BY COALESCE(processed_at, uploaded_at), number) - 1 AS processed_before,
+						ROW_NUMBER() OVER (PARTITION BY login, date_trunc('month', COALESCE(processed_at, uploaded_at))
+							ORDER BY COALESCE(processed_at, uploaded_at), number) AS processed_in_month,
+						to_char(COALESCE(processed_at, uploaded_at), 'YYYY-MM') AS month
+				   FROM orders WHERE status = 'PROCESSED') o
+		  WHERE processed >= $1 AND uploaded_at < $2
+		  ORDER BY processed, number`,
+		c.StartsAt, c.EndsAt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := campaigns.DryRun{}
+	awarded := make(map[string]bool)
+	users := make(map[string]bool)
+
+	for rows.Next() {
+		var facts campaigns.Facts
+		err := rows.Scan(&facts.Order, &facts.Login, &facts.Accrual, &facts.UploadedAt, &facts.ProcessedAt,
+			&facts.ProcessedBefore, &facts.ProcessedInMonth, &facts.Month)
+		if err != nil {
+			return nil, err
+		}
+		result.Orders++
+
+		award, ok := c.Evaluate(facts)
+		if !ok || awarded[award.Login+"\x00"+award.Key] {
+			continue
+		}
+		awarded[award.Login+"\x00"+award.Key] = true
+		users[award.Login] = true
+
+		result.Awards++
+		result.Total += award.Amount
+		if len(result.Sample) < dryRunSampleSize {
+			result.Sample = append(result.Sample, award)
+		}
+	}
+	result.Users = len(users)
+
+	return &result, rows.Err()
+}
@@ -3,31 +3,92 @@ package storage
 import (
 	"context"
 	"errors"
+	"fmt"
+	"strings"
+	"time"
 
-	"github.com/rs/zerolog/log"
+	"github.com/region23/praktikum-diplom/internal/logging"
+	"github.com/region23/praktikum-diplom/internal/tracing"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/jackc/pgx/v4/pgxpool"
 )
 
+var tracer = tracing.Tracer("storage")
+
+// Timeouts ограничивают время запросов к базе данных. Таймаут накладывается
+// поверх контекста вызывающего: запрос отменится и при отключении клиента
+type Timeouts struct {
+	// для методов, не перечисленных в PerMethod
+	Default time.Duration
+	// по имени метода хранилища, например "StreamStatement"; 0 — без таймаута
+	PerMethod map[string]time.Duration
+}
+
+// QueryMethods — методы хранилища, для которых в Timeouts.PerMethod можно задать свой таймаут
+var QueryMethods = []string{
+	"AddAuditEvent", "AddOrder", "AddOrdersBatch", "AddTransfer", "AddUser", "AddWithdraw",
+	"AdjustOrder", "ClaimWebhookDeliveries", "CompleteWebhookDelivery", "ConfirmTransfer",
+	"ConfirmWithdrawal", "CountOrdersForUpdate", "CreateCampaign", "CreateWebhook", "CurrentBalance",
+	"DeleteCampaign", "DeleteExpiredRateLimits", "DeleteWebhook", "DryRunCampaign", "ExpirePoints",
+	"ExpireTransfers", "GetAdjustments", "GetAuditEvents", "GetCampaign", "GetCampaigns",
+	"GetEventsAfter", "GetOrder", "GetOrders", "GetOrdersForUpdate", "GetReferrals", "GetTier",
+	"GetTransfers", "GetUser", "GetWebhookDeliveries", "GetWebhooks", "GetWithdrawals",
+	"HitRateLimit", "MarkAccrualChecked", "OpeningBalance", "RefundWithdrawal",
+	"RetryWebhookDelivery", "StreamStatement", "UpdateCampaign", "UpdateOrder", "UserExist",
+}
+
+// таймаут для метода хранилища
+func (t Timeouts) For(method string) time.Duration {
+	if timeout, ok := t.PerMethod[method]; ok {
+		return timeout
+	}
+
+	return t.Default
+}
+
 type Database struct {
-	dbpool *pgxpool.Pool
-	Ctx    context.Context
+	dbpool    *pgxpool.Pool
+	timeouts  Timeouts
+	points    PointsPolicy
+	transfers TransferLimits
 }
 
-func NewDatabase(ctx context.Context, dbpool *pgxpool.Pool) *Database {
+func NewDatabase(dbpool *pgxpool.Pool, timeouts Timeouts, points PointsPolicy, transfers TransferLimits) *Database {
 	return &Database{
-		Ctx:    ctx,
-		dbpool: dbpool,
+		dbpool:    dbpool,
+		timeouts:  timeouts,
+		points:    points,
+		transfers: transfers,
+	}
+}
+
+// открывает спан для метода хранилища и ограничивает контекст таймаутом этого метода.
+// Возвращённую функцию нужно вызвать по завершении метода: она закрывает спан и освобождает контекст
+func (storage *Database) startSpan(ctx context.Context, method string) (context.Context, trace.Span, func()) {
+	cancel := context.CancelFunc(func() {})
+	if timeout := storage.timeouts.For(method); timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+
+	ctx, span := tracer.Start(ctx, "storage."+method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.DBSystemPostgreSQL, semconv.DBOperationName(method)))
+
+	return ctx, span, func() {
+		span.End()
+		cancel()
 	}
 }
 
 // проверяем есть ли соединение с базой данных
-func Ping(dbpool *pgxpool.Pool) error {
+func Ping(ctx context.Context, dbpool *pgxpool.Pool) error {
 	if dbpool == nil {
 		return errors.New("connection is nil")
 	}
 
-	err := dbpool.Ping(context.Background())
+	err := dbpool.Ping(ctx)
 	if err != nil {
 		return err
 	}
@@ -35,6 +96,38 @@ func Ping(dbpool *pgxpool.Pool) error {
 	return nil
 }
 
+// таблицы, которые создаёт InitDB
+var schemaTables = []string{"users", "orders", "withdrawals", "events", "rate_limits", "audit_events", "point_lots", "point_expirations", "campaigns", "campaign_awards", "referrals", "transfers", "refunds", "adjustments", "webhook_subscriptions", "webhook_deliveries"}
+
+// проверяем, что схема базы данных создана: все таблицы на месте
+func CheckSchema(ctx context.Context, dbpool *pgxpool.Pool) error {
+	rows, err := dbpool.Query(ctx,
+		`SELECT t FROM unnest($1::text[]) AS t WHERE to_regclass(t) IS NULL`,
+		schemaTables)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var missing []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			return err
+		}
+		missing = append(missing, table)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("нет таблиц: %s", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
 // При инициализации базы данных проверить, есть ли таблица metrics.
 // Если её нет, то создать.
 func InitDB(ctx context.Context, dbpool *pgxpool.Pool) error {
@@ -52,16 +145,245 @@ func InitDB(ctx context.Context, dbpool *pgxpool.Pool) error {
 		uploaded_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
 	  );
 
+	  ALTER TABLE orders ADD COLUMN IF NOT EXISTS processed_at TIMESTAMPTZ;
+	  -- когда последний раз получен результат расчёта: от системы начислений или опросом
+	  ALTER TABLE orders ADD COLUMN IF NOT EXISTS accrual_checked_at TIMESTAMPTZ;
+	  ALTER TABLE users ADD COLUMN IF NOT EXISTS tier VARCHAR(50) NOT NULL DEFAULT '';
+	  ALTER TABLE users ADD COLUMN IF NOT EXISTS referral_code VARCHAR(20) UNIQUE;
+	  -- откуда зарегистрировался пользователь: по ним ловятся приглашения самого себя
+	  ALTER TABLE users ADD COLUMN IF NOT EXISTS registration_ip VARCHAR(100) NOT NULL DEFAULT '';
+	  ALTER TABLE users ADD COLUMN IF NOT EXISTS registration_user_agent TEXT NOT NULL DEFAULT '';
+
 	  CREATE TABLE IF NOT EXISTS withdrawals (
 		order_number VARCHAR(100) PRIMARY KEY,
 		login VARCHAR(100) NOT NULL,
 		sum NUMERIC NOT NULL,
 		processed_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
-	  );`
+	  );
+
+	  -- списания, сделанные до появления статусов, считаются подтверждёнными
+	  ALTER TABLE withdrawals ADD COLUMN IF NOT EXISTS status VARCHAR(20) NOT NULL DEFAULT 'CONFIRMED';
+	  ALTER TABLE withdrawals ADD COLUMN IF NOT EXISTS refunded NUMERIC NOT NULL DEFAULT 0;
+	  ALTER TABLE withdrawals ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ;
+	  ALTER TABLE withdrawals ADD COLUMN IF NOT EXISTS merchant VARCHAR(100) NOT NULL DEFAULT '';
+
+	  CREATE TABLE IF NOT EXISTS events (
+		id BIGSERIAL PRIMARY KEY,
+		login VARCHAR(100) NOT NULL,
+		type VARCHAR(50) NOT NULL,
+		payload JSONB NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	  );
+
+	  CREATE INDEX IF NOT EXISTS events_login_id_idx ON events (login, id);
+
+	  CREATE TABLE IF NOT EXISTS rate_limits (
+		key VARCHAR(300) NOT NULL,
+		window_start TIMESTAMPTZ NOT NULL,
+		expires_at TIMESTAMPTZ NOT NULL,
+		count INTEGER NOT NULL,
+		PRIMARY KEY (key, window_start)
+	  );
+
+	  CREATE INDEX IF NOT EXISTS rate_limits_expires_at_idx ON rate_limits (expires_at);
+
+	  CREATE TABLE IF NOT EXISTS audit_events (
+		id BIGSERIAL PRIMARY KEY,
+		login VARCHAR(100) NOT NULL,
+		action VARCHAR(100) NOT NULL,
+		actor VARCHAR(100) NOT NULL,
+		ip VARCHAR(100) NOT NULL DEFAULT '',
+		user_agent TEXT NOT NULL DEFAULT '',
+		before JSONB,
+		after JSONB,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	  );
+
+	  CREATE INDEX IF NOT EXISTS audit_events_login_id_idx ON audit_events (login, id);
+
+	  -- журнал аудита только дополняется: изменить или удалить запись нельзя
+	  CREATE OR REPLACE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+	  BEGIN
+		RAISE EXCEPTION 'audit_events is append-only';
+	  END;
+	  $$ LANGUAGE plpgsql;
+
+	  DO $$
+	  BEGIN
+		IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = 'audit_events_append_only') THEN
+		  CREATE TRIGGER audit_events_append_only
+			BEFORE UPDATE OR DELETE OR TRUNCATE ON audit_events
+			FOR EACH STATEMENT EXECUTE PROCEDURE audit_events_append_only();
+		END IF;
+	  END;
+	  $$;
+
+	  CREATE TABLE IF NOT EXISTS point_lots (
+		id BIGSERIAL PRIMARY KEY,
+		login VARCHAR(100) NOT NULL,
+		source VARCHAR(20) NOT NULL,
+		reference VARCHAR(200) NOT NULL,
+		amount NUMERIC NOT NULL,
+		remaining NUMERIC NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		expires_at TIMESTAMPTZ,
+		expired_at TIMESTAMPTZ
+	  );
+
+	  CREATE UNIQUE INDEX IF NOT EXISTS point_lots_source_reference_idx ON point_lots (source, reference);
+	  CREATE INDEX IF NOT EXISTS point_lots_login_created_at_idx ON point_lots (login, created_at, id);
+	  CREATE INDEX IF NOT EXISTS point_lots_expires_at_idx ON point_lots (expires_at) WHERE expired_at IS NULL;
+
+	  CREATE TABLE IF NOT EXISTS point_expirations (
+		id BIGSERIAL PRIMARY KEY,
+		lot_id BIGINT NOT NULL REFERENCES point_lots (id),
+		login VARCHAR(100) NOT NULL,
+		reference VARCHAR(200) NOT NULL,
+		amount NUMERIC NOT NULL,
+		expired_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	  );
+
+	  CREATE INDEX IF NOT EXISTS point_expirations_login_idx ON point_expirations (login, expired_at);
+
+	  -- баллы, начисленные до появления партий, переносятся в бессрочные партии.
+	  -- Уже сделанные списания вычитаются из самых ранних начислений
+	  INSERT INTO point_lots (login, source, reference, amount, remaining, created_at)
+	  SELECT o.login, 'order', o.number, o.accrual,
+		LEAST(o.accrual, GREATEST(0, o.cumulative - COALESCE(w.withdrawn, 0))),
+		o.date
+	    FROM (SELECT login, number, accrual, COALESCE(processed_at, uploaded_at) AS date,
+				 SUM(accrual) OVER (PARTITION BY login ORDER BY COALESCE(processed_at, uploaded_at), number) AS cumulative
+			    FROM orders
+			   WHERE status = 'PROCESSED' AND accrual > 0) o
+	    LEFT JOIN (SELECT login, SUM(sum) AS withdrawn FROM withdrawals GROUP BY login) w ON w.login = o.login
+	   WHERE NOT EXISTS (SELECT 1 FROM point_lots l WHERE l.login = o.login)
+	  ON CONFLICT (source, reference) DO NOTHING;
+
+	  CREATE TABLE IF NOT EXISTS campaigns (
+		id BIGSERIAL PRIMARY KEY,
+		name VARCHAR(200) NOT NULL,
+		rule VARCHAR(30) NOT NULL,
+		multiplier NUMERIC NOT NULL DEFAULT 0,
+		amount NUMERIC NOT NULL DEFAULT 0,
+		orders_count INTEGER NOT NULL DEFAULT 0,
+		starts_at TIMESTAMPTZ NOT NULL,
+		ends_at TIMESTAMPTZ NOT NULL,
+		active BOOLEAN NOT NULL DEFAULT TRUE,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	  );
+
+	  -- начисленные бонусы по акциям: ключ не даёт начислить один бонус дважды
+	  CREATE TABLE IF NOT EXISTS campaign_awards (
+		campaign_id BIGINT NOT NULL,
+		login VARCHAR(100) NOT NULL,
+		award_key VARCHAR(150) NOT NULL,
+		order_number VARCHAR(100) NOT NULL,
+		amount NUMERIC NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		PRIMARY KEY (campaign_id, login, award_key)
+	  );
+
+	  CREATE TABLE IF NOT EXISTS referrals (
+		invitee VARCHAR(100) PRIMARY KEY,
+		inviter VARCHAR(100) NOT NULL,
+		status VARCHAR(20) NOT NULL,
+		inviter_bonus NUMERIC NOT NULL DEFAULT 0,
+		invitee_bonus NUMERIC NOT NULL DEFAULT 0,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		rewarded_at TIMESTAMPTZ
+	  );
+
+	  CREATE INDEX IF NOT EXISTS referrals_inviter_idx ON referrals (inviter, status);
+
+	  CREATE TABLE IF NOT EXISTS transfers (
+		id BIGSERIAL PRIMARY KEY,
+		sender VARCHAR(100) NOT NULL,
+		recipient VARCHAR(100) NOT NULL,
+		amount NUMERIC NOT NULL,
+		note VARCHAR(200) NOT NULL DEFAULT '',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	  );
+
+	  CREATE INDEX IF NOT EXISTS transfers_sender_idx ON transfers (sender, created_at);
+	  CREATE INDEX IF NOT EXISTS transfers_recipient_idx ON transfers (recipient, created_at);
+
+	  ALTER TABLE transfers ADD COLUMN IF NOT EXISTS status VARCHAR(20) NOT NULL DEFAULT 'COMPLETED';
+	  ALTER TABLE transfers ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ;
+	  ALTER TABLE transfers ADD COLUMN IF NOT EXISTS confirmed_at TIMESTAMPTZ;
+	  ALTER TABLE transfers ADD COLUMN IF NOT EXISTS lot_expires_at TIMESTAMPTZ;
+	  CREATE INDEX IF NOT EXISTS transfers_pending_idx ON transfers (expires_at) WHERE status = 'PENDING';
+
+	  CREATE TABLE IF NOT EXISTS refunds (
+		id BIGSERIAL PRIMARY KEY,
+		order_number VARCHAR(100) NOT NULL,
+		login VARCHAR(100) NOT NULL,
+		amount NUMERIC NOT NULL,
+		reason VARCHAR(200) NOT NULL DEFAULT '',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	  );
+
+	  CREATE INDEX IF NOT EXISTS refunds_order_number_idx ON refunds (order_number);
+
+	  CREATE TABLE IF NOT EXISTS adjustments (
+		id BIGSERIAL PRIMARY KEY,
+		order_number VARCHAR(100) NOT NULL,
+		login VARCHAR(100) NOT NULL,
+		previous_accrual NUMERIC NOT NULL,
+		accrual NUMERIC NOT NULL,
+		amount NUMERIC NOT NULL,
+		debt NUMERIC NOT NULL DEFAULT 0,
+		reason VARCHAR(200) NOT NULL,
+		actor VARCHAR(100) NOT NULL DEFAULT '',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	  );
+
+	  CREATE INDEX IF NOT EXISTS adjustments_order_number_idx ON adjustments (order_number);
+	  CREATE INDEX IF NOT EXISTS adjustments_login_idx ON adjustments (login, created_at);
+
+	  CREATE TABLE IF NOT EXISTS webhook_subscriptions (
+		id BIGSERIAL PRIMARY KEY,
+		login VARCHAR(100) NOT NULL DEFAULT '',
+		merchant VARCHAR(100) NOT NULL DEFAULT '',
+		url VARCHAR(2000) NOT NULL,
+		secret VARCHAR(200) NOT NULL,
+		event_types TEXT[] NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	  );
+
+	  CREATE INDEX IF NOT EXISTS webhook_subscriptions_owner_idx ON webhook_subscriptions (login, merchant);
+
+	  -- исходящая очередь вебхуков: пишется в транзакции вместе с событием
+	  CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id BIGSERIAL PRIMARY KEY,
+		subscription_id BIGINT NOT NULL REFERENCES webhook_subscriptions (id) ON DELETE CASCADE,
+		event_id BIGINT NOT NULL,
+		event_type VARCHAR(50) NOT NULL,
+		status VARCHAR(20) NOT NULL DEFAULT 'PENDING',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		last_status_code INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT NOT NULL DEFAULT '',
+		next_attempt_at TIMESTAMPTZ DEFAULT NOW(),
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		delivered_at TIMESTAMPTZ
+	  );
+
+	  CREATE INDEX IF NOT EXISTS webhook_deliveries_subscription_idx ON webhook_deliveries (subscription_id, id);
+	  CREATE INDEX IF NOT EXISTS webhook_deliveries_due_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'PENDING';
+
+	  -- долговые партии, которые гасятся новыми начислениями
+	  CREATE INDEX IF NOT EXISTS point_lots_debt_idx ON point_lots (login) WHERE remaining < 0;`
 
 	_, err := dbpool.Exec(ctx, query)
 	if err != nil {
-		log.Error().Err(err).Msg("Error when creating tables")
+		logging.FromContext(ctx).Error().Err(err).Msg("Error when creating tables")
+		return err
+	}
+
+	// реферальные коды пользователям, зарегистрированным до их появления
+	err = assignReferralCodes(ctx, dbpool)
+	if err != nil {
+		logging.FromContext(ctx).Error().Err(err).Msg("Error when assigning referral codes")
 		return err
 	}
 
@@ -0,0 +1,43 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// QueryMethods перечисляет ровно те методы, которые открывают спан через startSpan:
+// иначе таймаут нового метода нельзя будет задать, а опечатка в старом пройдёт проверку
+func TestQueryMethodsMatchStartSpan(t *testing.T) {
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	call := regexp.MustCompile(`startSpan\(ctx, "(\w+)"\)`)
+	var methods []string
+	for _, file := range files {
+		if strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+		src, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range call.FindAllSubmatch(src, -1) {
+			methods = append(methods, string(m[1]))
+		}
+	}
+	slices.Sort(methods)
+	methods = slices.Compact(methods)
+
+	listed := slices.Clone(QueryMethods)
+	slices.Sort(listed)
+
+	if !slices.Equal(methods, listed) {
+		t.Fatalf("QueryMethods %v, а startSpan вызывается для %v", listed, methods)
+	}
+}
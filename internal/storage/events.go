@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/region23/praktikum-diplom/internal/logging"
+)
+
+// канал PostgreSQL, через который экземпляры сервиса обмениваются событиями
+const EventsChannel = "gophermart_events"
+
+const (
+	EventOrderUpdated        = "order.updated"
+	EventWithdrawalCreated   = "withdrawal.created"
+	EventPointsExpired       = "points.expired"
+	EventTierChanged         = "tier.changed"
+	EventCampaignAwarded     = "campaign.awarded"
+	EventReferralRewarded    = "referral.rewarded"
+	EventTransferSent        = "transfer.sent"
+	EventTransferReceived    = "transfer.received"
+	EventTransferConfirmed   = "transfer.confirmed"
+	EventTransferExpired     = "transfer.expired"
+	EventWithdrawalConfirmed = "withdrawal.confirmed"
+	EventWithdrawalRefunded  = "withdrawal.refunded"
+	EventOrderAdjusted       = "order.adjusted"
+)
+
+// все типы событий, например для проверки подписок на вебхуки
+var EventTypes = []string{
+	EventOrderUpdated, EventWithdrawalCreated, EventPointsExpired, EventTierChanged,
+	EventCampaignAwarded, EventReferralRewarded, EventTransferSent, EventTransferReceived,
+	EventTransferConfirmed, EventTransferExpired, EventWithdrawalConfirmed, EventWithdrawalRefunded, EventOrderAdjusted,
+}
+
+type Event struct {
+	ID        int64           `json:"id"`         // порядковый номер события
+	Login     string          `json:"login"`      // логин пользователя, которому адресовано событие
+	Type      string          `json:"type"`       // тип события
+	Payload   json.RawMessage `json:"payload"`    // данные события
+	CreatedAt time.Time       `json:"created_at"` // время возникновения события
+}
+
+// сохраняет событие в рамках транзакции и рассылает его через NOTIFY.
+// Уведомление будет доставлено слушателям только после фиксации транзакции.
+func (storage *Database) addEvent(ctx context.Context, tx pgx.Tx, login, eventType string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	event := Event{Login: login, Type: eventType, Payload: data}
+
+	row := tx.QueryRow(ctx,
+		`INSERT INTO events (login, type, payload) VALUES ($1, $2, $3) RETURNING id, created_at;`,
+		login, eventType, data)
+
+	err = row.Scan(&event.ID, &event.CreatedAt)
+	if err != nil {
+		logging.FromContext(ctx).Error().Err(err).Msg("Unable to INSERT event to DB")
+		return err
+	}
+
+	err = storage.enqueueWebhooks(ctx, tx, event)
+	if err != nil {
+		logging.FromContext(ctx).Error().Err(err).Msg("Unable to enqueue webhooks")
+		return err
+	}
+
+	notification, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `SELECT pg_notify($1, $2);`, EventsChannel, string(notification))
+	if err != nil {
+		logging.FromContext(ctx).Error().Err(err).Msg("Unable to NOTIFY event")
+		return err
+	}
+
+	return nil
+}
+
+// извлекает события пользователя, произошедшие после события с номером afterID
+func (storage *Database) GetEventsAfter(ctx context.Context, login string, afterID int64) (*[]Event, error) {
+	ctx, _, end := storage.startSpan(ctx, "GetEventsAfter")
+	defer end()
+
+	rows, err := storage.dbpool.Query(ctx,
+		`SELECT id, login, type, payload, created_at FROM events WHERE login = $1 AND id > $2 ORDER BY id ASC`,
+		login, afterID)
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []Event
+
+	for rows.Next() {
+		var event Event
+		err := rows.Scan(&event.ID, &event.Login, &event.Type, &event.Payload, &event.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+
+	return &events, rows.Err()
+}
+
+// подписывается на канал событий и передаёт каждое полученное событие в handler.
+// Работает до отмены ctx, при потере соединения переподключается.
+func (storage *Database) ListenEvents(ctx context.Context, handler func(Event)) {
+	for {
+		err := storage.listenEvents(ctx, handler)
+		if ctx.Err() != nil {
+			return
+		}
+
+		logging.FromContext(ctx).Error().Err(err).Msg("Потеряно соединение для LISTEN, переподключаемся")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (storage *Database) listenEvents(ctx context.Context, handler func(Event)) error {
+	conn, err := storage.dbpool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, "LISTEN "+EventsChannel)
+	if err != nil {
+		return err
+	}
+
+	for {
+		notification, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+
+		var event Event
+		err = json.Unmarshal([]byte(notification.Payload), &event)
+		if err != nil {
+			logging.FromContext(ctx).Error().Err(err).Msg("Не смогли разобрать событие из NOTIFY")
+			continue
+		}
+
+		handler(event)
+	}
+}
@@ -0,0 +1,316 @@
+package storage
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	my_errors "github.com/region23/praktikum-diplom/internal/errors"
+	"github.com/region23/praktikum-diplom/internal/loyalty"
+	"github.com/region23/praktikum-diplom/internal/tracing"
+)
+
+// Начисленные баллы хранятся партиями (lots): у каждой партии свой срок действия
+// и остаток. Списания расходуют партии в порядке начисления (FIFO),
+// по истечении срока неизрасходованный остаток партии сгорает.
+
+// откуда пришли баллы партии
+const (
+	LotSourceOrder     = "order"       // начисление за заказ
+	LotSourceTierBonus = "tier_bonus"  // бонус уровня лояльности за заказ
+	LotSourceCampaign  = "campaign"    // бонус по акции, reference — "акция:заказ"
+	LotSourceReferrer  = "referrer"    // бонус пригласившему, reference — логин приглашённого
+	LotSourceReferee   = "referee"     // бонус приглашённому, reference — его первый заказ
+	LotSourceTransfer  = "transfer_in" // баллы от другого пользователя, reference — номер перевода
+	LotSourceRefund    = "refund"      // возврат по отменённому заказу, reference — "заказ:номер возврата"
+	// долг после корректировки начисления: остаток партии отрицательный,
+	// reference — "заказ:номер корректировки"
+	LotSourceClawback = "clawback"
+	// возврат отправителю неподтверждённого перевода, reference — номер перевода
+	LotSourceTransferReturn = "transfer_return"
+)
+
+// условие для действующих партий: ещё не сгорели и срок не истёк. Партии с истёкшим
+// сроком не учитываются в балансе и до того, как их обработает ExpirePoints
+const activeLot = `expired_at IS NULL AND (expires_at IS NULL OR expires_at > NOW())`
+
+// ExpiringPoints — баллы, которые сгорят в указанный день
+type ExpiringPoints struct {
+	Amount    float64   `json:"amount"`     // сколько баллов сгорит
+	ExpiresAt time.Time `json:"expires_at"` // когда сгорят
+}
+
+// PointsPolicy — правила начисления и срока действия баллов
+type PointsPolicy struct {
+	// через сколько месяцев после начисления баллы сгорают; 0 — не сгорают
+	LifetimeMonths int
+	// за сколько до сгорания показывать баллы в балансе как сгорающие
+	ExpiringSoonWindow time.Duration
+
+	// уровни лояльности; пусто — начисления не увеличиваются
+	Tiers loyalty.Tiers
+	// за что начисляется уровень: loyalty.BasisEarned или loyalty.BasisSpent
+	TierBasis string
+	// за сколько последних месяцев считается сумма для уровня
+	TierWindowMonths int
+
+	// бонусы пригласившему и приглашённому за первый обработанный заказ приглашённого
+	ReferralInviterBonus float64
+	ReferralInviteeBonus float64
+	// скольким приглашённым пригласивший может получить бонус; 0 — без ограничения
+	ReferralMaxPerInviter int
+}
+
+// добавляет партию баллов пользователю
+func (storage *Database) addLot(ctx context.Context, tx pgx.Tx, login, source, reference string, amount float64) error {
+	var id int64
+	err := tx.QueryRow(ctx,
+		`INSERT INTO point_lots (login, source, reference, amount, remaining, expires_at)
+		 VALUES ($1, $2, $3, $4, $4,
+			CASE WHEN $5::int > 0 THEN NOW() + make_interval(months => $5::int) END)
+		 RETURNING id;`,
+		login, source, reference, amount, storage.points.LifetimeMonths).Scan(&id)
+	if err != nil {
+		return err
+	}
+
+	return storage.repayDebt(ctx, tx, login, id, amount)
+}
+
+// добавляет партию баллов с заданным сроком сгорания, nil — бессрочную
+func (storage *Database) addLotExpiring(ctx context.Context, tx pgx.Tx, login, source, reference string, amount float64, expiresAt *time.Time) error {
+	var id int64
+	err := tx.QueryRow(ctx,
+		`INSERT INTO point_lots (login, source, reference, amount, remaining, expires_at)
+		 VALUES ($1, $2, $3, $4, $4, $5)
+		 RETURNING id;`,
+		login, source, reference, amount, expiresAt).Scan(&id)
+	if err != nil {
+		return err
+	}
+
+	return storage.repayDebt(ctx, tx, login, id, amount)
+}
+
+// гасит долг пользователя из только что добавленной партии: остаток партии
+// уменьшается, долговые партии закрываются начиная с самых ранних.
+// Пока долг не погашен, новые баллы потратить нельзя
+func (storage *Database) repayDebt(ctx context.Context, tx pgx.Tx, login string, lotID int64, amount float64) error {
+	if amount <= 0 {
+		return nil
+	}
+
+	var debt float64
+	err := tx.QueryRow(ctx,
+		`SELECT COALESCE(-SUM(remaining), 0) FROM (
+			SELECT remaining FROM point_lots WHERE login = $1 AND remaining < 0 FOR UPDATE
+		 ) d`,
+		login).Scan(&debt)
+	if err != nil || debt <= 0 {
+		return err
+	}
+
+	repaid := math.Min(debt, amount)
+
+	_, err = tx.Exec(ctx, `UPDATE point_lots SET remaining = remaining - $2 WHERE id = $1`, lotID, repaid)
+	if err != nil {
+		return err
+	}
+
+	// before — сколько долга приходится на партии, появившиеся раньше текущей
+	_, err = tx.Exec(ctx,
+		`UPDATE point_lots l
+		    SET remaining = l.remaining + LEAST(-l.remaining, $2 - c.before)
+		   FROM (SELECT id, SUM(-remaining) OVER (ORDER BY created_at, id) + remaining AS before
+		           FROM point_lots
+		          WHERE login = $1 AND remaining < 0) c
+		  WHERE l.id = c.id AND c.before < $2`,
+		login, repaid)
+
+	return err
+}
+
+// сумма остатков действующих партий пользователя
+func (storage *Database) availablePoints(ctx context.Context, tx pgx.Tx, login string) (float64, error) {
+	var available float64
+	err := tx.QueryRow(ctx,
+		`SELECT COALESCE(SUM(remaining), 0) FROM point_lots WHERE login = $1 AND `+activeLot,
+		login).Scan(&available)
+
+	return available, err
+}
+
+// блокирует действующие партии пользователя до конца транзакции.
+// Параллельные списания одного пользователя выполняются по очереди
+func (storage *Database) lockLots(ctx context.Context, tx pgx.Tx, login string) error {
+	_, err := tx.Exec(ctx,
+		`SELECT id FROM point_lots
+		  WHERE login = $1 AND remaining > 0 AND `+activeLot+`
+		  ORDER BY created_at, id
+		  FOR UPDATE`,
+		login)
+
+	return err
+}
+
+// расходует amount баллов из партий пользователя, начиная с самых ранних.
+// Партии должны быть заблокированы lockLots в той же транзакции.
+// Возвращает самый ранний срок сгорания среди израсходованных партий, nil — если они бессрочные
+func (storage *Database) consumeLots(ctx context.Context, tx pgx.Tx, login string, amount float64) (*time.Time, error) {
+	// before — сколько баллов покрывают партии, начисленные раньше текущей
+	rows, err := tx.Query(ctx,
+		`UPDATE point_lots l
+		    SET remaining = l.remaining - LEAST(l.remaining, $2 - c.before)
+		   FROM (SELECT id, SUM(remaining) OVER (ORDER BY created_at, id) - remaining AS before
+		           FROM point_lots
+		          WHERE login = $1 AND remaining > 0 AND `+activeLot+`) c
+		  WHERE l.id = c.id AND c.before < $2
+		 RETURNING l.expires_at`,
+		login, amount)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var consumed int
+	var earliest *time.Time
+	for rows.Next() {
+		var expiresAt *time.Time
+		if err := rows.Scan(&expiresAt); err != nil {
+			return nil, err
+		}
+		consumed++
+		if expiresAt != nil && (earliest == nil || expiresAt.Before(*earliest)) {
+			earliest = expiresAt
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if consumed == 0 && amount > 0 {
+		return nil, my_errors.ErrInsufficientBalance
+	}
+
+	return earliest, nil
+}
+
+// баллы пользователя, которые сгорят в ближайшее время, по дням
+func (storage *Database) expiringSoon(ctx context.Context, tx pgx.Tx, login string) ([]ExpiringPoints, error) {
+	if storage.points.ExpiringSoonWindow <= 0 {
+		return nil, nil
+	}
+
+	rows, err := tx.Query(ctx,
+		`SELECT date_trunc('day', expires_at) AS day, SUM(remaining)
+		   FROM point_lots
+		  WHERE login = $1 AND remaining > 0 AND `+activeLot+`
+		    AND expires_at <= NOW() + make_interval(secs => $2::bigint)
+		  GROUP BY day
+		  ORDER BY day`,
+		login, int64(storage.points.ExpiringSoonWindow/time.Second))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var expiring []ExpiringPoints
+	for rows.Next() {
+		var points ExpiringPoints
+		if err := rows.Scan(&points.ExpiresAt, &points.Amount); err != nil {
+			return nil, err
+		}
+		expiring = append(expiring, points)
+	}
+
+	return expiring, rows.Err()
+}
+
+// PointsExpiration — сгоревший остаток партии
+type PointsExpiration struct {
+	Login     string    `json:"login"`      // чьи баллы сгорели
+	Reference string    `json:"reference"`  // номер заказа, за который были начислены баллы
+	Amount    float64   `json:"amount"`     // сколько баллов сгорело
+	ExpiredAt time.Time `json:"expired_at"` // когда сгорели
+}
+
+// Списывает остатки партий с истёкшим сроком, не больше limit партий за вызов.
+// Для каждой сгоревшей партии записывается операция сгорания, событие и запись аудита.
+// Возвращает количество обработанных партий; если оно равно limit, стоит вызвать ещё раз.
+// Несколько экземпляров сервиса могут выполнять его одновременно: занятые партии пропускаются
+func (storage *Database) ExpirePoints(ctx context.Context, limit int) (int, error) {
+	ctx, span, end := storage.startSpan(ctx, "ExpirePoints")
+	defer end()
+
+	ctx = WithActor(ctx, Actor{Name: ActorPointsExpiry})
+
+	tx, err := storage.dbpool.Begin(ctx)
+	if err != nil {
+		tracing.RecordError(span, err)
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx,
+		`WITH due AS (
+			SELECT id FROM point_lots
+			 WHERE expired_at IS NULL AND expires_at <= NOW()
+			 ORDER BY expires_at
+			 LIMIT $1
+			 FOR UPDATE SKIP LOCKED
+		 ), expired AS (
+			UPDATE point_lots l SET expired_at = NOW()
+			  FROM due WHERE l.id = due.id
+			RETURNING l.id, l.login, l.reference, l.remaining, l.expired_at
+		 ), recorded AS (
+			INSERT INTO point_expirations (lot_id, login, reference, amount, expired_at)
+			SELECT id, login, reference, remaining, expired_at FROM expired WHERE remaining > 0
+		 )
+		 SELECT login, reference, remaining, expired_at FROM expired`,
+		limit)
+	if err != nil {
+		tracing.RecordError(span, err)
+		return 0, err
+	}
+
+	var expirations []PointsExpiration
+	for rows.Next() {
+		var expiration PointsExpiration
+		if err := rows.Scan(&expiration.Login, &expiration.Reference, &expiration.Amount, &expiration.ExpiredAt); err != nil {
+			rows.Close()
+			tracing.RecordError(span, err)
+			return 0, err
+		}
+		expirations = append(expirations, expiration)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		tracing.RecordError(span, err)
+		return 0, err
+	}
+
+	for _, expiration := range expirations {
+		// партия была израсходована целиком — баланс не изменился
+		if expiration.Amount <= 0 {
+			continue
+		}
+
+		if err := storage.addEvent(ctx, tx, expiration.Login, EventPointsExpired, expiration); err != nil {
+			tracing.RecordError(span, err)
+			return 0, err
+		}
+
+		if err := storage.addAudit(ctx, tx, expiration.Login, AuditPointsExpired, nil, expiration); err != nil {
+			tracing.RecordError(span, err)
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		tracing.RecordError(span, err)
+		return 0, err
+	}
+
+	return len(expirations), nil
+}
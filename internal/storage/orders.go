@@ -1,11 +1,17 @@
 package storage
 
 import (
+	"context"
+	"fmt"
 	"time"
 
-	"github.com/rs/zerolog/log"
+	my_errors "github.com/region23/praktikum-diplom/internal/errors"
+	"github.com/region23/praktikum-diplom/internal/logging"
+	"github.com/region23/praktikum-diplom/internal/loyalty"
+	"github.com/region23/praktikum-diplom/internal/tracing"
 
 	"github.com/jackc/pgx/v4"
+	"github.com/joeljunstrom/go-luhn"
 )
 
 type OrderStatus string
@@ -15,8 +21,45 @@ const (
 	StatusNew        OrderStatus = "NEW"
 	StatusProcessing OrderStatus = "PROCESSING"
 	StatusProcessed  OrderStatus = "PROCESSED"
+	StatusInvalid    OrderStatus = "INVALID"
 )
 
+// порядок статусов расчёта: заказ может перейти только в статус не раньше текущего
+var statusRank = map[OrderStatus]int{
+	StatusNew:        0,
+	StatusRegistered: 1,
+	StatusProcessing: 2,
+	StatusProcessed:  3,
+	StatusInvalid:    3,
+}
+
+// длина колонок с номером заказа (orders.number, withdrawals.order_number)
+const MaxOrderNumberLength = 100
+
+// ValidOrderNumber — номер проходит проверку алгоритмом Луна и помещается в колонку,
+// иначе INSERT упадёт с ошибкой базы
+func ValidOrderNumber(number string) bool {
+	return len(number) <= MaxOrderNumberLength && luhn.Valid(number)
+}
+
+// Known — статус из тех, что присылает система начислений или ставит сервис
+func (status OrderStatus) Known() bool {
+	_, known := statusRank[status]
+	return known
+}
+
+// Final — расчёт по заказу завершён, статус больше не меняется
+func (status OrderStatus) Final() bool {
+	return status == StatusProcessed || status == StatusInvalid
+}
+
+// CanBecome — допустим ли переход в статус next. Результаты расчёта приходят
+// и от поллера, и от системы начислений напрямую, поэтому опоздавший
+// или повторный результат не должен откатить заказ назад
+func (status OrderStatus) CanBecome(next OrderStatus) bool {
+	return next.Known() && !status.Final() && statusRank[next] >= statusRank[status]
+}
+
 type Order struct {
 	Number     string      `json:"number"`            // номер заказа
 	Login      string      `json:"login"`             // логин пользователя, оформившего заказ
@@ -26,39 +69,172 @@ type Order struct {
 }
 
 // Добавляем новый заказ в базу
-func (storage *Database) AddOrder(orderNumber string, login string, status OrderStatus) error {
-	_, err := storage.dbpool.Exec(storage.Ctx,
+func (storage *Database) AddOrder(ctx context.Context, orderNumber string, login string, status OrderStatus) error {
+	ctx, span, end := storage.startSpan(ctx, "AddOrder")
+	defer end()
+
+	tx, err := storage.dbpool.Begin(ctx)
+	if err != nil {
+		tracing.RecordError(span, err)
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx,
 		`INSERT INTO orders (number, login, status) VALUES ($1, $2, $3);`,
 		orderNumber,
 		login,
 		status)
 
 	if err != nil {
-		log.Error().Err(err).Msg("Unable to INSERT order to DB")
+		logging.FromContext(ctx).Error().Err(err).Msg("Unable to INSERT order to DB")
+		tracing.RecordError(span, err)
 		return err
 	}
 
-	return nil
+	after := map[string]interface{}{"number": orderNumber, "status": status}
+	err = storage.addAudit(ctx, tx, login, AuditOrderUploaded, nil, after)
+	if err != nil {
+		tracing.RecordError(span, err)
+		return err
+	}
+
+	return tx.Commit(ctx)
 }
 
-func (storage *Database) UpdateOrder(orderNumber string, status OrderStatus, accrual float64) error {
-	_, err := storage.dbpool.Exec(storage.Ctx,
-		`UPDATE orders SET status = $1, accrual = $2 WHERE number = $3;`,
+// Обновляет статус и начисление по заказу. Если статус изменился,
+// в той же транзакции публикуется событие order.updated.
+// Недопустимый переход статуса (см. CanBecome) возвращает ErrOrderState, неизвестный заказ — ErrNotFound
+func (storage *Database) UpdateOrder(ctx context.Context, orderNumber string, status OrderStatus, accrual float64) error {
+	ctx, span, end := storage.startSpan(ctx, "UpdateOrder")
+	defer end()
+
+	tx, err := storage.dbpool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var login string
+	var prevStatus OrderStatus
+	var prevAccrual float64
+	var uploadedAt time.Time
+
+	err = tx.QueryRow(ctx,
+		`SELECT login, status, accrual, uploaded_at FROM orders WHERE number = $1 FOR UPDATE`,
+		orderNumber).Scan(&login, &prevStatus, &prevAccrual, &uploadedAt)
+	if err == pgx.ErrNoRows {
+		return my_errors.ErrNotFound
+	}
+	if err != nil {
+		logging.FromContext(ctx).Error().Err(err).Msg("Unable to SELECT order for UPDATE")
+		tracing.RecordError(span, err)
+		return err
+	}
+
+	if !prevStatus.CanBecome(status) {
+		return fmt.Errorf("заказ %s: переход %s → %s: %w", orderNumber, prevStatus, status, my_errors.ErrOrderState)
+	}
+
+	processed := status == StatusProcessed && prevStatus != StatusProcessed
+	tiered := processed && len(storage.points.Tiers) > 0
+
+	var storedTier string
+	var tier *loyalty.Tier
+	if tiered {
+		storedTier, tier, err = storage.lockTier(ctx, tx, login)
+		if err != nil {
+			logging.FromContext(ctx).Error().Err(err).Msg("Unable to get user tier")
+			tracing.RecordError(span, err)
+			return err
+		}
+	}
+
+	_, err = tx.Exec(ctx,
+		`UPDATE orders SET status = $1, accrual = $2, accrual_checked_at = NOW(),
+			processed_at = CASE WHEN $1 = $4 THEN COALESCE(processed_at, NOW()) ELSE processed_at END
+		 WHERE number = $3;`,
 		status,
 		accrual,
-		orderNumber)
+		orderNumber,
+		StatusProcessed)
 
 	if err != nil {
-		log.Error().Err(err).Msg("Unable to UPDATE order in DB")
+		logging.FromContext(ctx).Error().Err(err).Msg("Unable to UPDATE order in DB")
+		tracing.RecordError(span, err)
 		return err
 	}
 
-	return nil
+	// начисленные баллы становятся новой партией со своим сроком действия
+	if processed && accrual > 0 {
+		err = storage.addLot(ctx, tx, login, LotSourceOrder, orderNumber, accrual)
+		if err != nil {
+			logging.FromContext(ctx).Error().Err(err).Msg("Unable to INSERT point lot to DB")
+			tracing.RecordError(span, err)
+			return err
+		}
+
+		// бонус уровня начисляется поверх ответа системы начислений отдельной партией
+		if bonus := tier.Bonus(accrual); bonus > 0 {
+			err = storage.addLot(ctx, tx, login, LotSourceTierBonus, orderNumber, bonus)
+			if err != nil {
+				logging.FromContext(ctx).Error().Err(err).Msg("Unable to INSERT tier bonus to DB")
+				tracing.RecordError(span, err)
+				return err
+			}
+		}
+	}
+
+	if processed {
+		err = storage.applyReferral(ctx, tx, login, orderNumber)
+		if err != nil {
+			logging.FromContext(ctx).Error().Err(err).Msg("Unable to apply referral")
+			tracing.RecordError(span, err)
+			return err
+		}
+
+		order := Order{Number: orderNumber, Login: login, Status: status, Accrual: accrual, UploadedAt: uploadedAt}
+		err = storage.applyCampaigns(ctx, tx, order)
+		if err != nil {
+			logging.FromContext(ctx).Error().Err(err).Msg("Unable to apply campaigns")
+			tracing.RecordError(span, err)
+			return err
+		}
+	}
+
+	if tiered {
+		err = storage.recalculateTier(ctx, tx, login, storedTier)
+		if err != nil {
+			logging.FromContext(ctx).Error().Err(err).Msg("Unable to recalculate user tier")
+			tracing.RecordError(span, err)
+			return err
+		}
+	}
+
+	if prevStatus != status {
+		payload := Order{Number: orderNumber, Login: login, Status: status, Accrual: accrual, UploadedAt: uploadedAt}
+		err = storage.addEvent(ctx, tx, login, EventOrderUpdated, payload)
+		if err != nil {
+			return err
+		}
+
+		before := map[string]interface{}{"number": orderNumber, "status": prevStatus, "accrual": prevAccrual}
+		after := map[string]interface{}{"number": orderNumber, "status": status, "accrual": accrual}
+		err = storage.addAudit(ctx, tx, login, AuditOrderStatusChanged, before, after)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
 }
 
 // извлекает заказ из базы
-func (storage *Database) GetOrder(orderNumber string) (*Order, error) {
-	row := storage.dbpool.QueryRow(storage.Ctx,
+func (storage *Database) GetOrder(ctx context.Context, orderNumber string) (*Order, error) {
+	ctx, _, end := storage.startSpan(ctx, "GetOrder")
+	defer end()
+
+	row := storage.dbpool.QueryRow(ctx,
 		`SELECT number, login, status, accrual, uploaded_at FROM orders WHERE number = $1`,
 		orderNumber)
 
@@ -77,8 +253,11 @@ func (storage *Database) GetOrder(orderNumber string) (*Order, error) {
 }
 
 // извлекает все заказы пользователя из базы
-func (storage *Database) GetOrders(login string) (*[]Order, error) {
-	rows, err := storage.dbpool.Query(storage.Ctx,
+func (storage *Database) GetOrders(ctx context.Context, login string) (*[]Order, error) {
+	ctx, _, end := storage.startSpan(ctx, "GetOrders")
+	defer end()
+
+	rows, err := storage.dbpool.Query(ctx,
 		`SELECT number, login, status, accrual, uploaded_at FROM orders WHERE login = $1 ORDER BY uploaded_at ASC`,
 		login)
 
@@ -100,10 +279,19 @@ func (storage *Database) GetOrders(login string) (*[]Order, error) {
 	return &orders, rows.Err()
 }
 
-// извлекает все заказы всех пользователей из базы, требующие обновление статуса и начислений
-func (storage *Database) GetOrdersForUpdate() (*[]Order, error) {
-	rows, err := storage.dbpool.Query(storage.Ctx,
-		`SELECT number, login, status, accrual, uploaded_at FROM orders WHERE status IN ($1, $2, $3) ORDER BY uploaded_at ASC`, StatusNew, StatusProcessing, StatusRegistered)
+// извлекает все заказы всех пользователей из базы, требующие обновление статуса и начислений.
+// reconcile > 0 — только заказы, по которым результатов не было дольше reconcile:
+// остальные система начислений присылает сама
+func (storage *Database) GetOrdersForUpdate(ctx context.Context, reconcile time.Duration) (*[]Order, error) {
+	ctx, _, end := storage.startSpan(ctx, "GetOrdersForUpdate")
+	defer end()
+
+	rows, err := storage.dbpool.Query(ctx,
+		`SELECT number, login, status, accrual, uploaded_at FROM orders
+		  WHERE status IN ($1, $2, $3)
+		    AND ($4::bigint = 0 OR COALESCE(accrual_checked_at, uploaded_at) <= NOW() - make_interval(secs => $4::bigint))
+		  ORDER BY uploaded_at ASC`,
+		StatusNew, StatusProcessing, StatusRegistered, int64(reconcile/time.Second))
 
 	if err != nil {
 		return nil, err
@@ -122,3 +310,46 @@ func (storage *Database) GetOrdersForUpdate() (*[]Order, error) {
 
 	return &orders, rows.Err()
 }
+
+// отмечает, что результат расчёта по заказу получен, даже если статус не изменился:
+// сверка опросом нужна только заказам, о которых давно ничего не известно
+func (storage *Database) MarkAccrualChecked(ctx context.Context, orderNumber string) error {
+	ctx, _, end := storage.startSpan(ctx, "MarkAccrualChecked")
+	defer end()
+
+	_, err := storage.dbpool.Exec(ctx, `UPDATE orders SET accrual_checked_at = NOW() WHERE number = $1`, orderNumber)
+
+	return err
+}
+
+// количество заказов, ожидающих обновления статуса и начислений, по статусам
+func (storage *Database) CountOrdersForUpdate(ctx context.Context) (map[string]int, error) {
+	ctx, _, end := storage.startSpan(ctx, "CountOrdersForUpdate")
+	defer end()
+
+	rows, err := storage.dbpool.Query(ctx,
+		`SELECT status, count(*) FROM orders WHERE status IN ($1, $2, $3) GROUP BY status`, StatusNew, StatusProcessing, StatusRegistered)
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := map[string]int{
+		string(StatusNew):        0,
+		string(StatusProcessing): 0,
+		string(StatusRegistered): 0,
+	}
+
+	for rows.Next() {
+		var status string
+		var count int
+		err := rows.Scan(&status, &count)
+		if err != nil {
+			return nil, err
+		}
+		counts[status] = count
+	}
+
+	return counts, rows.Err()
+}
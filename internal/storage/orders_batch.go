@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/region23/praktikum-diplom/internal/logging"
+	"github.com/region23/praktikum-diplom/internal/tracing"
+)
+
+// начиная с какого размера пакета заказы загружаются через COPY
+const copyThreshold = 100
+
+type BatchResult string
+
+const (
+	BatchAccepted     BatchResult = "accepted"      // новый номер заказа принят в обработку
+	BatchAlreadyYours BatchResult = "already_yours" // номер заказа уже был загружен этим пользователем
+	BatchConflict     BatchResult = "conflict"      // номер заказа уже был загружен другим пользователем
+	BatchInvalid      BatchResult = "invalid"       // неверный формат номера заказа
+)
+
+// Добавляет пакет заказов пользователя одной транзакцией.
+// Номера должны быть уже проверены и не повторяться.
+// Возвращает результат обработки для каждого номера.
+func (storage *Database) AddOrdersBatch(ctx context.Context, login string, numbers []string) (map[string]BatchResult, error) {
+	ctx, span, end := storage.startSpan(ctx, "AddOrdersBatch")
+	defer end()
+
+	tx, err := storage.dbpool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	var inserted []string
+	if len(numbers) >= copyThreshold {
+		inserted, err = storage.copyOrders(ctx, tx, login, numbers)
+	} else {
+		inserted, err = storage.insertOrders(ctx, tx, login, numbers)
+	}
+	if err != nil {
+		logging.FromContext(ctx).Error().Err(err).Msg("Unable to INSERT orders batch to DB")
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+
+	results := make(map[string]BatchResult, len(numbers))
+	for _, number := range inserted {
+		results[number] = BatchAccepted
+	}
+
+	// для номеров, которые не удалось вставить, выясняем, кому они принадлежат
+	if len(inserted) < len(numbers) {
+		rows, err := tx.Query(ctx,
+			`SELECT number, login FROM orders WHERE number = ANY($1)`,
+			numbers)
+		if err != nil {
+			return nil, err
+		}
+
+		for rows.Next() {
+			var number, owner string
+			if err := rows.Scan(&number, &owner); err != nil {
+				rows.Close()
+				return nil, err
+			}
+
+			if _, ok := results[number]; ok {
+				continue
+			}
+
+			if owner == login {
+				results[number] = BatchAlreadyYours
+			} else {
+				results[number] = BatchConflict
+			}
+		}
+		rows.Close()
+
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	// одна запись на пакет: списки номеров по результату
+	after := make(map[BatchResult][]string)
+	for _, number := range numbers {
+		result := results[number]
+		after[result] = append(after[result], number)
+	}
+	if err := storage.addAudit(ctx, tx, login, AuditOrdersBatchUploaded, nil, after); err != nil {
+		return nil, err
+	}
+
+	return results, tx.Commit(ctx)
+}
+
+// вставляет небольшой пакет одним INSERT ... SELECT unnest
+func (storage *Database) insertOrders(ctx context.Context, tx pgx.Tx, login string, numbers []string) ([]string, error) {
+	rows, err := tx.Query(ctx,
+		`INSERT INTO orders (number, login, status)
+		 SELECT n, $2, $3 FROM unnest($1::varchar[]) AS n
+		 ON CONFLICT (number) DO NOTHING
+		 RETURNING number`,
+		numbers, login, StatusNew)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanNumbers(rows)
+}
+
+// загружает большой пакет через COPY во временную таблицу и переносит в orders
+func (storage *Database) copyOrders(ctx context.Context, tx pgx.Tx, login string, numbers []string) ([]string, error) {
+	_, err := tx.Exec(ctx,
+		`CREATE TEMP TABLE orders_batch (number VARCHAR(100) NOT NULL) ON COMMIT DROP`)
+	if err != nil {
+		return nil, err
+	}
+
+	source := make([][]interface{}, len(numbers))
+	for i, number := range numbers {
+		source[i] = []interface{}{number}
+	}
+
+	copied, err := tx.CopyFrom(ctx, pgx.Identifier{"orders_batch"}, []string{"number"}, pgx.CopyFromRows(source))
+	if err != nil {
+		return nil, err
+	}
+
+	if copied != int64(len(numbers)) {
+		return nil, fmt.Errorf("COPY загрузил %d номеров из %d", copied, len(numbers))
+	}
+
+	rows, err := tx.Query(ctx,
+		`INSERT INTO orders (number, login, status)
+		 SELECT number, $1, $2 FROM orders_batch
+		 ON CONFLICT (number) DO NOTHING
+		 RETURNING number`,
+		login, StatusNew)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanNumbers(rows)
+}
+
+func scanNumbers(rows pgx.Rows) ([]string, error) {
+	defer rows.Close()
+
+	var numbers []string
+	for rows.Next() {
+		var number string
+		if err := rows.Scan(&number); err != nil {
+			return nil, err
+		}
+		numbers = append(numbers, number)
+	}
+
+	return numbers, rows.Err()
+}
@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/region23/praktikum-diplom/internal/tracing"
+)
+
+// Увеличивает счётчик запросов по ключу в текущем окне. Окна считаются по часам
+// базы данных, чтобы у всех экземпляров сервиса они совпадали.
+// Возвращает значение счётчика и время окончания окна
+func (storage *Database) HitRateLimit(ctx context.Context, key string, window time.Duration) (int, time.Time, error) {
+	ctx, span, end := storage.startSpan(ctx, "HitRateLimit")
+	defer end()
+
+	seconds := int64(window / time.Second)
+
+	row := storage.dbpool.QueryRow(ctx,
+		`INSERT INTO rate_limits (key, window_start, expires_at, count)
+		 SELECT $1, start, start + make_interval(secs => $2::bigint), 1
+		   FROM (SELECT to_timestamp(floor(extract(epoch FROM NOW()) / $2::bigint) * $2::bigint) AS start) w
+		 ON CONFLICT (key, window_start) DO UPDATE SET count = rate_limits.count + 1
+		 RETURNING count, expires_at`,
+		key, seconds)
+
+	var count int
+	var reset time.Time
+	if err := row.Scan(&count, &reset); err != nil {
+		tracing.RecordError(span, err)
+		return 0, time.Time{}, err
+	}
+
+	return count, reset, nil
+}
+
+// удаляет счётчики закончившихся окон
+func (storage *Database) DeleteExpiredRateLimits(ctx context.Context) error {
+	ctx, _, end := storage.startSpan(ctx, "DeleteExpiredRateLimits")
+	defer end()
+
+	_, err := storage.dbpool.Exec(ctx, `DELETE FROM rate_limits WHERE expires_at < NOW()`)
+
+	return err
+}
@@ -0,0 +1,251 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	my_errors "github.com/region23/praktikum-diplom/internal/errors"
+)
+
+// состояния приглашения
+const (
+	ReferralPending  = "pending"  // приглашённый ещё не сделал обработанный заказ
+	ReferralRewarded = "rewarded" // бонусы начислены
+	ReferralCapped   = "capped"   // пригласивший исчерпал лимит бонусов, приглашение без бонусов
+	ReferralRejected = "rejected" // похоже на второй аккаунт пригласившего, приглашение без бонусов
+)
+
+// Referral — приглашённый пользователь
+type Referral struct {
+	Login      string     `json:"login"`                 // логин приглашённого
+	Status     string     `json:"status"`                // состояние приглашения
+	Bonus      float64    `json:"bonus"`                 // бонус пригласившему
+	CreatedAt  time.Time  `json:"created_at"`            // когда приглашённый зарегистрировался
+	RewardedAt *time.Time `json:"rewarded_at,omitempty"` // когда начислены бонусы
+}
+
+// Referrals — реферальный код пользователя и приглашённые им
+type Referrals struct {
+	Code      string     `json:"code"`
+	Referrals []Referral `json:"referrals"`
+}
+
+// ReferralReward — бонусы за приглашение
+type ReferralReward struct {
+	Inviter      string  `json:"inviter"`
+	Invitee      string  `json:"invitee"`
+	Order        string  `json:"order"` // первый обработанный заказ приглашённого
+	InviterBonus float64 `json:"inviter_bonus"`
+	InviteeBonus float64 `json:"invitee_bonus"`
+}
+
+// сколько случайных байт в реферальном коде: 80 бит, 16 символов base32
+const referralCodeBytes = 10
+
+var referralEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// случайный реферальный код. В нём нет ничего, кроме случайных байт,
+// поэтому коды других пользователей нельзя получить перебором соседних значений
+func newReferralCode() (string, error) {
+	b := make([]byte, referralCodeBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return referralEncoding.EncodeToString(b), nil
+}
+
+// выдаёт пользователю новый реферальный код
+func setReferralCode(ctx context.Context, tx pgx.Tx, login string) error {
+	code, err := newReferralCode()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `UPDATE users SET referral_code = $2 WHERE login = $1`, login, code)
+
+	return err
+}
+
+// выдаёт коды пользователям без кода или со старым кодом, который можно было подобрать
+func assignReferralCodes(ctx context.Context, dbpool *pgxpool.Pool) error {
+	tx, err := dbpool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx,
+		`SELECT login FROM users WHERE referral_code IS NULL OR length(referral_code) <> $1`,
+		referralEncoding.EncodedLen(referralCodeBytes))
+	if err != nil {
+		return err
+	}
+
+	var logins []string
+	for rows.Next() {
+		var login string
+		if err := rows.Scan(&login); err != nil {
+			rows.Close()
+			return err
+		}
+		logins = append(logins, login)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, login := range logins {
+		if err := setReferralCode(ctx, tx, login); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+// приглашённый, скорее всего, — второй аккаунт пригласившего:
+// зарегистрирован с того же адреса и из того же клиентского приложения
+func sameClient(inviter, invitee Actor) bool {
+	return inviter.IP != "" && inviter.IP == invitee.IP && inviter.UserAgent == invitee.UserAgent
+}
+
+// связывает нового пользователя с пригласившим по реферальному коду и возвращает
+// состояние приглашения. Вызывается в транзакции AddUser до того, как новый
+// пользователь получит свой код, поэтому тем же аккаунтом пригласить себя нельзя.
+// Второй аккаунт, зарегистрированный оттуда же, откуда пригласивший, бонусов не получит
+func (storage *Database) addReferral(ctx context.Context, tx pgx.Tx, invitee, code string, actor Actor) (string, error) {
+	var inviter Actor
+	err := tx.QueryRow(ctx,
+		`SELECT login, registration_ip, registration_user_agent FROM users WHERE referral_code = upper($1)`,
+		code).Scan(&inviter.Name, &inviter.IP, &inviter.UserAgent)
+	if err == pgx.ErrNoRows {
+		return "", my_errors.ErrInvalidReferral
+	}
+	if err != nil {
+		return "", err
+	}
+
+	status := ReferralPending
+	if sameClient(inviter, actor) {
+		status = ReferralRejected
+	}
+
+	_, err = tx.Exec(ctx,
+		`INSERT INTO referrals (invitee, inviter, status) VALUES ($1, $2, $3)`,
+		invitee, inviter.Name, status)
+
+	return status, err
+}
+
+// начисляет бонусы за приглашение, когда у приглашённого обработан первый заказ.
+// Вызывается в транзакции UpdateOrder; приглашение переводится из pending один раз
+func (storage *Database) applyReferral(ctx context.Context, tx pgx.Tx, invitee, orderNumber string) error {
+	var inviter string
+	err := tx.QueryRow(ctx,
+		`SELECT inviter FROM referrals WHERE invitee = $1 AND status = $2 FOR UPDATE`,
+		invitee, ReferralPending).Scan(&inviter)
+	if err == pgx.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// приглашения одного пользователя обрабатываются по очереди, чтобы не превысить лимит
+	_, err = tx.Exec(ctx, `SELECT 1 FROM users WHERE login = $1 FOR UPDATE`, inviter)
+	if err != nil {
+		return err
+	}
+
+	reward := ReferralReward{Inviter: inviter, Invitee: invitee, Order: orderNumber}
+	status := ReferralRewarded
+
+	if max := storage.points.ReferralMaxPerInviter; max > 0 {
+		var rewarded int
+		err = tx.QueryRow(ctx,
+			`SELECT COUNT(*) FROM referrals WHERE inviter = $1 AND status = $2`,
+			inviter, ReferralRewarded).Scan(&rewarded)
+		if err != nil {
+			return err
+		}
+		if rewarded >= max {
+			status = ReferralCapped
+		}
+	}
+
+	if status == ReferralRewarded {
+		reward.InviterBonus = storage.points.ReferralInviterBonus
+		reward.InviteeBonus = storage.points.ReferralInviteeBonus
+	}
+
+	_, err = tx.Exec(ctx,
+		`UPDATE referrals SET status = $2, inviter_bonus = $3, invitee_bonus = $4, rewarded_at = NOW()
+		  WHERE invitee = $1`,
+		invitee, status, reward.InviterBonus, reward.InviteeBonus)
+	if err != nil {
+		return err
+	}
+
+	// бонусы записываются отдельными партиями у каждого из пользователей
+	if reward.InviterBonus > 0 {
+		if err := storage.addLot(ctx, tx, inviter, LotSourceReferrer, invitee, reward.InviterBonus); err != nil {
+			return err
+		}
+	}
+	if reward.InviteeBonus > 0 {
+		if err := storage.addLot(ctx, tx, invitee, LotSourceReferee, orderNumber, reward.InviteeBonus); err != nil {
+			return err
+		}
+	}
+
+	for _, login := range []string{inviter, invitee} {
+		if err := storage.addEvent(ctx, tx, login, EventReferralRewarded, reward); err != nil {
+			return err
+		}
+
+		after := map[string]interface{}{"status": status, "reward": reward}
+		if err := storage.addAudit(ctx, tx, login, AuditReferralRewarded, nil, after); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// реферальный код пользователя и приглашённые им, от новых к старым
+func (storage *Database) GetReferrals(ctx context.Context, login string) (*Referrals, error) {
+	ctx, _, end := storage.startSpan(ctx, "GetReferrals")
+	defer end()
+
+	result := Referrals{Referrals: []Referral{}}
+	err := storage.dbpool.QueryRow(ctx, `SELECT referral_code FROM users WHERE login = $1`, login).Scan(&result.Code)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := storage.dbpool.Query(ctx,
+		`SELECT invitee, status, inviter_bonus, created_at, rewarded_at
+		   FROM referrals WHERE inviter = $1
+		  ORDER BY created_at DESC`,
+		login)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var referral Referral
+		if err := rows.Scan(&referral.Login, &referral.Status, &referral.Bonus, &referral.CreatedAt, &referral.RewardedAt); err != nil {
+			return nil, err
+		}
+		result.Referrals = append(result.Referrals, referral)
+	}
+
+	return &result, rows.Err()
+}
@@ -0,0 +1,25 @@
+package storage
+
+import "testing"
+
+func TestSameClient(t *testing.T) {
+	const browser = "Mozilla/5.0 (X11; Linux x86_64) Firefox/128.0"
+
+	tests := []struct {
+		name    string
+		inviter Actor
+		invitee Actor
+		want    bool
+	}{
+		{"тот же адрес и клиент", Actor{IP: "203.0.113.7", UserAgent: browser}, Actor{IP: "203.0.113.7", UserAgent: browser}, true},
+		{"другой адрес", Actor{IP: "203.0.113.7", UserAgent: browser}, Actor{IP: "198.51.100.1", UserAgent: browser}, false},
+		{"другой клиент за тем же адресом", Actor{IP: "203.0.113.7", UserAgent: browser}, Actor{IP: "203.0.113.7", UserAgent: "curl/8.5.0"}, false},
+		// пригласивший зарегистрирован до того, как адрес стал записываться
+		{"адрес пригласившего неизвестен", Actor{}, Actor{}, false},
+	}
+	for _, tt := range tests {
+		if got := sameClient(tt.inviter, tt.invitee); got != tt.want {
+			t.Errorf("%s: sameClient = %v, ожидали %v", tt.name, got, tt.want)
+		}
+	}
+}
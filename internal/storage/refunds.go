@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	my_errors "github.com/region23/praktikum-diplom/internal/errors"
+	"github.com/region23/praktikum-diplom/internal/logging"
+	"github.com/region23/praktikum-diplom/internal/tracing"
+)
+
+// Refund — возврат баллов по списанию
+type Refund struct {
+	ID        int64     `json:"id"`
+	Order     string    `json:"order"`
+	Login     string    `json:"login"`
+	Amount    float64   `json:"amount"`
+	Reason    string    `json:"reason,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// блокирует списание до конца транзакции. Если задан merchant, списание другого магазина
+// не находится, как будто его нет; пусто — запрос администратора, доступны все списания
+func (storage *Database) lockWithdrawal(ctx context.Context, tx pgx.Tx, orderNumber, merchant string) (string, Withdraw, *time.Time, error) {
+	var login string
+	var withdraw Withdraw
+	var expiresAt *time.Time
+
+	err := tx.QueryRow(ctx,
+		`SELECT login, order_number, sum, processed_at, status, refunded, merchant, expires_at
+		   FROM withdrawals WHERE order_number = $1 AND ($2 = '' OR merchant = $2) FOR UPDATE`,
+		orderNumber, merchant).Scan(&login, &withdraw.Order, &withdraw.Sum, &withdraw.ProcessedAt, &withdraw.Status,
+		&withdraw.Refunded, &withdraw.Merchant, &expiresAt)
+	if err == pgx.ErrNoRows {
+		return "", withdraw, nil, my_errors.ErrNotFound
+	}
+
+	return login, withdraw, expiresAt, err
+}
+
+// Подтверждает списание: магазин принял заказ, оплаченный баллами.
+// merchant — магазин, от имени которого запрос, пусто — администратор
+func (storage *Database) ConfirmWithdrawal(ctx context.Context, orderNumber, merchant string) (*Withdraw, error) {
+	ctx, span, end := storage.startSpan(ctx, "ConfirmWithdrawal")
+	defer end()
+
+	tx, err := storage.dbpool.Begin(ctx)
+	if err != nil {
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	login, withdraw, _, err := storage.lockWithdrawal(ctx, tx, orderNumber, merchant)
+	if err != nil {
+		return nil, err
+	}
+
+	if withdraw.Status != WithdrawPending {
+		return nil, fmt.Errorf("списание в статусе %s: %w", withdraw.Status, my_errors.ErrWithdrawalState)
+	}
+
+	before := withdraw
+	withdraw.Status = WithdrawConfirmed
+
+	_, err = tx.Exec(ctx, `UPDATE withdrawals SET status = $1 WHERE order_number = $2`, withdraw.Status, orderNumber)
+	if err != nil {
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+
+	if err := storage.addEvent(ctx, tx, login, EventWithdrawalConfirmed, withdraw); err != nil {
+		return nil, err
+	}
+	if err := storage.addAudit(ctx, tx, login, AuditWithdrawalConfirmed, before, withdraw); err != nil {
+		return nil, err
+	}
+
+	return &withdraw, tx.Commit(ctx)
+}
+
+// Возвращает пользователю amount баллов по списанию, amount = 0 — всё, что ещё не возвращено.
+// Возврат записывается отдельной операцией и новой партией баллов со сроком сгорания
+// самых ранних из списанных баллов. Когда возвращено всё, списание отменяется.
+// merchant — магазин, от имени которого запрос, пусто — администратор
+func (storage *Database) RefundWithdrawal(ctx context.Context, orderNumber, merchant string, amount float64, reason string) (*Withdraw, error) {
+	ctx, span, end := storage.startSpan(ctx, "RefundWithdrawal")
+	defer end()
+
+	tx, err := storage.dbpool.Begin(ctx)
+	if err != nil {
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	login, withdraw, expiresAt, err := storage.lockWithdrawal(ctx, tx, orderNumber, merchant)
+	if err != nil {
+		return nil, err
+	}
+
+	if withdraw.Status == WithdrawCancelled {
+		return nil, fmt.Errorf("списание уже отменено: %w", my_errors.ErrWithdrawalState)
+	}
+
+	left := withdraw.Sum - withdraw.Refunded
+	if amount == 0 {
+		amount = left
+	}
+	if amount > left {
+		return nil, fmt.Errorf("вернуть можно не больше %v: %w", left, my_errors.ErrWithdrawalState)
+	}
+
+	before := withdraw
+	withdraw.Refunded += amount
+	// копейки, накопленные при сложении частичных возвратов, не должны мешать отмене
+	if math.Abs(withdraw.Sum-withdraw.Refunded) < 0.005 {
+		withdraw.Status = WithdrawCancelled
+	}
+
+	_, err = tx.Exec(ctx,
+		`UPDATE withdrawals SET refunded = refunded + $1, status = $2 WHERE order_number = $3`,
+		amount, withdraw.Status, orderNumber)
+	if err != nil {
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+
+	refund := Refund{Order: orderNumber, Login: login, Amount: amount, Reason: reason}
+	err = tx.QueryRow(ctx,
+		`INSERT INTO refunds (order_number, login, amount, reason) VALUES ($1, $2, $3, $4) RETURNING id, created_at`,
+		orderNumber, login, amount, reason).Scan(&refund.ID, &refund.CreatedAt)
+	if err != nil {
+		logging.FromContext(ctx).Error().Err(err).Msg("Unable to INSERT refund to DB")
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+
+	reference := fmt.Sprintf("%s:%d", orderNumber, refund.ID)
+	err = storage.addLotExpiring(ctx, tx, login, LotSourceRefund, reference, amount, expiresAt)
+	if err != nil {
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+
+	if err := storage.addEvent(ctx, tx, login, EventWithdrawalRefunded, refund); err != nil {
+		return nil, err
+	}
+	if err := storage.addAudit(ctx, tx, login, AuditWithdrawalRefunded, before, withdraw); err != nil {
+		return nil, err
+	}
+
+	return &withdraw, tx.Commit(ctx)
+}
@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+type EntryType string
+
+const (
+	EntryAccrual     EntryType = "accrual"      // начисление баллов за заказ
+	EntryWithdrawal  EntryType = "withdrawal"   // списание баллов
+	EntryExpiry      EntryType = "expiry"       // сгорание баллов с истёкшим сроком
+	EntryTierBonus   EntryType = "tier_bonus"   // бонус уровня лояльности за заказ
+	EntryCampaign    EntryType = "campaign"     // бонус по акции
+	EntryReferrer    EntryType = "referrer"     // бонус за приглашённого пользователя
+	EntryReferee     EntryType = "referee"      // бонус приглашённому пользователю
+	EntryTransferIn  EntryType = "transfer_in"  // перевод от другого пользователя
+	EntryTransferOut EntryType = "transfer_out" // перевод другому пользователю
+	EntryRefund      EntryType = "refund"       // возврат баллов по отменённому заказу
+	EntryAdjustment  EntryType = "adjustment"   // корректировка начисления по заказу
+	// возврат отправителю баллов по переводу, который не подтвердили вовремя
+	EntryTransferReturn EntryType = "transfer_return"
+)
+
+type StatementEntry struct {
+	Date      time.Time `json:"date"`      // время операции
+	Type      EntryType `json:"type"`      // тип операции
+	Reference string    `json:"reference"` // номер заказа, к которому относится операция
+	Amount    float64   `json:"amount"`    // сумма операции: начисления положительные, списания отрицательные
+	Balance   float64   `json:"balance"`   // баланс после операции
+}
+
+// все операции пользователя, влияющие на баланс. Начисления берутся из партий баллов:
+// в них остаётся первоначальная сумма, даже если начисление по заказу потом уменьшили
+const statementEntries = `
+	SELECT created_at AS date,
+	       CASE source WHEN 'order' THEN 'accrual' ELSE source END AS type,
+	       reference, amount
+	  FROM point_lots WHERE login = $1 AND source <> 'clawback'
+	UNION ALL
+	SELECT processed_at, 'withdrawal', order_number, -sum
+	  FROM withdrawals WHERE login = $1
+	UNION ALL
+	SELECT expired_at, 'expiry', reference, -amount
+	  FROM point_expirations WHERE login = $1
+	UNION ALL
+	SELECT created_at, 'transfer_out', id::text, -amount
+	  FROM transfers WHERE sender = $1
+	UNION ALL
+	SELECT created_at, 'adjustment', order_number, -amount
+	  FROM adjustments WHERE login = $1`
+
+// баланс пользователя на момент from
+func (storage *Database) OpeningBalance(ctx context.Context, login string, from time.Time) (float64, error) {
+	ctx, _, end := storage.startSpan(ctx, "OpeningBalance")
+	defer end()
+
+	row := storage.dbpool.QueryRow(ctx,
+		`SELECT COALESCE(SUM(amount), 0) FROM (`+statementEntries+`) e WHERE date < $2`,
+		login, from)
+
+	var balance float64
+	err := row.Scan(&balance)
+
+	return balance, err
+}
+
+// Построчно передаёт в fn операции пользователя за период [from, to) в хронологическом порядке
+// с нарастающим итогом, начиная с opening. Строки читаются из базы по мере обработки,
+// вся выписка в памяти не держится. Возвращает баланс на конец периода.
+func (storage *Database) StreamStatement(ctx context.Context, login string, from, to time.Time, opening float64, fn func(StatementEntry) error) (float64, error) {
+	ctx, _, end := storage.startSpan(ctx, "StreamStatement")
+	defer end()
+
+	rows, err := storage.dbpool.Query(ctx,
+		`SELECT date, type, reference, amount FROM (`+statementEntries+`) e
+		 WHERE date >= $2 AND date < $3
+		 ORDER BY date ASC, reference ASC`,
+		login, from, to)
+	if err != nil {
+		return opening, err
+	}
+	defer rows.Close()
+
+	balance := opening
+	for rows.Next() {
+		var entry StatementEntry
+		err := rows.Scan(&entry.Date, &entry.Type, &entry.Reference, &entry.Amount)
+		if err != nil {
+			return balance, err
+		}
+
+		balance += entry.Amount
+		entry.Balance = balance
+
+		if err := fn(entry); err != nil {
+			return balance, err
+		}
+	}
+
+	return balance, rows.Err()
+}
@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/region23/praktikum-diplom/internal/loyalty"
+	"github.com/region23/praktikum-diplom/internal/tracing"
+)
+
+// TierStatus — уровень пользователя и прогресс до следующего
+type TierStatus struct {
+	Tier       string  `json:"tier,omitempty"` // текущий уровень, пусто — ещё не достигнут первый
+	Multiplier float64 `json:"multiplier"`     // множитель начислений текущего уровня
+	Basis      string  `json:"basis"`          // за что начисляется уровень: earned или spent
+	Months     int     `json:"months"`         // за сколько последних месяцев считается сумма
+	Amount     float64 `json:"amount"`         // сумма за период
+	// следующий уровень и сколько до него осталось
+	NextTier      string  `json:"next_tier,omitempty"`
+	NextThreshold float64 `json:"next_threshold,omitempty"`
+	Remaining     float64 `json:"remaining,omitempty"`
+}
+
+// TierChange — смена уровня пользователя
+type TierChange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// сумма, по которой определяется уровень пользователя, за последние TierWindowMonths месяцев
+func (storage *Database) tierAmount(ctx context.Context, tx pgx.Tx, login string) (float64, error) {
+	query := `SELECT COALESCE(SUM(accrual), 0) FROM orders
+		WHERE login = $1 AND status = 'PROCESSED'
+		  AND COALESCE(processed_at, uploaded_at) >= NOW() - make_interval(months => $2::int)`
+	if storage.points.TierBasis == loyalty.BasisSpent {
+		// возвращённые баллы не считаются потраченными, как и в Balance.Withdrawn
+		query = `SELECT COALESCE(SUM(sum - refunded), 0) FROM withdrawals
+			WHERE login = $1 AND status <> 'CANCELLED'
+			  AND processed_at >= NOW() - make_interval(months => $2::int)`
+	}
+
+	var amount float64
+	err := tx.QueryRow(ctx, query, login, storage.points.TierWindowMonths).Scan(&amount)
+
+	return amount, err
+}
+
+func (storage *Database) tierStatus(amount float64) TierStatus {
+	status := TierStatus{
+		Multiplier: 1,
+		Basis:      storage.points.TierBasis,
+		Months:     storage.points.TierWindowMonths,
+		Amount:     amount,
+	}
+
+	current, next := storage.points.Tiers.For(amount)
+	if current != nil {
+		status.Tier = current.Name
+		status.Multiplier = current.Multiplier
+	}
+	if next != nil {
+		status.NextTier = next.Name
+		status.NextThreshold = next.Threshold
+		status.Remaining = next.Threshold - amount
+	}
+
+	return status
+}
+
+// блокирует строку пользователя, чтобы параллельно обработанные заказы видели
+// уровень друг друга, и возвращает сохранённый уровень и уровень по текущей сумме.
+// Бонус за заказ считается по уровню, который был до этого заказа
+func (storage *Database) lockTier(ctx context.Context, tx pgx.Tx, login string) (string, *loyalty.Tier, error) {
+	var stored string
+	err := tx.QueryRow(ctx, `SELECT tier FROM users WHERE login = $1 FOR UPDATE`, login).Scan(&stored)
+	if err != nil {
+		return "", nil, err
+	}
+
+	amount, err := storage.tierAmount(ctx, tx, login)
+	if err != nil {
+		return "", nil, err
+	}
+
+	current, _ := storage.points.Tiers.For(amount)
+
+	return stored, current, nil
+}
+
+// пересчитывает уровень пользователя после обработки заказа. При смене уровня
+// сохраняет его, отправляет событие и пишет в журнал аудита
+func (storage *Database) recalculateTier(ctx context.Context, tx pgx.Tx, login, stored string) error {
+	amount, err := storage.tierAmount(ctx, tx, login)
+	if err != nil {
+		return err
+	}
+
+	status := storage.tierStatus(amount)
+	if status.Tier == stored {
+		return nil
+	}
+
+	_, err = tx.Exec(ctx, `UPDATE users SET tier = $1 WHERE login = $2`, status.Tier, login)
+	if err != nil {
+		return err
+	}
+
+	change := TierChange{From: stored, To: status.Tier}
+	if err := storage.addEvent(ctx, tx, login, EventTierChanged, change); err != nil {
+		return err
+	}
+
+	before := map[string]interface{}{"tier": stored}
+	after := map[string]interface{}{"tier": status.Tier, "amount": amount}
+	return storage.addAudit(ctx, tx, login, AuditTierChanged, before, after)
+}
+
+// Уровень пользователя и прогресс до следующего на текущий момент.
+// nil — уровни не настроены
+func (storage *Database) GetTier(ctx context.Context, login string) (*TierStatus, error) {
+	ctx, span, end := storage.startSpan(ctx, "GetTier")
+	defer end()
+
+	if len(storage.points.Tiers) == 0 {
+		return nil, nil
+	}
+
+	tx, err := storage.dbpool.Begin(ctx)
+	if err != nil {
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	amount, err := storage.tierAmount(ctx, tx, login)
+	if err != nil {
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+
+	status := storage.tierStatus(amount)
+
+	return &status, tx.Commit(ctx)
+}
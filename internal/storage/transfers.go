@@ -0,0 +1,368 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	my_errors "github.com/region23/praktikum-diplom/internal/errors"
+	"github.com/region23/praktikum-diplom/internal/logging"
+	"github.com/region23/praktikum-diplom/internal/tracing"
+)
+
+// направление перевода относительно пользователя, запросившего список
+const (
+	TransferIn  = "in"
+	TransferOut = "out"
+)
+
+// статусы перевода
+const (
+	TransferPending   = "PENDING"   // баллы списаны у отправителя и ждут подтверждения
+	TransferCompleted = "COMPLETED" // подтверждён, баллы зачислены получателю
+	TransferExpired   = "EXPIRED"   // не подтверждён вовремя, баллы вернулись отправителю
+)
+
+// Transfer — перевод баллов другому пользователю
+type Transfer struct {
+	ID          int64      `json:"id"`
+	Sender      string     `json:"sender"`
+	Recipient   string     `json:"recipient"`
+	Amount      float64    `json:"amount"`
+	Note        string     `json:"note,omitempty"`
+	Status      string     `json:"status"`
+	Direction   string     `json:"direction,omitempty"`    // in — получен, out — отправлен
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`   // до какого времени перевод можно подтвердить
+	ConfirmedAt *time.Time `json:"confirmed_at,omitempty"` // когда перевод подтверждён
+	CreatedAt   time.Time  `json:"created_at"`
+
+	// срок действия переведённых баллов: с ним они зачисляются получателю
+	// или возвращаются отправителю
+	lotExpiresAt *time.Time
+}
+
+// TransferLimits — сколько пользователь может перевести за последние сутки
+// и сколько перевод ждёт подтверждения
+type TransferLimits struct {
+	// сумма переводов, 0 — без ограничения
+	DailyAmount float64
+	// количество переводов, 0 — без ограничения
+	DailyCount int
+	// за сколько отправитель должен подтвердить перевод, иначе баллы вернутся к нему
+	PendingTTL time.Duration
+}
+
+// Создаёт перевод amount баллов от sender к recipient в статусе PENDING: у отправителя
+// баллы списываются из партий так же, как при списании, и перевод появляется в его
+// истории. Получатель не видит перевод и не может потратить баллы, пока отправитель
+// не подтвердит его через ConfirmTransfer; неподтверждённый вовремя перевод
+// возвращает отправителю ExpireTransfers.
+// Переведённые баллы сгорают не позже самых ранних из израсходованных партий,
+// чтобы переводом нельзя было продлить срок их действия
+func (storage *Database) AddTransfer(ctx context.Context, sender, recipient string, amount float64, note string) (*Transfer, error) {
+	ctx, span, end := storage.startSpan(ctx, "AddTransfer")
+	defer end()
+
+	tx, err := storage.dbpool.Begin(ctx)
+	if err != nil {
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	var exists bool
+	err = tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM users WHERE login = $1)`, recipient).Scan(&exists)
+	if err != nil {
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+	if !exists {
+		return nil, my_errors.ErrNotFound
+	}
+
+	// партии отправителя блокируются, как при списании: параллельные списания
+	// и переводы одного пользователя выполняются по очереди, в том числе проверка лимитов
+	err = storage.lockLots(ctx, tx, sender)
+	if err != nil {
+		logging.FromContext(ctx).Error().Err(err).Msg("Unable to lock point lots")
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+
+	if err := storage.checkTransferLimits(ctx, tx, sender, amount); err != nil {
+		return nil, err
+	}
+
+	senderBefore, err := storage.currentBalance(ctx, tx, sender)
+	if err != nil {
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+
+	if senderBefore.Blocked {
+		return nil, my_errors.ErrBalanceBlocked
+	}
+
+	if amount > senderBefore.Current {
+		return nil, my_errors.ErrInsufficientBalance
+	}
+
+	expiresAt, err := storage.consumeLots(ctx, tx, sender, amount)
+	if err != nil {
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+
+	transfer := Transfer{Sender: sender, Recipient: recipient, Amount: amount, Note: note, Status: TransferPending}
+	err = tx.QueryRow(ctx,
+		`INSERT INTO transfers (sender, recipient, amount, note, status, expires_at, lot_expires_at)
+		 VALUES ($1, $2, $3, $4, $5, NOW() + make_interval(secs => $6), $7)
+		 RETURNING id, expires_at, created_at`,
+		sender, recipient, amount, note, TransferPending, storage.transfers.PendingTTL.Seconds(), expiresAt).
+		Scan(&transfer.ID, &transfer.ExpiresAt, &transfer.CreatedAt)
+	if err != nil {
+		logging.FromContext(ctx).Error().Err(err).Msg("Unable to INSERT transfer to DB")
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+
+	if err := storage.addEvent(ctx, tx, sender, EventTransferSent, transfer); err != nil {
+		return nil, err
+	}
+
+	before := map[string]interface{}{"current": senderBefore.Current}
+	after := map[string]interface{}{"transfer": transfer, "current": senderBefore.Current - amount}
+	if err := storage.addAudit(ctx, tx, sender, AuditTransferSent, before, after); err != nil {
+		return nil, err
+	}
+
+	return &transfer, tx.Commit(ctx)
+}
+
+// Подтверждает перевод отправителя: баллы зачисляются получателю новой партией,
+// перевод появляется в его истории. Перевод другого отправителя считается ненайденным,
+// подтверждённый или истёкший возвращает ErrTransferState
+func (storage *Database) ConfirmTransfer(ctx context.Context, sender string, id int64) (*Transfer, error) {
+	ctx, span, end := storage.startSpan(ctx, "ConfirmTransfer")
+	defer end()
+
+	tx, err := storage.dbpool.Begin(ctx)
+	if err != nil {
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	transfer, expired, err := lockTransfer(ctx, tx, id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, my_errors.ErrNotFound
+	}
+	if err != nil {
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+	if transfer.Sender != sender {
+		return nil, my_errors.ErrNotFound
+	}
+
+	// истёкший, но ещё не обработанный ExpireTransfers перевод подтвердить тоже нельзя
+	if transfer.Status != TransferPending || expired {
+		return nil, my_errors.ErrTransferState
+	}
+
+	transfer.Status = TransferCompleted
+	transfer.ConfirmedAt = new(time.Time)
+	err = tx.QueryRow(ctx,
+		`UPDATE transfers SET status = $2, confirmed_at = NOW() WHERE id = $1 RETURNING confirmed_at`,
+		id, TransferCompleted).Scan(transfer.ConfirmedAt)
+	if err != nil {
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+
+	reference := strconv.FormatInt(transfer.ID, 10)
+	err = storage.addLotExpiring(ctx, tx, transfer.Recipient, LotSourceTransfer, reference, transfer.Amount, transfer.lotExpiresAt)
+	if err != nil {
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+
+	if err := storage.addEvent(ctx, tx, sender, EventTransferConfirmed, transfer); err != nil {
+		return nil, err
+	}
+	if err := storage.addEvent(ctx, tx, transfer.Recipient, EventTransferReceived, transfer); err != nil {
+		return nil, err
+	}
+	if err := storage.addAudit(ctx, tx, transfer.Recipient, AuditTransferReceived, nil, transfer); err != nil {
+		return nil, err
+	}
+
+	return transfer, tx.Commit(ctx)
+}
+
+// Возвращает отправителям баллы по переводам, которые не подтвердили вовремя,
+// не больше limit переводов за вызов. Баллы возвращаются партией с прежним сроком действия.
+// Возвращает количество обработанных переводов; если оно равно limit, стоит вызвать ещё раз.
+// Несколько экземпляров сервиса могут выполнять его одновременно: занятые переводы пропускаются
+func (storage *Database) ExpireTransfers(ctx context.Context, limit int) (int, error) {
+	ctx, span, end := storage.startSpan(ctx, "ExpireTransfers")
+	defer end()
+
+	ctx = WithActor(ctx, Actor{Name: ActorTransfersExpiry})
+
+	tx, err := storage.dbpool.Begin(ctx)
+	if err != nil {
+		tracing.RecordError(span, err)
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx,
+		`WITH due AS (
+			SELECT id FROM transfers
+			 WHERE status = $2 AND expires_at <= NOW()
+			 ORDER BY expires_at
+			 LIMIT $1
+			 FOR UPDATE SKIP LOCKED
+		 )
+		 UPDATE transfers t SET status = $3
+		   FROM due WHERE t.id = due.id
+		 RETURNING `+transferColumns,
+		limit, TransferPending, TransferExpired)
+	if err != nil {
+		tracing.RecordError(span, err)
+		return 0, err
+	}
+
+	var transfers []*Transfer
+	for rows.Next() {
+		transfer, err := scanTransfer(rows)
+		if err != nil {
+			rows.Close()
+			tracing.RecordError(span, err)
+			return 0, err
+		}
+		transfers = append(transfers, transfer)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		tracing.RecordError(span, err)
+		return 0, err
+	}
+
+	for _, transfer := range transfers {
+		reference := strconv.FormatInt(transfer.ID, 10)
+		err := storage.addLotExpiring(ctx, tx, transfer.Sender, LotSourceTransferReturn, reference, transfer.Amount, transfer.lotExpiresAt)
+		if err != nil {
+			tracing.RecordError(span, err)
+			return 0, err
+		}
+
+		if err := storage.addEvent(ctx, tx, transfer.Sender, EventTransferExpired, transfer); err != nil {
+			tracing.RecordError(span, err)
+			return 0, err
+		}
+		if err := storage.addAudit(ctx, tx, transfer.Sender, AuditTransferExpired, nil, transfer); err != nil {
+			tracing.RecordError(span, err)
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		tracing.RecordError(span, err)
+		return 0, err
+	}
+
+	return len(transfers), nil
+}
+
+const transferColumns = `id, sender, recipient, amount, note, status, expires_at, confirmed_at, lot_expires_at, created_at`
+
+func scanTransfer(row pgx.Row) (*Transfer, error) {
+	var transfer Transfer
+	err := row.Scan(&transfer.ID, &transfer.Sender, &transfer.Recipient, &transfer.Amount, &transfer.Note,
+		&transfer.Status, &transfer.ExpiresAt, &transfer.ConfirmedAt, &transfer.lotExpiresAt, &transfer.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &transfer, nil
+}
+
+// блокирует перевод до конца транзакции; expired — истёк ли срок подтверждения
+func lockTransfer(ctx context.Context, tx pgx.Tx, id int64) (*Transfer, bool, error) {
+	var expired bool
+	var transfer Transfer
+	err := tx.QueryRow(ctx,
+		`SELECT `+transferColumns+`, COALESCE(expires_at <= NOW(), false)
+		   FROM transfers WHERE id = $1 FOR UPDATE`,
+		id).Scan(&transfer.ID, &transfer.Sender, &transfer.Recipient, &transfer.Amount, &transfer.Note,
+		&transfer.Status, &transfer.ExpiresAt, &transfer.ConfirmedAt, &transfer.lotExpiresAt, &transfer.CreatedAt, &expired)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return &transfer, expired, nil
+}
+
+// проверяет, что перевод не превысит лимиты отправителя за последние сутки
+func (storage *Database) checkTransferLimits(ctx context.Context, tx pgx.Tx, sender string, amount float64) error {
+	limits := storage.transfers
+	if limits.DailyAmount <= 0 && limits.DailyCount <= 0 {
+		return nil
+	}
+
+	var count int
+	var total float64
+	err := tx.QueryRow(ctx,
+		`SELECT COUNT(*), COALESCE(SUM(amount), 0) FROM transfers
+		  WHERE sender = $1 AND status <> $2 AND created_at > NOW() - INTERVAL '1 day'`,
+		sender, TransferExpired).Scan(&count, &total)
+	if err != nil {
+		return err
+	}
+
+	if limits.DailyCount > 0 && count >= limits.DailyCount {
+		return my_errors.ErrTransferLimit
+	}
+	if limits.DailyAmount > 0 && total+amount > limits.DailyAmount {
+		return my_errors.ErrTransferLimit
+	}
+
+	return nil
+}
+
+// Переводы пользователя в обе стороны, от новых к старым. Входящие переводы
+// видны получателю только после подтверждения
+func (storage *Database) GetTransfers(ctx context.Context, login string) (*[]Transfer, error) {
+	ctx, _, end := storage.startSpan(ctx, "GetTransfers")
+	defer end()
+
+	rows, err := storage.dbpool.Query(ctx,
+		`SELECT `+transferColumns+`,
+				CASE WHEN sender = $1 THEN 'out' ELSE 'in' END
+		   FROM transfers
+		  WHERE sender = $1 OR (recipient = $1 AND status = $2)
+		  ORDER BY id DESC`,
+		login, TransferCompleted)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var transfers []Transfer
+	for rows.Next() {
+		var transfer Transfer
+		err := rows.Scan(&transfer.ID, &transfer.Sender, &transfer.Recipient, &transfer.Amount, &transfer.Note,
+			&transfer.Status, &transfer.ExpiresAt, &transfer.ConfirmedAt, &transfer.lotExpiresAt, &transfer.CreatedAt,
+			&transfer.Direction)
+		if err != nil {
+			return nil, err
+		}
+		transfers = append(transfers, transfer)
+	}
+
+	return &transfers, rows.Err()
+}
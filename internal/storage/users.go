@@ -1,26 +1,34 @@
 package storage
 
 import (
-	"github.com/rs/zerolog/log"
+	"context"
 
 	"github.com/jackc/pgx/v4"
+	"github.com/region23/praktikum-diplom/internal/logging"
+	"github.com/region23/praktikum-diplom/internal/metrics"
+	"github.com/region23/praktikum-diplom/internal/tracing"
 )
 
 type User struct {
 	ID       string `json:"id,omitempty"` // ID пользователя
 	Login    string `json:"login"`        // логин пользователя
 	Password string `json:"password"`     // хэш пароля SHA-256
+	// реферальный код пригласившего, необязательный
+	InvitedBy string `json:"referral_code,omitempty"`
 }
 
 // проверяем, есть ли пользователь с таким логином в базе
-func (storage *Database) UserExist(login, hashedPassword string) (bool, error) {
+func (storage *Database) UserExist(ctx context.Context, login, hashedPassword string) (bool, error) {
+	ctx, _, end := storage.startSpan(ctx, "UserExist")
+	defer end()
+
 	var row pgx.Row
 	if hashedPassword != "" {
-		row = storage.dbpool.QueryRow(storage.Ctx,
+		row = storage.dbpool.QueryRow(ctx,
 			`SELECT count(*) FROM users WHERE login = $1 AND password = $2`,
 			login, hashedPassword)
 	} else {
-		row = storage.dbpool.QueryRow(storage.Ctx,
+		row = storage.dbpool.QueryRow(ctx,
 			`SELECT count(*) FROM users WHERE login = $1`,
 			login)
 	}
@@ -46,8 +54,11 @@ func (storage *Database) UserExist(login, hashedPassword string) (bool, error) {
 }
 
 // извлекает пользователя из базы
-func (storage *Database) GetUser(login string) (*User, error) {
-	row := storage.dbpool.QueryRow(storage.Ctx,
+func (storage *Database) GetUser(ctx context.Context, login string) (*User, error) {
+	ctx, _, end := storage.startSpan(ctx, "GetUser")
+	defer end()
+
+	row := storage.dbpool.QueryRow(ctx,
 		`SELECT id, login, password FROM users WHERE login = $1`,
 		login)
 
@@ -67,16 +78,64 @@ func (storage *Database) GetUser(login string) (*User, error) {
 }
 
 // добавляет пользователя в базу
-func (storage *Database) AddUser(user *User) error {
-	_, err := storage.dbpool.Exec(storage.Ctx,
-		`INSERT INTO users (login, password) VALUES ($1, $2);`,
+func (storage *Database) AddUser(ctx context.Context, user *User) error {
+	ctx, span, end := storage.startSpan(ctx, "AddUser")
+	defer end()
+
+	tx, err := storage.dbpool.Begin(ctx)
+	if err != nil {
+		tracing.RecordError(span, err)
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	actor := ActorFromContext(ctx)
+	_, err = tx.Exec(ctx,
+		`INSERT INTO users (login, password, registration_ip, registration_user_agent) VALUES ($1, $2, $3, $4);`,
 		user.Login,
-		user.Password)
+		user.Password,
+		actor.IP,
+		actor.UserAgent)
+
+	if err != nil {
+		logging.FromContext(ctx).Error().Err(err).Msg("Unable to INSERT user to DB")
+		tracing.RecordError(span, err)
+		return err
+	}
+
+	var referralStatus string
+	if user.InvitedBy != "" {
+		referralStatus, err = storage.addReferral(ctx, tx, user.Login, user.InvitedBy, actor)
+		if err != nil {
+			tracing.RecordError(span, err)
+			return err
+		}
+	}
+
+	err = setReferralCode(ctx, tx, user.Login)
+	if err != nil {
+		tracing.RecordError(span, err)
+		return err
+	}
 
+	after := map[string]string{"login": user.Login}
+	if user.InvitedBy != "" {
+		after["referral_code"] = user.InvitedBy
+		after["referral_status"] = referralStatus
+	}
+	err = storage.addAudit(ctx, tx, user.Login, AuditUserRegistered, nil, after)
+	if err != nil {
+		tracing.RecordError(span, err)
+		return err
+	}
+
+	err = tx.Commit(ctx)
 	if err != nil {
-		log.Error().Err(err).Msg("Unable to INSERT user to DB")
+		tracing.RecordError(span, err)
 		return err
 	}
 
+	metrics.IncRegistrations()
+
 	return nil
 }
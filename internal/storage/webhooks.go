@@ -0,0 +1,365 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	my_errors "github.com/region23/praktikum-diplom/internal/errors"
+	"github.com/region23/praktikum-diplom/internal/tracing"
+)
+
+// Вебхуки доставляются через исходящую очередь (outbox): addEvent в той же транзакции,
+// что и само изменение, записывает в webhook_deliveries по строке на каждую подходящую
+// подписку. Доставкой занимается отдельный обработчик, поэтому недоступность получателя
+// не влияет на запросы пользователей, а откат транзакции не оставляет лишних вебхуков
+
+type WebhookDeliveryStatus string
+
+const (
+	WebhookPending   WebhookDeliveryStatus = "PENDING"   // ждёт очередной попытки доставки
+	WebhookDelivered WebhookDeliveryStatus = "DELIVERED" // получатель ответил 2xx
+	WebhookDead      WebhookDeliveryStatus = "DEAD"      // попытки кончились, доставка остановлена
+)
+
+// WebhookOwner — владелец подписки: пользователь или магазин с API-ключом.
+// Пользователь получает только свои события, магазин — только события списаний
+// в счёт своих заказов (MerchantEventTypes)
+type WebhookOwner struct {
+	Login    string
+	Merchant string
+}
+
+// имя владельца для журнала аудита
+func (owner WebhookOwner) String() string {
+	if owner.Merchant != "" {
+		return "merchant:" + owner.Merchant
+	}
+	return owner.Login
+}
+
+// WebhookSubscription — подписка на события
+type WebhookSubscription struct {
+	ID         int64     `json:"id"`
+	URL        string    `json:"url"`              // куда отправлять события
+	Secret     string    `json:"secret,omitempty"` // ключ подписи HMAC-SHA256, показывается только при создании
+	EventTypes []string  `json:"event_types"`      // типы событий, на которые оформлена подписка
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// WebhookDelivery — доставка одного события по одной подписке
+type WebhookDelivery struct {
+	ID             int64                 `json:"id"`
+	SubscriptionID int64                 `json:"subscription_id"`
+	EventID        int64                 `json:"event_id"`
+	EventType      string                `json:"event_type"`
+	Status         WebhookDeliveryStatus `json:"status"`
+	Attempts       int                   `json:"attempts"`                   // сколько попыток сделано
+	LastStatusCode int                   `json:"last_status_code,omitempty"` // код ответа получателя на последней попытке
+	LastError      string                `json:"last_error,omitempty"`       // ошибка последней попытки
+	NextAttemptAt  *time.Time            `json:"next_attempt_at,omitempty"`  // когда будет следующая попытка
+	CreatedAt      time.Time             `json:"created_at"`
+	DeliveredAt    *time.Time            `json:"delivered_at,omitempty"`
+}
+
+// PendingWebhook — доставка, взятая в работу обработчиком
+type PendingWebhook struct {
+	Delivery WebhookDelivery
+	URL      string
+	Secret   string
+	// тело запроса: событие в том же виде, что и в потоке событий пользователя
+	Body []byte
+}
+
+// WebhookAttempt — итог попытки доставки
+type WebhookAttempt struct {
+	Status     WebhookDeliveryStatus
+	StatusCode int
+	Error      string
+	// когда повторить, если Status = WebhookPending
+	NextAttemptAt time.Time
+}
+
+// события, на которые может подписаться магазин: о списаниях в счёт его заказов
+var MerchantEventTypes = []string{EventWithdrawalCreated, EventWithdrawalConfirmed, EventWithdrawalRefunded}
+
+// ставит событие в очередь доставки подписчикам. Вызывается из addEvent.
+// Подписка пользователя получает его события, подписка магазина — события
+// списаний, у которых указан этот магазин
+func (storage *Database) enqueueWebhooks(ctx context.Context, tx pgx.Tx, event Event) error {
+	// номер заказа списания есть в событиях о нём: и в Withdraw, и в Refund
+	var withdrawal struct {
+		Order string `json:"order"`
+	}
+	for _, eventType := range MerchantEventTypes {
+		if event.Type == eventType {
+			if err := json.Unmarshal(event.Payload, &withdrawal); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err := tx.Exec(ctx,
+		`INSERT INTO webhook_deliveries (subscription_id, event_id, event_type)
+		 SELECT s.id, $1, $2 FROM webhook_subscriptions s
+		  WHERE $2 = ANY(s.event_types)
+		    AND ((s.merchant = '' AND s.login = $3)
+		      OR (s.merchant <> '' AND EXISTS (
+				SELECT 1 FROM withdrawals w WHERE w.order_number = $4 AND w.merchant = s.merchant)))`,
+		event.ID, event.Type, event.Login, withdrawal.Order)
+
+	return err
+}
+
+// Создаёт подписку на события. У владельца может быть не больше limit подписок
+func (storage *Database) CreateWebhook(ctx context.Context, owner WebhookOwner, subscription WebhookSubscription, limit int) (*WebhookSubscription, error) {
+	ctx, span, end := storage.startSpan(ctx, "CreateWebhook")
+	defer end()
+
+	tx, err := storage.dbpool.Begin(ctx)
+	if err != nil {
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	// параллельные запросы одного владельца проверяют лимит по очереди
+	_, err = tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext('webhooks:' || $1))`, owner.String())
+	if err != nil {
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+
+	var count int
+	err = tx.QueryRow(ctx,
+		`SELECT COUNT(*) FROM webhook_subscriptions WHERE login = $1 AND merchant = $2`,
+		owner.Login, owner.Merchant).Scan(&count)
+	if err != nil {
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+	if count >= limit {
+		return nil, my_errors.ErrWebhookLimit
+	}
+
+	err = tx.QueryRow(ctx,
+		`INSERT INTO webhook_subscriptions (login, merchant, url, secret, event_types)
+		 VALUES ($1, $2, $3, $4, $5) RETURNING id, created_at`,
+		owner.Login, owner.Merchant, subscription.URL, subscription.Secret, subscription.EventTypes).
+		Scan(&subscription.ID, &subscription.CreatedAt)
+	if err != nil {
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+
+	// секрет в журнал не попадает
+	after := subscription
+	after.Secret = ""
+	if err := storage.addAudit(ctx, tx, owner.String(), AuditWebhookCreated, nil, after); err != nil {
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+
+	return &subscription, tx.Commit(ctx)
+}
+
+// подписки владельца, без секретов
+func (storage *Database) GetWebhooks(ctx context.Context, owner WebhookOwner) (*[]WebhookSubscription, error) {
+	ctx, _, end := storage.startSpan(ctx, "GetWebhooks")
+	defer end()
+
+	rows, err := storage.dbpool.Query(ctx,
+		`SELECT id, url, event_types, created_at FROM webhook_subscriptions
+		  WHERE login = $1 AND merchant = $2 ORDER BY id`,
+		owner.Login, owner.Merchant)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subscriptions []WebhookSubscription
+	for rows.Next() {
+		var s WebhookSubscription
+		if err := rows.Scan(&s.ID, &s.URL, &s.EventTypes, &s.CreatedAt); err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, s)
+	}
+
+	return &subscriptions, rows.Err()
+}
+
+// Удаляет подписку вместе с её очередью доставки
+func (storage *Database) DeleteWebhook(ctx context.Context, owner WebhookOwner, id int64) error {
+	ctx, span, end := storage.startSpan(ctx, "DeleteWebhook")
+	defer end()
+
+	tx, err := storage.dbpool.Begin(ctx)
+	if err != nil {
+		tracing.RecordError(span, err)
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var before WebhookSubscription
+	err = tx.QueryRow(ctx,
+		`DELETE FROM webhook_subscriptions WHERE id = $1 AND login = $2 AND merchant = $3
+		 RETURNING id, url, event_types, created_at`,
+		id, owner.Login, owner.Merchant).Scan(&before.ID, &before.URL, &before.EventTypes, &before.CreatedAt)
+	if err == pgx.ErrNoRows {
+		return my_errors.ErrNotFound
+	}
+	if err != nil {
+		tracing.RecordError(span, err)
+		return err
+	}
+
+	if err := storage.addAudit(ctx, tx, owner.String(), AuditWebhookDeleted, before, nil); err != nil {
+		tracing.RecordError(span, err)
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// журнал доставок по подписке от новых к старым, постранично по id как журнал аудита
+func (storage *Database) GetWebhookDeliveries(ctx context.Context, owner WebhookOwner, subscriptionID, beforeID int64, limit int) (*[]WebhookDelivery, error) {
+	ctx, _, end := storage.startSpan(ctx, "GetWebhookDeliveries")
+	defer end()
+
+	var exists bool
+	err := storage.dbpool.QueryRow(ctx,
+		`SELECT EXISTS (SELECT 1 FROM webhook_subscriptions WHERE id = $1 AND login = $2 AND merchant = $3)`,
+		subscriptionID, owner.Login, owner.Merchant).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, my_errors.ErrNotFound
+	}
+
+	rows, err := storage.dbpool.Query(ctx,
+		`SELECT id, subscription_id, event_id, event_type, status, attempts, last_status_code, last_error,
+				next_attempt_at, created_at, delivered_at
+		   FROM webhook_deliveries
+		  WHERE subscription_id = $1 AND ($2 = 0 OR id < $2)
+		  ORDER BY id DESC
+		  LIMIT $3`,
+		subscriptionID, beforeID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []WebhookDelivery
+	for rows.Next() {
+		var d WebhookDelivery
+		err := rows.Scan(&d.ID, &d.SubscriptionID, &d.EventID, &d.EventType, &d.Status, &d.Attempts,
+			&d.LastStatusCode, &d.LastError, &d.NextAttemptAt, &d.CreatedAt, &d.DeliveredAt)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	return &deliveries, rows.Err()
+}
+
+// Возвращает недоставленный вебхук в очередь: попытки начинаются заново
+func (storage *Database) RetryWebhookDelivery(ctx context.Context, owner WebhookOwner, subscriptionID, deliveryID int64) error {
+	ctx, _, end := storage.startSpan(ctx, "RetryWebhookDelivery")
+	defer end()
+
+	tag, err := storage.dbpool.Exec(ctx,
+		`UPDATE webhook_deliveries d SET status = $1, attempts = 0, next_attempt_at = NOW()
+		   FROM webhook_subscriptions s
+		  WHERE d.id = $2 AND d.subscription_id = $3 AND d.status = $4
+		    AND s.id = d.subscription_id AND s.login = $5 AND s.merchant = $6`,
+		WebhookPending, deliveryID, subscriptionID, WebhookDead, owner.Login, owner.Merchant)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return my_errors.ErrNotFound
+	}
+
+	return nil
+}
+
+// Берёт в работу до limit доставок, время попытки которых подошло. На время lease
+// доставки откладываются, чтобы другие экземпляры сервиса их не взяли; если обработчик
+// упадёт, не записав итог, по истечении lease доставка будет повторена
+func (storage *Database) ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]PendingWebhook, error) {
+	ctx, span, end := storage.startSpan(ctx, "ClaimWebhookDeliveries")
+	defer end()
+
+	rows, err := storage.dbpool.Query(ctx,
+		`WITH due AS (
+			SELECT id FROM webhook_deliveries
+			 WHERE status = $1 AND next_attempt_at <= NOW()
+			 ORDER BY next_attempt_at
+			 LIMIT $2
+			 FOR UPDATE SKIP LOCKED
+		 ), claimed AS (
+			UPDATE webhook_deliveries d SET next_attempt_at = NOW() + make_interval(secs => $3::bigint)
+			  FROM due WHERE d.id = due.id
+			RETURNING d.id, d.subscription_id, d.event_id, d.event_type, d.attempts, d.created_at
+		 )
+		 SELECT c.id, c.subscription_id, c.event_id, c.event_type, c.attempts, c.created_at,
+				s.url, s.secret, e.login, e.payload, e.created_at
+		   FROM claimed c
+		   JOIN webhook_subscriptions s ON s.id = c.subscription_id
+		   JOIN events e ON e.id = c.event_id`,
+		WebhookPending, limit, int64(lease/time.Second))
+	if err != nil {
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pending []PendingWebhook
+	for rows.Next() {
+		var p PendingWebhook
+		var event Event
+		err := rows.Scan(&p.Delivery.ID, &p.Delivery.SubscriptionID, &p.Delivery.EventID, &p.Delivery.EventType,
+			&p.Delivery.Attempts, &p.Delivery.CreatedAt, &p.URL, &p.Secret, &event.Login, &event.Payload, &event.CreatedAt)
+		if err != nil {
+			tracing.RecordError(span, err)
+			return nil, err
+		}
+
+		event.ID = p.Delivery.EventID
+		event.Type = p.Delivery.EventType
+		p.Delivery.Status = WebhookPending
+		p.Body, err = json.Marshal(event)
+		if err != nil {
+			return nil, err
+		}
+
+		pending = append(pending, p)
+	}
+
+	return pending, rows.Err()
+}
+
+// записывает итог попытки доставки
+func (storage *Database) CompleteWebhookDelivery(ctx context.Context, id int64, attempt WebhookAttempt) error {
+	ctx, _, end := storage.startSpan(ctx, "CompleteWebhookDelivery")
+	defer end()
+
+	var next *time.Time
+	if attempt.Status == WebhookPending {
+		next = &attempt.NextAttemptAt
+	}
+
+	_, err := storage.dbpool.Exec(ctx,
+		`UPDATE webhook_deliveries
+		    SET status = $2, attempts = attempts + 1, last_status_code = $3, last_error = $4,
+				next_attempt_at = $5,
+				delivered_at = CASE WHEN $2 = 'DELIVERED' THEN NOW() END
+		  WHERE id = $1`,
+		id, attempt.Status, attempt.StatusCode, attempt.Error, next)
+
+	return err
+}
@@ -1,122 +1,204 @@
 package storage
 
 import (
+	"context"
 	"fmt"
 	"time"
 
 	"github.com/jackc/pgx/v4"
 	my_errors "github.com/region23/praktikum-diplom/internal/errors"
-	"github.com/rs/zerolog/log"
+	"github.com/region23/praktikum-diplom/internal/logging"
+	"github.com/region23/praktikum-diplom/internal/metrics"
+	"github.com/region23/praktikum-diplom/internal/tracing"
+)
+
+type WithdrawStatus string
+
+const (
+	WithdrawPending   WithdrawStatus = "PENDING"   // магазин ещё не подтвердил заказ
+	WithdrawConfirmed WithdrawStatus = "CONFIRMED" // заказ подтверждён магазином
+	WithdrawCancelled WithdrawStatus = "CANCELLED" // заказ отменён, баллы возвращены полностью
 )
 
 type Withdraw struct {
-	Order       string    `json:"order"`        // номер заказа
-	Sum         float64   `json:"sum"`          // сумма списания в счет заказа 1 бал = 1 рубль (в копейках)
-	ProcessedAt time.Time `json:"processed_at"` // время списания
+	Order       string         `json:"order"`              // номер заказа
+	Sum         float64        `json:"sum"`                // сумма списания в счет заказа 1 бал = 1 рубль (в копейках)
+	ProcessedAt time.Time      `json:"processed_at"`       // время списания
+	Status      WithdrawStatus `json:"status,omitempty"`   // статус списания
+	Refunded    float64        `json:"refunded,omitempty"` // сколько баллов возвращено
+	// магазин, в котором оплачен заказ: только он может подтвердить списание или вернуть баллы.
+	// Пусто — списанием управляет только администратор
+	Merchant string `json:"merchant,omitempty"`
 }
 
 type Balance struct {
 	Current   float64 `json:"current"`   // текущая сумма балов лояльности
 	Withdrawn float64 `json:"withdrawn"` // сумма использованных за весь период регистрации баллов
+	// баланс отрицательный после корректировки начисления: списания и переводы недоступны
+	Blocked bool `json:"blocked,omitempty"`
+	// сколько баллов из текущих сгорит в ближайшее время
+	ExpiringSoon float64 `json:"expiring_soon,omitempty"`
+	// сгорающие баллы по дням
+	Expiring []ExpiringPoints `json:"expiring,omitempty"`
 }
 
-func (storage *Database) currentBalance(tx pgx.Tx, login string) (*Balance, error) {
-	// получить общее количество баллов лояльности, накопленных за весь период
-	row := tx.QueryRow(storage.Ctx,
-		`SELECT COALESCE(SUM(accrual), 0) as sum FROM orders WHERE login = $1 AND status = $2`,
-		login, StatusProcessed)
-
-	var totalaccruals float64
-
-	err := row.Scan(&totalaccruals)
+func (storage *Database) currentBalance(ctx context.Context, tx pgx.Tx, login string) (*Balance, error) {
+	// текущий баланс — остатки действующих партий баллов
+	current, err := storage.availablePoints(ctx, tx, login)
 	if err != nil {
 		return nil, err
 	}
 
-	// сумма использованных за весь период регистрации баллов
-	row2 := tx.QueryRow(storage.Ctx,
-		`SELECT COALESCE(SUM(sum), 0) as sum FROM withdrawals WHERE login = $1`,
+	// сумма использованных за весь период регистрации баллов, без возвращённых
+	row := tx.QueryRow(ctx,
+		`SELECT COALESCE(SUM(sum - refunded), 0) as sum FROM withdrawals WHERE login = $1`,
 		login)
 
 	var withdrawn float64
 
-	err = row2.Scan(&withdrawn)
+	err = row.Scan(&withdrawn)
 	if err != nil {
 		return nil, err
 	}
 
-	current := totalaccruals - withdrawn
+	balance := Balance{Current: current, Withdrawn: withdrawn, Blocked: current < 0}
 
-	balance := Balance{Current: current, Withdrawn: withdrawn}
+	balance.Expiring, err = storage.expiringSoon(ctx, tx, login)
+	if err != nil {
+		return nil, err
+	}
+	for _, points := range balance.Expiring {
+		balance.ExpiringSoon += points.Amount
+	}
 
 	return &balance, nil
 }
 
 // Получение текущего баланса пользователя
-func (storage *Database) CurrentBalance(login string) (*Balance, error) {
-	tx, err := storage.dbpool.Begin(storage.Ctx)
+func (storage *Database) CurrentBalance(ctx context.Context, login string) (*Balance, error) {
+	ctx, _, end := storage.startSpan(ctx, "CurrentBalance")
+	defer end()
+
+	tx, err := storage.dbpool.Begin(ctx)
 	if err != nil {
 		return nil, err
 	}
-	//defer tx.Rollback(storage.Ctx)
-	balance, err := storage.currentBalance(tx, login)
+	//defer tx.Rollback(ctx)
+	balance, err := storage.currentBalance(ctx, tx, login)
 	if err != nil {
 		wrapped := fmt.Errorf("[functionName] error when getting current balance: %w", err)
-		errRlbck := tx.Rollback(storage.Ctx)
+		errRlbck := tx.Rollback(ctx)
 		if errRlbck != nil {
-			log.Error().Err(errRlbck).Msg("[functionName] error when rollback transaction in current balance")
+			logging.FromContext(ctx).Error().Err(errRlbck).Msg("[functionName] error when rollback transaction in current balance")
 		}
 
 		return nil, wrapped
 	}
 
-	return balance, tx.Commit(storage.Ctx)
+	return balance, tx.Commit(ctx)
 }
 
 // Добавляем новое списание баллов
-// sum - сумма списания в рублях
-func (storage *Database) AddWithdraw(orderNumber string, login string, sum float64) error {
+// sum - сумма списания в рублях.
+// merchant - магазин, в котором оплачен заказ, может быть пустым.
+// Баллы списываются из партий начислений начиная с самых ранних, чтобы первыми
+// расходовались баллы, которые раньше сгорят
+func (storage *Database) AddWithdraw(ctx context.Context, orderNumber string, login string, sum float64, merchant string) error {
+	ctx, span, end := storage.startSpan(ctx, "AddWithdraw")
+	defer end()
+
 	// начать транзакцию
-	tx, err := storage.dbpool.Begin(storage.Ctx)
+	tx, err := storage.dbpool.Begin(ctx)
 	if err != nil {
+		tracing.RecordError(span, err)
 		return err
 	}
-	//defer tx.Rollback(storage.Ctx)
-	// считать текущий баланс пользователя
-	// не понимаю как этот метод обернуть в транзакцию - он используется в нескольких местах
-	balance, err := storage.currentBalance(tx, login)
+	defer tx.Rollback(ctx)
+	// события спана показывают, на каком шаге списания ушло время
+	span.AddEvent("transaction started")
+
+	// партии блокируются, чтобы параллельные списания не потратили одни и те же баллы
+	err = storage.lockLots(ctx, tx, login)
+	if err != nil {
+		logging.FromContext(ctx).Error().Err(err).Msg("Unable to lock point lots")
+		tracing.RecordError(span, err)
+		return err
+	}
+
+	span.AddEvent("lots locked")
+
+	balance, err := storage.currentBalance(ctx, tx, login)
 	if err != nil {
-		log.Error().Err(err).Msg("Unable to get current balance from DB")
+		logging.FromContext(ctx).Error().Err(err).Msg("Unable to get current balance from DB")
+		tracing.RecordError(span, err)
 		return err
 	}
 
+	span.AddEvent("balance calculated")
+
+	if balance.Blocked {
+		return my_errors.ErrBalanceBlocked
+	}
+
 	if sum >= balance.Current {
 		return my_errors.ErrInsufficientBalance
 	}
 
 	// если баланса хватает для текущего списания - делаем списание
-	_, err = tx.Exec(storage.Ctx,
-		`INSERT INTO withdrawals (order_number, login, sum) VALUES ($1, $2, $3);`,
+	expiresAt, err := storage.consumeLots(ctx, tx, login, sum)
+	if err != nil {
+		logging.FromContext(ctx).Error().Err(err).Msg("Unable to consume point lots")
+		tracing.RecordError(span, err)
+		return err
+	}
+
+	// срок сгорания запоминается, чтобы возвращённые баллы сгорели не позже списанных
+	_, err = tx.Exec(ctx,
+		`INSERT INTO withdrawals (order_number, login, sum, status, expires_at, merchant) VALUES ($1, $2, $3, $4, $5, $6);`,
 		orderNumber,
 		login,
-		sum)
+		sum,
+		WithdrawPending,
+		expiresAt,
+		merchant)
 
 	if err != nil {
-		log.Error().Err(err).Msg("Unable to INSERT withdraw to DB")
-		wrapped := fmt.Errorf("[functionName] error when getting current balance: %w", err)
-		errRlbck := tx.Rollback(storage.Ctx)
-		if errRlbck != nil {
-			log.Error().Err(errRlbck).Msg("[functionName] error when rollback transaction in current balance")
-		}
-		return wrapped
+		logging.FromContext(ctx).Error().Err(err).Msg("Unable to INSERT withdraw to DB")
+		tracing.RecordError(span, err)
+		return fmt.Errorf("[AddWithdraw] error when inserting withdrawal: %w", err)
+	}
+
+	span.AddEvent("withdrawal inserted")
+
+	payload := Withdraw{Order: orderNumber, Sum: sum, ProcessedAt: time.Now(), Status: WithdrawPending, Merchant: merchant}
+	err = storage.addEvent(ctx, tx, login, EventWithdrawalCreated, payload)
+	if err != nil {
+		return err
 	}
 
-	return tx.Commit(storage.Ctx)
+	before := map[string]interface{}{"current": balance.Current, "withdrawn": balance.Withdrawn}
+	after := map[string]interface{}{"order": orderNumber, "sum": sum, "current": balance.Current - sum, "withdrawn": balance.Withdrawn + sum}
+	err = storage.addAudit(ctx, tx, login, AuditWithdrawalCreated, before, after)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return err
+	}
+
+	metrics.ObserveWithdrawal(sum)
+
+	return nil
 }
 
-func (storage *Database) GetWithdrawals(login string) (*[]Withdraw, error) {
-	rows, err := storage.dbpool.Query(storage.Ctx,
-		`SELECT order_number, sum, processed_at FROM withdrawals WHERE login = $1 ORDER BY processed_at ASC`,
+func (storage *Database) GetWithdrawals(ctx context.Context, login string) (*[]Withdraw, error) {
+	ctx, _, end := storage.startSpan(ctx, "GetWithdrawals")
+	defer end()
+
+	rows, err := storage.dbpool.Query(ctx,
+		`SELECT order_number, sum, processed_at, status, refunded, merchant FROM withdrawals WHERE login = $1 ORDER BY processed_at ASC`,
 		login)
 
 	if err != nil {
@@ -127,7 +209,7 @@ func (storage *Database) GetWithdrawals(login string) (*[]Withdraw, error) {
 
 	for rows.Next() {
 		var withdraw Withdraw
-		err := rows.Scan(&withdraw.Order, &withdraw.Sum, &withdraw.ProcessedAt)
+		err := rows.Scan(&withdraw.Order, &withdraw.Sum, &withdraw.ProcessedAt, &withdraw.Status, &withdraw.Refunded, &withdraw.Merchant)
 		if err != nil {
 			return nil, err
 		}
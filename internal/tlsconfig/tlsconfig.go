@@ -0,0 +1,232 @@
+// Package tlsconfig собирает настройки TLS для HTTP и gRPC серверов
+// и перечитывает сертификаты без перезапуска сервиса.
+package tlsconfig
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// проверка клиентских сертификатов
+const (
+	ClientAuthNone     = "none"     // клиентский сертификат не запрашивается
+	ClientAuthOptional = "optional" // проверяется, если клиент его предъявил (партнёры), остальные подключаются как обычно
+	ClientAuthRequire  = "require"  // без действительного клиентского сертификата соединение не устанавливается
+)
+
+// набор шифров для TLS 1.2. В TLS 1.3 шифры не настраиваются
+const (
+	CipherPolicyIntermediate = "intermediate" // только ECDHE с AEAD, как в рекомендациях Mozilla
+	CipherPolicyCompatible   = "compatible"   // набор Go по умолчанию
+)
+
+// шифры политики intermediate. Первым идёт обязательный для HTTP/2
+var intermediateCiphers = []uint16{
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+type Config struct {
+	CertFile string
+	KeyFile  string
+	// "1.2" или "1.3"
+	MinVersion   string
+	CipherPolicy string
+	// сертификаты центров, выпускающих клиентские сертификаты партнёров
+	ClientCAFile string
+	ClientAuth   string
+}
+
+// Reloader отдаёт серверам актуальные сертификаты. Перечитанные сертификаты
+// применяются к новым TLS-рукопожатиям, открытые соединения не разрываются
+type Reloader struct {
+	cfg        Config
+	minVersion uint16
+	ciphers    []uint16
+	clientAuth tls.ClientAuthType
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  map[string]time.Time
+}
+
+// New проверяет настройки и загружает сертификаты
+func New(cfg Config) (*Reloader, error) {
+	r := &Reloader{cfg: cfg}
+
+	switch cfg.MinVersion {
+	case "1.2":
+		r.minVersion = tls.VersionTLS12
+	case "1.3":
+		r.minVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("неизвестная версия TLS %q: ожидается 1.2 или 1.3", cfg.MinVersion)
+	}
+
+	switch cfg.CipherPolicy {
+	case CipherPolicyIntermediate:
+		r.ciphers = intermediateCiphers
+	case CipherPolicyCompatible:
+	default:
+		return nil, fmt.Errorf("неизвестная политика шифров %q: ожидается intermediate или compatible", cfg.CipherPolicy)
+	}
+
+	switch cfg.ClientAuth {
+	case ClientAuthNone:
+		r.clientAuth = tls.NoClientCert
+	case ClientAuthOptional:
+		r.clientAuth = tls.VerifyClientCertIfGiven
+	case ClientAuthRequire:
+		r.clientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("неизвестный режим проверки клиентов %q: ожидается none, optional или require", cfg.ClientAuth)
+	}
+
+	if r.clientAuth != tls.NoClientCert && cfg.ClientCAFile == "" {
+		return nil, errors.New("для проверки клиентских сертификатов нужен файл с сертификатами центров")
+	}
+
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Reload перечитывает сертификат, ключ и сертификаты центров. При ошибке
+// остаются прежние сертификаты, чтобы полузаписанный файл не уронил сервис
+func (r *Reloader) Reload() error {
+	modTimes := make(map[string]time.Time)
+	for _, path := range r.files() {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		modTimes[path] = info.ModTime()
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+	if err != nil {
+		return fmt.Errorf("сертификат сервера: %w", err)
+	}
+
+	var clientCAs *x509.CertPool
+	if r.cfg.ClientCAFile != "" {
+		pem, err := os.ReadFile(r.cfg.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("сертификаты центров: %w", err)
+		}
+
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("сертификаты центров: в %s нет ни одного сертификата", r.cfg.ClientCAFile)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.cert = &cert
+	r.clientCAs = clientCAs
+	r.modTimes = modTimes
+
+	return nil
+}
+
+// TLSConfig возвращает настройки для http.Server и gRPC. Сертификаты
+// подставляются на каждом рукопожатии, поэтому Reload действует сразу
+func (r *Reloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: r.minVersion,
+		NextProtos: []string{"h2", "http/1.1"},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+
+			return &tls.Config{
+				MinVersion:   r.minVersion,
+				CipherSuites: r.ciphers,
+				NextProtos:   []string{"h2", "http/1.1"},
+				Certificates: []tls.Certificate{*r.cert},
+				ClientAuth:   r.clientAuth,
+				ClientCAs:    r.clientCAs,
+			}, nil
+		},
+	}
+}
+
+// Watch перечитывает сертификаты, когда меняются файлы (проверяются раз в interval)
+// или приходит SIGHUP. Работает до отмены ctx
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			r.reload("SIGHUP")
+		case <-ticker.C:
+			if r.changed() {
+				r.reload("изменились файлы")
+			}
+		}
+	}
+}
+
+func (r *Reloader) reload(reason string) {
+	if err := r.Reload(); err != nil {
+		log.Error().Err(err).Str("reason", reason).Msg("Не смогли перечитать сертификаты, работаем со старыми")
+		return
+	}
+
+	log.Info().Str("reason", reason).Msg("Сертификаты перечитаны")
+}
+
+// изменился ли хотя бы один файл с момента последней загрузки
+func (r *Reloader) changed() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, path := range r.files() {
+		info, err := os.Stat(path)
+		if err != nil {
+			// файл могут заменять прямо сейчас — проверим на следующем шаге
+			continue
+		}
+		if !info.ModTime().Equal(r.modTimes[path]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *Reloader) files() []string {
+	files := []string{r.cfg.CertFile, r.cfg.KeyFile}
+	if r.cfg.ClientCAFile != "" {
+		files = append(files, r.cfg.ClientCAFile)
+	}
+
+	return files
+}
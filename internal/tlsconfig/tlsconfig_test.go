@@ -0,0 +1,249 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// удостоверяющий центр для тестов
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newCA(t *testing.T, name string) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// выпускает сертификат сервера для 127.0.0.1 или клиента и возвращает его и ключ в PEM
+func (ca *testCA) issue(t *testing.T, name string, usage x509.ExtKeyUsage) (certPEM, keyPEM []byte) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// файлы сертификатов сервера и центров клиентских сертификатов
+type files struct {
+	cert, key, clientCA string
+}
+
+func writeFiles(t *testing.T, dir string, ca, clientCA *testCA, name string) files {
+	t.Helper()
+
+	certPEM, keyPEM := ca.issue(t, name, x509.ExtKeyUsageServerAuth)
+	f := files{
+		cert:     filepath.Join(dir, "server.crt"),
+		key:      filepath.Join(dir, "server.key"),
+		clientCA: filepath.Join(dir, "clients.crt"),
+	}
+	for path, data := range map[string][]byte{f.cert: certPEM, f.key: keyPEM, f.clientCA: clientCA.pem} {
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return f
+}
+
+// сертификат, который сервер отдаст при следующем рукопожатии
+func servedName(t *testing.T, r *Reloader) string {
+	t.Helper()
+
+	cfg, err := r.TLSConfig().GetConfigForClient(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(cfg.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert.Subject.CommonName
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	ca, clients := newCA(t, "server-ca"), newCA(t, "partners-ca")
+	f := writeFiles(t, dir, ca, clients, "first")
+
+	r, err := New(Config{CertFile: f.cert, KeyFile: f.key, MinVersion: "1.2", CipherPolicy: CipherPolicyIntermediate,
+		ClientCAFile: f.clientCA, ClientAuth: ClientAuthOptional})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if name := servedName(t, r); name != "first" {
+		t.Fatalf("сертификат %q, ожидали first", name)
+	}
+	if r.changed() {
+		t.Fatal("файлы не менялись, а changed сообщает об изменении")
+	}
+
+	// сертификат заменили: новые рукопожатия получают новый без перезапуска
+	writeFiles(t, dir, ca, clients, "second")
+	future := time.Now().Add(time.Minute)
+	for _, path := range []string{f.cert, f.key, f.clientCA} {
+		os.Chtimes(path, future, future)
+	}
+	if !r.changed() {
+		t.Fatal("changed не заметил новые файлы")
+	}
+	if err := r.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if name := servedName(t, r); name != "second" {
+		t.Fatalf("после Reload сертификат %q, ожидали second", name)
+	}
+	if r.changed() {
+		t.Fatal("после Reload changed сообщает об изменении")
+	}
+
+	// полузаписанный файл: ошибка, но сервер продолжает работать со старым сертификатом
+	if err := os.WriteFile(f.cert, []byte("-----BEGIN CERTIFICATE-----\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(); err == nil {
+		t.Fatal("Reload принял испорченный сертификат")
+	}
+	if name := servedName(t, r); name != "second" {
+		t.Fatalf("после неудачного Reload сертификат %q, ожидали second", name)
+	}
+}
+
+func TestClientCertificates(t *testing.T) {
+	ca, partners, strangers := newCA(t, "server-ca"), newCA(t, "partners-ca"), newCA(t, "strangers-ca")
+	f := writeFiles(t, t.TempDir(), ca, partners, "server")
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	clientCert := func(ca *testCA) []tls.Certificate {
+		certPEM, keyPEM := ca.issue(t, "shop", x509.ExtKeyUsageClientAuth)
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []tls.Certificate{cert}
+	}
+
+	tests := []struct {
+		mode    string
+		certs   []tls.Certificate
+		want    string // CN проверенного клиентского сертификата
+		wantErr bool
+	}{
+		{mode: ClientAuthOptional, certs: nil, want: ""},
+		{mode: ClientAuthOptional, certs: clientCert(partners), want: "shop"},
+		{mode: ClientAuthOptional, certs: clientCert(strangers), wantErr: true},
+		{mode: ClientAuthRequire, certs: nil, wantErr: true},
+		{mode: ClientAuthRequire, certs: clientCert(partners), want: "shop"},
+	}
+	for _, tt := range tests {
+		r, err := New(Config{CertFile: f.cert, KeyFile: f.key, MinVersion: "1.2", CipherPolicy: CipherPolicyIntermediate,
+			ClientCAFile: f.clientCA, ClientAuth: tt.mode})
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if len(r.TLS.VerifiedChains) > 0 {
+				io.WriteString(w, r.TLS.VerifiedChains[0][0].Subject.CommonName)
+			}
+		}))
+		srv.TLS = r.TLSConfig()
+		srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+		srv.StartTLS()
+
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs: roots,
+			// сертификат отправляется, даже если его выпустил центр, которому сервер не доверяет
+			GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				if len(tt.certs) == 0 {
+					return &tls.Certificate{}, nil
+				}
+				return &tt.certs[0], nil
+			},
+		}}}
+		resp, err := client.Get(srv.URL)
+
+		var got string
+		if err == nil {
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			got = string(body)
+		}
+		srv.Close()
+
+		switch {
+		case tt.wantErr && err == nil:
+			t.Errorf("%s, сертификатов %d: соединение установлено", tt.mode, len(tt.certs))
+		case !tt.wantErr && err != nil:
+			t.Errorf("%s, сертификатов %d: %v", tt.mode, len(tt.certs), err)
+		case !tt.wantErr && got != tt.want:
+			t.Errorf("%s, сертификатов %d: клиент %q, ожидали %q", tt.mode, len(tt.certs), got, tt.want)
+		}
+	}
+}
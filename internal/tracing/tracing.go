@@ -0,0 +1,165 @@
+// Package tracing настраивает OpenTelemetry: провайдер трейсов, экспорт и
+// распространение контекста в формате W3C traceparent.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const serviceName = "gophermart"
+
+// способы экспорта трейсов
+const (
+	ExporterNone   = "none"   // трейсы не собираются
+	ExporterOTLP   = "otlp"   // OTLP/gRPC, например в OpenTelemetry Collector или Jaeger
+	ExporterStdout = "stdout" // в стандартный вывод, удобно при локальной отладке
+	ExporterFile   = "file"   // в файл построчно в JSON, для работы без коллектора
+)
+
+type Config struct {
+	Exporter     string  // none, otlp, stdout или file
+	OTLPEndpoint string  // host:port коллектора для otlp
+	OTLPInsecure bool    // не использовать TLS при подключении к коллектору
+	File         string  // путь к файлу для экспорта file
+	SampleRatio  float64 // доля запросов, для которых пишутся трейсы, от 0 до 1
+}
+
+// Setup настраивает глобальный провайдер трейсов и пропагатор.
+// Возвращённую функцию нужно вызвать при остановке, чтобы выгрузить накопленные спаны
+func Setup(ctx context.Context, cfg Config) (func(context.Context) error, error) {
+	// W3C traceparent распространяем всегда, даже если сами трейсы не пишем,
+	// чтобы не разрывать цепочку между вызывающими и системой начислений
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var closer io.Closer
+	var err error
+
+	switch cfg.Exporter {
+	case "", ExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case ExporterOTLP:
+		opts := []otlptracegrpc.Option{}
+		if cfg.OTLPEndpoint != "" {
+			opts = append(opts, otlptracegrpc.WithEndpoint(cfg.OTLPEndpoint))
+		}
+		if cfg.OTLPInsecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		exporter, err = otlptracegrpc.New(ctx, opts...)
+	case ExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout), stdouttrace.WithPrettyPrint())
+	case ExporterFile:
+		if cfg.File == "" {
+			return nil, fmt.Errorf("для экспорта трейсов в файл нужно указать путь к файлу")
+		}
+		var f *os.File
+		f, err = os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		closer = f
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(f))
+	default:
+		return nil, fmt.Errorf("неизвестный экспортёр трейсов %q: ожидается none, otlp, stdout или file", cfg.Exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(serviceName),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if closer != nil {
+			if errClose := closer.Close(); err == nil {
+				err = errClose
+			}
+		}
+		return err
+	}, nil
+}
+
+// Tracer возвращает трейсер для компонента сервиса
+func Tracer(component string) trace.Tracer {
+	return otel.Tracer(serviceName + "/" + component)
+}
+
+// RecordError отмечает спан как завершившийся ошибкой
+func RecordError(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// Inject добавляет в заголовки исходящего запроса traceparent текущего спана
+func Inject(ctx context.Context, header http.Header) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+// Middleware открывает серверный спан на каждый HTTP-запрос, продолжая трейс
+// из входящего traceparent. Имя спана — шаблон маршрута chi, известный после роутинга
+func Middleware(next http.Handler) http.Handler {
+	tracer := Tracer("http")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.URLPath(r.URL.Path),
+				attribute.String("http.user_agent", r.UserAgent()),
+			))
+		defer span.End()
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r.WithContext(ctx))
+
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			span.SetName(r.Method + " " + rctx.RoutePattern())
+			span.SetAttributes(semconv.HTTPRoute(rctx.RoutePattern()))
+		}
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	})
+}
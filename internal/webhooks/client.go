@@ -0,0 +1,67 @@
+package webhooks
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+	"time"
+)
+
+// ErrForbiddenAddress — адрес получателя во внутренней сети
+var ErrForbiddenAddress = errors.New("адрес получателя вебхука во внутренней сети")
+
+// адреса общего пространства провайдеров (RFC 6598), их нет среди netip.Addr.IsPrivate
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// NewClient возвращает HTTP-клиент для доставки вебхуков. Адрес получателя задаёт
+// пользователь, поэтому соединения с loopback, частными, link-local и прочими
+// внутренними адресами запрещены. Проверяется адрес, к которому идёт соединение,
+// уже после разрешения имени: так не обойти проверку через DNS с внутренним адресом.
+// Переадресации не выполняются, прокси из окружения не используется
+func NewClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			return CheckAddress(address)
+		},
+	}
+
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: timeout,
+			MaxIdleConns:        100,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// CheckAddress возвращает ErrForbiddenAddress, если address ("ip:port" или ip)
+// не публичный адрес в интернете
+func CheckAddress(address string) error {
+	host := address
+	if h, _, err := net.SplitHostPort(address); err == nil {
+		host = h
+	}
+
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return fmt.Errorf("%w: %q не IP-адрес", ErrForbiddenAddress, address)
+	}
+	ip = ip.Unmap()
+
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() ||
+		sharedAddressSpace.Contains(ip) {
+		return fmt.Errorf("%w: %s", ErrForbiddenAddress, ip)
+	}
+
+	return nil
+}
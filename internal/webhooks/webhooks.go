@@ -0,0 +1,178 @@
+// Package webhooks доставляет события сервиса подписчикам по HTTP.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/region23/praktikum-diplom/internal/metrics"
+	"github.com/region23/praktikum-diplom/internal/signature"
+	"github.com/region23/praktikum-diplom/internal/storage"
+	"github.com/region23/praktikum-diplom/internal/tracing"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = tracing.Tracer("webhooks")
+
+// заголовки запроса с вебхуком
+const (
+	HeaderEvent    = "X-Gophermart-Event"
+	HeaderDelivery = "X-Gophermart-Delivery"
+	// подпись signature.Sign на секрете подписки
+	HeaderSignature = "X-Gophermart-Signature"
+)
+
+const (
+	// сколько доставок берётся в работу за раз; они отправляются параллельно
+	batchSize = 50
+	// пауза между повторами растёт вдвое, но не дольше
+	maxRetryDelay = 6 * time.Hour
+)
+
+// Backoff — пауза перед повтором после attempts неудачных попыток: base, 2·base, 4·base…
+func Backoff(base time.Duration, attempts int) time.Duration {
+	delay := base
+	for i := 1; i < attempts && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+
+	return delay
+}
+
+// Queue — исходящая очередь вебхуков, её реализует *storage.Database
+type Queue interface {
+	ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]storage.PendingWebhook, error)
+	CompleteWebhookDelivery(ctx context.Context, id int64, attempt storage.WebhookAttempt) error
+}
+
+// Dispatcher отправляет вебхуки из исходящей очереди. Неудачные доставки повторяются
+// с экспоненциальной паузой, после maxAttempts попыток доставка помечается недоставленной
+type Dispatcher struct {
+	client      *http.Client
+	repository  Queue
+	maxAttempts int
+	retryBase   time.Duration
+}
+
+func NewDispatcher(client *http.Client, repository Queue, maxAttempts int, retryBase time.Duration) *Dispatcher {
+	return &Dispatcher{
+		client:      client,
+		repository:  repository,
+		maxAttempts: maxAttempts,
+		retryBase:   retryBase,
+	}
+}
+
+// Deliver отправляет все доставки, время которых подошло. Запускается периодически
+func (d *Dispatcher) Deliver(ctx context.Context) error {
+	// доставка не должна достаться другому экземпляру, пока запрос ещё может идти
+	lease := 2*d.client.Timeout + time.Minute
+
+	for {
+		pending, err := d.repository.ClaimWebhookDeliveries(ctx, batchSize, lease)
+		if err != nil {
+			return err
+		}
+
+		var wg sync.WaitGroup
+		for _, webhook := range pending {
+			wg.Add(1)
+			go func(webhook storage.PendingWebhook) {
+				defer wg.Done()
+				d.deliver(ctx, webhook)
+			}(webhook)
+		}
+		wg.Wait()
+
+		if len(pending) < batchSize || ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+// отправляет один вебхук и записывает итог попытки
+func (d *Dispatcher) deliver(ctx context.Context, webhook storage.PendingWebhook) {
+	statusCode, err := d.send(ctx, webhook)
+
+	attempt := storage.WebhookAttempt{Status: storage.WebhookDelivered, StatusCode: statusCode}
+	outcome := metrics.WebhookDelivered
+	if err != nil {
+		attempt.Error = err.Error()
+		attempts := webhook.Delivery.Attempts + 1
+		if attempts >= d.maxAttempts {
+			attempt.Status = storage.WebhookDead
+			outcome = metrics.WebhookDead
+		} else {
+			attempt.Status = storage.WebhookPending
+			attempt.NextAttemptAt = time.Now().Add(Backoff(d.retryBase, attempts))
+			outcome = metrics.WebhookRetry
+		}
+	}
+	metrics.ObserveWebhookDelivery(outcome)
+
+	if err := d.repository.CompleteWebhookDelivery(ctx, webhook.Delivery.ID, attempt); err != nil {
+		// доставка осталась в очереди и будет повторена по истечении lease
+		log.Error().Err(err).Int64("delivery", webhook.Delivery.ID).Msg("Не смогли записать итог доставки вебхука")
+		return
+	}
+
+	if attempt.Status == storage.WebhookDead {
+		log.Warn().Int64("delivery", webhook.Delivery.ID).Int64("subscription", webhook.Delivery.SubscriptionID).
+			Str("error", attempt.Error).Msg("Вебхук не доставлен, попытки кончились")
+	}
+}
+
+// отправляет запрос получателю. Доставленным считается ответ 2xx
+func (d *Dispatcher) send(ctx context.Context, webhook storage.PendingWebhook) (statusCode int, err error) {
+	ctx, span := tracer.Start(ctx, "webhooks.send",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.Int64("webhook.delivery", webhook.Delivery.ID),
+			attribute.String("webhook.event", webhook.Delivery.EventType)))
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(webhook.Body))
+	if err != nil {
+		return 0, err
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "gophermart-webhooks")
+	request.Header.Set(HeaderEvent, webhook.Delivery.EventType)
+	request.Header.Set(HeaderDelivery, strconv.FormatInt(webhook.Delivery.ID, 10))
+	request.Header.Set(HeaderSignature, signature.Sign(webhook.Secret, time.Now(), webhook.Body))
+	tracing.Inject(ctx, request.Header)
+
+	response, err := d.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	span.SetAttributes(semconv.HTTPResponseStatusCode(response.StatusCode))
+
+	// соединение вернётся в пул, только если тело ответа прочитано. Само тело
+	// не сохраняется: журнал доставки не должен пересказывать ответы чужих серверов
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64<<10))
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Errorf("получатель ответил %d", response.StatusCode)
+	}
+
+	return response.StatusCode, nil
+}
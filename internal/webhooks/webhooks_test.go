@@ -0,0 +1,300 @@
+package webhooks
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/region23/praktikum-diplom/internal/signature"
+	"github.com/region23/praktikum-diplom/internal/storage"
+)
+
+const testSecret = "0123456789abcdef0123456789abcdef"
+
+// исходящая очередь в памяти с той же логикой статусов, что и в базе
+type memoryQueue struct {
+	mu         sync.Mutex
+	url        string
+	deliveries map[int64]*storage.WebhookDelivery
+}
+
+func newMemoryQueue(url string, ids ...int64) *memoryQueue {
+	q := &memoryQueue{url: url, deliveries: map[int64]*storage.WebhookDelivery{}}
+	for _, id := range ids {
+		now := time.Now()
+		q.deliveries[id] = &storage.WebhookDelivery{
+			ID: id, SubscriptionID: 1, EventID: id, EventType: storage.EventOrderUpdated,
+			Status: storage.WebhookPending, NextAttemptAt: &now, CreatedAt: now,
+		}
+	}
+
+	return q
+}
+
+func (q *memoryQueue) ClaimWebhookDeliveries(_ context.Context, limit int, lease time.Duration) ([]storage.PendingWebhook, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var pending []storage.PendingWebhook
+	for _, d := range q.deliveries {
+		if len(pending) == limit || d.Status != storage.WebhookPending || d.NextAttemptAt.After(time.Now()) {
+			continue
+		}
+
+		next := time.Now().Add(lease)
+		d.NextAttemptAt = &next
+		pending = append(pending, storage.PendingWebhook{
+			Delivery: *d,
+			URL:      q.url,
+			Secret:   testSecret,
+			Body:     []byte(`{"id":` + strconv.FormatInt(d.EventID, 10) + `,"type":"order.updated"}`),
+		})
+	}
+
+	return pending, nil
+}
+
+func (q *memoryQueue) CompleteWebhookDelivery(_ context.Context, id int64, attempt storage.WebhookAttempt) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	d := q.deliveries[id]
+	d.Status = attempt.Status
+	d.Attempts++
+	d.LastStatusCode = attempt.StatusCode
+	d.LastError = attempt.Error
+	d.NextAttemptAt = nil
+	if attempt.Status == storage.WebhookPending {
+		next := attempt.NextAttemptAt
+		d.NextAttemptAt = &next
+	}
+
+	return nil
+}
+
+// как RetryWebhookDelivery: недоставленный вебхук снова в очереди, попытки заново
+func (q *memoryQueue) retry(id int64) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	d := q.deliveries[id]
+	if d.Status != storage.WebhookDead {
+		return false
+	}
+
+	now := time.Now()
+	d.Status, d.Attempts, d.NextAttemptAt = storage.WebhookPending, 0, &now
+
+	return true
+}
+
+// торопит время: следующая попытка уже подошла
+func (q *memoryQueue) due(id int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if d := q.deliveries[id]; d.NextAttemptAt != nil {
+		now := time.Now()
+		d.NextAttemptAt = &now
+	}
+}
+
+func (q *memoryQueue) get(id int64) storage.WebhookDelivery {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return *q.deliveries[id]
+}
+
+// получатель, отвечающий кодом status
+type receiver struct {
+	status   atomic.Int64
+	requests atomic.Int64
+}
+
+func newReceiver(t *testing.T, status int) (*receiver, *httptest.Server) {
+	t.Helper()
+
+	rcv := &receiver{}
+	rcv.status.Store(int64(status))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rcv.requests.Add(1)
+		w.WriteHeader(int(rcv.status.Load()))
+		io.WriteString(w, "internal details that must not leak")
+	}))
+	t.Cleanup(srv.Close)
+
+	return rcv, srv
+}
+
+func TestSignedDelivery(t *testing.T) {
+	type received struct {
+		header http.Header
+		body   []byte
+	}
+	got := make(chan received, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got <- received{header: r.Header.Clone(), body: body}
+	}))
+	defer srv.Close()
+
+	queue := newMemoryQueue(srv.URL, 7)
+	if err := NewDispatcher(srv.Client(), queue, 3, time.Minute).Deliver(context.Background()); err != nil {
+		t.Fatalf("Deliver: %v", err)
+	}
+
+	request := <-got
+	if v := request.header.Get(HeaderEvent); v != storage.EventOrderUpdated {
+		t.Errorf("%s = %q", HeaderEvent, v)
+	}
+	if v := request.header.Get(HeaderDelivery); v != "7" {
+		t.Errorf("%s = %q", HeaderDelivery, v)
+	}
+	if v := request.header.Get("Content-Type"); v != "application/json" {
+		t.Errorf("Content-Type = %q", v)
+	}
+
+	header := request.header.Get(HeaderSignature)
+	if err := signature.Verify(testSecret, header, request.body, time.Now(), time.Minute); err != nil {
+		t.Fatalf("подпись %q не прошла проверку: %v", header, err)
+	}
+	if err := signature.Verify("another-secret-0123456789", header, request.body, time.Now(), time.Minute); err == nil {
+		t.Fatal("подпись прошла проверку с чужим секретом")
+	}
+
+	d := queue.get(7)
+	if d.Status != storage.WebhookDelivered || d.Attempts != 1 || d.LastStatusCode != http.StatusOK {
+		t.Fatalf("доставка %+v, ожидали DELIVERED с одной попыткой и кодом 200", d)
+	}
+}
+
+func TestRetryWithBackoffOn5xx(t *testing.T) {
+	const base = time.Minute
+	_, srv := newReceiver(t, http.StatusInternalServerError)
+	queue := newMemoryQueue(srv.URL, 1)
+	dispatcher := NewDispatcher(srv.Client(), queue, 5, base)
+
+	for attempt := 1; attempt <= 3; attempt++ {
+		start := time.Now()
+		if err := dispatcher.Deliver(context.Background()); err != nil {
+			t.Fatalf("Deliver: %v", err)
+		}
+
+		d := queue.get(1)
+		if d.Status != storage.WebhookPending || d.Attempts != attempt || d.LastStatusCode != http.StatusInternalServerError {
+			t.Fatalf("попытка %d: доставка %+v, ожидали PENDING с кодом 500", attempt, d)
+		}
+
+		// пауза base, 2·base, 4·base
+		want := base << (attempt - 1)
+		if wait := d.NextAttemptAt.Sub(start); wait < want || wait > want+time.Second {
+			t.Fatalf("попытка %d: следующая через %s, ожидали %s", attempt, wait, want)
+		}
+
+		// в журнал попадает только код ответа
+		if strings.Contains(d.LastError, "internal details") {
+			t.Fatalf("в журнал доставки попало тело ответа: %q", d.LastError)
+		}
+
+		// пока пауза не истекла, доставка не повторяется
+		if err := dispatcher.Deliver(context.Background()); err != nil {
+			t.Fatalf("Deliver: %v", err)
+		}
+		if d := queue.get(1); d.Attempts != attempt {
+			t.Fatalf("доставка повторена до истечения паузы: %+v", d)
+		}
+
+		queue.due(1)
+	}
+}
+
+func TestGiveUpAndManualRetry(t *testing.T) {
+	rcv, srv := newReceiver(t, http.StatusServiceUnavailable)
+	queue := newMemoryQueue(srv.URL, 1)
+	dispatcher := NewDispatcher(srv.Client(), queue, 3, time.Minute)
+
+	for i := 0; i < 5; i++ {
+		if err := dispatcher.Deliver(context.Background()); err != nil {
+			t.Fatalf("Deliver: %v", err)
+		}
+		queue.due(1)
+	}
+
+	d := queue.get(1)
+	if d.Status != storage.WebhookDead || d.Attempts != 3 || d.NextAttemptAt != nil {
+		t.Fatalf("доставка %+v, ожидали DEAD после трёх попыток", d)
+	}
+	if got := rcv.requests.Load(); got != 3 {
+		t.Fatalf("получатель получил %d запросов, ожидали 3", got)
+	}
+
+	// получатель починен, доставку возвращают в очередь вручную
+	rcv.status.Store(http.StatusNoContent)
+	if !queue.retry(1) {
+		t.Fatal("недоставленный вебхук не вернулся в очередь")
+	}
+	if err := dispatcher.Deliver(context.Background()); err != nil {
+		t.Fatalf("Deliver: %v", err)
+	}
+
+	d = queue.get(1)
+	if d.Status != storage.WebhookDelivered || d.Attempts != 1 || d.LastStatusCode != http.StatusNoContent {
+		t.Fatalf("доставка после повтора %+v, ожидали DELIVERED с первой попытки", d)
+	}
+	if queue.retry(1) {
+		t.Fatal("доставленный вебхук вернулся в очередь")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	want := []time.Duration{30 * time.Second, time.Minute, 2 * time.Minute, 4 * time.Minute}
+	for i, w := range want {
+		if got := Backoff(30*time.Second, i+1); got != w {
+			t.Errorf("Backoff(30s, %d) = %s, ожидали %s", i+1, got, w)
+		}
+	}
+
+	if got := Backoff(30*time.Second, 100); got != maxRetryDelay {
+		t.Errorf("Backoff(30s, 100) = %s, ожидали %s", got, maxRetryDelay)
+	}
+}
+
+func TestCheckAddress(t *testing.T) {
+	forbidden := []string{
+		"127.0.0.1:80", "[::1]:443", "10.1.2.3:80", "172.16.0.1:80", "192.168.1.1:8080",
+		"169.254.169.254:80", "0.0.0.0:80", "[::]:80", "[fe80::1]:80", "[fc00::1]:80",
+		"100.64.0.1:80", "[::ffff:127.0.0.1]:80", "224.0.0.1:80", "localhost:80",
+	}
+	for _, address := range forbidden {
+		if err := CheckAddress(address); !errors.Is(err, ErrForbiddenAddress) {
+			t.Errorf("CheckAddress(%q) = %v, ожидали ErrForbiddenAddress", address, err)
+		}
+	}
+
+	for _, address := range []string{"93.184.216.34:443", "[2606:4700::1111]:443", "8.8.8.8"} {
+		if err := CheckAddress(address); err != nil {
+			t.Errorf("CheckAddress(%q) = %v", address, err)
+		}
+	}
+}
+
+func TestClientRefusesInternalAddress(t *testing.T) {
+	rcv, srv := newReceiver(t, http.StatusOK)
+
+	_, err := NewClient(time.Second).Post(srv.URL, "application/json", strings.NewReader("{}"))
+	if !errors.Is(err, ErrForbiddenAddress) {
+		t.Fatalf("запрос на %s: %v, ожидали ErrForbiddenAddress", srv.URL, err)
+	}
+	if rcv.requests.Load() != 0 {
+		t.Fatal("запрос дошёл до получателя во внутренней сети")
+	}
+}